@@ -9,17 +9,33 @@ import (
 
 type BlockRepo struct {
 	blockStore blockstore.Blockstore
+	// admission rejects writes that do not fit into the repo, nil disables the check
+	admission admitter
 }
 
-// SaveBlock save block to blockstore
+// SaveBlock save block to blockstore, it fails with RepoFullError if the blocks do not fit
 func (b *BlockRepo) SaveBlock(ctx context.Context, data [][]byte) error {
 	var blks []blocks.Block
+	var size uint64
 	for _, d := range data {
 		blk := blocks.NewBlock(d)
 		blks = append(blks, blk)
+		size += uint64(len(d))
 	}
 
-	return b.blockStore.PutMany(ctx, blks)
+	if b.admission == nil {
+		return b.blockStore.PutMany(ctx, blks)
+	}
+
+	reservation, err := b.admission.reserve(size)
+	if err != nil {
+		return err
+	}
+	defer reservation.Release()
+
+	// the batch turns the reservation into usage as it is written
+	bs := &reservedBlockstore{Blockstore: b.blockStore, reservation: reservation}
+	return bs.PutMany(ctx, blks)
 }
 
 // HasBlock check if block exists in blockstore
@@ -0,0 +1,351 @@
+package ipfsrepo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/fsrepo"
+	"github.com/ipfs/boxo/datastore/dshelp"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	mh "github.com/multiformats/go-multihash"
+	"sync"
+	"time"
+)
+
+const defaultMetaFlushInterval = 10 * time.Second
+
+var (
+	ErrBlockMetaNotFound = errors.New("block metadata not found")
+
+	// blockMetaPrefix is where the index lives; it falls under the "/" mount, i.e. leveldb
+	blockMetaPrefix = ds.NewKey("/blockmeta")
+)
+
+// BlockMeta is the metadata recorded for a single block
+type BlockMeta struct {
+	Size        uint64    `json:"size"`
+	Inserted    time.Time `json:"inserted"`
+	LastAccess  time.Time `json:"lastAccess"`
+	AccessCount uint64    `json:"accessCount"`
+}
+
+// blockMetaDelta holds the not yet flushed changes of a block
+type blockMetaDelta struct {
+	size       uint64
+	inserted   time.Time
+	lastAccess time.Time
+	accesses   uint64
+}
+
+// BlockMetaIndex is a side index of per-block metadata. Updates are kept in
+// memory and written to the datastore in batches every flushInterval, so the
+// read path only pays for a map update.
+type BlockMetaIndex struct {
+	ctx           context.Context
+	ds            fsrepo.Datastore
+	flushInterval time.Duration
+
+	// flushMu serializes flushes with deletes, so a flush never resurrects a deleted entry
+	flushMu sync.Mutex
+	mu      sync.Mutex
+	pending map[ds.Key]*blockMetaDelta
+	// removed keeps the keys removed since the last two flushes, so a read
+	// that raced with the delete does not bring the entry back
+	removed, removedBefore map[ds.Key]struct{}
+	// readOnly drops updates, the datastore can not be written
+	readOnly bool
+
+	done chan struct{}
+}
+
+func NewBlockMetaIndex(ctx context.Context, d fsrepo.Datastore) *BlockMetaIndex {
+	return &BlockMetaIndex{
+		ctx:           ctx,
+		ds:            d,
+		flushInterval: defaultMetaFlushInterval,
+		pending:       make(map[ds.Key]*blockMetaDelta),
+		removed:       make(map[ds.Key]struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+func (m *BlockMetaIndex) SetFlushInterval(flushInterval time.Duration) {
+	m.flushInterval = flushInterval
+}
+
+// Start starts flushing pending updates in the background
+func (m *BlockMetaIndex) Start() {
+	go m.loop()
+}
+
+// Close waits for the background loop to exit and flushes what is left.
+// The context passed to NewBlockMetaIndex must be canceled first.
+func (m *BlockMetaIndex) Close() error {
+	<-m.done
+	return m.Flush(context.Background())
+}
+
+// Get returns the metadata of the given block, including pending updates
+func (m *BlockMetaIndex) Get(ctx context.Context, c cid.Cid) (*BlockMeta, error) {
+	key := blockMetaKey(c)
+
+	meta, err := m.load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	delta, ok := m.pending[key]
+	if ok {
+		meta = delta.apply(meta)
+	}
+	m.mu.Unlock()
+
+	if meta == nil {
+		return nil, ErrBlockMetaNotFound
+	}
+
+	return meta, nil
+}
+
+// ForEach calls fn with the multihash of every block in the index, the index
+// does not know the codec of a block. Pending updates are flushed first, a
+// degraded repo drops them and its index is read as it is.
+func (m *BlockMetaIndex) ForEach(ctx context.Context, fn func(hash mh.Multihash, meta *BlockMeta) error) error {
+	if err := m.Flush(ctx); err != nil && !errors.Is(err, ErrRepoDegraded) {
+		return err
+	}
+
+	results, err := m.ds.Query(ctx, query.Query{Prefix: blockMetaPrefix.String()})
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+
+	for r := range results.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+
+		hash, err := dshelp.DsKeyToMultihash(ds.NewKey(ds.RawKey(r.Key).BaseNamespace()))
+		if err != nil {
+			continue
+		}
+
+		var meta BlockMeta
+		if err := json.Unmarshal(r.Value, &meta); err != nil {
+			return err
+		}
+
+		if err := fn(hash, &meta); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Flush writes all pending updates to the datastore. If that fails they are
+// kept for the next flush, unless the repo is degraded.
+func (m *BlockMetaIndex) Flush(ctx context.Context) error {
+	m.flushMu.Lock()
+	defer m.flushMu.Unlock()
+
+	m.mu.Lock()
+	pending := m.pending
+	m.pending = make(map[ds.Key]*blockMetaDelta)
+	m.removedBefore = m.removed
+	m.removed = make(map[ds.Key]struct{})
+	m.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err := m.write(ctx, pending)
+	if err != nil && !errors.Is(err, ErrRepoDegraded) {
+		m.mu.Lock()
+		for key, delta := range pending {
+			if newer, ok := m.pending[key]; ok {
+				delta.merge(newer)
+			}
+			m.pending[key] = delta
+		}
+		m.mu.Unlock()
+	}
+
+	return err
+}
+
+// write puts the deltas applied to the stored metadata in one batch
+func (m *BlockMetaIndex) write(ctx context.Context, pending map[ds.Key]*blockMetaDelta) error {
+	batch, err := m.ds.Batch(ctx)
+	if err != nil {
+		return err
+	}
+
+	for key, delta := range pending {
+		meta, err := m.load(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		b, err := json.Marshal(delta.apply(meta))
+		if err != nil {
+			return err
+		}
+
+		if err := batch.Put(ctx, key, b); err != nil {
+			return err
+		}
+	}
+
+	return batch.Commit(ctx)
+}
+
+// recordPut records that the block was written
+func (m *BlockMetaIndex) recordPut(c cid.Cid, size int) {
+	if m.readOnly {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := blockMetaKey(c)
+	delete(m.removed, key)
+	delete(m.removedBefore, key)
+
+	delta := m.delta(key)
+	delta.size = uint64(size)
+	if delta.inserted.IsZero() {
+		delta.inserted = time.Now()
+	}
+}
+
+// recordAccess records that the block was read
+func (m *BlockMetaIndex) recordAccess(c cid.Cid, size int) {
+	if m.readOnly {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := blockMetaKey(c)
+	if _, ok := m.removed[key]; ok {
+		return
+	}
+	if _, ok := m.removedBefore[key]; ok {
+		return
+	}
+
+	delta := m.delta(key)
+	delta.size = uint64(size)
+	delta.lastAccess = time.Now()
+	delta.accesses++
+}
+
+// remove drops the metadata of a deleted block
+func (m *BlockMetaIndex) remove(ctx context.Context, c cid.Cid) error {
+	m.flushMu.Lock()
+	defer m.flushMu.Unlock()
+
+	key := blockMetaKey(c)
+
+	m.mu.Lock()
+	delete(m.pending, key)
+	m.removed[key] = struct{}{}
+	m.mu.Unlock()
+
+	return m.ds.Delete(ctx, key)
+}
+
+// delta returns the pending delta of key, m.mu must be held
+func (m *BlockMetaIndex) delta(key ds.Key) *blockMetaDelta {
+	delta, ok := m.pending[key]
+	if !ok {
+		delta = &blockMetaDelta{}
+		m.pending[key] = delta
+	}
+
+	return delta
+}
+
+// load reads the stored metadata of key, it returns nil if there is none
+func (m *BlockMetaIndex) load(ctx context.Context, key ds.Key) (*BlockMeta, error) {
+	b, err := m.ds.Get(ctx, key)
+	if err != nil {
+		if errors.Is(err, ds.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var meta BlockMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, err
+	}
+
+	return &meta, nil
+}
+
+// loop is a background goroutine that periodically flushes pending updates
+func (m *BlockMetaIndex) loop() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+			_ = m.Flush(m.ctx)
+		}
+	}
+}
+
+// merge adds the newer delta to d
+func (d *blockMetaDelta) merge(newer *blockMetaDelta) {
+	if newer.size != 0 {
+		d.size = newer.size
+	}
+	if d.inserted.IsZero() {
+		d.inserted = newer.inserted
+	}
+	if newer.lastAccess.After(d.lastAccess) {
+		d.lastAccess = newer.lastAccess
+	}
+	d.accesses += newer.accesses
+}
+
+// apply merges the delta into meta, meta may be nil
+func (d *blockMetaDelta) apply(meta *BlockMeta) *BlockMeta {
+	if meta == nil {
+		meta = &BlockMeta{Inserted: d.inserted}
+	}
+
+	// a rewrite of an existing block keeps its original insertion time
+	if meta.Inserted.IsZero() {
+		meta.Inserted = d.inserted
+	}
+
+	if d.size != 0 {
+		meta.Size = d.size
+	}
+
+	if d.lastAccess.After(meta.LastAccess) {
+		meta.LastAccess = d.lastAccess
+	}
+	meta.AccessCount += d.accesses
+
+	return meta
+}
+
+func blockMetaKey(c cid.Cid) ds.Key {
+	return blockMetaPrefix.Child(dshelp.MultihashToDsKey(c.Hash()))
+}
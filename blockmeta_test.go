@@ -0,0 +1,165 @@
+package ipfsrepo
+
+import (
+	"context"
+	"errors"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/fsrepo"
+	"github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestBlockMetaIndex(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	repo, err := fsrepo.NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+	defer repo.Close()
+
+	meta := NewBlockMetaIndex(ctx, repo.Datastore())
+	meta.SetFlushInterval(5 * time.Millisecond)
+	meta.Start()
+
+	bs := newRepoBlockstore(blockstore.NewBlockstore(repo.Datastore(), blockstore.WriteThrough(true)), meta, &StorageUsage{maxStorage: 1 << 30}, nil, nil)
+
+	blk := blocks.NewBlock([]byte("hello block meta"))
+	require.NoError(t, bs.Put(ctx, blk))
+
+	m, err := meta.Get(ctx, blk.Cid())
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(blk.RawData())), m.Size)
+	require.False(t, m.Inserted.IsZero())
+	require.Zero(t, m.AccessCount)
+
+	inserted := m.Inserted
+
+	for i := 0; i < 3; i++ {
+		_, err = bs.Get(ctx, blk.Cid())
+		require.NoError(t, err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	m, err = meta.Get(ctx, blk.Cid())
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), m.AccessCount)
+	require.False(t, m.LastAccess.IsZero())
+
+	// a rewrite keeps the original insertion time
+	require.NoError(t, bs.Put(ctx, blk))
+	require.NoError(t, meta.Flush(ctx))
+
+	m, err = meta.Get(ctx, blk.Cid())
+	require.NoError(t, err)
+	require.True(t, inserted.Equal(m.Inserted))
+
+	var count int
+	require.NoError(t, meta.ForEach(ctx, func(hash mh.Multihash, m *BlockMeta) error {
+		require.Equal(t, blk.Cid().Hash(), hash)
+		count++
+		return nil
+	}))
+	require.Equal(t, 1, count)
+
+	require.NoError(t, bs.DeleteBlock(ctx, blk.Cid()))
+	_, err = meta.Get(ctx, blk.Cid())
+	require.ErrorIs(t, err, ErrBlockMetaNotFound)
+
+	cancel()
+	require.NoError(t, meta.Close())
+}
+
+func TestRepoBlockstore_ExistingBlocks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	repo, err := fsrepo.NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+	defer repo.Close()
+
+	meta := NewBlockMetaIndex(ctx, repo.Datastore())
+	usage := &StorageUsage{maxStorage: 1 << 30}
+	events := newEventBus()
+	sub, err := events.subscribe(ctx, EventBlocksAdded|EventBlocksDeleted, SetEventBufferSize(16))
+	require.NoError(t, err)
+	defer sub.Close()
+	bs := newRepoBlockstore(blockstore.NewBlockstore(repo.Datastore(), blockstore.WriteThrough(true)), meta, usage, events, nil)
+
+	blk := blocks.NewBlock([]byte("written once"))
+	other := blocks.NewBlock([]byte("written in a batch"))
+
+	t.Log("a block the repo has is neither counted nor published again")
+	require.NoError(t, bs.Put(ctx, blk))
+	require.NoError(t, bs.Put(ctx, blk))
+	require.NoError(t, bs.PutMany(ctx, []blocks.Block{blk, other, other}))
+	require.Equal(t, uint64(len(blk.RawData())+len(other.RawData())), usage.used())
+
+	added := (<-sub.Events()).(BlocksAddedEvent)
+	require.Equal(t, []cid.Cid{blk.Cid()}, added.Cids)
+	added = (<-sub.Events()).(BlocksAddedEvent)
+	require.Equal(t, []cid.Cid{other.Cid()}, added.Cids)
+
+	t.Log("deleting a block the repo does not have publishes nothing")
+	require.NoError(t, bs.DeleteBlock(ctx, blk.Cid()))
+	require.NoError(t, bs.DeleteBlock(ctx, blk.Cid()))
+	deleted := (<-sub.Events()).(BlocksDeletedEvent)
+	require.Equal(t, []cid.Cid{blk.Cid()}, deleted.Cids)
+	select {
+	case e := <-sub.Events():
+		t.Fatalf("unexpected event %v", e)
+	default:
+	}
+
+	t.Log("a read that raced with the delete does not bring the metadata back")
+	meta.recordAccess(blk.Cid(), len(blk.RawData()))
+	require.NoError(t, meta.Flush(ctx))
+	_, err = meta.Get(ctx, blk.Cid())
+	require.ErrorIs(t, err, ErrBlockMetaNotFound)
+
+	t.Log("writing the block again records it")
+	require.NoError(t, bs.Put(ctx, blk))
+	_, err = meta.Get(ctx, blk.Cid())
+	require.NoError(t, err)
+}
+
+// failingBatchDatastore fails to commit batches while fail is set
+type failingBatchDatastore struct {
+	fsrepo.Datastore
+	fail bool
+}
+
+func (d *failingBatchDatastore) Batch(ctx context.Context) (ds.Batch, error) {
+	if d.fail {
+		return nil, errors.New("batch failed")
+	}
+	return d.Datastore.Batch(ctx)
+}
+
+func TestBlockMetaIndex_FlushFailure(t *testing.T) {
+	ctx := context.Background()
+	d := &failingBatchDatastore{Datastore: dssync.MutexWrap(ds.NewMapDatastore()), fail: true}
+	meta := NewBlockMetaIndex(ctx, d)
+
+	blk := blocks.NewBlock([]byte("flushed later"))
+	meta.recordPut(blk.Cid(), len(blk.RawData()))
+	meta.recordAccess(blk.Cid(), len(blk.RawData()))
+	require.Error(t, meta.Flush(ctx))
+
+	t.Log("the updates of a failed flush are kept and merged with newer ones")
+	meta.recordAccess(blk.Cid(), len(blk.RawData()))
+	d.fail = false
+	require.NoError(t, meta.Flush(ctx))
+
+	m, err := meta.load(ctx, blockMetaKey(blk.Cid()))
+	require.NoError(t, err)
+	require.NotNil(t, m)
+	require.False(t, m.Inserted.IsZero())
+	require.Equal(t, uint64(2), m.AccessCount)
+}
@@ -0,0 +1,141 @@
+package ipfsrepo
+
+import (
+	"context"
+	"github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// repoBlockstore wraps the blockstore of a repo, so every write and read,
+// whether it comes from the importer or the BlockRepo, is seen by the repo.
+type repoBlockstore struct {
+	blockstore.Blockstore
+	meta   *BlockMetaIndex
+	usage  *StorageUsage
+	events *eventBus
+	// readOnly turns writes into ErrReadOnly
+	readOnly bool
+	// health turns writes into errors once the repo is degraded, and is told about every result
+	health *deviceHealth
+}
+
+func newRepoBlockstore(bs blockstore.Blockstore, meta *BlockMetaIndex, usage *StorageUsage, events *eventBus, health *deviceHealth) *repoBlockstore {
+	return &repoBlockstore{Blockstore: bs, meta: meta, usage: usage, events: events, health: health}
+}
+
+// writable returns ErrReadOnly for a read-only repo, and the error a degraded repo has
+func (b *repoBlockstore) writable() error {
+	if b.readOnly {
+		return ErrReadOnly
+	}
+	return b.health.err()
+}
+
+// Put writes the block unless the repo has it already, only new blocks are
+// counted and published
+func (b *repoBlockstore) Put(ctx context.Context, blk blocks.Block) error {
+	if err := b.writable(); err != nil {
+		return err
+	}
+
+	has, err := b.Blockstore.Has(ctx, blk.Cid())
+	b.health.observe(err)
+	if err != nil || has {
+		return err
+	}
+
+	err = b.Blockstore.Put(ctx, blk)
+	b.health.observe(err)
+	if err != nil {
+		return err
+	}
+
+	b.meta.recordPut(blk.Cid(), len(blk.RawData()))
+	b.usage.added(uint64(len(blk.RawData())))
+	b.events.publish(BlocksAddedEvent{eventBase: newEventBase(), Cids: []cid.Cid{blk.Cid()}, Bytes: uint64(len(blk.RawData()))})
+	return nil
+}
+
+// PutMany writes the blocks the repo does not have yet, like Put
+func (b *repoBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	if err := b.writable(); err != nil {
+		return err
+	}
+
+	missing := make([]blocks.Block, 0, len(blks))
+	seen := make(map[string]struct{}, len(blks))
+	for _, blk := range blks {
+		if _, ok := seen[string(blk.Cid().Hash())]; ok {
+			continue
+		}
+		seen[string(blk.Cid().Hash())] = struct{}{}
+
+		has, err := b.Blockstore.Has(ctx, blk.Cid())
+		b.health.observe(err)
+		if err != nil {
+			return err
+		}
+		if !has {
+			missing = append(missing, blk)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	err := b.Blockstore.PutMany(ctx, missing)
+	b.health.observe(err)
+	if err != nil {
+		return err
+	}
+
+	added := BlocksAddedEvent{eventBase: newEventBase(), Cids: make([]cid.Cid, 0, len(missing))}
+	for _, blk := range missing {
+		b.meta.recordPut(blk.Cid(), len(blk.RawData()))
+		added.Cids = append(added.Cids, blk.Cid())
+		added.Bytes += uint64(len(blk.RawData()))
+	}
+
+	b.usage.added(added.Bytes)
+	b.events.publish(added)
+	return nil
+}
+
+func (b *repoBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	blk, err := b.Blockstore.Get(ctx, c)
+	b.health.observe(err)
+	if err != nil {
+		return nil, err
+	}
+
+	b.meta.recordAccess(c, len(blk.RawData()))
+	return blk, nil
+}
+
+func (b *repoBlockstore) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	if err := b.writable(); err != nil {
+		return err
+	}
+
+	size, err := b.Blockstore.GetSize(ctx, c)
+	if ipld.IsNotFound(err) {
+		// nothing is deleted, only metadata left behind is dropped
+		return b.meta.remove(ctx, c)
+	}
+	b.health.observe(err)
+	if err != nil {
+		return err
+	}
+
+	err = b.Blockstore.DeleteBlock(ctx, c)
+	b.health.observe(err)
+	if err != nil {
+		return err
+	}
+
+	b.usage.removed(uint64(size))
+	b.events.publish(BlocksDeletedEvent{eventBase: newEventBase(), Cids: []cid.Cid{c}, Bytes: uint64(size)})
+	return b.meta.remove(ctx, c)
+}
@@ -0,0 +1,228 @@
+package ipfsrepo
+
+import (
+	"context"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/fsrepo"
+	"github.com/ipfs/go-cid"
+	"os"
+	"path/filepath"
+)
+
+// flatfsTempDir is where flatfs writes blocks before moving them into place
+const flatfsTempDir = ".temp"
+
+// DatastoreUsage is the space allocated by one datastore of the disk spec
+type DatastoreUsage struct {
+	fsrepo.Mount
+	Size uint64
+}
+
+// RootUsage is the size of the blocks of an imported root. Sizes are block
+// sizes, not the space allocated for them on disk.
+type RootUsage struct {
+	Cid  string
+	Name string
+	// Tenant is the tenant that imported the root, empty for roots of the repo
+	Tenant string
+	Blocks int
+	Size   uint64
+	// Exclusive is the size of the blocks no other root references, what
+	// removing the root would free
+	Exclusive uint64
+	// Shared is the size of the blocks also referenced by other roots
+	Shared uint64
+}
+
+// UsageBreakdown splits the space used by a repo by component and by root
+type UsageBreakdown struct {
+	// Total is the space allocated by the repo directory
+	Total uint64
+	// Datastores holds every datastore of the spec, temp files excluded
+	Datastores []DatastoreUsage
+	// Temp is the space used by blocks being written
+	Temp uint64
+	Lock uint64
+	// Other is everything else in the repo directory, like the spec and the usage cache
+	Other uint64
+	Roots []RootUsage
+}
+
+// UsageBreakdown walks the repo directory and the dag of every root. It is
+// expensive on large repos.
+func (r *Repo) UsageBreakdown(ctx context.Context) (*UsageBreakdown, error) {
+	spec := r.storage.Spec()
+	if spec == nil {
+		return nil, ErrNoDiskSpec
+	}
+
+	breakdown, err := componentUsage(r.storage.Path(), spec)
+	if err != nil {
+		return nil, err
+	}
+
+	breakdown.Roots, err = r.RootUsage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return breakdown, nil
+}
+
+// RootUsage returns the exclusive and shared size of every root of the repo
+// and of its tenants. A block referenced by a root of the repo and by a root
+// of a tenant is shared. Blocks tenants saved outside of a root are not
+// counted, a block of a root they also saved counts as exclusive to the root.
+func (r *Repo) RootUsage(ctx context.Context) ([]RootUsage, error) {
+	roots, err := r.roots.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tenantOf := make([]string, len(roots))
+
+	ids, err := r.tenants.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		t, err := r.tenants.get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		tenantRoots, err := t.Roots(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, root := range tenantRoots {
+			roots = append(roots, root)
+			tenantOf = append(tenantOf, id)
+		}
+	}
+
+	// blocks are keyed by multihash like in the blockstore, a block linked
+	// as CIDv0 and as CIDv1 is the same block
+	bs := r.repoBlockStore.Blockstore
+	sizes := make(map[string]uint64)
+	refs := make(map[string]int)
+	dags := make([][]string, len(roots))
+
+	for i, root := range roots {
+		c, err := cid.Decode(root.Cid)
+		if err != nil {
+			return nil, err
+		}
+
+		blks, err := dagBlocks(ctx, bs, c)
+		if err != nil {
+			return nil, err
+		}
+
+		seen := make(map[string]struct{}, len(blks))
+		for _, blk := range blks {
+			hash := string(blk.Hash())
+			if _, ok := seen[hash]; ok {
+				continue
+			}
+			seen[hash] = struct{}{}
+			dags[i] = append(dags[i], hash)
+
+			refs[hash]++
+			if _, ok := sizes[hash]; ok {
+				continue
+			}
+
+			size, err := bs.GetSize(ctx, blk)
+			if err != nil {
+				return nil, err
+			}
+			sizes[hash] = uint64(size)
+		}
+	}
+
+	usage := make([]RootUsage, len(roots))
+	for i, root := range roots {
+		usage[i] = RootUsage{Cid: root.Cid, Name: root.Name, Tenant: tenantOf[i], Blocks: len(dags[i])}
+		for _, blk := range dags[i] {
+			usage[i].Size += sizes[blk]
+			if refs[blk] == 1 {
+				usage[i].Exclusive += sizes[blk]
+			} else {
+				usage[i].Shared += sizes[blk]
+			}
+		}
+	}
+
+	return usage, nil
+}
+
+// componentUsage splits the space allocated by the repo directory using the mounts of spec
+func componentUsage(repoPath string, spec fsrepo.DiskSpec) (*UsageBreakdown, error) {
+	total, err := dirUsage(repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	breakdown := &UsageBreakdown{Total: total}
+	inRepo := uint64(0)
+
+	for _, m := range spec.Mounts() {
+		path := m.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(repoPath, path)
+		}
+
+		size, err := dirUsage(path)
+		if err != nil {
+			return nil, err
+		}
+
+		temp := uint64(0)
+		if m.Type == "flatfs" {
+			temp, err = dirUsage(filepath.Join(path, flatfsTempDir))
+			if err != nil {
+				return nil, err
+			}
+			size -= min(temp, size)
+			breakdown.Temp += temp
+		}
+
+		breakdown.Datastores = append(breakdown.Datastores, DatastoreUsage{Mount: m, Size: size})
+		if !filepath.IsAbs(m.Path) {
+			inRepo += size + temp
+		}
+	}
+
+	if info, err := os.Stat(filepath.Join(repoPath, fsrepo.LockFile)); err == nil {
+		breakdown.Lock = allocatedSize(info)
+	}
+
+	inRepo += breakdown.Lock
+	if total > inRepo {
+		breakdown.Other = total - inRepo
+	}
+
+	return breakdown, nil
+}
+
+// dirUsage returns the space allocated for path, zero if it does not exist
+func dirUsage(path string) (uint64, error) {
+	var usage uint64
+
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// files may be deleted while walking
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		usage += allocatedSize(info)
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return usage, nil
+}
@@ -0,0 +1,107 @@
+package ipfsrepo
+
+import (
+	"context"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRepo_UsageBreakdown(t *testing.T) {
+	ctx := context.Background()
+
+	repo, err := FromPath("test-uuid", t.TempDir(), 1<<30, SetChunkSize(64<<10))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	tmpDir := t.TempDir()
+
+	// the first file is a prefix of the second, they share their first chunks
+	fileBytes, err := createFile0to100k()
+	require.NoError(t, err)
+	smallPath := path.Join(tmpDir, "small")
+	require.NoError(t, os.WriteFile(smallPath, fileBytes, 0644))
+
+	fileBytes, err = createFile0to200k()
+	require.NoError(t, err)
+	largePath := path.Join(tmpDir, "large")
+	require.NoError(t, os.WriteFile(largePath, fileBytes, 0644))
+
+	small, err := repo.Import(ctx, smallPath)
+	require.NoError(t, err)
+	large, err := repo.Import(ctx, largePath)
+	require.NoError(t, err)
+
+	breakdown, err := repo.UsageBreakdown(ctx)
+	require.NoError(t, err)
+
+	require.Len(t, breakdown.Datastores, 2)
+	sum := breakdown.Temp + breakdown.Lock + breakdown.Other
+	for _, d := range breakdown.Datastores {
+		require.NotZero(t, d.Size, d.Name)
+		sum += d.Size
+	}
+	require.Equal(t, breakdown.Total, sum)
+
+	require.Len(t, breakdown.Roots, 2)
+	usage := make(map[string]RootUsage)
+	for _, r := range breakdown.Roots {
+		require.Equal(t, r.Size, r.Exclusive+r.Shared)
+		usage[r.Cid] = r
+	}
+
+	require.NotZero(t, usage[small.RootCid].Shared)
+	require.Equal(t, usage[small.RootCid].Shared, usage[large.RootCid].Shared)
+	require.Greater(t, usage[large.RootCid].Exclusive, usage[small.RootCid].Exclusive)
+
+	t.Log("roots of tenants share their blocks with the roots of the repo")
+	tenant, err := repo.CreateTenant(ctx, "tenant", 1<<30)
+	require.NoError(t, err)
+	_, err = tenant.Import(ctx, smallPath)
+	require.NoError(t, err)
+
+	roots, err := repo.RootUsage(ctx)
+	require.NoError(t, err)
+	require.Len(t, roots, 3)
+	for _, r := range roots {
+		if r.Cid != small.RootCid {
+			continue
+		}
+		require.Zero(t, r.Exclusive, r.Tenant)
+		require.Equal(t, r.Size, r.Shared)
+		if r.Tenant != "" {
+			require.Equal(t, "tenant", r.Tenant)
+		}
+	}
+}
+
+func TestRepo_RootUsageCidVersions(t *testing.T) {
+	ctx := context.Background()
+
+	repo, err := FromPath("test-uuid", t.TempDir(), 1<<30)
+	require.NoError(t, err)
+	defer repo.Close()
+
+	nd := merkledag.NodeWithData([]byte("shared by both roots"))
+	require.NoError(t, repo.BlockStore().Put(ctx, nd))
+
+	t.Log("a block referenced as CIDv0 and as CIDv1 is shared by the roots")
+	v0 := nd.Cid()
+	v1 := cid.NewCidV1(cid.DagProtobuf, v0.Hash())
+	for _, c := range []cid.Cid{v0, v1} {
+		require.NoError(t, repo.roots.Add(ctx, &Root{Cid: c.String(), Added: time.Now()}))
+	}
+
+	roots, err := repo.RootUsage(ctx)
+	require.NoError(t, err)
+	require.Len(t, roots, 2)
+	for _, r := range roots {
+		require.Equal(t, 1, r.Blocks)
+		require.Zero(t, r.Exclusive, r.Cid)
+		require.Equal(t, uint64(len(nd.RawData())), r.Shared)
+	}
+}
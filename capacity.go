@@ -0,0 +1,195 @@
+package ipfsrepo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"sync"
+)
+
+var ErrRepoFull = errors.New("repo is full")
+
+// RepoFullError is returned when a write does not fit into the remaining
+// capacity of the repo, it matches ErrRepoFull
+type RepoFullError struct {
+	Requested uint64
+	Available uint64
+}
+
+func (e *RepoFullError) Error() string {
+	return fmt.Sprintf("%s: requested %s, available %s", ErrRepoFull,
+		humanize.Bytes(e.Requested), humanize.Bytes(e.Available))
+}
+
+func (e *RepoFullError) Is(target error) bool {
+	return target == ErrRepoFull
+}
+
+// Admission checks writes against the remaining capacity of the repo. The
+// capacity reserved by in-flight imports and not written yet counts as used,
+// written bytes are part of the usage as soon as they are put.
+type Admission struct {
+	usage *StorageUsage
+
+	mu       sync.Mutex
+	reserved uint64
+}
+
+func NewAdmission(usage *StorageUsage) *Admission {
+	return &Admission{usage: usage}
+}
+
+// Available returns the bytes that can still be written
+func (a *Admission) Available() uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.available()
+}
+
+// Check returns RepoFullError if size bytes do not fit into the repo
+func (a *Admission) Check(size uint64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.check(size)
+}
+
+// Reserve reserves size bytes for a write that is about to happen
+func (a *Admission) Reserve(size uint64) (*Reservation, error) {
+	r := &Reservation{admission: a}
+	if err := r.Grow(int64(size)); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// available returns the free capacity, a.mu must be held
+func (a *Admission) available() uint64 {
+	used := a.usage.used() + a.reserved
+	if used >= a.usage.maxStorage {
+		return 0
+	}
+
+	return a.usage.maxStorage - used
+}
+
+// check is Check with a.mu held
+func (a *Admission) check(size uint64) error {
+	if available := a.available(); size > available {
+		return &RepoFullError{Requested: size, Available: available}
+	}
+
+	return nil
+}
+
+// Reservation is capacity held by an in-flight write
+type Reservation struct {
+	admission *Admission
+	// outstanding is the reserved capacity that was not written yet
+	outstanding uint64
+	released    bool
+}
+
+// Grow reserves size more bytes
+func (r *Reservation) Grow(size int64) error {
+	a := r.admission
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.check(uint64(size)); err != nil {
+		return err
+	}
+
+	r.outstanding += uint64(size)
+	a.reserved += uint64(size)
+	return nil
+}
+
+// Consume charges written bytes against the reservation. Once written they
+// are part of the usage, bytes beyond the reservation must still fit.
+func (r *Reservation) Consume(size uint64) error {
+	a := r.admission
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if size > r.outstanding {
+		if err := a.check(size - r.outstanding); err != nil {
+			return err
+		}
+		size = r.outstanding
+	}
+
+	r.outstanding -= size
+	a.reserved -= size
+	return nil
+}
+
+// Release gives the capacity that was not written back
+func (r *Reservation) Release() {
+	a := r.admission
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if r.released {
+		return
+	}
+
+	a.reserved -= r.outstanding
+	r.outstanding = 0
+	r.released = true
+}
+
+// reserver holds capacity for an in-flight write, a Reservation holds capacity
+// of the repo and a quotaReservation quota of a tenant
+type reserver interface {
+	Grow(size int64) error
+	Consume(size uint64) error
+	Release()
+}
+
+// admitter reserves capacity for a batch of blocks about to be written, an
+// Admission for the disk of a repo and a multiBlockstore for the disks of a MultiRepo
+type admitter interface {
+	reserve(size uint64) (reserver, error)
+}
+
+func (a *Admission) reserve(size uint64) (reserver, error) {
+	r, err := a.Reserve(size)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// reservedBlockstore enforces a reservation on every batch written
+type reservedBlockstore struct {
+	blockstore.Blockstore
+	reservation reserver
+}
+
+func (b *reservedBlockstore) Put(ctx context.Context, blk blocks.Block) error {
+	if err := b.reservation.Consume(uint64(len(blk.RawData()))); err != nil {
+		return err
+	}
+
+	return b.Blockstore.Put(ctx, blk)
+}
+
+func (b *reservedBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	var size uint64
+	for _, blk := range blks {
+		size += uint64(len(blk.RawData()))
+	}
+
+	if err := b.reservation.Consume(size); err != nil {
+		return err
+	}
+
+	return b.Blockstore.PutMany(ctx, blks)
+}
@@ -0,0 +1,109 @@
+package ipfsrepo
+
+import (
+	"context"
+	"errors"
+	"github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestAdmission_Reserve(t *testing.T) {
+	usage := &StorageUsage{usage: 100, maxStorage: 1000}
+	a := NewAdmission(usage)
+	require.Equal(t, uint64(900), a.Available())
+
+	r, err := a.Reserve(600)
+	require.NoError(t, err)
+	require.Equal(t, uint64(300), a.Available())
+
+	var full *RepoFullError
+	_, err = a.Reserve(400)
+	require.ErrorIs(t, err, ErrRepoFull)
+	require.True(t, errors.As(err, &full))
+	require.Equal(t, uint64(400), full.Requested)
+	require.Equal(t, uint64(300), full.Available)
+
+	// written bytes leave the reservation and become usage
+	require.NoError(t, r.Consume(500))
+	usage.usage += 500
+	require.Equal(t, uint64(300), a.Available())
+
+	// bytes beyond the reservation must fit into what is left
+	require.Error(t, r.Consume(500))
+	require.NoError(t, r.Consume(200))
+	usage.usage += 200
+
+	r.Release()
+	require.Equal(t, uint64(200), a.Available())
+}
+
+func TestRepo_ImportRepoFull(t *testing.T) {
+	ctx := context.Background()
+
+	repo, err := FromPath("test-uuid", t.TempDir(), 1<<30)
+	require.NoError(t, err)
+	defer repo.Close()
+
+	// leave 64KiB of room
+	repo.StorageUsage.maxStorage = repo.StorageUsage.usage + 64<<10
+
+	fileBytes, err := createFile0to100k()
+	require.NoError(t, err)
+	filePath := path.Join(t.TempDir(), "testfile")
+	require.NoError(t, os.WriteFile(filePath, fileBytes, 0644))
+
+	var full *RepoFullError
+	_, err = repo.Import(ctx, filePath)
+	require.ErrorIs(t, err, ErrRepoFull)
+	require.True(t, errors.As(err, &full))
+	require.Equal(t, uint64(len(fileBytes)), full.Requested)
+	require.Equal(t, uint64(64<<10), full.Available)
+
+	err = repo.SaveBlock(ctx, [][]byte{make([]byte, 128<<10)})
+	require.True(t, errors.As(err, &full))
+
+	// the saved block counts as used right away
+	require.NoError(t, repo.SaveBlock(ctx, [][]byte{make([]byte, 1<<10)}))
+	require.Equal(t, uint64(63<<10), repo.Available())
+
+	t.Log("tenants reserve their blocks the same way")
+	tenant, err := repo.CreateTenant(ctx, "tenant", 1<<30)
+	require.NoError(t, err)
+	err = tenant.SaveBlock(ctx, [][]byte{make([]byte, 128<<10)})
+	require.True(t, errors.As(err, &full))
+	require.NoError(t, tenant.SaveBlock(ctx, [][]byte{[]byte("tenant block")}))
+	require.Equal(t, uint64(63<<10)-uint64(len("tenant block")), repo.Available())
+}
+
+// putHookBlockstore calls put before every batch is written
+type putHookBlockstore struct {
+	blockstore.Blockstore
+	put func()
+}
+
+func (b *putHookBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	b.put()
+	return b.Blockstore.PutMany(ctx, blks)
+}
+
+func TestBlockRepo_SaveBlockConsumesReservation(t *testing.T) {
+	ctx := context.Background()
+	a := NewAdmission(&StorageUsage{maxStorage: 1000})
+
+	t.Log("a batch leaves the reservation before it is written and counted as usage")
+	bs := &putHookBlockstore{
+		Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		put:        func() { require.Zero(t, a.reserved) },
+	}
+	b := &BlockRepo{blockStore: bs, admission: a}
+	require.NoError(t, b.SaveBlock(ctx, [][]byte{make([]byte, 600)}))
+
+	err := b.SaveBlock(ctx, [][]byte{make([]byte, 1001)})
+	require.ErrorIs(t, err, ErrRepoFull)
+}
@@ -0,0 +1,186 @@
+package ipfsrepo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/chunker"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/fsrepo"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// repoConfigFile is written next to datastore_spec when the repo is created
+const repoConfigFile = "config"
+
+var (
+	ErrInvalidConfig  = errors.New("invalid repo config")
+	ErrConfigConflict = errors.New("options conflict with the repo config")
+)
+
+// RepoConfig is kept in the config file of a repo, so every process opening
+// it chunks files into the same CIDs and sees the same usage levels. Options
+// that differ from it are rejected unless OverrideConfig is set.
+type RepoConfig struct {
+	Chunking chunker.Profile `json:"chunking"`
+	Usage    UsageConfig     `json:"usage"`
+}
+
+// UsageConfig are the usage settings of a RepoConfig
+type UsageConfig struct {
+	Watermarks Watermarks
+	// ScanInterval is how often usage is refreshed, see StorageUsage.SetScanInterval
+	ScanInterval time.Duration
+}
+
+// usageConfigJSON keeps the scan interval readable in the config file
+type usageConfigJSON struct {
+	Watermarks   Watermarks `json:"watermarks"`
+	ScanInterval string     `json:"scanInterval"`
+}
+
+func (c UsageConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(usageConfigJSON{Watermarks: c.Watermarks, ScanInterval: c.ScanInterval.String()})
+}
+
+func (c *UsageConfig) UnmarshalJSON(b []byte) error {
+	var v usageConfigJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	scanInterval, err := time.ParseDuration(v.ScanInterval)
+	if err != nil {
+		return fmt.Errorf("%w: scan interval: %s", ErrInvalidConfig, err)
+	}
+
+	*c = UsageConfig{Watermarks: v.Watermarks, ScanInterval: scanInterval}
+	return nil
+}
+
+// DefaultRepoConfig returns the config of repos created without options
+func DefaultRepoConfig() RepoConfig {
+	return RepoConfig{
+		Chunking: chunker.DefaultProfile(),
+		Usage:    UsageConfig{Watermarks: DefaultWatermarks(), ScanInterval: defaultScanInterval},
+	}
+}
+
+// Validate checks the chunking profile, the watermarks and the scan interval
+func (c RepoConfig) Validate() error {
+	if err := c.Chunking.Validate(); err != nil {
+		return err
+	}
+	if err := c.Usage.Watermarks.Validate(); err != nil {
+		return err
+	}
+	if c.Usage.ScanInterval <= 0 {
+		return fmt.Errorf("%w: scan interval %s must be positive", ErrInvalidConfig, c.Usage.ScanInterval)
+	}
+
+	return nil
+}
+
+// conflicts returns the sections of other that differ from c
+func (c RepoConfig) conflicts(other RepoConfig) []string {
+	var sections []string
+	if c.Chunking != other.Chunking {
+		sections = append(sections, "chunking")
+	}
+	if c.Usage != other.Usage {
+		sections = append(sections, "usage")
+	}
+	return sections
+}
+
+// ConfigFile get repo config file path
+func ConfigFile(repoPath string) string {
+	return filepath.Join(repoPath, repoConfigFile)
+}
+
+// ReadRepoConfig reads the config file of the repo at repoPath, it fails
+// with os.ErrNotExist for repos created before the config file
+func ReadRepoConfig(repoPath string) (RepoConfig, error) {
+	b, err := os.ReadFile(ConfigFile(repoPath))
+	if err != nil {
+		return RepoConfig{}, err
+	}
+
+	var config RepoConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return RepoConfig{}, fmt.Errorf("%w: %s", ErrInvalidConfig, err)
+	}
+	if err := config.Validate(); err != nil {
+		return RepoConfig{}, err
+	}
+
+	return config, nil
+}
+
+// writeRepoConfig replaces the config file atomically
+func writeRepoConfig(repoPath string, config RepoConfig) error {
+	b, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return fsrepo.WriteFile(ConfigFile(repoPath), b)
+}
+
+// loadConfig applies the config file of the repo before the options run.
+// Repos without one get the default config, created is true then.
+func (r *Repo) loadConfig(repoPath string) (config RepoConfig, created bool, err error) {
+	config, err = ReadRepoConfig(repoPath)
+	if errors.Is(err, os.ErrNotExist) {
+		config, created, err = DefaultRepoConfig(), true, nil
+	}
+	if err != nil {
+		return RepoConfig{}, false, err
+	}
+
+	r.profile = config.Chunking
+	r.StorageUsage.SetScanInterval(config.Usage.ScanInterval)
+	if err := r.StorageUsage.SetWatermarks(config.Usage.Watermarks); err != nil {
+		return RepoConfig{}, false, err
+	}
+
+	return config, created, nil
+}
+
+// settleConfig compares the settings left by the options with stored. A repo
+// without a config file gets one with them, a conflict fails unless
+// OverrideConfig is set and then replaces the config file. Read-only repos
+// keep the settings in memory.
+func (r *Repo) settleConfig(repoPath string, stored RepoConfig, created bool) error {
+	config := RepoConfig{
+		Chunking: r.profile,
+		Usage:    UsageConfig{Watermarks: r.StorageUsage.Watermarks(), ScanInterval: r.StorageUsage.scanInterval},
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	r.config = config
+
+	if !created {
+		sections := stored.conflicts(config)
+		if len(sections) == 0 {
+			return nil
+		}
+		if !r.overrideConfig {
+			return fmt.Errorf("%w: %s settings differ from %s", ErrConfigConflict, strings.Join(sections, " and "), ConfigFile(repoPath))
+		}
+		log.Warnf("options override the %s settings of %s", strings.Join(sections, " and "), ConfigFile(repoPath))
+	}
+
+	if r.readOnly {
+		return nil
+	}
+	return writeRepoConfig(repoPath, config)
+}
+
+// Config returns the config the repo runs with
+func (r *Repo) Config() RepoConfig {
+	return r.config
+}
@@ -0,0 +1,126 @@
+package ipfsrepo
+
+import (
+	"context"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/chunker"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRepoConfigRoundTrip(t *testing.T) {
+	repoPath := t.TempDir()
+
+	config := DefaultRepoConfig()
+	config.Chunking.ChunkSize = chunker.Chunk10MiB
+	config.Usage.ScanInterval = 90 * time.Second
+	require.NoError(t, writeRepoConfig(repoPath, config))
+
+	read, err := ReadRepoConfig(repoPath)
+	require.NoError(t, err)
+	require.Equal(t, config, read)
+
+	b, err := os.ReadFile(ConfigFile(repoPath))
+	require.NoError(t, err)
+	require.Contains(t, string(b), `"scanInterval": "1m30s"`)
+
+	t.Log("an invalid config file is rejected")
+	require.NoError(t, os.WriteFile(ConfigFile(repoPath), []byte(`{"usage": {"scanInterval": "often"}}`), 0o600))
+	_, err = ReadRepoConfig(repoPath)
+	require.ErrorIs(t, err, ErrInvalidConfig)
+
+	_, err = ReadRepoConfig(t.TempDir())
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRepoConfig(t *testing.T) {
+	ctx := context.Background()
+	repoPath := t.TempDir()
+
+	fileBytes, err := createFile0to100k()
+	require.NoError(t, err)
+	filePath := path.Join(t.TempDir(), "testfile")
+	require.NoError(t, os.WriteFile(filePath, fileBytes, 0644))
+
+	profile := chunker.DefaultProfile()
+	profile.ChunkSize = 64 << 10
+	repo, err := FromPath("test-uuid", repoPath, 1<<30, SetChunkingProfile(profile), SetStorageUsage(time.Minute, 80))
+	require.NoError(t, err)
+	result, err := repo.Import(ctx, filePath)
+	require.NoError(t, err)
+	repo.Close()
+
+	t.Log("the options of the first open are written to the config file")
+	config, err := ReadRepoConfig(repoPath)
+	require.NoError(t, err)
+	require.Equal(t, profile, config.Chunking)
+	require.Equal(t, time.Minute, config.Usage.ScanInterval)
+	require.Equal(t, 80.0, config.Usage.Watermarks.Full.Enter)
+
+	t.Log("an open without options uses the config file")
+	repo, err = FromPath("test-uuid", repoPath, 1<<30)
+	require.NoError(t, err)
+	require.Equal(t, config, repo.Config())
+	_, err = repo.Import(ctx, filePath)
+	require.NoError(t, err)
+	roots, err := repo.Roots(ctx)
+	require.NoError(t, err)
+	require.Len(t, roots, 1, "the same file gets the same root")
+	require.Equal(t, result.RootCid, roots[0].Cid)
+	repo.Close()
+
+	t.Log("options matching the config file are accepted")
+	repo, err = FromPath("test-uuid", repoPath, 1<<30, SetChunkSize(profile.ChunkSize))
+	require.NoError(t, err)
+	repo.Close()
+
+	t.Log("conflicting options are rejected")
+	_, err = FromPath("test-uuid", repoPath, 1<<30, SetChunkSize(chunker.Chunk1MiB))
+	require.ErrorIs(t, err, ErrConfigConflict)
+	_, err = FromPath("test-uuid", repoPath, 1<<30, SetStorageUsage(time.Minute, 90))
+	require.ErrorIs(t, err, ErrConfigConflict)
+	_, err = FromPathReadOnly("test-uuid", repoPath, 1<<30, SetChunkSize(chunker.Chunk1MiB))
+	require.ErrorIs(t, err, ErrConfigConflict)
+
+	t.Log("a read-only override does not change the config file")
+	repo, err = FromPathReadOnly("test-uuid", repoPath, 1<<30, SetChunkSize(chunker.Chunk1MiB), OverrideConfig())
+	require.NoError(t, err)
+	require.Equal(t, int64(chunker.Chunk1MiB), repo.Config().Chunking.ChunkSize)
+	repo.Close()
+	read, err := ReadRepoConfig(repoPath)
+	require.NoError(t, err)
+	require.Equal(t, config, read)
+
+	t.Log("an override replaces the config file")
+	repo, err = FromPath("test-uuid", repoPath, 1<<30, SetChunkSize(chunker.Chunk1MiB), OverrideConfig())
+	require.NoError(t, err)
+	repo.Close()
+	read, err = ReadRepoConfig(repoPath)
+	require.NoError(t, err)
+	require.Equal(t, int64(chunker.Chunk1MiB), read.Chunking.ChunkSize)
+	require.Equal(t, config.Usage, read.Usage)
+
+	t.Log("an invalid profile is rejected")
+	invalid := chunker.DefaultProfile()
+	invalid.HashFunction = "none"
+	_, err = FromPath("test-uuid", repoPath, 1<<30, SetChunkingProfile(invalid), OverrideConfig())
+	require.ErrorIs(t, err, chunker.ErrInvalidProfile)
+}
+
+func TestRepoConfigMigrates(t *testing.T) {
+	ctx := context.Background()
+
+	repo, err := FromPath("test-uuid", t.TempDir(), 1<<30, SetChunkSize(chunker.Chunk10MiB))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	newPath := t.TempDir()
+	_, err = repo.MigrateTo(ctx, newPath)
+	require.NoError(t, err)
+
+	config, err := ReadRepoConfig(newPath)
+	require.NoError(t, err)
+	require.Equal(t, repo.Config(), config)
+}
@@ -0,0 +1,41 @@
+package ipfsrepo
+
+import (
+	"fmt"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/linuxutils/lsblk"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+)
+
+// fakeLsblk returns canned lsblk output instead of running it
+type fakeLsblk struct {
+	out string
+}
+
+func (e *fakeLsblk) ExecuteCmd(string) (string, string, error) {
+	return e.out, "", nil
+}
+
+func TestFromDevice(t *testing.T) {
+	mountPoint := t.TempDir()
+	out := fmt.Sprintf(`{"blockdevices": [
+		{"name":"/dev/sdb", "type":"disk", "size":1073741824, "mountpoint":%q, "fstype":"ext4", "label":"data", "uuid":"9f1e-3333"},
+		{"name":"/dev/sdc", "type":"disk", "size":1073741824, "mountpoint":null, "fstype":"ext4", "label":"spare", "uuid":"9f1e-4444"}
+	]}`, mountPoint)
+	lsblkCmd := lsblk.NewCmdWithExecutor(&fakeLsblk{out: out})
+
+	repo, err := fromDevice(lsblkCmd, "data", false)
+	require.NoError(t, err)
+	defer repo.Close()
+
+	require.Equal(t, "9f1e-3333", repo.UUID())
+	require.Equal(t, uint64(1<<30), repo.MaxStorageSize())
+	require.DirExists(t, filepath.Join(mountPoint, DeviceRepoDir))
+
+	_, err = fromDevice(lsblkCmd, "9f1e-4444", false)
+	require.ErrorIs(t, err, ErrDeviceNotMounted)
+
+	_, err = fromDevice(lsblkCmd, "missing", false)
+	require.ErrorIs(t, err, lsblk.ErrDeviceNotFound)
+}
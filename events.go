@@ -0,0 +1,346 @@
+package ipfsrepo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"go.uber.org/atomic"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultEventBufferSize = 64
+
+var ErrInvalidEventBufferSize = errors.New("event buffer size must not be negative")
+
+// EventType identifies a kind of repo event, types can be or-ed together to form a filter
+type EventType uint32
+
+const (
+	EventImportStarted EventType = 1 << iota
+	EventImportProgress
+	EventImportFinished
+	EventBlocksAdded
+	EventBlocksDeleted
+	EventGC
+	EventUsageThreshold
+	EventExtractFinished
+	EventDegraded
+	EventMigration
+
+	// EventAll matches every event type
+	EventAll EventType = 1<<iota - 1
+)
+
+var eventTypeNames = []string{
+	"ImportStarted",
+	"ImportProgress",
+	"ImportFinished",
+	"BlocksAdded",
+	"BlocksDeleted",
+	"GC",
+	"UsageThreshold",
+	"ExtractFinished",
+	"Degraded",
+	"Migration",
+}
+
+func (t EventType) String() string {
+	var names []string
+	for i, name := range eventTypeNames {
+		if t&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return fmt.Sprintf("EventType(%d)", uint32(t))
+	}
+	return strings.Join(names, "|")
+}
+
+// Event is delivered to subscribers, use a type switch to get the concrete event
+type Event interface {
+	Type() EventType
+	Time() time.Time
+}
+
+// eventBase carries the time shared by all events
+type eventBase struct {
+	At time.Time
+}
+
+func (e eventBase) Time() time.Time {
+	return e.At
+}
+
+func newEventBase() eventBase {
+	return eventBase{At: time.Now()}
+}
+
+type ImportStartedEvent struct {
+	eventBase
+	PathName string
+}
+
+func (ImportStartedEvent) Type() EventType { return EventImportStarted }
+
+type ImportProgressEvent struct {
+	eventBase
+	PathName string
+	Progress float64
+}
+
+func (ImportProgressEvent) Type() EventType { return EventImportProgress }
+
+// ImportFinishedEvent is sent for every import, Err is set if it failed
+type ImportFinishedEvent struct {
+	eventBase
+	PathName string
+	RootCid  string
+	// Bytes is the size of the imported file
+	Bytes    int64
+	Duration time.Duration
+	Err      error
+}
+
+func (ImportFinishedEvent) Type() EventType { return EventImportFinished }
+
+type BlocksAddedEvent struct {
+	eventBase
+	Cids  []cid.Cid
+	Bytes uint64
+}
+
+func (BlocksAddedEvent) Type() EventType { return EventBlocksAdded }
+
+type BlocksDeletedEvent struct {
+	eventBase
+	Cids  []cid.Cid
+	Bytes uint64
+}
+
+func (BlocksDeletedEvent) Type() EventType { return EventBlocksDeleted }
+
+// ExtractFinishedEvent is sent for every extraction, Err is set if it failed
+type ExtractFinishedEvent struct {
+	eventBase
+	RootCid  string
+	Path     string
+	Bytes    int64
+	Duration time.Duration
+	Err      error
+}
+
+func (ExtractFinishedEvent) Type() EventType { return EventExtractFinished }
+
+// GCEvent is sent after every eviction run, Err is set if it failed
+type GCEvent struct {
+	eventBase
+	Result *EvictionResult
+	Err    error
+}
+
+func (GCEvent) Type() EventType { return EventGC }
+
+// UsageThresholdEvent is sent when usage moves to another level, in either
+// direction. Watermark is the one of the higher of the two levels.
+type UsageThresholdEvent struct {
+	eventBase
+	Percentage float64
+	Watermark  Watermark
+	From       UsageLevel
+	To         UsageLevel
+	Full       bool
+}
+
+func (UsageThresholdEvent) Type() EventType { return EventUsageThreshold }
+
+// DegradedEvent is sent once when the repo turns read-only because its device is gone or failing
+type DegradedEvent struct {
+	eventBase
+	Reason string
+	Err    error
+}
+
+func (DegradedEvent) Type() EventType { return EventDegraded }
+
+// MigrationProgressEvent is sent during Repo.MigrateTo and once when it ends, Err is set if it failed
+type MigrationProgressEvent struct {
+	eventBase
+	MigrationProgress
+	Err error
+}
+
+func (MigrationProgressEvent) Type() EventType { return EventMigration }
+
+// DeliveryPolicy decides what happens when a subscriber's buffer is full
+type DeliveryPolicy int
+
+const (
+	// DeliveryDrop drops the event and counts it in Subscription.Dropped
+	DeliveryDrop DeliveryPolicy = iota
+	// DeliveryBlock blocks the publisher until the subscriber catches up
+	DeliveryBlock
+)
+
+type SubscribeOption func(*Subscription) error
+
+// SetEventBufferSize sets how many events are buffered for the subscriber,
+// a negative size fails with ErrInvalidEventBufferSize
+func SetEventBufferSize(size int) SubscribeOption {
+	return func(s *Subscription) error {
+		if size < 0 {
+			return fmt.Errorf("%w: %d", ErrInvalidEventBufferSize, size)
+		}
+		s.bufferSize = size
+		return nil
+	}
+}
+
+// SetDeliveryPolicy sets what happens when the buffer is full. DeliveryBlock
+// stalls the repo operation that publishes the event, use it with care.
+func SetDeliveryPolicy(policy DeliveryPolicy) SubscribeOption {
+	return func(s *Subscription) error {
+		s.policy = policy
+		return nil
+	}
+}
+
+// Subscription delivers the events matching its filter until its context is
+// done or it is closed
+type Subscription struct {
+	ctx        context.Context
+	cancel     context.CancelFunc
+	filter     EventType
+	policy     DeliveryPolicy
+	bufferSize int
+	ch         chan Event
+	dropped    *atomic.Uint64
+
+	// mu keeps ch open while events are delivered on it
+	mu     sync.RWMutex
+	closed bool
+}
+
+// Events returns the channel events are delivered on, it is closed when the subscription ends
+func (s *Subscription) Events() <-chan Event {
+	return s.ch
+}
+
+// Dropped returns the number of events dropped because the buffer was full
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close ends the subscription
+func (s *Subscription) Close() {
+	s.cancel()
+}
+
+func (s *Subscription) deliver(e Event) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return
+	}
+
+	if s.policy == DeliveryBlock {
+		select {
+		case s.ch <- e:
+		case <-s.ctx.Done():
+		}
+		return
+	}
+
+	select {
+	case s.ch <- e:
+	default:
+		s.dropped.Inc()
+	}
+}
+
+// eventBus fans events out to subscriptions, a nil bus drops everything
+type eventBus struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[*Subscription]struct{})}
+}
+
+func (b *eventBus) subscribe(ctx context.Context, filter EventType, opts ...SubscribeOption) (*Subscription, error) {
+	s := &Subscription{
+		filter:     filter,
+		bufferSize: defaultEventBufferSize,
+		dropped:    atomic.NewUint64(0),
+	}
+
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s.ctx, s.cancel = ctx, cancel
+	s.ch = make(chan Event, s.bufferSize)
+
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		b.mu.Lock()
+		delete(b.subs, s)
+		b.mu.Unlock()
+
+		// a blocked delivery returns once ctx is done, then the channel is not in use anymore
+		s.mu.Lock()
+		s.closed = true
+		close(s.ch)
+		s.mu.Unlock()
+	}()
+
+	return s, nil
+}
+
+// publish delivers e to the matching subscriptions. They are delivered to
+// outside of the bus lock, a subscriber that blocks does not hold up others
+// subscribing or leaving.
+func (b *eventBus) publish(e Event) {
+	if b == nil {
+		return
+	}
+
+	b.mu.RLock()
+	subs := make([]*Subscription, 0, len(b.subs))
+	for s := range b.subs {
+		if s.filter&e.Type() != 0 {
+			subs = append(subs, s)
+		}
+	}
+	b.mu.RUnlock()
+
+	for _, s := range subs {
+		if s.ctx.Err() != nil {
+			continue
+		}
+		s.deliver(e)
+	}
+}
+
+// close ends all subscriptions
+func (b *eventBus) close() {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for s := range b.subs {
+		s.cancel()
+	}
+}
@@ -0,0 +1,95 @@
+package ipfsrepo
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRepo_Subscribe(t *testing.T) {
+	ctx := context.Background()
+
+	repo, err := FromPath("test-uuid", t.TempDir(), 1<<30)
+	require.NoError(t, err)
+	defer repo.Close()
+
+	sub, err := repo.Subscribe(ctx, EventImportStarted|EventImportFinished|EventBlocksDeleted, SetEventBufferSize(16))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	fileBytes, err := createFile0to100k()
+	require.NoError(t, err)
+	filePath := path.Join(t.TempDir(), "testfile")
+	require.NoError(t, os.WriteFile(filePath, fileBytes, 0644))
+
+	result, err := repo.Import(ctx, filePath)
+	require.NoError(t, err)
+	require.NoError(t, repo.DeleteBlock(ctx, []string{result.RootCid}))
+
+	started := (<-sub.Events()).(ImportStartedEvent)
+	require.Equal(t, "testfile", started.PathName)
+
+	finished := (<-sub.Events()).(ImportFinishedEvent)
+	require.Equal(t, result.RootCid, finished.RootCid)
+	require.NoError(t, finished.Err)
+
+	deleted := (<-sub.Events()).(BlocksDeletedEvent)
+	require.Equal(t, result.RootCid, deleted.Cids[0].String())
+
+	sub.Close()
+	select {
+	case _, ok := <-sub.Events():
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("subscription was not closed")
+	}
+}
+
+func TestEventBus_Drop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bus := newEventBus()
+	sub, err := bus.subscribe(ctx, EventAll, SetEventBufferSize(1))
+	require.NoError(t, err)
+	blocking, err := bus.subscribe(ctx, EventGC, SetEventBufferSize(1), SetDeliveryPolicy(DeliveryBlock))
+	require.NoError(t, err)
+
+	bus.publish(GCEvent{eventBase: newEventBase()})
+	bus.publish(BlocksAddedEvent{eventBase: newEventBase()})
+	require.Equal(t, uint64(1), sub.Dropped())
+
+	// the blocking subscriber holds up the publisher until it reads
+	published := make(chan struct{})
+	go func() {
+		bus.publish(GCEvent{eventBase: newEventBase()})
+		close(published)
+	}()
+
+	select {
+	case <-published:
+		t.Fatal("publish did not block")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	t.Log("others subscribe and leave while the publisher is blocked")
+	other, err := bus.subscribe(ctx, EventAll)
+	require.NoError(t, err)
+	other.Close()
+	select {
+	case _, ok := <-other.Events():
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("subscription was not closed")
+	}
+
+	require.Equal(t, EventGC, (<-blocking.Events()).Type())
+	<-published
+	require.Zero(t, blocking.Dropped())
+
+	_, err = bus.subscribe(ctx, EventAll, SetEventBufferSize(-1))
+	require.ErrorIs(t, err, ErrInvalidEventBufferSize)
+}
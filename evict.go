@@ -0,0 +1,342 @@
+package ipfsrepo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	logging "github.com/ipfs/go-log/v2"
+	mh "github.com/multiformats/go-multihash"
+	"go.uber.org/atomic"
+	"sort"
+	"time"
+)
+
+var log = logging.Logger("ipfsrepo")
+
+const (
+	defaultEvictInterval = time.Minute
+	defaultHighWatermark = 90.0
+	defaultLowWatermark  = 80.0
+)
+
+var (
+	ErrEvictionAlreadyRunning = errors.New("eviction is already running")
+)
+
+// EvictionPolicy decides which content is evicted first
+type EvictionPolicy int
+
+const (
+	// EvictLRU evicts the least recently used content first
+	EvictLRU EvictionPolicy = iota
+	// EvictLFU evicts the least frequently used content first
+	EvictLFU
+	// EvictOldest evicts the content that was stored first
+	EvictOldest
+)
+
+func (p EvictionPolicy) String() string {
+	switch p {
+	case EvictLRU:
+		return "lru"
+	case EvictLFU:
+		return "lfu"
+	case EvictOldest:
+		return "oldest"
+	default:
+		return fmt.Sprintf("EvictionPolicy(%d)", int(p))
+	}
+}
+
+// EvictionResult describes what a single eviction run removed
+type EvictionResult struct {
+	Policy     EvictionPolicy
+	Roots      []string
+	Blocks     int
+	FreedBytes uint64
+}
+
+// evictionCandidate is either an unretained root with all its blocks, or a
+// loose block that is not part of any root
+type evictionCandidate struct {
+	root   string
+	blocks []cid.Cid
+	meta   BlockMeta
+}
+
+// Evictor deletes unretained content once usage crosses the high watermark,
+// until usage drops below the low watermark.
+type Evictor struct {
+	ctx           context.Context
+	policy        EvictionPolicy
+	highWatermark float64
+	lowWatermark  float64
+	interval      time.Duration
+	usage         *StorageUsage
+	blockStore    *repoBlockstore
+	meta          *BlockMetaIndex
+	roots         *RootSet
+	// protected reports blocks that must survive even if no root references them
+	protected func(ctx context.Context, c cid.Cid) (bool, error)
+	// importing reports running imports, whose blocks are not part of a root yet
+	importing func() bool
+	events    *eventBus
+	running   *atomic.Bool
+}
+
+func NewEvictor(ctx context.Context, usage *StorageUsage, blockStore *repoBlockstore, meta *BlockMetaIndex, roots *RootSet) *Evictor {
+	return &Evictor{
+		ctx:           ctx,
+		policy:        EvictLRU,
+		highWatermark: defaultHighWatermark,
+		lowWatermark:  defaultLowWatermark,
+		interval:      defaultEvictInterval,
+		usage:         usage,
+		blockStore:    blockStore,
+		meta:          meta,
+		roots:         roots,
+		running:       atomic.NewBool(false),
+	}
+}
+
+func (e *Evictor) SetPolicy(policy EvictionPolicy) {
+	e.policy = policy
+}
+
+func (e *Evictor) SetWatermarks(high, low float64) {
+	e.highWatermark = high
+	e.lowWatermark = low
+}
+
+func (e *Evictor) SetInterval(interval time.Duration) {
+	e.interval = interval
+}
+
+// Start starts checking the usage against the high watermark
+func (e *Evictor) Start() {
+	go e.loop()
+}
+
+// Run evicts content until usage is below the low watermark. It does nothing
+// if usage is below the high watermark or while an import is running.
+func (e *Evictor) Run(ctx context.Context) (*EvictionResult, error) {
+	if !e.running.CompareAndSwap(false, true) {
+		return nil, ErrEvictionAlreadyRunning
+	}
+	defer e.running.Store(false)
+
+	if e.usage.UsagePercentage() < e.highWatermark {
+		return &EvictionResult{Policy: e.policy}, nil
+	}
+	if e.importing != nil && e.importing() {
+		log.Infof("eviction postponed until the running imports finish")
+		return &EvictionResult{Policy: e.policy}, nil
+	}
+
+	result, err := e.run(ctx)
+	e.events.publish(GCEvent{eventBase: newEventBase(), Result: result, Err: err})
+
+	return result, err
+}
+
+func (e *Evictor) run(ctx context.Context) (*EvictionResult, error) {
+	result := &EvictionResult{Policy: e.policy}
+
+	percentage := e.usage.UsagePercentage()
+
+	used := e.usage.used()
+	target := uint64(float64(e.usage.maxStorage) * e.lowWatermark / 100)
+	if used <= target {
+		return result, nil
+	}
+	need := used - target
+	reason := fmt.Sprintf("usage %.1f%% above high watermark %.1f%%", percentage, e.highWatermark)
+
+	candidates, refs, err := e.candidates(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range candidates {
+		if result.FreedBytes >= need {
+			break
+		}
+		if e.importing != nil && e.importing() {
+			// the import may reuse blocks of the remaining candidates
+			log.Infof("eviction stopped by an import")
+			break
+		}
+
+		if err := e.evict(ctx, c, refs, reason, result); err != nil {
+			return result, err
+		}
+	}
+
+	log.Infof("eviction (%s) freed %s in %d blocks and %d roots, %s",
+		e.policy, humanize.Bytes(result.FreedBytes), result.Blocks, len(result.Roots), reason)
+
+	return result, e.usage.Refresh()
+}
+
+// candidates returns the evictable content ordered by the policy, and the
+// number of roots referencing each block. Blocks of retained roots are
+// referenced by a root that is never evicted, so they never drop to zero.
+func (e *Evictor) candidates(ctx context.Context) ([]*evictionCandidate, map[string]int, error) {
+	roots, err := e.roots.List(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var candidates []*evictionCandidate
+	refs := make(map[string]int)
+
+	for _, root := range roots {
+		rootCid, err := cid.Parse(root.Cid)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		blks, err := dagBlocks(ctx, e.blockStore.Blockstore, rootCid)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, c := range blks {
+			refs[string(c.Hash())]++
+		}
+
+		if root.Retained {
+			continue
+		}
+
+		c := &evictionCandidate{root: root.Cid, blocks: blks}
+		if meta, err := e.meta.Get(ctx, rootCid); err == nil {
+			c.meta = *meta
+		}
+		candidates = append(candidates, c)
+	}
+
+	err = e.meta.ForEach(ctx, func(hash mh.Multihash, meta *BlockMeta) error {
+		if refs[string(hash)] > 0 {
+			return nil
+		}
+
+		// blocks are found by their multihash, the codec does not matter
+		c := cid.NewCidV1(cid.Raw, hash)
+
+		if e.protected != nil {
+			protected, err := e.protected(ctx, c)
+			if err != nil {
+				return err
+			}
+			if protected {
+				return nil
+			}
+		}
+
+		candidates = append(candidates, &evictionCandidate{blocks: []cid.Cid{c}, meta: *meta})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return e.less(&candidates[i].meta, &candidates[j].meta)
+	})
+
+	return candidates, refs, nil
+}
+
+// evict deletes the blocks of the candidate that no other root references
+func (e *Evictor) evict(ctx context.Context, c *evictionCandidate, refs map[string]int, reason string, result *EvictionResult) error {
+	var freed uint64
+	var deleted int
+
+	for _, blk := range c.blocks {
+		key := string(blk.Hash())
+		if c.root != "" {
+			refs[key]--
+			if refs[key] > 0 {
+				continue
+			}
+		}
+
+		size, err := e.blockStore.Blockstore.GetSize(ctx, blk)
+		if err != nil {
+			if ipld.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+
+		if err := e.blockStore.DeleteBlock(ctx, blk); err != nil {
+			return err
+		}
+
+		freed += uint64(size)
+		deleted++
+	}
+
+	if c.root != "" {
+		if err := e.roots.Remove(ctx, c.root); err != nil {
+			return err
+		}
+		result.Roots = append(result.Roots, c.root)
+		log.Infof("evicted root %s (%s, %d blocks): %s", c.root, humanize.Bytes(freed), deleted, reason)
+	} else if deleted > 0 {
+		log.Debugf("evicted block %s (%s): %s", c.blocks[0], humanize.Bytes(freed), reason)
+	}
+
+	result.Blocks += deleted
+	result.FreedBytes += freed
+
+	return nil
+}
+
+// less reports whether a should be evicted before b
+func (e *Evictor) less(a, b *BlockMeta) bool {
+	switch e.policy {
+	case EvictLFU:
+		if a.AccessCount != b.AccessCount {
+			return a.AccessCount < b.AccessCount
+		}
+		return lastUsed(a).Before(lastUsed(b))
+	case EvictOldest:
+		return a.Inserted.Before(b.Inserted)
+	default:
+		return lastUsed(a).Before(lastUsed(b))
+	}
+}
+
+// loop is a background goroutine that periodically checks the high watermark
+func (e *Evictor) loop() {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			if e.usage.UsagePercentage() < e.highWatermark {
+				continue
+			}
+
+			if _, err := e.Run(e.ctx); err != nil {
+				log.Errorf("eviction failed: %s", err)
+			}
+		}
+	}
+}
+
+// lastUsed returns the last access time, or the insertion time if never read
+func lastUsed(meta *BlockMeta) time.Time {
+	if meta.LastAccess.After(meta.Inserted) {
+		return meta.LastAccess
+	}
+	return meta.Inserted
+}
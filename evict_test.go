@@ -0,0 +1,122 @@
+package ipfsrepo
+
+import (
+	"context"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/fsrepo"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestEvictor_Run(t *testing.T) {
+	ctx := context.Background()
+
+	repo, err := FromPath("test-uuid", t.TempDir(), 1<<30, SetEviction(EvictLRU, 90, 80))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	tmpDir := t.TempDir()
+
+	fileBytes, err := createFile0to100k()
+	require.NoError(t, err)
+	evictedPath := path.Join(tmpDir, "evicted")
+	require.NoError(t, os.WriteFile(evictedPath, fileBytes, 0644))
+
+	fileBytes, err = createFile0to200k()
+	require.NoError(t, err)
+	retainedPath := path.Join(tmpDir, "retained")
+	require.NoError(t, os.WriteFile(retainedPath, fileBytes, 0644))
+
+	evicted, err := repo.Import(ctx, evictedPath)
+	require.NoError(t, err)
+
+	retained, err := repo.Import(ctx, retainedPath)
+	require.NoError(t, err)
+	require.NoError(t, repo.Retain(ctx, retained.RootCid))
+
+	require.NoError(t, repo.SaveBlock(ctx, [][]byte{[]byte("loose block")}))
+
+	// a tiny max storage puts the repo above the high watermark
+	repo.StorageUsage.maxStorage = 1
+
+	result, err := repo.Evict(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{evicted.RootCid}, result.Roots)
+	require.NotZero(t, result.FreedBytes)
+
+	require.False(t, repo.HasBlock(ctx, evicted.Blocks))
+	require.True(t, repo.HasBlock(ctx, retained.Blocks))
+
+	roots, err := repo.Roots(ctx)
+	require.NoError(t, err)
+	require.Len(t, roots, 1)
+	require.Equal(t, retained.RootCid, roots[0].Cid)
+	require.True(t, roots[0].Retained)
+}
+
+func TestEvictor_WaitsForImports(t *testing.T) {
+	ctx := context.Background()
+
+	repo, err := FromPath("test-uuid", t.TempDir(), 1<<30, SetEviction(EvictLRU, 90, 80))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	require.NoError(t, repo.SaveBlock(ctx, [][]byte{[]byte("loose block")}))
+	repo.StorageUsage.maxStorage = 1
+
+	t.Log("loose blocks may belong to the dag of a running import")
+	repo.imports.Inc()
+	result, err := repo.Evict(ctx)
+	require.NoError(t, err)
+	require.Zero(t, result.Blocks)
+	require.True(t, repo.HasBlock(ctx, []string{blocks.NewBlock([]byte("loose block")).Cid().String()}))
+
+	repo.imports.Dec()
+	result, err = repo.Evict(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, result.Blocks)
+}
+
+func TestRecordLegacyRoots(t *testing.T) {
+	ctx := context.Background()
+	repoPath := t.TempDir()
+
+	repo, err := FromPath("test-uuid", repoPath, 1<<30)
+	require.NoError(t, err)
+
+	fileBytes, err := createFile0to200k()
+	require.NoError(t, err)
+	filePath := path.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(filePath, fileBytes, 0644))
+
+	legacy, err := repo.Import(ctx, filePath)
+	require.NoError(t, err)
+	tenant, err := repo.CreateTenant(ctx, "a", 1<<30)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filePath, fileBytes[1:], 0644))
+	owned, err := tenant.Import(ctx, filePath)
+	require.NoError(t, err)
+	require.NoError(t, repo.SaveBlock(ctx, [][]byte{[]byte("loose block")}))
+
+	// forget the root as if it was imported before roots were recorded, by a
+	// repo of version 1
+	require.NoError(t, repo.roots.Remove(ctx, legacy.RootCid))
+	require.NoError(t, repo.DataStore().Delete(ctx, rootsRecordedKey))
+	repo.Close()
+	require.NoError(t, os.WriteFile(fsrepo.VersionFile(repoPath), []byte("1\n"), 0o600))
+
+	repo, err = FromPath("test-uuid", repoPath, 1<<30)
+	require.NoError(t, err)
+	defer repo.Close()
+
+	t.Log("only the dag root that is neither linked nor owned by a tenant is recorded")
+	roots, err := repo.Roots(ctx)
+	require.NoError(t, err)
+	require.Len(t, roots, 1)
+	require.Equal(t, legacy.RootCid, roots[0].Cid)
+	require.Equal(t, legacy.FileName, roots[0].Name)
+	require.False(t, roots[0].Retained)
+	require.NotEqual(t, owned.RootCid, roots[0].Cid)
+}
@@ -0,0 +1,250 @@
+package ipfsrepo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/fsrepo"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/linuxutils/lsblk"
+	ds "github.com/ipfs/go-datastore"
+	ipld "github.com/ipfs/go-ipld-format"
+	"go.uber.org/atomic"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthCheckInterval = 30 * time.Second
+	defaultIOErrorRate         = 0.5
+	defaultIOErrorMin          = 10
+)
+
+var ErrRepoDegraded = errors.New("repo is degraded and read-only until it is reopened")
+
+// deviceHealth checks that the repo is still on its device and that the
+// datastore is not failing, and degrades the repo to read-only otherwise
+type deviceHealth struct {
+	ctx      context.Context
+	repoPath string
+	device   *lsblk.BlockDevice
+	// lsblkCmd is nil if the device was not found with lsblk
+	lsblkCmd *lsblk.Cmd
+	// fsDevice is the id of the device holding the repo when it was opened
+	fsDevice    uint64
+	hasFSDevice bool
+	interval    time.Duration
+	errorRate   float64
+	errorMin    uint64
+	ops         *atomic.Uint64
+	errs        *atomic.Uint64
+	events      *eventBus
+
+	// mu guards the fields a migration changes as well
+	mu       sync.Mutex
+	degraded error
+}
+
+func newDeviceHealth(ctx context.Context, repoPath string, device *lsblk.BlockDevice, lsblkCmd *lsblk.Cmd) (*deviceHealth, error) {
+	fsDevice, ok, err := fileDevice(repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &deviceHealth{
+		ctx:         ctx,
+		repoPath:    repoPath,
+		device:      device,
+		lsblkCmd:    lsblkCmd,
+		fsDevice:    fsDevice,
+		hasFSDevice: ok,
+		interval:    defaultHealthCheckInterval,
+		errorRate:   defaultIOErrorRate,
+		errorMin:    defaultIOErrorMin,
+		ops:         atomic.NewUint64(0),
+		errs:        atomic.NewUint64(0),
+	}, nil
+}
+
+func (h *deviceHealth) SetInterval(interval time.Duration) {
+	h.interval = interval
+}
+
+// SetErrorThreshold degrades the repo once at least min datastore operations
+// failed during a check interval and they are at least rate of all operations
+func (h *deviceHealth) SetErrorThreshold(rate float64, min uint64) {
+	h.errorRate = rate
+	h.errorMin = min
+}
+
+func (h *deviceHealth) Start() {
+	go h.loop()
+}
+
+// Check runs the checks right away, it returns the error the repo is degraded with
+func (h *deviceHealth) Check() error {
+	if err := h.err(); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	repoPath, lsblkCmd := h.repoPath, h.lsblkCmd
+	fsDevice, hasFSDevice := h.fsDevice, h.hasFSDevice
+	h.mu.Unlock()
+
+	if lsblkCmd != nil {
+		dev, err := lsblkCmd.FindBlockDevice(h.device.UUID)
+		switch {
+		case errors.Is(err, lsblk.ErrDeviceNotFound):
+			h.degrade(fmt.Sprintf("device %s is gone", h.device.UUID))
+		case err != nil:
+			// lsblk failing says nothing about the device
+			log.Warnf("find device %s: %s", h.device.UUID, err)
+		case dev.MountPoint != h.device.MountPoint:
+			h.degrade(fmt.Sprintf("device %s is mounted at %q instead of %q", h.device.UUID, dev.MountPoint, h.device.MountPoint))
+		}
+	}
+
+	current, _, err := fileDevice(repoPath)
+	if err != nil {
+		h.degrade(fmt.Sprintf("repo path: %s", err))
+	} else if hasFSDevice && current != fsDevice {
+		h.degrade("repo path is on another filesystem than when it was opened")
+	}
+
+	ops, errs := h.ops.Swap(0), h.errs.Swap(0)
+	if errs >= h.errorMin && float64(errs) >= h.errorRate*float64(ops) {
+		h.degrade(fmt.Sprintf("%d of %d datastore operations failed", errs, ops))
+	}
+
+	return h.err()
+}
+
+// moved points the device checks at the new repo path
+func (h *deviceHealth) moved(repoPath string) {
+	fsDevice, ok, err := fileDevice(repoPath)
+	if err != nil {
+		log.Warnf("stat %s: %s", repoPath, err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.repoPath = repoPath
+	h.fsDevice, h.hasFSDevice = fsDevice, ok && err == nil
+	h.lsblkCmd = nil
+}
+
+// observe counts a datastore operation, not found is not a failure
+func (h *deviceHealth) observe(err error) {
+	if h == nil {
+		return
+	}
+
+	h.ops.Inc()
+	if err != nil && !ipld.IsNotFound(err) && !errors.Is(err, ErrRepoDegraded) {
+		h.errs.Inc()
+	}
+}
+
+// err returns nil while the repo is healthy, a nil health is always healthy
+func (h *deviceHealth) err() error {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.degraded
+}
+
+func (h *deviceHealth) degrade(reason string) {
+	h.mu.Lock()
+	if h.degraded != nil {
+		h.mu.Unlock()
+		return
+	}
+	h.degraded = fmt.Errorf("%w: %s", ErrRepoDegraded, reason)
+	err := h.degraded
+	h.mu.Unlock()
+
+	log.Errorf("repo %s: %s", h.device.UUID, err)
+	h.events.publish(DegradedEvent{eventBase: newEventBase(), Reason: reason, Err: err})
+}
+
+// loop is a background goroutine that periodically checks the device
+func (h *deviceHealth) loop() {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-ticker.C:
+			if h.Check() != nil {
+				return
+			}
+		}
+	}
+}
+
+// healthDatastore turns writes into errors once the repo is degraded, like
+// repoBlockstore does for blocks, and tells health about their results. The
+// roots, tenants and block metadata are written through it.
+type healthDatastore struct {
+	fsrepo.Datastore
+	health *deviceHealth
+}
+
+func newHealthDatastore(d fsrepo.Datastore, health *deviceHealth) *healthDatastore {
+	return &healthDatastore{Datastore: d, health: health}
+}
+
+func (d *healthDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	if err := d.health.err(); err != nil {
+		return err
+	}
+
+	err := d.Datastore.Put(ctx, key, value)
+	d.health.observe(err)
+	return err
+}
+
+func (d *healthDatastore) Delete(ctx context.Context, key ds.Key) error {
+	if err := d.health.err(); err != nil {
+		return err
+	}
+
+	err := d.Datastore.Delete(ctx, key)
+	d.health.observe(err)
+	return err
+}
+
+func (d *healthDatastore) Batch(ctx context.Context) (ds.Batch, error) {
+	if err := d.health.err(); err != nil {
+		return nil, err
+	}
+
+	b, err := d.Datastore.Batch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &healthBatch{Batch: b, health: d.health}, nil
+}
+
+// healthBatch checks health again when it is committed
+type healthBatch struct {
+	ds.Batch
+	health *deviceHealth
+}
+
+func (b *healthBatch) Commit(ctx context.Context) error {
+	if err := b.health.err(); err != nil {
+		return err
+	}
+
+	err := b.Batch.Commit(ctx)
+	b.health.observe(err)
+	return err
+}
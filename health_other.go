@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+
+package ipfsrepo
+
+import "os"
+
+// fileDevice only checks that path exists, device ids are not available on this platform
+func fileDevice(path string) (uint64, bool, error) {
+	_, err := os.Stat(path)
+	return 0, false, err
+}
@@ -0,0 +1,109 @@
+package ipfsrepo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/linuxutils/lsblk"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepo_DeviceRemoved(t *testing.T) {
+	ctx := context.Background()
+
+	mountPoint := t.TempDir()
+	device := fmt.Sprintf(`{"name":"/dev/sdb", "type":"disk", "size":1073741824, "mountpoint":%q, "fstype":"ext4", "label":"data", "uuid":"9f1e-3333"}`, mountPoint)
+	executor := &fakeLsblk{out: `{"blockdevices": [` + device + `]}`}
+
+	repo, err := fromDevice(lsblk.NewCmdWithExecutor(executor), "data", false)
+	require.NoError(t, err)
+	defer repo.Close()
+
+	sub, err := repo.Subscribe(ctx, EventDegraded)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, repo.SaveBlock(ctx, [][]byte{[]byte("before")}))
+	require.NoError(t, repo.CheckDevice())
+	require.NoError(t, repo.Degraded())
+
+	// the disk is unplugged
+	executor.out = `{"blockdevices": []}`
+
+	require.ErrorIs(t, repo.CheckDevice(), ErrRepoDegraded)
+	require.ErrorIs(t, repo.Degraded(), ErrRepoDegraded)
+	require.ErrorIs(t, repo.SaveBlock(ctx, [][]byte{[]byte("after")}), ErrRepoDegraded)
+
+	e := (<-sub.Events()).(DegradedEvent)
+	require.ErrorIs(t, e.Err, ErrRepoDegraded)
+	require.Contains(t, e.Reason, "9f1e-3333")
+}
+
+func TestRepo_DegradedMetadata(t *testing.T) {
+	ctx := context.Background()
+
+	mountPoint := t.TempDir()
+	device := fmt.Sprintf(`{"name":"/dev/sdb", "type":"disk", "size":1073741824, "mountpoint":%q, "fstype":"ext4", "label":"data", "uuid":"9f1e-4444"}`, mountPoint)
+	executor := &fakeLsblk{out: `{"blockdevices": [` + device + `]}`}
+
+	repo, err := fromDevice(lsblk.NewCmdWithExecutor(executor), "data", false)
+	require.NoError(t, err)
+	defer repo.Close()
+
+	tenant, err := repo.CreateTenant(ctx, "tenant", 1<<20)
+	require.NoError(t, err)
+	require.NoError(t, repo.roots.Add(ctx, &Root{Cid: "root"}))
+	require.NoError(t, repo.SaveBlock(ctx, [][]byte{[]byte("before")}))
+
+	executor.out = `{"blockdevices": []}`
+	require.ErrorIs(t, repo.CheckDevice(), ErrRepoDegraded)
+
+	t.Log("the roots, tenants and block metadata are not written")
+	require.ErrorIs(t, repo.Retain(ctx, "root"), ErrRepoDegraded)
+	require.ErrorIs(t, tenant.SetQuota(ctx, 2<<20), ErrRepoDegraded)
+	_, err = repo.CreateTenant(ctx, "other", 1<<20)
+	require.ErrorIs(t, err, ErrRepoDegraded)
+	_, err = repo.BlockStore().Get(ctx, blocks.NewBlock([]byte("before")).Cid())
+	require.NoError(t, err)
+	require.ErrorIs(t, repo.blockMeta.Flush(ctx), ErrRepoDegraded)
+
+	t.Log("reads still work")
+	root, err := repo.roots.Get(ctx, "root")
+	require.NoError(t, err)
+	require.False(t, root.Retained)
+	require.Equal(t, uint64(1<<20), tenant.Quota())
+
+	t.Log("the usage cache and history are kept in memory")
+	repoPath := repo.StorageUsage.path()
+	require.NoError(t, os.RemoveAll(filepath.Join(repoPath, usageCacheFile)))
+	require.NoError(t, os.RemoveAll(filepath.Join(repoPath, usageHistoryFile)))
+	require.NoError(t, repo.Reconcile())
+	require.NoError(t, repo.Refresh())
+	require.NoFileExists(t, filepath.Join(repoPath, usageCacheFile))
+	require.NoFileExists(t, filepath.Join(repoPath, usageHistoryFile))
+}
+
+func TestDeviceHealth_IOErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	health, err := newDeviceHealth(ctx, t.TempDir(), &lsblk.BlockDevice{UUID: "test-uuid"}, nil)
+	require.NoError(t, err)
+	health.SetErrorThreshold(0.5, 2)
+
+	ioErr := errors.New("input/output error")
+
+	// a single error is below the minimum
+	health.observe(ioErr)
+	health.observe(nil)
+	require.NoError(t, health.Check())
+
+	health.observe(ioErr)
+	health.observe(ioErr)
+	health.observe(nil)
+	require.ErrorIs(t, health.Check(), ErrRepoDegraded)
+}
@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd
+
+package ipfsrepo
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileDevice returns the id of the device holding path, it changes when another filesystem is mounted over it
+func fileDevice(path string) (uint64, bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev), true, nil
+	}
+
+	return 0, false, nil
+}
@@ -0,0 +1,274 @@
+package ipfsrepo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/fsrepo"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// defaultHistorySize keeps a week of samples at the default scan interval
+	defaultHistorySize = 7 * 24 * 12
+
+	// usageHistoryFile keeps the usage samples across restarts, one per line
+	usageHistoryFile = "usage_history"
+
+	// ForecastNever is the time to full of a repo whose usage is not growing
+	ForecastNever time.Duration = math.MaxInt64
+)
+
+var (
+	ErrNotEnoughHistory   = errors.New("not enough usage history")
+	ErrInvalidHistorySize = errors.New("usage history size must not be negative")
+)
+
+// UsageSample is the usage of the repo at a point in time
+type UsageSample struct {
+	Time time.Time `json:"time"`
+	Used uint64    `json:"used"`
+}
+
+// UsageForecast projects the usage history of a repo
+type UsageForecast struct {
+	// GrowthRate is in bytes per second, from a linear fit of the samples
+	GrowthRate float64
+	// TimeToFull is how long until usage reaches the maximum storage size,
+	// zero if it already has, ForecastNever if usage is not growing
+	TimeToFull time.Duration
+	// TimeToThreshold is the same for the full watermark
+	TimeToThreshold time.Duration
+	Samples         int
+}
+
+// SetHistorySize sets how many usage samples are kept, one is taken on every
+// successful scan. Zero keeps none, a negative size fails with ErrInvalidHistorySize.
+func (s *StorageUsage) SetHistorySize(size int) error {
+	if size < 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidHistorySize, size)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.historySize = size
+	if len(s.history) > size {
+		s.history = append([]UsageSample(nil), s.history[len(s.history)-size:]...)
+	}
+	return nil
+}
+
+// History returns the usage samples, oldest first
+func (s *StorageUsage) History() []UsageSample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]UsageSample(nil), s.history...)
+}
+
+// Forecast fits the samples of the last window, the whole history if window
+// is zero, and projects when the repo fills up
+func (s *StorageUsage) Forecast(window time.Duration) (*UsageForecast, error) {
+	s.mu.Lock()
+	samples := s.history
+	if window > 0 {
+		from := time.Now().Add(-window)
+		for len(samples) > 0 && samples[0].Time.Before(from) {
+			samples = samples[1:]
+		}
+	}
+	samples = append([]UsageSample(nil), samples...)
+	used := s.usage
+	threshold := s.watermarks.Full.Enter
+	s.mu.Unlock()
+
+	rate, ok := growthRate(samples)
+	if !ok {
+		return nil, ErrNotEnoughHistory
+	}
+
+	return &UsageForecast{
+		GrowthRate:      rate,
+		TimeToFull:      timeTo(used, s.maxStorage, rate),
+		TimeToThreshold: timeTo(used, uint64(float64(s.maxStorage)*threshold/100), rate),
+		Samples:         len(samples),
+	}, nil
+}
+
+// record adds a sample of the current usage and appends it to the history
+// file, which is only rewritten once it holds twice the kept samples
+func (s *StorageUsage) record() {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+
+	s.mu.Lock()
+	sample := UsageSample{Time: time.Now(), Used: s.usage}
+	s.history = append(s.history, sample)
+	if len(s.history) > s.historySize {
+		s.history = s.history[len(s.history)-s.historySize:]
+	}
+	rewrite := s.historyLines < 0 || s.historyLines >= 2*s.historySize
+	repoPath := s.repoPath
+	s.mu.Unlock()
+
+	if !s.writable() {
+		return
+	}
+
+	var err error
+	if rewrite {
+		err = s.rewriteHistoryLocked()
+	} else if s.historySize > 0 {
+		if err = appendUsageSample(repoPath, sample); err != nil {
+			// the file may end in a partial sample
+			s.mu.Lock()
+			s.historyLines = -1
+			s.mu.Unlock()
+		} else {
+			s.mu.Lock()
+			s.historyLines++
+			s.mu.Unlock()
+		}
+	}
+
+	if err != nil {
+		log.Warnf("write usage history of %s: %s", repoPath, err)
+	}
+}
+
+// rewriteHistory replaces the history file with the kept samples
+func (s *StorageUsage) rewriteHistory() error {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+
+	return s.rewriteHistoryLocked()
+}
+
+// rewriteHistoryLocked is rewriteHistory with s.historyMu held
+func (s *StorageUsage) rewriteHistoryLocked() error {
+	s.mu.Lock()
+	history := append([]UsageSample(nil), s.history...)
+	repoPath := s.repoPath
+	s.mu.Unlock()
+
+	err := writeUsageHistory(repoPath, history)
+
+	s.mu.Lock()
+	s.historyLines = len(history)
+	if err != nil {
+		s.historyLines = -1
+	}
+	s.mu.Unlock()
+
+	return err
+}
+
+// growthRate is the slope of the least squares fit of the samples, in bytes per second
+func growthRate(samples []UsageSample) (float64, bool) {
+	if len(samples) < 2 {
+		return 0, false
+	}
+
+	var sumX, sumY, sumXY, sumXX float64
+	start := samples[0].Time
+	for _, sample := range samples {
+		x := sample.Time.Sub(start).Seconds()
+		y := float64(sample.Used)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+
+	n := float64(len(samples))
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0, false
+	}
+
+	return (n*sumXY - sumX*sumY) / denominator, true
+}
+
+func timeTo(used, target uint64, rate float64) time.Duration {
+	if used >= target {
+		return 0
+	}
+	if rate <= 0 {
+		return ForecastNever
+	}
+
+	seconds := float64(target-used) / rate
+	if seconds >= float64(ForecastNever)/float64(time.Second) {
+		return ForecastNever
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// readUsageHistory reads the samples of the history file, a sample cut short
+// by a crash ends the history. A file of older versions holds a JSON array.
+func readUsageHistory(repoPath string) ([]UsageSample, error) {
+	b, err := os.ReadFile(filepath.Join(repoPath, usageHistoryFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var history []UsageSample
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+		if err := json.Unmarshal(b, &history); err != nil {
+			return nil, err
+		}
+		return history, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		var sample UsageSample
+		if err := json.Unmarshal(scanner.Bytes(), &sample); err != nil {
+			break
+		}
+		history = append(history, sample)
+	}
+
+	return history, nil
+}
+
+// writeUsageHistory replaces the history file atomically
+func writeUsageHistory(repoPath string, history []UsageSample) error {
+	var buf bytes.Buffer
+	for _, sample := range history {
+		b, err := json.Marshal(sample)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+
+	return fsrepo.WriteFile(filepath.Join(repoPath, usageHistoryFile), buf.Bytes())
+}
+
+// appendUsageSample adds the sample to the end of the history file
+func appendUsageSample(repoPath string, sample UsageSample) error {
+	b, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(repoPath, usageHistoryFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,124 @@
+package ipfsrepo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGrowthRate(t *testing.T) {
+	start := time.Now()
+
+	_, ok := growthRate([]UsageSample{{Time: start, Used: 100}})
+	require.False(t, ok)
+
+	rate, ok := growthRate([]UsageSample{
+		{Time: start, Used: 100},
+		{Time: start.Add(time.Second), Used: 110},
+		{Time: start.Add(2 * time.Second), Used: 120},
+	})
+	require.True(t, ok)
+	require.InDelta(t, 10.0, rate, 0.001)
+
+	require.Equal(t, 10*time.Second, timeTo(100, 200, 10))
+	require.Equal(t, time.Duration(0), timeTo(200, 100, 10))
+	require.Equal(t, ForecastNever, timeTo(100, 200, 0))
+}
+
+func TestStorageUsage_Forecast(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tmpDir := t.TempDir()
+	usage, err := NewStorageUsage(ctx, tmpDir, 1000)
+	require.NoError(t, err)
+	require.NoError(t, usage.SetHistorySize(3))
+
+	_, err = usage.Forecast(0)
+	require.ErrorIs(t, err, ErrNotEnoughHistory)
+
+	start := time.Now().Add(-time.Hour)
+	usage.mu.Lock()
+	for i := 0; i < 4; i++ {
+		usage.history = append(usage.history, UsageSample{Time: start.Add(time.Duration(i) * time.Second), Used: uint64(i * 100)})
+	}
+	usage.mu.Unlock()
+	usage.setUsage(500)
+	require.NoError(t, usage.SetHistorySize(2))
+	require.Len(t, usage.History(), 2)
+
+	t.Log("a negative size is rejected and keeps the history")
+	require.ErrorIs(t, usage.SetHistorySize(-1), ErrInvalidHistorySize)
+	require.Len(t, usage.History(), 2)
+
+	forecast, err := usage.Forecast(0)
+	require.NoError(t, err)
+	require.InDelta(t, 100.0, forecast.GrowthRate, 0.001)
+	require.Equal(t, 5*time.Second, forecast.TimeToFull)
+	require.Equal(t, 2*time.Second, forecast.TimeToThreshold)
+
+	_, err = usage.Forecast(time.Minute)
+	require.ErrorIs(t, err, ErrNotEnoughHistory)
+
+	// samples are taken on scans and survive a restart
+	require.NoError(t, usage.Refresh())
+	reopened, err := NewStorageUsage(ctx, tmpDir, 1000)
+	require.NoError(t, err)
+	require.Equal(t, usage.History()[1].Used, reopened.History()[1].Used)
+}
+
+func TestStorageUsage_HistoryFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tmpDir := t.TempDir()
+	fn := filepath.Join(tmpDir, usageHistoryFile)
+
+	t.Log("a history of older versions is a JSON array")
+	legacy := []UsageSample{{Time: time.Now().Add(-time.Minute), Used: 1}}
+	b, err := json.Marshal(legacy)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(fn, b, 0o600))
+
+	usage, err := NewStorageUsage(ctx, tmpDir, 1<<30)
+	require.NoError(t, err)
+	require.NoError(t, usage.SetHistorySize(2))
+	require.Len(t, usage.History(), 1)
+
+	lines := func() int {
+		b, err := os.ReadFile(fn)
+		require.NoError(t, err)
+		return bytes.Count(b, []byte("\n"))
+	}
+
+	t.Log("the first sample rewrites the file, later ones are appended")
+	require.NoError(t, usage.Refresh())
+	require.Equal(t, 2, lines())
+	require.NoError(t, usage.Refresh())
+	require.Equal(t, 3, lines())
+
+	t.Log("once the file holds twice the kept samples it is rewritten with them")
+	require.NoError(t, usage.Refresh())
+	require.Equal(t, 4, lines())
+	require.NoError(t, usage.Refresh())
+	require.Equal(t, 2, lines())
+
+	t.Log("a sample cut short ends the history")
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0o600)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"time":`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	reopened, err := NewStorageUsage(ctx, tmpDir, 1<<30)
+	require.NoError(t, err)
+	require.Len(t, reopened.History(), 2)
+	for i, sample := range usage.History() {
+		require.True(t, sample.Time.Equal(reopened.History()[i].Time))
+	}
+}
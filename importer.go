@@ -27,22 +27,45 @@ func (p *ImportProgressInfo) Update(progress float64) {
 }
 
 type Importer struct {
-	chunkSize    int64
+	profile      chunker.Profile
 	blockStore   blockstore.Blockstore
 	ProgressInfo *ImportProgressInfo
 	running      *atomic.Bool
+	// admission rejects imports that do not fit into the repo, nil disables the check
+	admission *Admission
+	events    *eventBus
 }
 
+// NewImporter returns an importer that chunks with the default profile and chunkSize
 func NewImporter(blockStore blockstore.Blockstore, chunkSize int64) *Importer {
+	profile := chunker.DefaultProfile()
+	profile.ChunkSize = chunkSize
+
 	return &Importer{
 		blockStore:   blockStore,
 		running:      atomic.NewBool(false),
 		ProgressInfo: &ImportProgressInfo{},
-		chunkSize:    chunkSize,
+		profile:      profile,
 	}
 }
 
-func (i *Importer) Import(ctx context.Context, path string) (*chunker.Result, error) {
+// SetProfile sets how imported files are chunked and linked
+func (i *Importer) SetProfile(profile chunker.Profile) {
+	i.profile = profile
+}
+
+// SetAdmission makes imports reserve their size up front and checks every batch written
+func (i *Importer) SetAdmission(admission *Admission) {
+	i.admission = admission
+}
+
+func (i *Importer) Import(ctx context.Context, path string) (result *chunker.Result, err error) {
+	return i.importReserved(ctx, path, nil)
+}
+
+// importReserved is Import, with quota held up front and consumed by every batch
+// written like the capacity of the repo. quota is released by the caller.
+func (i *Importer) importReserved(ctx context.Context, path string, quota reserver) (result *chunker.Result, err error) {
 	defer func() {
 		i.ProgressInfo = &ImportProgressInfo{}
 	}()
@@ -53,34 +76,72 @@ func (i *Importer) Import(ctx context.Context, path string) (*chunker.Result, er
 
 	defer i.running.Store(false)
 
-	bsrv := blockservice.New(i.blockStore, offline.Exchange(i.blockStore))
+	pathName := filepath.Base(path)
+	start := time.Now()
+	i.events.publish(ImportStartedEvent{eventBase: newEventBase(), PathName: pathName})
+	defer func() {
+		finished := ImportFinishedEvent{eventBase: newEventBase(), PathName: pathName, Duration: time.Since(start), Err: err}
+		if result != nil {
+			finished.RootCid = result.RootCid
+			finished.Bytes = result.FileSizeBytes
+		}
+		i.events.publish(finished)
+	}()
+
+	var bs blockstore.Blockstore = i.blockStore
+	var reservation *Reservation
+	if i.admission != nil {
+		reservation = &Reservation{admission: i.admission}
+		defer reservation.Release()
+
+		bs = &reservedBlockstore{Blockstore: i.blockStore, reservation: reservation}
+	}
+	if quota != nil {
+		bs = &reservedBlockstore{Blockstore: bs, reservation: quota}
+	}
+
+	bsrv := blockservice.New(bs, offline.Exchange(bs))
 	dsrv := merkledag.NewDAGService(bsrv)
 
-	ab, clean := chunker.NewAdderWithBar(ctx, dsrv, i.chunkSize)
+	ab, clean := chunker.NewAdderWithBar(ctx, dsrv, i.profile.ChunkSize, chunker.WithProfile(i.profile))
 	defer clean()
 
+	ab.SetSizeCheck(func(size int64) error {
+		if quota != nil {
+			if err := quota.Grow(size); err != nil {
+				return err
+			}
+		}
+		if reservation != nil {
+			return reservation.Grow(size)
+		}
+		return nil
+	})
+
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
 
-	i.ProgressInfo.PathName = filepath.Base(path)
+	i.ProgressInfo.PathName = pathName
+
+	done := make(chan struct{})
+	defer close(done)
 
 	go func() {
 		for {
 			select {
 			case <-ctx.Done():
 				return
+			case <-done:
+				return
 			case <-ticker.C:
-				i.ProgressInfo.Update(ab.Progress())
+				progress := ab.Progress()
+				i.ProgressInfo.Update(progress)
+				i.events.publish(ImportProgressEvent{eventBase: newEventBase(), PathName: pathName, Progress: progress})
 			}
 		}
 	}()
 
-	result, err := ab.Add(path)
-	if err != nil {
-		return nil, err
-	}
-
-	return result, nil
+	return ab.Add(path)
 }
 
 // Progress returns the current progress of the import
@@ -0,0 +1,67 @@
+package ipfsrepo
+
+import (
+	"context"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/fsrepo"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func init() {
+	if err := fsrepo.AddMigration(fsrepo.Migration{Version: 2, Datastore: migrateLayout}); err != nil {
+		panic(err)
+	}
+}
+
+// migrateLayout brings the metadata of a repo to version 2, tenant
+// descriptions get their own prefix and content stored before roots were
+// recorded gets roots
+func migrateLayout(ctx context.Context, d fsrepo.Datastore) error {
+	if err := moveTenantInfo(ctx, d); err != nil {
+		return err
+	}
+
+	return recordLegacyRoots(ctx, d)
+}
+
+// moveTenantInfo moves the descriptions of tenants from /tenants/<tenant>/info,
+// which list had to find among all their blocks, to tenantInfoPrefix. Repos
+// that moved them before are skipped.
+func moveTenantInfo(ctx context.Context, d fsrepo.Datastore) error {
+	moved, err := d.Has(ctx, tenantInfoMovedKey)
+	if err != nil || moved {
+		return err
+	}
+
+	results, err := d.Query(ctx, query.Query{Prefix: tenantsPrefix.String()})
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+
+	batch, err := d.Batch(ctx)
+	if err != nil {
+		return err
+	}
+	for r := range results.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+
+		key := ds.RawKey(r.Key)
+		if key.Name() != "info" || !key.Parent().Parent().Equal(tenantsPrefix) {
+			continue
+		}
+		if err := batch.Put(ctx, tenantInfoKey(key.Parent().Name()), r.Value); err != nil {
+			return err
+		}
+		if err := batch.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	if err := batch.Put(ctx, tenantInfoMovedKey, nil); err != nil {
+		return err
+	}
+
+	return batch.Commit(ctx)
+}
@@ -0,0 +1,195 @@
+package ipfsrepo
+
+import (
+	"github.com/Xib1uvXi/ipfsrepo/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"reflect"
+	"sync"
+)
+
+const (
+	metricsNamespace = "ipfsrepo"
+
+	// metricsEventBufferSize lets the metrics fall behind bursts of block writes without stalling them
+	metricsEventBufferSize = 1024
+)
+
+// SetMetricsRegistry registers the repo metrics, and the go-ds-measure metrics
+// of the datastores, with reg as well as with the registry of MetricsHandler.
+// The datastore metrics of every repo opened with this option have its UUID as
+// repo label, the repo metrics are removed from reg when the repo is closed.
+func SetMetricsRegistry(reg prometheus.Registerer) RepoOption {
+	return func(r *Repo) error {
+		r.metricsRegisterer = reg
+		return nil
+	}
+}
+
+// MetricsHandler returns a handler serving the repo metrics to Prometheus
+func (r *Repo) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(r.registry, promhttp.HandlerOpts{})
+}
+
+// repoMetrics turns repo events and usage into Prometheus metrics
+type repoMetrics struct {
+	imports          *prometheus.CounterVec
+	importBytes      prometheus.Counter
+	importDuration   prometheus.Histogram
+	importThroughput prometheus.Histogram
+	extracts         *prometheus.CounterVec
+	extractBytes     prometheus.Counter
+	blocksAdded      prometheus.Counter
+	blocksDeleted    prometheus.Counter
+	blockBytesAdded  prometheus.Counter
+	blockBytesDel    prometheus.Counter
+	gcRuns           *prometheus.CounterVec
+	gcFreedBytes     prometheus.Counter
+	usage            []prometheus.Collector
+}
+
+func newRepoMetrics(uuid string, usage *StorageUsage) *repoMetrics {
+	labels := prometheus.Labels{"repo": uuid}
+	counter := func(name, help string) prometheus.Counter {
+		return prometheus.NewCounter(prometheus.CounterOpts{Namespace: metricsNamespace, Name: name, Help: help, ConstLabels: labels})
+	}
+	counterVec := func(name, help string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: metricsNamespace, Name: name, Help: help, ConstLabels: labels}, []string{"result"})
+	}
+	gauge := func(name, help string, fn func(UsageSnapshot) float64) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Namespace: metricsNamespace, Name: name, Help: help, ConstLabels: labels}, func() float64 {
+			return fn(usage.Snapshot())
+		})
+	}
+
+	return &repoMetrics{
+		imports:     counterVec("imports_total", "Number of imports by result"),
+		importBytes: counter("import_bytes_total", "Size of the files imported successfully"),
+		importDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace, Name: "import_duration_seconds", Help: "Duration of successful imports",
+			ConstLabels: labels, Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+		}),
+		importThroughput: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace, Name: "import_throughput_bytes_per_second", Help: "Throughput of successful imports",
+			ConstLabels: labels, Buckets: prometheus.ExponentialBuckets(1<<20, 2, 12),
+		}),
+		extracts:        counterVec("extracts_total", "Number of extractions by result"),
+		extractBytes:    counter("extract_bytes_total", "Size of the files extracted successfully"),
+		blocksAdded:     counter("blocks_added_total", "Number of blocks written"),
+		blocksDeleted:   counter("blocks_deleted_total", "Number of blocks deleted"),
+		blockBytesAdded: counter("block_bytes_added_total", "Size of the blocks written"),
+		blockBytesDel:   counter("block_bytes_deleted_total", "Size of the blocks deleted"),
+		gcRuns:          counterVec("gc_runs_total", "Number of eviction runs by result"),
+		gcFreedBytes:    counter("gc_freed_bytes_total", "Bytes freed by eviction"),
+		usage: []prometheus.Collector{
+			gauge("usage_bytes", "Bytes used by the repo", func(s UsageSnapshot) float64 { return float64(s.Used) }),
+			gauge("max_storage_bytes", "Maximum storage size of the repo", func(s UsageSnapshot) float64 { return float64(s.Max) }),
+			gauge("usage_ratio", "Used share of the maximum storage size", func(s UsageSnapshot) float64 { return s.Percent / 100 }),
+			gauge("usage_level", "Usage level, 0 normal, 1 warn, 2 critical, 3 full", func(s UsageSnapshot) float64 { return float64(s.Level) }),
+			gauge("fs_free_bytes", "Bytes available on the filesystem of the repo", func(s UsageSnapshot) float64 { return float64(s.FSFree) }),
+			gauge("fs_free_inodes", "Free inodes on the filesystem of the repo", func(s UsageSnapshot) float64 { return float64(s.FSFreeInodes) }),
+		},
+	}
+}
+
+func (m *repoMetrics) collectors() []prometheus.Collector {
+	return append([]prometheus.Collector{
+		m.imports, m.importBytes, m.importDuration, m.importThroughput,
+		m.extracts, m.extractBytes,
+		m.blocksAdded, m.blocksDeleted, m.blockBytesAdded, m.blockBytesDel,
+		m.gcRuns, m.gcFreedBytes,
+	}, m.usage...)
+}
+
+// datastoreMetricsRegistered are the registerers the datastore metrics were
+// registered with. They are shared by all repos of the process, and the
+// registerer can not tell they are registered already as they describe nothing.
+var datastoreMetricsRegistered = struct {
+	sync.Mutex
+	regs map[prometheus.Registerer]struct{}
+}{regs: make(map[prometheus.Registerer]struct{})}
+
+// register registers the repo metrics with reg
+func (m *repoMetrics) register(reg prometheus.Registerer) error {
+	collectors := m.collectors()
+	for i, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			// a collector that is already registered is another one with the same descriptors
+			for _, c := range collectors[:i] {
+				reg.Unregister(c)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// registerDatastoreMetrics registers the datastore metrics with reg once
+func registerDatastoreMetrics(reg prometheus.Registerer) error {
+	if !reflect.TypeOf(reg).Comparable() {
+		return reg.Register(metrics.Default())
+	}
+
+	datastoreMetricsRegistered.Lock()
+	defer datastoreMetricsRegistered.Unlock()
+
+	if _, ok := datastoreMetricsRegistered.regs[reg]; ok {
+		return nil
+	}
+	if err := reg.Register(metrics.Default()); err != nil {
+		return err
+	}
+	datastoreMetricsRegistered.regs[reg] = struct{}{}
+	return nil
+}
+
+// unregister removes the repo metrics from reg, the datastore metrics stay as
+// other repos may share them
+func (m *repoMetrics) unregister(reg prometheus.Registerer) {
+	for _, c := range m.collectors() {
+		reg.Unregister(c)
+	}
+}
+
+// observe updates the metrics from the events of sub until it ends
+func (m *repoMetrics) observe(sub *Subscription) {
+	for e := range sub.Events() {
+		switch e := e.(type) {
+		case ImportFinishedEvent:
+			if e.Err != nil {
+				m.imports.WithLabelValues("error").Inc()
+				continue
+			}
+			m.imports.WithLabelValues("ok").Inc()
+			m.importBytes.Add(float64(e.Bytes))
+			m.importDuration.Observe(e.Duration.Seconds())
+			if e.Duration > 0 {
+				m.importThroughput.Observe(float64(e.Bytes) / e.Duration.Seconds())
+			}
+		case ExtractFinishedEvent:
+			if e.Err != nil {
+				m.extracts.WithLabelValues("error").Inc()
+				continue
+			}
+			m.extracts.WithLabelValues("ok").Inc()
+			m.extractBytes.Add(float64(e.Bytes))
+		case BlocksAddedEvent:
+			m.blocksAdded.Add(float64(len(e.Cids)))
+			m.blockBytesAdded.Add(float64(e.Bytes))
+		case BlocksDeletedEvent:
+			m.blocksDeleted.Add(float64(len(e.Cids)))
+			m.blockBytesDel.Add(float64(e.Bytes))
+		case GCEvent:
+			if e.Err != nil {
+				m.gcRuns.WithLabelValues("error").Inc()
+				continue
+			}
+			m.gcRuns.WithLabelValues("ok").Inc()
+			if e.Result != nil {
+				m.gcFreedBytes.Add(float64(e.Result.FreedBytes))
+			}
+		}
+	}
+}
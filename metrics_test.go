@@ -0,0 +1,136 @@
+package ipfsrepo
+
+import (
+	"context"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRepo_Metrics(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewRegistry()
+
+	repo, err := FromPath("test-uuid", t.TempDir(), 1<<30, SetMetricsRegistry(reg))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	tmpDir := t.TempDir()
+	fileBytes, err := createFile0to100k()
+	require.NoError(t, err)
+	filePath := path.Join(tmpDir, "file")
+	require.NoError(t, os.WriteFile(filePath, fileBytes, 0644))
+
+	result, err := repo.Import(ctx, filePath)
+	require.NoError(t, err)
+	require.NoError(t, repo.Extract(ctx, result.RootCid, path.Join(tmpDir, "extracted")))
+
+	require.Eventually(t, func() bool {
+		return gatheredValue(t, reg, "ipfsrepo_extract_bytes_total") == float64(len(fileBytes))
+	}, time.Second, 10*time.Millisecond)
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	names := make(map[string]bool)
+	for _, f := range families {
+		names[f.GetName()] = true
+	}
+	require.True(t, names["ipfsrepo_import_bytes_total"])
+	require.True(t, names["ipfsrepo_usage_bytes"])
+	require.True(t, names["ipfs_fsrepo_datastore_put_total"])
+
+	rec := httptest.NewRecorder()
+	repo.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(rec.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), `ipfsrepo_blocks_added_total{repo="test-uuid"}`)
+}
+
+// gatheredValue returns the value of the counter or gauge with the given name
+func gatheredValue(t *testing.T, reg prometheus.Gatherer, name string) float64 {
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		m := f.GetMetric()[0]
+		if m.GetCounter() != nil {
+			return m.GetCounter().GetValue()
+		}
+		return m.GetGauge().GetValue()
+	}
+
+	return 0
+}
+
+func TestRepo_MetricsReopen(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	repoPath := t.TempDir()
+
+	repo, err := FromPath("test-uuid", repoPath, 1<<30, SetMetricsRegistry(reg))
+	require.NoError(t, err)
+
+	t.Log("another repo with the same UUID can not register its metrics")
+	otherPath := t.TempDir()
+	_, err = FromPath("test-uuid", otherPath, 1<<30, SetMetricsRegistry(reg))
+	var registered prometheus.AlreadyRegisteredError
+	require.ErrorAs(t, err, &registered)
+	require.True(t, gatheredValue(t, reg, "ipfsrepo_max_storage_bytes") > 0, "the metrics of the first repo stay")
+
+	t.Log("the failed open released the other repo")
+	other, err := FromPath("other-uuid", otherPath, 1<<30, SetMetricsRegistry(reg))
+	require.NoError(t, err)
+	other.Close()
+
+	t.Log("the repo can be opened again with the same registerer once it is closed")
+	repo.Close()
+	repo, err = FromPath("test-uuid", repoPath, 1<<30, SetMetricsRegistry(reg))
+	require.NoError(t, err)
+	defer repo.Close()
+	require.True(t, gatheredValue(t, reg, "ipfsrepo_max_storage_bytes") > 0)
+}
+
+func TestRepo_DatastoreMetricsLabel(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewRegistry()
+
+	repo1, err := FromPath("uuid-1", t.TempDir(), 1<<30, SetMetricsRegistry(reg))
+	require.NoError(t, err)
+	defer repo1.Close()
+	repo2, err := FromPath("uuid-2", t.TempDir(), 1<<30, SetMetricsRegistry(reg))
+	require.NoError(t, err)
+	defer repo2.Close()
+
+	puts := func(repo string) float64 {
+		families, err := reg.Gather()
+		require.NoError(t, err)
+		for _, f := range families {
+			if f.GetName() != "flatfs_datastore_put_total" {
+				continue
+			}
+			for _, m := range f.GetMetric() {
+				for _, label := range m.GetLabel() {
+					if label.GetName() == "repo" && label.GetValue() == repo {
+						return m.GetCounter().GetValue()
+					}
+				}
+			}
+		}
+		return 0
+	}
+	before1, before2 := puts("uuid-1"), puts("uuid-2")
+
+	t.Log("the blocks of one repo are only counted for that repo")
+	block := blocks.NewBlock([]byte("labeled"))
+	require.NoError(t, repo1.BlockStore().Put(ctx, block))
+	require.Equal(t, before1+1, puts("uuid-1"))
+	require.Equal(t, before2, puts("uuid-2"))
+}
@@ -0,0 +1,464 @@
+package ipfsrepo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/fsrepo"
+	"github.com/ipfs/boxo/blockstore"
+	dshelp "github.com/ipfs/boxo/datastore/dshelp"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	mh "github.com/multiformats/go-multihash"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// migrationProgressInterval is how often progress events are sent during a migration
+const migrationProgressInterval = 5 * time.Second
+
+var (
+	ErrMigrationRunning = errors.New("migration is already running")
+	ErrCorruptBlocks    = errors.New("blocks do not match their hash")
+	ErrNoDiskSpec       = errors.New("storage has no disk spec")
+)
+
+// MigrationProgress reports how far a migration is
+type MigrationProgress struct {
+	Path string
+	// Keys is the number of datastore keys when the migration started
+	Keys   uint64
+	Copied uint64
+	Bytes  uint64
+	// Corrupt counts the blocks that did not match their hash, they are not
+	// copied and the migration fails once every key was checked
+	Corrupt uint64
+	Done    bool
+}
+
+// MigrateTo moves the repo to a new FSRepo at newPath with the same datastore
+// spec, while it keeps serving reads and writes. Writes go to both repos while
+// every key is copied, blocks are checked against their hash and every copy
+// is read back. Then the repo switches over to newPath and closes the old
+// one, unless a block did not match its hash, then it fails with
+// ErrCorruptBlocks. Progress is sent as MigrationProgressEvent. On error the
+// repo stays where it is, newPath is left for the caller to remove.
+//
+// Device checks only compare the filesystem of newPath after a migration.
+func (r *Repo) MigrateTo(ctx context.Context, newPath string) (*MigrationProgress, error) {
+	if err := r.writable(); err != nil {
+		return nil, err
+	}
+	if !r.migrating.CompareAndSwap(false, true) {
+		return nil, ErrMigrationRunning
+	}
+	defer r.migrating.Store(false)
+
+	if err := os.MkdirAll(newPath, 0o755); err != nil {
+		return nil, err
+	}
+
+	spec := r.storage.Spec()
+	if spec == nil {
+		return nil, fmt.Errorf("%w: it can not be migrated", ErrNoDiskSpec)
+	}
+
+	// the target gets the datastores of the repo, encrypted ones stay encrypted
+	target, err := fsrepo.NewFSRepoWithSpec(newPath, spec, fsrepo.Unmeasured())
+	if err != nil {
+		return nil, err
+	}
+
+	progress, err := r.migrate(ctx, target)
+	r.events.publish(MigrationProgressEvent{eventBase: newEventBase(), MigrationProgress: *progress, Err: err})
+	if err != nil {
+		r.storage.stopMirror()
+		_ = target.Close()
+		return progress, err
+	}
+
+	return progress, nil
+}
+
+func (r *Repo) migrate(ctx context.Context, target *fsrepo.FSRepo) (*MigrationProgress, error) {
+	progress := &MigrationProgress{Path: target.Path()}
+	source := r.storage.current().Datastore()
+
+	keys, err := fsrepo.CountKeys(ctx, source)
+	if err != nil {
+		return progress, err
+	}
+	progress.Keys = keys
+
+	// from here on every write also goes to target, keys written are copied already
+	r.storage.startMirror(target)
+
+	results, err := source.Query(ctx, query.Query{KeysOnly: true})
+	if err != nil {
+		return progress, err
+	}
+	defer results.Close()
+
+	reported := time.Now()
+	for res := range results.Next() {
+		if res.Error != nil {
+			return progress, res.Error
+		}
+
+		if err := r.storage.copyKey(ctx, ds.NewKey(res.Key), progress); err != nil {
+			return progress, fmt.Errorf("copy %s: %w", res.Key, err)
+		}
+
+		if time.Since(reported) >= migrationProgressInterval {
+			reported = time.Now()
+			r.events.publish(MigrationProgressEvent{eventBase: newEventBase(), MigrationProgress: *progress})
+		}
+	}
+
+	if progress.Corrupt > 0 {
+		// the source keeps the only copy of them, it has to stay in use
+		return progress, fmt.Errorf("%w: %d blocks were not copied", ErrCorruptBlocks, progress.Corrupt)
+	}
+
+	if err := r.blockMeta.Flush(ctx); err != nil {
+		return progress, err
+	}
+	if err := target.Datastore().Sync(ctx, ds.NewKey("/")); err != nil {
+		return progress, err
+	}
+
+	if err := writeRepoConfig(target.Path(), r.config); err != nil {
+		return progress, err
+	}
+
+	// a write the target missed fails the switch, the source keeps the only copy
+	old, err := r.storage.switchTo(target)
+	if err != nil {
+		return progress, err
+	}
+	if err := old.Close(); err != nil {
+		log.Warnf("close %s after migration: %s", storagePath(old), err)
+	}
+
+	r.StorageUsage.moveTo(target.Path())
+	if err := r.StorageUsage.rewriteHistory(); err != nil {
+		log.Warnf("write usage history of %s: %s", target.Path(), err)
+	}
+	if err := r.StorageUsage.Reconcile(); err != nil {
+		log.Warnf("reconcile storage usage of %s: %s", target.Path(), err)
+	}
+	r.health.moved(target.Path())
+
+	progress.Done = true
+	return progress, nil
+}
+
+// verifyBlock checks a value stored under the blockstore prefix against the hash in its key
+func verifyBlock(key ds.Key, value []byte) (bool, error) {
+	if !strings.HasPrefix(key.String(), blockstore.BlockPrefix.String()+"/") {
+		return true, nil
+	}
+
+	hash, err := dshelp.DsKeyToMultihash(ds.NewKey(key.BaseNamespace()))
+	if err != nil {
+		return false, err
+	}
+
+	decoded, err := mh.Decode(hash)
+	if err != nil {
+		return false, err
+	}
+
+	sum, err := mh.Sum(value, decoded.Code, decoded.Length)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(sum, hash), nil
+}
+
+// switchStorage is the storage of a repo. During a migration it mirrors every
+// write to the target, and it switches over to the target once it is done.
+// A write that fails on the mirror only fails the migration.
+type switchStorage struct {
+	// mu is held for reading by writes, and for writing while a key is copied or storages are switched
+	mu     sync.RWMutex
+	active fsrepo.Storage
+	mirror fsrepo.Storage
+
+	// mirrorErr is the first write that failed on the mirror
+	mirrorMu  sync.Mutex
+	mirrorErr error
+
+	// labels are the labels of the datastore metrics, nil if the repo has none
+	labels map[string]string
+}
+
+func newSwitchStorage(storage fsrepo.Storage) *switchStorage {
+	return &switchStorage{active: storage}
+}
+
+func (s *switchStorage) current() fsrepo.Storage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.active
+}
+
+func (s *switchStorage) Datastore() fsrepo.Datastore {
+	return (*switchDatastore)(s)
+}
+
+// Path returns the directory of the active storage, empty if it is not kept in one
+func (s *switchStorage) Path() string {
+	return storagePath(s.current())
+}
+
+// Spec returns the spec of the active storage, nil if it has none
+func (s *switchStorage) Spec() fsrepo.DiskSpec {
+	if storage, ok := s.current().(fsrepo.SpecStorage); ok {
+		return storage.Spec()
+	}
+	return nil
+}
+
+// storagePath returns the directory of storage, empty if it is not kept in one
+func storagePath(storage fsrepo.Storage) string {
+	if storage, ok := storage.(fsrepo.SpecStorage); ok {
+		return storage.Path()
+	}
+	return ""
+}
+
+func (s *switchStorage) GetStorageUsage(ctx context.Context) (uint64, error) {
+	return s.current().GetStorageUsage(ctx)
+}
+
+func (s *switchStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.mirror != nil {
+		_ = s.mirror.Close()
+		s.mirror = nil
+	}
+
+	return s.active.Close()
+}
+
+func (s *switchStorage) startMirror(target fsrepo.Storage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mirror = target
+	s.mirrorErr = nil
+}
+
+func (s *switchStorage) stopMirror() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mirror = nil
+}
+
+// switchTo makes the mirror the active storage and returns the old one. It
+// fails if a write did not reach the mirror, which stays in place then.
+func (s *switchStorage) switchTo(target fsrepo.Storage) (fsrepo.Storage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.mirrorError(); err != nil {
+		return nil, err
+	}
+
+	old := s.active
+	s.active, s.mirror = target, nil
+	if s.labels != nil {
+		measureStorage(target, s.labels)
+	}
+	return old, nil
+}
+
+func (s *switchStorage) mirrorError() error {
+	s.mirrorMu.Lock()
+	defer s.mirrorMu.Unlock()
+
+	return s.mirrorErr
+}
+
+// mirrorFailed records err unless an earlier write failed on the mirror already
+func (s *switchStorage) mirrorFailed(err error) {
+	s.mirrorMu.Lock()
+	defer s.mirrorMu.Unlock()
+
+	if s.mirrorErr == nil {
+		s.mirrorErr = err
+	}
+}
+
+// measure creates the datastore metrics of the active storage with the given
+// labels, a storage it switches to later gets them too
+func (s *switchStorage) measure(labels map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.labels = labels
+	measureStorage(s.active, labels)
+}
+
+// measureStorage creates the datastore metrics of storage, if it has them
+func measureStorage(storage fsrepo.Storage, labels map[string]string) {
+	if storage, ok := storage.(fsrepo.MeasuredStorage); ok {
+		storage.Measure(labels)
+	}
+}
+
+// copyKey copies one key to the mirror, no write can happen in between
+func (s *switchStorage) copyKey(ctx context.Context, key ds.Key, progress *MigrationProgress) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, err := s.active.Datastore().Get(ctx, key)
+	if errors.Is(err, ds.ErrNotFound) {
+		// deleted since the query, the delete went to the mirror too
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	ok, err := verifyBlock(key, value)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		log.Errorf("block %s does not match its hash, it is not copied", key)
+		progress.Corrupt++
+		return nil
+	}
+
+	target := s.mirror.Datastore()
+	if err := target.Put(ctx, key, value); err != nil {
+		return err
+	}
+
+	written, err := target.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(written, value) {
+		return errors.New("value read back differs")
+	}
+
+	progress.Copied++
+	progress.Bytes += uint64(len(value))
+	return nil
+}
+
+// switchDatastore forwards to the active storage, and writes to the mirror as well
+type switchDatastore switchStorage
+
+var _ ds.Batching = (*switchDatastore)(nil)
+var _ ds.PersistentDatastore = (*switchDatastore)(nil)
+
+func (d *switchDatastore) storage() *switchStorage {
+	return (*switchStorage)(d)
+}
+
+// write runs fn on the active datastore and the mirror, if there is one. A
+// failure on the mirror is kept for the migration, the write succeeded.
+func (d *switchDatastore) write(fn func(fsrepo.Datastore) error) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if err := fn(d.active.Datastore()); err != nil {
+		return err
+	}
+
+	if d.mirror != nil {
+		if err := fn(d.mirror.Datastore()); err != nil {
+			err = fmt.Errorf("migration target %s: %w", storagePath(d.mirror), err)
+			log.Errorf("%s, the migration will fail", err)
+			d.storage().mirrorFailed(err)
+		}
+	}
+
+	return nil
+}
+
+func (d *switchDatastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	return d.storage().current().Datastore().Get(ctx, key)
+}
+
+func (d *switchDatastore) Has(ctx context.Context, key ds.Key) (bool, error) {
+	return d.storage().current().Datastore().Has(ctx, key)
+}
+
+func (d *switchDatastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	return d.storage().current().Datastore().GetSize(ctx, key)
+}
+
+func (d *switchDatastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	return d.storage().current().Datastore().Query(ctx, q)
+}
+
+func (d *switchDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	return d.write(func(w fsrepo.Datastore) error { return w.Put(ctx, key, value) })
+}
+
+func (d *switchDatastore) Delete(ctx context.Context, key ds.Key) error {
+	return d.write(func(w fsrepo.Datastore) error { return w.Delete(ctx, key) })
+}
+
+func (d *switchDatastore) Sync(ctx context.Context, prefix ds.Key) error {
+	return d.write(func(w fsrepo.Datastore) error { return w.Sync(ctx, prefix) })
+}
+
+func (d *switchDatastore) DiskUsage(ctx context.Context) (uint64, error) {
+	return ds.DiskUsage(ctx, d.storage().current().Datastore())
+}
+
+// Close is a no-op, the storage is closed with the repo
+func (d *switchDatastore) Close() error {
+	return nil
+}
+
+func (d *switchDatastore) Batch(context.Context) (ds.Batch, error) {
+	return &switchBatch{ds: d}, nil
+}
+
+// switchBatch buffers its operations and writes them to both datastores on commit
+type switchBatch struct {
+	ds  *switchDatastore
+	ops []func(ds.Batch) error
+}
+
+func (b *switchBatch) Put(ctx context.Context, key ds.Key, value []byte) error {
+	b.ops = append(b.ops, func(batch ds.Batch) error { return batch.Put(ctx, key, value) })
+	return nil
+}
+
+func (b *switchBatch) Delete(ctx context.Context, key ds.Key) error {
+	b.ops = append(b.ops, func(batch ds.Batch) error { return batch.Delete(ctx, key) })
+	return nil
+}
+
+func (b *switchBatch) Commit(ctx context.Context) error {
+	return b.ds.write(func(w fsrepo.Datastore) error {
+		batch, err := w.Batch(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, op := range b.ops {
+			if err := op(batch); err != nil {
+				return err
+			}
+		}
+
+		return batch.Commit(ctx)
+	})
+}
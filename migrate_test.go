@@ -0,0 +1,236 @@
+package ipfsrepo
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/encds"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/fsrepo"
+	"github.com/ipfs/boxo/blockstore"
+	dshelp "github.com/ipfs/boxo/datastore/dshelp"
+	blocks "github.com/ipfs/go-block-format"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/stretchr/testify/require"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepo_MigrateTo(t *testing.T) {
+	ctx := context.Background()
+	oldPath, newPath := t.TempDir(), path.Join(t.TempDir(), "repo")
+
+	repo, err := FromPath("test-uuid", oldPath, 1<<30)
+	require.NoError(t, err)
+	defer repo.Close()
+
+	tmpDir := t.TempDir()
+	fileBytes, err := createFile0to100k()
+	require.NoError(t, err)
+	filePath := path.Join(tmpDir, "file")
+	require.NoError(t, os.WriteFile(filePath, fileBytes, 0644))
+
+	result, err := repo.Import(ctx, filePath)
+	require.NoError(t, err)
+
+	sub, err := repo.Subscribe(ctx, EventMigration)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	progress, err := repo.MigrateTo(ctx, newPath)
+	require.NoError(t, err)
+	require.True(t, progress.Done)
+	require.Zero(t, progress.Corrupt)
+	require.Equal(t, progress.Keys, progress.Copied)
+
+	e := (<-sub.Events()).(MigrationProgressEvent)
+	require.True(t, e.Done)
+
+	require.Equal(t, newPath, repo.storage.Path())
+	require.True(t, repo.HasBlock(ctx, result.Blocks))
+	roots, err := repo.Roots(ctx)
+	require.NoError(t, err)
+	require.Len(t, roots, 1)
+
+	// new writes land on the new repo only
+	require.NoError(t, repo.SaveBlock(ctx, [][]byte{[]byte("after migration")}))
+	after := blocks.NewBlock([]byte("after migration"))
+	has, err := repo.DataStore().Has(ctx, blockstore.BlockPrefix.Child(dshelp.MultihashToDsKey(after.Cid().Hash())))
+	require.NoError(t, err)
+	require.True(t, has)
+
+	// the old repo is closed and unlocked
+	old, err := fsrepo.NewFSRepo(oldPath)
+	require.NoError(t, err)
+	defer old.Close()
+	_, err = old.Datastore().Get(ctx, blockstore.BlockPrefix.Child(dshelp.MultihashToDsKey(after.Cid().Hash())))
+	require.ErrorIs(t, err, ds.ErrNotFound)
+}
+
+func TestRepo_MigrateToCorrupt(t *testing.T) {
+	ctx := context.Background()
+	oldPath, newPath := t.TempDir(), path.Join(t.TempDir(), "repo")
+
+	repo, err := FromPath("test-uuid", oldPath, 1<<30)
+	require.NoError(t, err)
+	defer repo.Close()
+	require.NoError(t, repo.SaveBlock(ctx, [][]byte{[]byte("block")}))
+
+	// a block whose content does not match its hash is not copied
+	corrupt := blocks.NewBlock([]byte("corrupt"))
+	corruptKey := blockstore.BlockPrefix.Child(dshelp.MultihashToDsKey(corrupt.Cid().Hash()))
+	require.NoError(t, repo.DataStore().Put(ctx, corruptKey, []byte("tampered")))
+
+	progress, err := repo.MigrateTo(ctx, newPath)
+	require.ErrorIs(t, err, ErrCorruptBlocks)
+	require.False(t, progress.Done)
+	require.Equal(t, uint64(1), progress.Corrupt)
+
+	t.Log("the repo stays on the old path with the corrupt block")
+	require.Equal(t, oldPath, repo.storage.Path())
+	value, err := repo.DataStore().Get(ctx, corruptKey)
+	require.NoError(t, err)
+	require.Equal(t, []byte("tampered"), value)
+	require.True(t, repo.HasBlock(ctx, []string{blocks.NewBlock([]byte("block")).Cid().String()}))
+
+	t.Log("writes no longer go to the target")
+	require.NoError(t, repo.SaveBlock(ctx, [][]byte{[]byte("after")}))
+	target, err := fsrepo.Open(newPath)
+	require.NoError(t, err)
+	defer target.Close()
+	_, err = target.Datastore().Get(ctx, blockstore.BlockPrefix.Child(dshelp.MultihashToDsKey(blocks.NewBlock([]byte("after")).Cid().Hash())))
+	require.ErrorIs(t, err, ds.ErrNotFound)
+}
+
+func TestSwitchStorage_Mirror(t *testing.T) {
+	ctx := context.Background()
+
+	active, err := fsrepo.NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+	target, err := fsrepo.NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+
+	s := newSwitchStorage(active)
+	defer s.Close()
+	s.startMirror(target)
+
+	key := ds.NewKey("/test")
+	require.NoError(t, s.Datastore().Put(ctx, key, []byte("value")))
+
+	batch, err := s.Datastore().Batch(ctx)
+	require.NoError(t, err)
+	require.NoError(t, batch.Delete(ctx, key))
+	require.NoError(t, batch.Put(ctx, ds.NewKey("/batched"), []byte("value")))
+	require.NoError(t, batch.Commit(ctx))
+
+	for _, d := range []fsrepo.Datastore{active.Datastore(), target.Datastore()} {
+		has, err := d.Has(ctx, key)
+		require.NoError(t, err)
+		require.False(t, has)
+
+		v, err := d.Get(ctx, ds.NewKey("/batched"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), v)
+	}
+
+	old, err := s.switchTo(target)
+	require.NoError(t, err)
+	require.Equal(t, active, old)
+	require.NoError(t, active.Close())
+	require.Equal(t, target.Path(), s.Path())
+}
+
+func TestSwitchStorage_MirrorFails(t *testing.T) {
+	ctx := context.Background()
+
+	active, err := fsrepo.NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+	target, err := fsrepo.NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+
+	s := newSwitchStorage(active)
+	defer s.Close()
+	s.startMirror(target)
+
+	t.Log("a write the mirror misses succeeds on the active storage")
+	require.NoError(t, target.Close())
+	require.NoError(t, s.Datastore().Put(ctx, ds.NewKey("/test"), []byte("value")))
+	v, err := active.Datastore().Get(ctx, ds.NewKey("/test"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), v)
+
+	t.Log("and keeps the storage from switching to the mirror")
+	_, err = s.switchTo(target)
+	require.Error(t, err)
+	require.Equal(t, active.Path(), s.Path())
+}
+
+func TestRepo_MigrateToKeepsSpec(t *testing.T) {
+	ctx := context.Background()
+	oldPath, newPath := t.TempDir(), path.Join(t.TempDir(), "repo")
+
+	keyDir := t.TempDir()
+	key := hex.EncodeToString(bytes.Repeat([]byte{1}, encds.KeySize))
+	require.NoError(t, os.WriteFile(filepath.Join(keyDir, "k1.key"), []byte(key), 0o600))
+	spec := fsrepo.DiskSpec{
+		"type": "mount",
+		"mounts": []interface{}{
+			map[string]interface{}{
+				"mountpoint":  "/blocks",
+				"type":        "encrypted",
+				"keyId":       "k1",
+				"keyProvider": map[string]interface{}{"type": "file", "dir": keyDir},
+				"child": map[string]interface{}{
+					"type":      "flatfs",
+					"path":      "blocks",
+					"shardFunc": "/repo/flatfs/shard/v1/next-to-last/2",
+				},
+			},
+			map[string]interface{}{
+				"mountpoint":  "/",
+				"type":        "levelds",
+				"path":        "datastore",
+				"compression": "none",
+			},
+		},
+	}
+	storage, err := fsrepo.NewFSRepoWithSpec(oldPath, spec)
+	require.NoError(t, err)
+	require.NoError(t, storage.Close())
+
+	repo, err := FromPath("test-uuid", oldPath, 1<<30)
+	require.NoError(t, err)
+	defer repo.Close()
+
+	plaintext := []byte("secret block content")
+	require.NoError(t, repo.SaveBlock(ctx, [][]byte{plaintext}))
+
+	_, err = repo.MigrateTo(ctx, newPath)
+	require.NoError(t, err)
+
+	t.Log("the new repo has the encrypted spec")
+	onDisk, err := os.ReadFile(fsrepo.DatastoreSpec(newPath))
+	require.NoError(t, err)
+	oldSpec, err := os.ReadFile(fsrepo.DatastoreSpec(oldPath))
+	require.NoError(t, err)
+	require.Equal(t, string(oldSpec), string(onDisk))
+
+	t.Log("no block is written in plaintext")
+	var blockFiles int
+	require.NoError(t, filepath.WalkDir(filepath.Join(newPath, "blocks"), func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(p) != ".data" {
+			return err
+		}
+		blockFiles++
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		require.NotContains(t, string(b), string(plaintext))
+		return nil
+	}))
+	require.NotZero(t, blockFiles)
+	require.True(t, repo.HasBlock(ctx, []string{blocks.NewBlock(plaintext).Cid().String()}))
+}
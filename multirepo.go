@@ -0,0 +1,493 @@
+package ipfsrepo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/chunker"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/writer"
+	"github.com/dustin/go-humanize"
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+// placeLocks is the number of locks placement of blocks is serialized with
+const placeLocks = 64
+
+var ErrNoRepos = errors.New("no repos given")
+
+// PlacementPolicy decides which disk of a MultiRepo a new block is written to
+type PlacementPolicy int
+
+const (
+	// PlaceFillFirst writes to the first disk that has room
+	PlaceFillFirst PlacementPolicy = iota
+	// PlaceMostFree writes to the disk with the most available capacity
+	PlaceMostFree
+	// PlaceHash writes every block to the disk its hash maps to, so reads go to one disk
+	PlaceHash
+)
+
+func (p PlacementPolicy) String() string {
+	switch p {
+	case PlaceFillFirst:
+		return "fill-first"
+	case PlaceMostFree:
+		return "most-free"
+	case PlaceHash:
+		return "hash"
+	default:
+		return fmt.Sprintf("PlacementPolicy(%d)", int(p))
+	}
+}
+
+// MultiRepo spreads the blocks of one repo over the repos of several disks.
+// Every disk keeps its own usage, admission, block metadata and device checks.
+// The root of an import is recorded on every disk that holds blocks of it.
+// Retention, eviction and tenants stay per disk and are not available on a
+// MultiRepo.
+type MultiRepo struct {
+	repos      []*Repo
+	blockStore *multiBlockstore
+	importer   *Importer
+	*BlockRepo
+}
+
+// NewMultiRepo spans repos, which are opened already and are closed with the
+// MultiRepo. Imports use the chunking profile of the first repo. The keys of
+// every repo are read to find blocks without asking every disk, blocks
+// written to the repos directly afterwards are not seen by the MultiRepo.
+func NewMultiRepo(policy PlacementPolicy, repos ...*Repo) (*MultiRepo, error) {
+	if len(repos) == 0 {
+		return nil, ErrNoRepos
+	}
+
+	bs := &multiBlockstore{repos: repos, policy: policy, locations: make(map[string]*Repo)}
+	if err := bs.index(context.Background()); err != nil {
+		return nil, err
+	}
+	m := &MultiRepo{
+		repos:      repos,
+		blockStore: bs,
+		importer:   NewImporter(bs, repos[0].importer.profile.ChunkSize),
+		BlockRepo:  &BlockRepo{blockStore: bs, admission: bs},
+	}
+	m.importer.SetProfile(repos[0].importer.profile)
+
+	return m, nil
+}
+
+// Repos returns the repos of the disks
+func (m *MultiRepo) Repos() []*Repo {
+	return m.repos
+}
+
+func (m *MultiRepo) BlockStore() blockstore.Blockstore {
+	return m.blockStore
+}
+
+// Import the file, its blocks are placed by the placement policy. The root is
+// recorded unretained on every disk that holds blocks of the file.
+func (m *MultiRepo) Import(ctx context.Context, path string) (*chunker.Result, error) {
+	// the evictors of the disks wait until the root is recorded
+	for _, r := range m.repos {
+		r.imports.Inc()
+		defer r.imports.Dec()
+	}
+
+	result, err := m.importer.Import(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	holding := make(map[*Repo]struct{})
+	for _, cidStr := range append(result.Blocks, result.RootCid) {
+		c, err := cid.Parse(cidStr)
+		if err != nil {
+			return nil, err
+		}
+		if r := m.blockStore.location(c); r != nil {
+			holding[r] = struct{}{}
+		}
+	}
+
+	for _, r := range m.repos {
+		if _, ok := holding[r]; !ok {
+			continue
+		}
+		if err := r.roots.Add(ctx, &Root{Cid: result.RootCid, Name: result.FileName, Added: time.Now()}); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// Extract the file from the disks holding its blocks, writes it to the given path
+func (m *MultiRepo) Extract(ctx context.Context, rootCid string, toPath string) error {
+	bSrv := blockservice.New(m.blockStore, offline.Exchange(m.blockStore))
+	dSrv := merkledag.NewDAGService(bSrv)
+
+	return writer.NewSrv(dSrv).WriteTo(ctx, rootCid, toPath)
+}
+
+// MaxStorageSize returns the sum of the maximum storage sizes of the disks
+func (m *MultiRepo) MaxStorageSize() uint64 {
+	var size uint64
+	for _, r := range m.repos {
+		size += r.StorageUsage.maxStorage
+	}
+
+	return size
+}
+
+// Usage returns the storage used by all disks
+func (m *MultiRepo) Usage() string {
+	return humanize.Bytes(m.used())
+}
+
+// UsagePercentage returns the usage of all disks against their total maximum storage size
+func (m *MultiRepo) UsagePercentage() float64 {
+	return float64(m.used()) / float64(m.MaxStorageSize()) * 100
+}
+
+// Available returns the bytes that can still be written to all disks
+func (m *MultiRepo) Available() uint64 {
+	return m.blockStore.available()
+}
+
+// IsFull returns true once no disk takes new blocks anymore
+func (m *MultiRepo) IsFull() bool {
+	for _, r := range m.repos {
+		if !r.IsFull() && unwritable(r) == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Close closes the repos of all disks
+func (m *MultiRepo) Close() {
+	for _, r := range m.repos {
+		r.Close()
+	}
+}
+
+func (m *MultiRepo) used() uint64 {
+	var used uint64
+	for _, r := range m.repos {
+		used += r.StorageUsage.used()
+	}
+
+	return used
+}
+
+// multiBlockstore places new blocks on one of the blockstores of its repos,
+// and keeps the repo of every block to look it up on that one only
+type multiBlockstore struct {
+	repos  []*Repo
+	policy PlacementPolicy
+
+	mu sync.RWMutex
+	// locations maps the multihash of every block to the repo holding it
+	locations map[string]*Repo
+	// placing serializes finding, placing and writing a block by its hash, so
+	// a block written concurrently ends up on one disk only
+	placing [placeLocks]sync.Mutex
+}
+
+var _ blockstore.Blockstore = (*multiBlockstore)(nil)
+
+func (b *multiBlockstore) hashed(c cid.Cid) int {
+	return int(hashOf(c) % uint32(len(b.repos)))
+}
+
+func hashOf(c cid.Cid) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write(c.Hash())
+	return h.Sum32()
+}
+
+// unwritable returns why no blocks can be placed on r, nil if they can
+func unwritable(r *Repo) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+
+	return r.Degraded()
+}
+
+// index records the repo of every block, a block stored on several disks is
+// located on the first one, or on the one hash placement maps it to
+func (b *multiBlockstore) index(ctx context.Context) error {
+	for _, r := range b.repos {
+		keys, err := r.blockStore.AllKeysChan(ctx)
+		if err != nil {
+			return err
+		}
+
+		for c := range keys {
+			// hash placement has blocks on the disk they map to
+			b.locate(c, r, b.policy == PlaceHash && b.repos[b.hashed(c)] == r)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// locate records that r holds the block, an existing location is only overwritten if replace is set
+func (b *multiBlockstore) locate(c cid.Cid, r *Repo, replace bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.locations[string(c.Hash())]; ok && !replace {
+		return
+	}
+	b.locations[string(c.Hash())] = r
+}
+
+// location returns the repo the block was located on, nil if it is not known
+func (b *multiBlockstore) location(c cid.Cid) *Repo {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.locations[string(c.Hash())]
+}
+
+// forget drops the location of the block if it is still r
+func (b *multiBlockstore) forget(c cid.Cid, r *Repo) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.locations[string(c.Hash())] == r {
+		delete(b.locations, string(c.Hash()))
+	}
+}
+
+// find returns the repo holding the block, nil if no disk has it. Only the
+// disk it was located on is asked, a block evicted there is forgotten.
+func (b *multiBlockstore) find(ctx context.Context, c cid.Cid) (*Repo, error) {
+	r := b.location(c)
+	if r == nil {
+		return nil, nil
+	}
+
+	has, err := r.blockStore.Has(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		b.forget(c, r)
+		return nil, nil
+	}
+
+	return r, nil
+}
+
+// place picks the repo a new block of size bytes is written to and reserves
+// the capacity for it there. Read-only and degraded disks take no blocks.
+func (b *multiBlockstore) place(c cid.Cid, size uint64) (*Repo, *Reservation, error) {
+	if b.policy == PlaceHash {
+		r := b.repos[b.hashed(c)]
+		if err := unwritable(r); err != nil {
+			return nil, nil, err
+		}
+		reservation, err := r.admission.Reserve(size)
+		if err != nil {
+			return nil, nil, err
+		}
+		return r, reservation, nil
+	}
+
+	candidates := make([]*Repo, 0, len(b.repos))
+	for _, r := range b.repos {
+		if unwritable(r) == nil {
+			candidates = append(candidates, r)
+		}
+	}
+	if b.policy == PlaceMostFree {
+		available := make(map[*Repo]uint64, len(candidates))
+		for _, r := range candidates {
+			available[r] = r.Available()
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return available[candidates[i]] > available[candidates[j]]
+		})
+	}
+
+	// a disk filled up by a concurrent write is passed over
+	for _, r := range candidates {
+		if reservation, err := r.admission.Reserve(size); err == nil {
+			return r, reservation, nil
+		}
+	}
+
+	return nil, nil, &RepoFullError{Requested: size, Available: b.available()}
+}
+
+// available is the capacity left on the disks that take blocks
+func (b *multiBlockstore) available() uint64 {
+	var available uint64
+	for _, r := range b.repos {
+		if unwritable(r) == nil {
+			available += r.Available()
+		}
+	}
+
+	return available
+}
+
+// reserve checks that a batch fits into the disks that take blocks, the
+// capacity is reserved on the disk every block is placed on
+func (b *multiBlockstore) reserve(size uint64) (reserver, error) {
+	if available := b.available(); size > available {
+		return nil, &RepoFullError{Requested: size, Available: available}
+	}
+
+	return placedReservation{}, nil
+}
+
+// placedReservation holds nothing itself, placement reserves per block
+type placedReservation struct{}
+
+func (placedReservation) Grow(int64) error     { return nil }
+func (placedReservation) Consume(uint64) error { return nil }
+func (placedReservation) Release()             {}
+
+// DeleteBlock deletes the block from the disk it was located on
+func (b *multiBlockstore) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	mu := &b.placing[hashOf(c)%placeLocks]
+	mu.Lock()
+	defer mu.Unlock()
+
+	r := b.location(c)
+	if r == nil {
+		return nil
+	}
+
+	if err := r.blockStore.DeleteBlock(ctx, c); err != nil {
+		return err
+	}
+	b.forget(c, r)
+
+	return nil
+}
+
+func (b *multiBlockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	r, err := b.find(ctx, c)
+	return r != nil, err
+}
+
+func (b *multiBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	r, err := b.find(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, ipld.ErrNotFound{Cid: c}
+	}
+
+	return r.blockStore.Get(ctx, c)
+}
+
+func (b *multiBlockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	r, err := b.find(ctx, c)
+	if err != nil {
+		return -1, err
+	}
+	if r == nil {
+		return -1, ipld.ErrNotFound{Cid: c}
+	}
+
+	return r.blockStore.GetSize(ctx, c)
+}
+
+// Put writes the block to the disk chosen by the placement policy, unless a disk has it already
+func (b *multiBlockstore) Put(ctx context.Context, blk blocks.Block) error {
+	mu := &b.placing[hashOf(blk.Cid())%placeLocks]
+	mu.Lock()
+	defer mu.Unlock()
+
+	r, err := b.find(ctx, blk.Cid())
+	if err != nil || r != nil {
+		return err
+	}
+
+	r, reservation, err := b.place(blk.Cid(), uint64(len(blk.RawData())))
+	if err != nil {
+		return err
+	}
+	defer reservation.Release()
+
+	bs := &reservedBlockstore{Blockstore: r.blockStore, reservation: reservation}
+	if err := bs.Put(ctx, blk); err != nil {
+		return err
+	}
+	b.locate(blk.Cid(), r, true)
+
+	return nil
+}
+
+func (b *multiBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	for _, blk := range blks {
+		if err := b.Put(ctx, blk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AllKeysChan merges the keys of all disks, a block stored twice is sent twice
+func (b *multiBlockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	chans := make([]<-chan cid.Cid, 0, len(b.repos))
+	for _, r := range b.repos {
+		ch, err := r.blockStore.AllKeysChan(ctx)
+		if err != nil {
+			return nil, err
+		}
+		chans = append(chans, ch)
+	}
+
+	out := make(chan cid.Cid)
+	var wg sync.WaitGroup
+	for _, ch := range chans {
+		wg.Add(1)
+		go func(ch <-chan cid.Cid) {
+			defer wg.Done()
+			for c := range ch {
+				select {
+				case out <- c:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(ch)
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out, nil
+}
+
+func (b *multiBlockstore) HashOnRead(enabled bool) {
+	for _, r := range b.repos {
+		r.blockStore.HashOnRead(enabled)
+	}
+}
@@ -0,0 +1,146 @@
+package ipfsrepo
+
+import (
+	"context"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+func newTestMultiRepo(t *testing.T, policy PlacementPolicy, maxStorage ...uint64) *MultiRepo {
+	var repos []*Repo
+	for _, size := range maxStorage {
+		repo, err := FromPath("test-uuid", t.TempDir(), size, SetChunkSize(16<<10))
+		require.NoError(t, err)
+		repos = append(repos, repo)
+	}
+
+	m, err := NewMultiRepo(policy, repos...)
+	require.NoError(t, err)
+	t.Cleanup(m.Close)
+
+	return m
+}
+
+func TestMultiRepo_Import(t *testing.T) {
+	ctx := context.Background()
+
+	for _, policy := range []PlacementPolicy{PlaceFillFirst, PlaceMostFree, PlaceHash} {
+		t.Run(policy.String(), func(t *testing.T) {
+			m := newTestMultiRepo(t, policy, 1<<30, 1<<30, 1<<30)
+
+			tmpDir := t.TempDir()
+			fileBytes, err := createFile0to200k()
+			require.NoError(t, err)
+			filePath := path.Join(tmpDir, "file")
+			require.NoError(t, os.WriteFile(filePath, fileBytes, 0644))
+
+			before := make([]uint64, len(m.Repos()))
+			for i, r := range m.Repos() {
+				before[i] = r.StorageUsage.used()
+			}
+
+			result, err := m.Import(ctx, filePath)
+			require.NoError(t, err)
+			require.True(t, m.HasBlock(ctx, result.Blocks))
+
+			used := 0
+			for i, r := range m.Repos() {
+				if r.StorageUsage.used() > before[i] {
+					used++
+				}
+			}
+			if policy == PlaceFillFirst {
+				require.Equal(t, 1, used)
+			} else {
+				require.Equal(t, 3, used)
+			}
+
+			t.Log("the root is recorded on the disks holding blocks of the file")
+			recorded := 0
+			for _, r := range m.Repos() {
+				roots, err := r.Roots(ctx)
+				require.NoError(t, err)
+				if len(roots) > 0 {
+					require.Equal(t, result.RootCid, roots[0].Cid)
+					recorded++
+				}
+			}
+			require.Equal(t, used, recorded)
+
+			t.Log("a MultiRepo over the same disks locates the blocks")
+			spanned, err := NewMultiRepo(policy, m.Repos()...)
+			require.NoError(t, err)
+			require.True(t, spanned.HasBlock(ctx, result.Blocks))
+
+			extracted := path.Join(tmpDir, "extracted")
+			require.NoError(t, m.Extract(ctx, result.RootCid, extracted))
+			b, err := os.ReadFile(extracted)
+			require.NoError(t, err)
+			require.Equal(t, fileBytes, b)
+
+			require.NoError(t, m.DeleteBlock(ctx, result.Blocks))
+			require.False(t, m.HasBlock(ctx, result.Blocks[:1]))
+		})
+	}
+}
+
+func TestMultiRepo_FillFirstSpills(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMultiRepo(t, PlaceFillFirst, 1<<30, 1<<30)
+
+	// the first disk only takes one more block
+	first := m.Repos()[0]
+	first.StorageUsage.maxStorage = first.StorageUsage.used() + 10
+
+	second := m.Repos()[1].StorageUsage.used()
+	require.NoError(t, m.SaveBlock(ctx, [][]byte{[]byte("block 1"), []byte("block 2")}))
+	require.Equal(t, second+7, m.Repos()[1].StorageUsage.used())
+	require.False(t, m.IsFull())
+	require.Equal(t, first.StorageUsage.maxStorage+(1<<30), m.MaxStorageSize())
+}
+
+func TestMultiRepo_Placement(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMultiRepo(t, PlaceMostFree, 1<<30, 1<<30)
+	first, second := m.Repos()[0], m.Repos()[1]
+
+	t.Log("a batch that does not fit into the disks is rejected before any block is written")
+	big := make([]byte, 64<<10)
+	first.StorageUsage.maxStorage = first.StorageUsage.used() + 32<<10
+	second.StorageUsage.maxStorage = second.StorageUsage.used() + 16<<10
+	err := m.SaveBlock(ctx, [][]byte{[]byte("small"), big})
+	require.ErrorIs(t, err, ErrRepoFull)
+	require.False(t, m.HasBlock(ctx, []string{blocks.NewBlock([]byte("small")).Cid().String()}))
+
+	t.Log("a read-only disk takes no blocks, even with the most room")
+	first.readOnly = true
+	used := second.StorageUsage.used()
+	require.NoError(t, m.SaveBlock(ctx, [][]byte{[]byte("placed on the second disk")}))
+	require.Equal(t, used+uint64(len("placed on the second disk")), second.StorageUsage.used())
+	first.readOnly = false
+
+	t.Log("a block written concurrently is placed on one disk")
+	first.StorageUsage.maxStorage, second.StorageUsage.maxStorage = 1<<30, 1<<30
+	blk := blocks.NewBlock([]byte("written concurrently"))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, m.blockStore.Put(ctx, blk))
+		}()
+	}
+	wg.Wait()
+
+	var holding int
+	for _, r := range m.Repos() {
+		if r.HasBlock(ctx, []string{blk.Cid().String()}) {
+			holding++
+		}
+	}
+	require.Equal(t, 1, holding)
+}
@@ -58,9 +58,14 @@ type adder struct {
 	dagService ipld.DAGService
 	bufferedDS *ipld.BufferedDAG
 	cidBuilder cid.Builder
-	mroot      *mfs.Root
-	liveNodes  uint64
-	baseName   string
+	maxLinks   int
+	rawLeaves  bool
+	// profile is set by WithProfile, err is returned by Add if it is invalid
+	profile   *Profile
+	err       error
+	mroot     *mfs.Root
+	liveNodes uint64
+	baseName  string
 
 	Out chan<- interface{}
 }
@@ -81,15 +86,27 @@ func newAdder(ctx context.Context, dagService ipld.DAGService, chunkSize int64,
 	}
 
 	a.chunkSize = chunkSize
+	a.maxLinks = helpers.DefaultLinksPerBlock // Default max of 174 links per block
+	a.rawLeaves = true                        // Leave the actual file bytes untouched instead of wrapping them in a dag-pb protobuf wrapper
 
 	for _, opt := range opts {
 		opt(a)
 	}
 
+	if a.profile != nil {
+		if a.err = a.profile.Validate(); a.err == nil {
+			a.cidBuilder, _ = a.profile.CidBuilder()
+		}
+		a.chunkSize, a.maxLinks, a.rawLeaves = a.profile.ChunkSize, a.profile.MaxLinks, a.profile.RawLeaves
+	}
+
 	return a
 }
 
 func (a *adder) Add(file files.Node) (ipld.Node, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
 	if err := a.addFileNode(a.ctx, "", file, true); err != nil {
 		return nil, err
 	}
@@ -292,9 +309,9 @@ func (a *adder) add(reader io.Reader) (ipld.Node, error) {
 	chnk := chunk.NewSizeSplitter(reader, a.chunkSize)
 
 	params := helpers.DagBuilderParams{
-		Maxlinks:   helpers.DefaultLinksPerBlock, // Default max of 174 links per block
-		RawLeaves:  true,                         // Leave the actual file bytes untouched instead of wrapping them in a dag-pb protobuf wrapper
-		CidBuilder: a.cidBuilder,                 // Use CIDv1 for all links
+		Maxlinks:   a.maxLinks,
+		RawLeaves:  a.rawLeaves,
+		CidBuilder: a.cidBuilder,
 		Dagserv:    a.bufferedDS,
 		NoCopy:     false,
 	}
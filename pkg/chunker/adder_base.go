@@ -24,11 +24,20 @@ type AdderBase struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 	*adder
+
+	// sizeCheck is called with the total size before anything is added
+	sizeCheck func(size int64) error
 }
 
-func NewAdderBase(pctx context.Context, dagService ipld.DAGService, chunkSize int64) *AdderBase {
+func NewAdderBase(pctx context.Context, dagService ipld.DAGService, chunkSize int64, opts ...AdderOpt) *AdderBase {
 	ctx, cancel := context.WithCancel(pctx)
-	return &AdderBase{adder: newAdder(ctx, dagService, chunkSize), ctx: ctx, cancel: cancel}
+	return &AdderBase{adder: newAdder(ctx, dagService, chunkSize, opts...), ctx: ctx, cancel: cancel}
+}
+
+// SetSizeCheck sets a check that can reject the add up front, based on the
+// total size of the file or directory
+func (s *AdderBase) SetSizeCheck(check func(size int64) error) {
+	s.sizeCheck = check
 }
 
 func (s *AdderBase) Add(targetPath string) (*Result, error) {
@@ -52,6 +61,13 @@ func (s *AdderBase) Add(targetPath string) (*Result, error) {
 		return nil, err
 	}
 
+	if s.sizeCheck != nil {
+		if err := s.sizeCheck(fsize); err != nil {
+			_ = addit.Node().Close()
+			return nil, err
+		}
+	}
+
 	hSize := humanize.Bytes(uint64(fsize))
 	filename := gofilepath.Base(addit.Name())
 
@@ -19,9 +19,9 @@ type AdderWithBar struct {
 	swapSize int64
 }
 
-func NewAdderWithBar(pctx context.Context, dagService ipld.DAGService, chunkSize int64) (*AdderWithBar, func()) {
+func NewAdderWithBar(pctx context.Context, dagService ipld.DAGService, chunkSize int64, opts ...AdderOpt) (*AdderWithBar, func()) {
 	out := make(chan interface{}, 128)
-	a := NewAdderBase(pctx, dagService, chunkSize)
+	a := NewAdderBase(pctx, dagService, chunkSize, opts...)
 	adderS := &AdderWithBar{AdderBase: a, out: out, total: 0, addSize: 0, swapSize: 0}
 
 	go adderS.handleOut(a.ctx)
@@ -51,6 +51,13 @@ func (s *AdderWithBar) Add(targetPath string) (*Result, error) {
 		return nil, err
 	}
 
+	if s.sizeCheck != nil {
+		if err := s.sizeCheck(fsize); err != nil {
+			_ = addit.Node().Close()
+			return nil, err
+		}
+	}
+
 	s.total += fsize
 
 	hSize := humanize.Bytes(uint64(fsize))
@@ -0,0 +1,81 @@
+package chunker
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ipfs/boxo/ipld/unixfs/importer/helpers"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multicodec"
+	mh "github.com/multiformats/go-multihash"
+)
+
+var ErrInvalidProfile = errors.New("invalid chunking profile")
+
+// Profile is how files are split into blocks and linked. Adding the same
+// file with the same profile always gives the same root CID.
+type Profile struct {
+	ChunkSize int64 `json:"chunkSize"`
+	// MaxLinks is the most links of a DAG node
+	MaxLinks int `json:"maxLinks"`
+	// RawLeaves stores file data in raw blocks instead of dag-pb wrapped ones
+	RawLeaves bool `json:"rawLeaves"`
+	// CidVersion and HashFunction make up the CID builder of dag-pb nodes
+	CidVersion   int    `json:"cidVersion"`
+	HashFunction string `json:"hashFunction"`
+}
+
+// DefaultProfile returns the profile used when none is set, CIDv1 with
+// sha2-256, raw leaves and 1MiB chunks
+func DefaultProfile() Profile {
+	return Profile{
+		ChunkSize:    Chunk1MiB,
+		MaxLinks:     helpers.DefaultLinksPerBlock,
+		RawLeaves:    true,
+		CidVersion:   1,
+		HashFunction: "sha2-256",
+	}
+}
+
+// Validate checks that the profile can be used to add files
+func (p Profile) Validate() error {
+	if p.ChunkSize <= 0 || p.ChunkSize > int64(maxChunkSize) {
+		return fmt.Errorf("%w: chunk size %d must be between 1 and %d", ErrInvalidProfile, p.ChunkSize, maxChunkSize)
+	}
+	if p.MaxLinks < 2 {
+		return fmt.Errorf("%w: max links %d must be at least 2", ErrInvalidProfile, p.MaxLinks)
+	}
+	if _, err := p.CidBuilder(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CidBuilder returns the builder of the CIDs of dag-pb nodes
+func (p Profile) CidBuilder() (cid.Builder, error) {
+	code, ok := mh.Names[p.HashFunction]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown hash function %q", ErrInvalidProfile, p.HashFunction)
+	}
+
+	switch p.CidVersion {
+	case 0:
+		// CIDv0 is always dag-pb sha2-256, raw leaves would need CIDv1
+		if code != mh.SHA2_256 || p.RawLeaves {
+			return nil, fmt.Errorf("%w: CIDv0 only supports sha2-256 without raw leaves", ErrInvalidProfile)
+		}
+		return cid.V0Builder{}, nil
+	case 1:
+		return cid.V1Builder{Codec: uint64(multicodec.DagPb), MhType: code, MhLength: -1}, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown CID version %d", ErrInvalidProfile, p.CidVersion)
+	}
+}
+
+// WithProfile adds files with the profile instead of the default one, its
+// chunk size wins over the one the adder was created with
+func WithProfile(p Profile) AdderOpt {
+	return func(a *adder) {
+		a.profile = &p
+	}
+}
@@ -0,0 +1,93 @@
+package chunker
+
+import (
+	"context"
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/sync"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestProfileValidate(t *testing.T) {
+	require.NoError(t, DefaultProfile().Validate())
+
+	v0 := DefaultProfile()
+	v0.CidVersion, v0.RawLeaves = 0, false
+	require.NoError(t, v0.Validate())
+
+	for _, modify := range []func(p *Profile){
+		func(p *Profile) { p.ChunkSize = 0 },
+		func(p *Profile) { p.ChunkSize = int64(maxChunkSize) + 1 },
+		func(p *Profile) { p.MaxLinks = 1 },
+		func(p *Profile) { p.CidVersion = 2 },
+		func(p *Profile) { p.HashFunction = "md5sum" },
+		func(p *Profile) { p.CidVersion = 0 },
+		func(p *Profile) { p.CidVersion, p.RawLeaves, p.HashFunction = 0, false, "blake2b-256" },
+	} {
+		p := DefaultProfile()
+		modify(&p)
+		require.ErrorIs(t, p.Validate(), ErrInvalidProfile, p)
+	}
+}
+
+func TestAddWithProfile(t *testing.T) {
+	fileBytes, err := createFile0to200k()
+	require.NoError(t, err)
+	testFilePath := path.Join(t.TempDir(), "testfile")
+	require.NoError(t, os.WriteFile(testFilePath, fileBytes, 0644))
+
+	add := func(opts ...AdderOpt) (*Result, error) {
+		bs := blockstore.NewBlockstore(sync.MutexWrap(datastore.NewMapDatastore()))
+		bsrv := blockservice.New(bs, offline.Exchange(bs))
+		return NewAdderBase(context.Background(), merkledag.NewDAGService(bsrv), Chunk1MiB, opts...).Add(testFilePath)
+	}
+
+	expected, err := add()
+	require.NoError(t, err)
+
+	t.Log("the default profile gives the same CIDs as no profile")
+	result, err := add(WithProfile(DefaultProfile()))
+	require.NoError(t, err)
+	require.Equal(t, expected.RootCid, result.RootCid)
+
+	t.Log("the chunk size of the profile wins")
+	small := DefaultProfile()
+	small.ChunkSize = 256 << 10
+	result, err = add(WithProfile(small))
+	require.NoError(t, err)
+	require.NotEqual(t, expected.RootCid, result.RootCid)
+	// five leaves and their parent
+	require.Len(t, result.Blocks, 6)
+
+	t.Log("CIDv0 without raw leaves")
+	v0 := small
+	v0.CidVersion, v0.RawLeaves = 0, false
+	result, err = add(WithProfile(v0))
+	require.NoError(t, err)
+	root, err := cid.Decode(result.RootCid)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), root.Version())
+
+	t.Log("another hash function")
+	blake := small
+	blake.HashFunction = "blake2b-256"
+	result, err = add(WithProfile(blake))
+	require.NoError(t, err)
+	root, err = cid.Decode(result.RootCid)
+	require.NoError(t, err)
+	require.Equal(t, uint64(mh.BLAKE2B_MIN+31), root.Prefix().MhType)
+
+	t.Log("an invalid profile fails the add")
+	invalid := DefaultProfile()
+	invalid.MaxLinks = 0
+	_, err = add(WithProfile(invalid))
+	require.ErrorIs(t, err, ErrInvalidProfile)
+}
@@ -0,0 +1,276 @@
+// Package compressds is a datastore wrapper that compresses values. Every
+// value starts with the codec it is stored with and its uncompressed size,
+// values that do not get smaller are stored raw.
+package compressds
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec is how a value is stored
+type Codec byte
+
+const (
+	Raw Codec = iota
+	Snappy
+	Zstd
+)
+
+func (c Codec) String() string {
+	switch c {
+	case Raw:
+		return "raw"
+	case Snappy:
+		return "snappy"
+	case Zstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("Codec(%d)", byte(c))
+	}
+}
+
+// ParseCodec returns the codec named s
+func ParseCodec(s string) (Codec, error) {
+	for _, c := range []Codec{Raw, Snappy, Zstd} {
+		if c.String() == s {
+			return c, nil
+		}
+	}
+	return Raw, fmt.Errorf("unknown codec %q", s)
+}
+
+var ErrCorrupt = errors.New("compressed value is corrupt")
+
+// MaxValueSize is the largest value that is compressed, larger ones are
+// stored raw. The size in the header of a compressed value is checked against
+// it before the value is decoded into a buffer of that size.
+const MaxValueSize = 256 << 20
+
+// decoder is shared, DecodeAll is safe for concurrent use
+var decoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxValueSize))
+
+// Datastore compresses the values of its child with its codec
+type Datastore struct {
+	child   ds.Batching
+	codec   Codec
+	encoder *zstd.Encoder
+}
+
+var _ ds.Batching = (*Datastore)(nil)
+var _ ds.PersistentDatastore = (*Datastore)(nil)
+
+// New wraps child, new values are compressed with codec. level is the zstd
+// level, zero is the default one.
+func New(child ds.Batching, codec Codec, level int) (*Datastore, error) {
+	d := &Datastore{child: child, codec: codec}
+
+	switch codec {
+	case Raw, Snappy:
+	case Zstd:
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		encoder, err := zstd.NewWriter(nil, opts...)
+		if err != nil {
+			return nil, err
+		}
+		d.encoder = encoder
+	default:
+		return nil, fmt.Errorf("unknown codec %s", codec)
+	}
+
+	return d, nil
+}
+
+// encode compresses value, it is stored raw if that is not smaller
+func (d *Datastore) encode(value []byte) []byte {
+	header := make([]byte, 1, 1+binary.MaxVarintLen64)
+	header = binary.AppendUvarint(header, uint64(len(value)))
+
+	var b []byte
+	switch {
+	case len(value) > MaxValueSize:
+	case d.codec == Snappy:
+		b = append(header, snappy.Encode(nil, value)...)
+	case d.codec == Zstd:
+		b = d.encoder.EncodeAll(value, header)
+	}
+
+	if b == nil || len(b) >= len(header)+len(value) {
+		header[0] = byte(Raw)
+		return append(header, value...)
+	}
+	b[0] = byte(d.codec)
+	return b
+}
+
+// parseHeader returns the codec and the uncompressed size of a stored value and the data after it
+func parseHeader(b []byte) (Codec, int, []byte, error) {
+	if len(b) < 2 {
+		return Raw, 0, nil, ErrCorrupt
+	}
+
+	size, n := binary.Uvarint(b[1:])
+	if n <= 0 {
+		return Raw, 0, nil, ErrCorrupt
+	}
+
+	codec, data := Codec(b[0]), b[1+n:]
+	if codec != Raw && size > MaxValueSize {
+		return Raw, 0, nil, fmt.Errorf("%w: size %d is above %d", ErrCorrupt, size, MaxValueSize)
+	}
+
+	return codec, int(size), data, nil
+}
+
+func decode(b []byte) ([]byte, error) {
+	codec, size, data, err := parseHeader(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var value []byte
+	switch codec {
+	case Raw:
+		value = data
+	case Snappy:
+		// the header of the snappy block has the size as well
+		if n, err := snappy.DecodedLen(data); err != nil || n != size {
+			return nil, fmt.Errorf("%w: snappy block does not have %d bytes", ErrCorrupt, size)
+		}
+		value, err = snappy.Decode(make([]byte, size), data)
+	case Zstd:
+		// the zstd frame has the size as well
+		var header zstd.Header
+		if err := header.Decode(data); err != nil || !header.HasFCS || header.FrameContentSize != uint64(size) {
+			return nil, fmt.Errorf("%w: zstd frame does not have %d bytes", ErrCorrupt, size)
+		}
+		value, err = decoder.DecodeAll(data, make([]byte, 0, size))
+	default:
+		return nil, fmt.Errorf("%w: unknown codec %d", ErrCorrupt, byte(codec))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCorrupt, err)
+	}
+	if len(value) != size {
+		return nil, fmt.Errorf("%w: %d bytes instead of %d", ErrCorrupt, len(value), size)
+	}
+
+	return value, nil
+}
+
+func (d *Datastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	return d.child.Put(ctx, key, d.encode(value))
+}
+
+func (d *Datastore) Delete(ctx context.Context, key ds.Key) error {
+	return d.child.Delete(ctx, key)
+}
+
+func (d *Datastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	b, err := d.child.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return decode(b)
+}
+
+func (d *Datastore) Has(ctx context.Context, key ds.Key) (bool, error) {
+	return d.child.Has(ctx, key)
+}
+
+// GetSize returns the uncompressed size from the header of the value
+func (d *Datastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	b, err := d.child.Get(ctx, key)
+	if err != nil {
+		return -1, err
+	}
+
+	_, size, _, err := parseHeader(b)
+	if err != nil {
+		return -1, err
+	}
+	return size, nil
+}
+
+// Query decompresses the values of the child, filters and orders apply to the uncompressed values
+func (d *Datastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	keysOnly := q.KeysOnly && !q.ReturnsSizes
+	results, err := d.child.Query(ctx, query.Query{Prefix: q.Prefix, KeysOnly: keysOnly})
+	if err != nil {
+		return nil, err
+	}
+
+	decoded := query.ResultsFromIterator(q, query.Iterator{
+		Next: func() (query.Result, bool) {
+			res, ok := results.NextSync()
+			if !ok || res.Error != nil || keysOnly {
+				return res, ok
+			}
+
+			entry := query.Entry{Key: res.Key, Expiration: res.Expiration}
+			if q.KeysOnly {
+				_, entry.Size, _, err = parseHeader(res.Value)
+			} else {
+				entry.Value, err = decode(res.Value)
+				entry.Size = len(entry.Value)
+			}
+			if err != nil {
+				return query.Result{Error: fmt.Errorf("decompress %s: %w", res.Key, err)}, true
+			}
+			return query.Result{Entry: entry}, true
+		},
+		Close: results.Close,
+	})
+
+	return query.NaiveQueryApply(q, decoded), nil
+}
+
+func (d *Datastore) Sync(ctx context.Context, prefix ds.Key) error {
+	return d.child.Sync(ctx, prefix)
+}
+
+// DiskUsage is the compressed size
+func (d *Datastore) DiskUsage(ctx context.Context) (uint64, error) {
+	return ds.DiskUsage(ctx, d.child)
+}
+
+func (d *Datastore) Batch(ctx context.Context) (ds.Batch, error) {
+	b, err := d.child.Batch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &batch{ds: d, child: b}, nil
+}
+
+func (d *Datastore) Close() error {
+	if d.encoder != nil {
+		_ = d.encoder.Close()
+	}
+	return d.child.Close()
+}
+
+type batch struct {
+	ds    *Datastore
+	child ds.Batch
+}
+
+func (b *batch) Put(ctx context.Context, key ds.Key, value []byte) error {
+	return b.child.Put(ctx, key, b.ds.encode(value))
+}
+
+func (b *batch) Delete(ctx context.Context, key ds.Key) error {
+	return b.child.Delete(ctx, key)
+}
+
+func (b *batch) Commit(ctx context.Context) error {
+	return b.child.Commit(ctx)
+}
@@ -0,0 +1,148 @@
+package compressds
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestDatastore(t *testing.T) {
+	for _, codec := range []Codec{Snappy, Zstd} {
+		t.Run(codec.String(), func(t *testing.T) {
+			ctx := context.Background()
+			child := dssync.MutexWrap(ds.NewMapDatastore())
+
+			d, err := New(child, codec, 0)
+			require.NoError(t, err)
+			defer d.Close()
+
+			key := ds.NewKey("/blocks/KEY")
+			value := bytes.Repeat([]byte("compressible "), 100)
+			require.NoError(t, d.Put(ctx, key, value))
+
+			stored, err := child.Get(ctx, key)
+			require.NoError(t, err)
+			require.Equal(t, byte(codec), stored[0])
+			require.Less(t, len(stored), len(value))
+
+			got, err := d.Get(ctx, key)
+			require.NoError(t, err)
+			require.Equal(t, value, got)
+
+			size, err := d.GetSize(ctx, key)
+			require.NoError(t, err)
+			require.Equal(t, len(value), size)
+
+			t.Log("incompressible values are stored raw")
+			random := make([]byte, 1000)
+			_, err = rand.Read(random)
+			require.NoError(t, err)
+			require.NoError(t, d.Put(ctx, ds.NewKey("/blocks/RANDOM"), random))
+
+			stored, err = child.Get(ctx, ds.NewKey("/blocks/RANDOM"))
+			require.NoError(t, err)
+			require.Equal(t, byte(Raw), stored[0])
+
+			got, err = d.Get(ctx, ds.NewKey("/blocks/RANDOM"))
+			require.NoError(t, err)
+			require.Equal(t, random, got)
+		})
+	}
+}
+
+func TestCodecChange(t *testing.T) {
+	ctx := context.Background()
+	child := dssync.MutexWrap(ds.NewMapDatastore())
+	value := bytes.Repeat([]byte("compressible "), 100)
+
+	d1, err := New(child, Snappy, 0)
+	require.NoError(t, err)
+	require.NoError(t, d1.Put(ctx, ds.NewKey("/snappy"), value))
+
+	d2, err := New(child, Zstd, 3)
+	require.NoError(t, err)
+	defer d2.Close()
+	require.NoError(t, d2.Put(ctx, ds.NewKey("/zstd"), value))
+
+	for _, key := range []string{"/snappy", "/zstd"} {
+		got, err := d2.Get(ctx, ds.NewKey(key))
+		require.NoError(t, err)
+		require.Equal(t, value, got)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	ctx := context.Background()
+	d, err := New(dssync.MutexWrap(ds.NewMapDatastore()), Zstd, 0)
+	require.NoError(t, err)
+	defer d.Close()
+
+	b, err := d.Batch(ctx)
+	require.NoError(t, err)
+	require.NoError(t, b.Put(ctx, ds.NewKey("/a"), bytes.Repeat([]byte("a"), 500)))
+	require.NoError(t, b.Put(ctx, ds.NewKey("/b"), []byte("b")))
+	require.NoError(t, b.Commit(ctx))
+
+	results, err := d.Query(ctx, query.Query{Orders: []query.Order{query.OrderByKey{}}})
+	require.NoError(t, err)
+	entries, err := results.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, bytes.Repeat([]byte("a"), 500), entries[0].Value)
+	require.Equal(t, []byte("b"), entries[1].Value)
+
+	results, err = d.Query(ctx, query.Query{KeysOnly: true, ReturnsSizes: true})
+	require.NoError(t, err)
+	entries, err = results.Rest()
+	require.NoError(t, err)
+	sizes := map[string]int{}
+	for _, e := range entries {
+		require.Nil(t, e.Value)
+		sizes[e.Key] = e.Size
+	}
+	require.Equal(t, map[string]int{"/a": 500, "/b": 1}, sizes)
+}
+
+func TestCorrupt(t *testing.T) {
+	ctx := context.Background()
+	child := dssync.MutexWrap(ds.NewMapDatastore())
+	d, err := New(child, Zstd, 0)
+	require.NoError(t, err)
+	defer d.Close()
+
+	require.NoError(t, child.Put(ctx, ds.NewKey("/short"), []byte{byte(Zstd)}))
+	_, err = d.Get(ctx, ds.NewKey("/short"))
+	require.ErrorIs(t, err, ErrCorrupt)
+
+	require.NoError(t, child.Put(ctx, ds.NewKey("/garbage"), []byte{byte(Zstd), 10, 1, 2, 3}))
+	_, err = d.Get(ctx, ds.NewKey("/garbage"))
+	require.ErrorIs(t, err, ErrCorrupt)
+
+	t.Log("a huge size in the header is rejected before it is allocated")
+	value := bytes.Repeat([]byte("value"), 1000)
+	for _, codec := range []Codec{Snappy, Zstd} {
+		d, err := New(child, codec, 0)
+		require.NoError(t, err)
+		b := d.encode(value)
+		require.Equal(t, byte(codec), b[0])
+		_, n := binary.Uvarint(b[1:])
+		data := b[1+n:]
+
+		for _, size := range []uint64{1 << 62, MaxValueSize, uint64(len(value)) + 1} {
+			header := binary.AppendUvarint([]byte{byte(codec)}, size)
+			require.NoError(t, child.Put(ctx, ds.NewKey("/huge"), append(header, data...)))
+			_, err = d.Get(ctx, ds.NewKey("/huge"))
+			require.ErrorIs(t, err, ErrCorrupt, "%s %d", codec, size)
+		}
+	}
+
+	t.Log("values above the max size are stored raw")
+	large := make([]byte, MaxValueSize+1)
+	require.Equal(t, byte(Raw), d.encode(large)[0])
+}
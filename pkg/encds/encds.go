@@ -0,0 +1,463 @@
+// Package encds is a datastore wrapper that encrypts values with AES-256-GCM.
+// Keys stay in plain text, every value records the id of the key it is
+// encrypted with, so the key can be rotated while the datastore is in use.
+package encds
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	logging "github.com/ipfs/go-log/v2"
+	"sync"
+)
+
+var log = logging.Logger("encds")
+
+// value format: version(1) | key id length(1) | key id | nonce | sealed value
+const version = 1
+
+// stateKey holds the id of the key all values are encrypted with, it differs
+// from the current key while a rotation is running. flatfs accepts it and it
+// can not collide with the base32 keys of blocks.
+var stateKey = ds.NewKey("/_ENCRYPTION_KEY")
+
+var (
+	ErrNotEncrypted = errors.New("datastore has values that are not encrypted")
+	ErrCorrupt      = errors.New("encrypted value is corrupt")
+)
+
+// Datastore encrypts the values of its child with the current key
+type Datastore struct {
+	child ds.Batching
+	keys  KeyProvider
+
+	// mu is held for reading by writes and for writing while a value is re-encrypted
+	mu      sync.RWMutex
+	current string
+
+	aeadMu sync.Mutex
+	aeads  map[string]cipher.AEAD
+
+	rotating bool
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+var _ ds.Batching = (*Datastore)(nil)
+var _ ds.PersistentDatastore = (*Datastore)(nil)
+
+// New wraps child, new values are encrypted with the key keyID of keys. If
+// the values of child are encrypted with another key, they are re-encrypted
+// with keyID in the background, the other key has to stay available until
+// that is done.
+func New(child ds.Batching, keys KeyProvider, keyID string) (*Datastore, error) {
+	return newDatastore(child, keys, keyID, false)
+}
+
+// NewReadOnly wraps child without writing to it, the values of child are not
+// re-encrypted and no key is recorded. Values encrypted with any key keys has
+// can be read.
+func NewReadOnly(child ds.Batching, keys KeyProvider, keyID string) (*Datastore, error) {
+	return newDatastore(child, keys, keyID, true)
+}
+
+func newDatastore(child ds.Batching, keys KeyProvider, keyID string, readOnly bool) (*Datastore, error) {
+	if len(keyID) == 0 || len(keyID) > 255 {
+		return nil, fmt.Errorf("invalid key id %q", keyID)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Datastore{
+		child:   child,
+		keys:    keys,
+		current: keyID,
+		aeads:   make(map[string]cipher.AEAD),
+		cancel:  cancel,
+	}
+	if _, err := d.aead(keyID); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	state, err := child.Get(ctx, stateKey)
+	switch {
+	case errors.Is(err, ds.ErrNotFound):
+		empty, err := d.empty(ctx)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		if !empty {
+			cancel()
+			return nil, ErrNotEncrypted
+		}
+		if readOnly {
+			break
+		}
+		if err := child.Put(ctx, stateKey, []byte(keyID)); err != nil {
+			cancel()
+			return nil, err
+		}
+	case err != nil:
+		cancel()
+		return nil, err
+	case string(state) != keyID && readOnly:
+		log.Infof("re-encryption of values of key %s with key %s is not finished", state, keyID)
+	case string(state) != keyID:
+		log.Infof("re-encrypting values of key %s with key %s", state, keyID)
+		d.rotating = true
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			if _, err := d.Reencrypt(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				log.Errorf("re-encrypt with key %s: %s", keyID, err)
+			}
+		}()
+	}
+
+	return d, nil
+}
+
+// KeyID returns the id of the key new values are encrypted with
+func (d *Datastore) KeyID() string {
+	return d.current
+}
+
+// Rotating returns true until all values are encrypted with the current key
+func (d *Datastore) Rotating() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.rotating
+}
+
+// Reencrypt encrypts every value that is encrypted with another key with the
+// current key, it returns how many were. It runs in the background when the
+// datastore is opened with a new key.
+func (d *Datastore) Reencrypt(ctx context.Context) (int, error) {
+	results, err := d.child.Query(ctx, query.Query{KeysOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer results.Close()
+
+	n := 0
+	for res := range results.Next() {
+		if res.Error != nil {
+			return n, res.Error
+		}
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+
+		key := ds.RawKey(res.Key)
+		if key == stateKey {
+			continue
+		}
+
+		ok, err := d.reencrypt(ctx, key)
+		if err != nil {
+			return n, fmt.Errorf("re-encrypt %s: %w", key, err)
+		}
+		if ok {
+			n++
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.child.Put(ctx, stateKey, []byte(d.current)); err != nil {
+		return n, err
+	}
+	d.rotating = false
+
+	return n, nil
+}
+
+// reencrypt encrypts the value of key with the current key, no write can happen in between
+func (d *Datastore) reencrypt(ctx context.Context, key ds.Key) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sealed, err := d.child.Get(ctx, key)
+	if errors.Is(err, ds.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	keyID, _, err := parseHeader(sealed)
+	if err != nil {
+		return false, err
+	}
+	if keyID == d.current {
+		return false, nil
+	}
+
+	value, err := d.open(key, sealed)
+	if err != nil {
+		return false, err
+	}
+	sealed, err = d.seal(key, value)
+	if err != nil {
+		return false, err
+	}
+
+	return true, d.child.Put(ctx, key, sealed)
+}
+
+func (d *Datastore) empty(ctx context.Context) (bool, error) {
+	results, err := d.child.Query(ctx, query.Query{KeysOnly: true, Limit: 1})
+	if err != nil {
+		return false, err
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		return false, err
+	}
+
+	return len(entries) == 0, nil
+}
+
+func (d *Datastore) aead(keyID string) (cipher.AEAD, error) {
+	d.aeadMu.Lock()
+	defer d.aeadMu.Unlock()
+
+	if aead, ok := d.aeads[keyID]; ok {
+		return aead, nil
+	}
+
+	key, err := d.keys.Key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	d.aeads[keyID] = aead
+	return aead, nil
+}
+
+// seal encrypts value with the current key, the datastore key is authenticated with it
+func (d *Datastore) seal(key ds.Key, value []byte) ([]byte, error) {
+	aead, err := d.aead(d.current)
+	if err != nil {
+		return nil, err
+	}
+
+	header := 2 + len(d.current)
+	b := make([]byte, header+aead.NonceSize(), header+aead.NonceSize()+len(value)+aead.Overhead())
+	b[0] = version
+	b[1] = byte(len(d.current))
+	copy(b[2:], d.current)
+	nonce := b[header:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(b, nonce, value, key.Bytes()), nil
+}
+
+func (d *Datastore) open(key ds.Key, sealed []byte) ([]byte, error) {
+	keyID, rest, err := parseHeader(sealed)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := d.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrCorrupt
+	}
+
+	value, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], key.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCorrupt, err)
+	}
+	return value, nil
+}
+
+// parseHeader returns the key id of a sealed value and the nonce and ciphertext after it
+func parseHeader(sealed []byte) (string, []byte, error) {
+	if len(sealed) < 2 || sealed[0] != version || len(sealed) < 2+int(sealed[1]) {
+		return "", nil, ErrCorrupt
+	}
+
+	n := 2 + int(sealed[1])
+	return string(sealed[2:n]), sealed[n:], nil
+}
+
+// sizeOf returns the size of the value sealed holds without decrypting it
+func (d *Datastore) sizeOf(sealed []byte) (int, error) {
+	keyID, rest, err := parseHeader(sealed)
+	if err != nil {
+		return -1, err
+	}
+	aead, err := d.aead(keyID)
+	if err != nil {
+		return -1, err
+	}
+
+	size := len(rest) - aead.NonceSize() - aead.Overhead()
+	if size < 0 {
+		return -1, ErrCorrupt
+	}
+	return size, nil
+}
+
+func (d *Datastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	sealed, err := d.seal(key, value)
+	if err != nil {
+		return err
+	}
+	return d.child.Put(ctx, key, sealed)
+}
+
+func (d *Datastore) Delete(ctx context.Context, key ds.Key) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.child.Delete(ctx, key)
+}
+
+func (d *Datastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	if key == stateKey {
+		return nil, ds.ErrNotFound
+	}
+
+	sealed, err := d.child.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return d.open(key, sealed)
+}
+
+func (d *Datastore) Has(ctx context.Context, key ds.Key) (bool, error) {
+	if key == stateKey {
+		return false, nil
+	}
+	return d.child.Has(ctx, key)
+}
+
+func (d *Datastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	if key == stateKey {
+		return -1, ds.ErrNotFound
+	}
+
+	sealed, err := d.child.Get(ctx, key)
+	if err != nil {
+		return -1, err
+	}
+	return d.sizeOf(sealed)
+}
+
+// Query decrypts the values of the child, filters and orders apply to the decrypted values
+func (d *Datastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	keysOnly := q.KeysOnly && !q.ReturnsSizes
+	results, err := d.child.Query(ctx, query.Query{Prefix: q.Prefix, KeysOnly: keysOnly})
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted := query.ResultsFromIterator(q, query.Iterator{
+		Next: func() (query.Result, bool) {
+			for {
+				res, ok := results.NextSync()
+				if !ok || res.Error != nil {
+					return res, ok
+				}
+				key := ds.RawKey(res.Key)
+				if key == stateKey {
+					continue
+				}
+				if keysOnly {
+					return res, true
+				}
+
+				entry := query.Entry{Key: res.Key, Expiration: res.Expiration}
+				if q.KeysOnly {
+					entry.Size, err = d.sizeOf(res.Value)
+				} else {
+					entry.Value, err = d.open(key, res.Value)
+					entry.Size = len(entry.Value)
+				}
+				if err != nil {
+					return query.Result{Error: fmt.Errorf("decrypt %s: %w", key, err)}, true
+				}
+				return query.Result{Entry: entry}, true
+			}
+		},
+		Close: results.Close,
+	})
+
+	return query.NaiveQueryApply(q, decrypted), nil
+}
+
+func (d *Datastore) Sync(ctx context.Context, prefix ds.Key) error {
+	return d.child.Sync(ctx, prefix)
+}
+
+func (d *Datastore) DiskUsage(ctx context.Context) (uint64, error) {
+	return ds.DiskUsage(ctx, d.child)
+}
+
+func (d *Datastore) Batch(ctx context.Context) (ds.Batch, error) {
+	b, err := d.child.Batch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &batch{ds: d, child: b}, nil
+}
+
+// Close stops a re-encryption, it resumes when the datastore is opened again with the same key
+func (d *Datastore) Close() error {
+	d.cancel()
+	d.wg.Wait()
+
+	return d.child.Close()
+}
+
+type batch struct {
+	ds    *Datastore
+	child ds.Batch
+}
+
+func (b *batch) Put(ctx context.Context, key ds.Key, value []byte) error {
+	b.ds.mu.RLock()
+	defer b.ds.mu.RUnlock()
+
+	sealed, err := b.ds.seal(key, value)
+	if err != nil {
+		return err
+	}
+	return b.child.Put(ctx, key, sealed)
+}
+
+func (b *batch) Delete(ctx context.Context, key ds.Key) error {
+	return b.child.Delete(ctx, key)
+}
+
+// Commit holds off a re-encryption, so it does not overwrite values of the batch
+func (b *batch) Commit(ctx context.Context) error {
+	b.ds.mu.RLock()
+	defer b.ds.mu.RUnlock()
+
+	return b.child.Commit(ctx)
+}
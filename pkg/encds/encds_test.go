@@ -0,0 +1,185 @@
+package encds
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mapKeys serves fixed keys
+type mapKeys map[string][]byte
+
+func (k mapKeys) Key(id string) ([]byte, error) {
+	key, ok := k[id]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return key, nil
+}
+
+func testKeys() mapKeys {
+	return mapKeys{
+		"k1": bytes.Repeat([]byte{1}, KeySize),
+		"k2": bytes.Repeat([]byte{2}, KeySize),
+	}
+}
+
+func TestDatastore(t *testing.T) {
+	ctx := context.Background()
+	child := dssync.MutexWrap(ds.NewMapDatastore())
+
+	d, err := New(child, testKeys(), "k1")
+	require.NoError(t, err)
+	defer d.Close()
+
+	key := ds.NewKey("/blocks/KEY")
+	require.NoError(t, d.Put(ctx, key, []byte("secret value")))
+
+	stored, err := child.Get(ctx, key)
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(stored, []byte("secret")), "values are not stored in plain text")
+
+	value, err := d.Get(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret value"), value)
+
+	size, err := d.GetSize(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, len("secret value"), size)
+
+	t.Log("a value moved to another key does not decrypt")
+	require.NoError(t, child.Put(ctx, ds.NewKey("/blocks/OTHER"), stored))
+	_, err = d.Get(ctx, ds.NewKey("/blocks/OTHER"))
+	require.ErrorIs(t, err, ErrCorrupt)
+	require.NoError(t, child.Delete(ctx, ds.NewKey("/blocks/OTHER")))
+
+	b, err := d.Batch(ctx)
+	require.NoError(t, err)
+	require.NoError(t, b.Put(ctx, ds.NewKey("/blocks/BATCH"), []byte("batched")))
+	require.NoError(t, b.Commit(ctx))
+
+	results, err := d.Query(ctx, query.Query{})
+	require.NoError(t, err)
+	entries, err := results.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 2, "the state key is hidden")
+	for _, e := range entries {
+		require.NotContains(t, e.Key, "ENCRYPTION")
+		require.Equal(t, len(e.Value), e.Size)
+	}
+
+	results, err = d.Query(ctx, query.Query{KeysOnly: true, ReturnsSizes: true, Orders: []query.Order{query.OrderByKey{}}})
+	require.NoError(t, err)
+	entries, err = results.Rest()
+	require.NoError(t, err)
+	require.Equal(t, "/blocks/BATCH", entries[0].Key)
+	require.Equal(t, len("batched"), entries[0].Size)
+}
+
+func TestNotEncrypted(t *testing.T) {
+	ctx := context.Background()
+	child := dssync.MutexWrap(ds.NewMapDatastore())
+	require.NoError(t, child.Put(ctx, ds.NewKey("/plain"), []byte("plain")))
+
+	_, err := New(child, testKeys(), "k1")
+	require.ErrorIs(t, err, ErrNotEncrypted)
+
+	_, err = New(dssync.MutexWrap(ds.NewMapDatastore()), testKeys(), "k3")
+	require.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestRotation(t *testing.T) {
+	ctx := context.Background()
+	child := dssync.MutexWrap(ds.NewMapDatastore())
+
+	d, err := New(child, testKeys(), "k1")
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, d.Put(ctx, ds.NewKey(fmt.Sprintf("/KEY%d", i)), []byte(fmt.Sprintf("value %d", i))))
+	}
+	require.NoError(t, d.Close())
+
+	d, err = New(child, testKeys(), "k2")
+	require.NoError(t, err)
+	defer d.Close()
+	d.wg.Wait()
+	require.False(t, d.Rotating())
+
+	n, err := d.Reencrypt(ctx)
+	require.NoError(t, err)
+	require.Zero(t, n, "all values were re-encrypted in the background")
+
+	keys := testKeys()
+	delete(keys, "k1")
+	d2, err := New(child, keys, "k2")
+	require.NoError(t, err)
+	defer d2.Close()
+
+	for i := 0; i < 20; i++ {
+		value, err := d2.Get(ctx, ds.NewKey(fmt.Sprintf("/KEY%d", i)))
+		require.NoError(t, err, "the old key is not needed anymore")
+		require.Equal(t, []byte(fmt.Sprintf("value %d", i)), value)
+	}
+}
+
+func TestKeyProviders(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, KeySize)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "disk-1.key"), []byte(hex.EncodeToString(key)+"\n"), 0o600))
+	got, err := (&FileKeyProvider{Dir: dir}).Key("disk-1")
+	require.NoError(t, err)
+	require.Equal(t, key, got)
+	_, err = (&FileKeyProvider{Dir: dir}).Key("disk-2")
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = (&FileKeyProvider{Dir: dir}).Key("../disk-1")
+	require.Error(t, err)
+
+	t.Setenv("TEST_KEY_DISK_1", hex.EncodeToString(key))
+	got, err = (&EnvKeyProvider{Prefix: "TEST_KEY_"}).Key("disk-1")
+	require.NoError(t, err)
+	require.Equal(t, key, got)
+
+	t.Setenv("TEST_KEY_SHORT", "0102")
+	_, err = (&EnvKeyProvider{Prefix: "TEST_KEY_"}).Key("short")
+	require.Error(t, err)
+}
+
+func TestNewReadOnly(t *testing.T) {
+	ctx := context.Background()
+	child := dssync.MutexWrap(ds.NewMapDatastore())
+
+	t.Log("an empty datastore is not marked as encrypted")
+	d, err := NewReadOnly(child, testKeys(), "k1")
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+	has, err := child.Has(ctx, stateKey)
+	require.NoError(t, err)
+	require.False(t, has)
+
+	d1, err := New(child, testKeys(), "k1")
+	require.NoError(t, err)
+	require.NoError(t, d1.Put(ctx, ds.NewKey("/key"), []byte("value")))
+	require.NoError(t, d1.Close())
+
+	t.Log("another key id does not start a re-encryption")
+	d2, err := NewReadOnly(child, testKeys(), "k2")
+	require.NoError(t, err)
+	defer d2.Close()
+	require.False(t, d2.Rotating())
+
+	value, err := d2.Get(ctx, ds.NewKey("/key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+	state, err := child.Get(ctx, stateKey)
+	require.NoError(t, err)
+	require.Equal(t, "k1", string(state))
+}
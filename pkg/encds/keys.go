@@ -0,0 +1,80 @@
+package encds
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeySize is the size of the AES-256 keys
+const KeySize = 32
+
+var ErrKeyNotFound = errors.New("encryption key not found")
+
+// KeyProvider returns the key with the given id
+type KeyProvider interface {
+	Key(id string) ([]byte, error)
+}
+
+// FileKeyProvider reads the key with id from the file <Dir>/<id>.key, which holds it hex encoded
+type FileKeyProvider struct {
+	Dir string
+}
+
+func (p *FileKeyProvider) Key(id string) ([]byte, error) {
+	if !filepath.IsLocal(id) || strings.ContainsRune(id, filepath.Separator) {
+		return nil, fmt.Errorf("invalid key id %q", id)
+	}
+
+	b, err := os.ReadFile(filepath.Join(p.Dir, id+".key"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s in %s", ErrKeyNotFound, id, p.Dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return parseKey(id, string(b))
+}
+
+// EnvKeyProvider reads the key with id hex encoded from the environment
+// variable Prefix followed by the id in upper case, other characters than
+// letters and digits become underscores
+type EnvKeyProvider struct {
+	Prefix string
+}
+
+func (p *EnvKeyProvider) Key(id string) ([]byte, error) {
+	name := p.Prefix + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, id)
+
+	s, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s in $%s", ErrKeyNotFound, id, name)
+	}
+
+	return parseKey(id, s)
+}
+
+func parseKey(id, s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("key %s is not hex encoded: %w", id, err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key %s has %d bytes instead of %d", id, len(key), KeySize)
+	}
+
+	return key, nil
+}
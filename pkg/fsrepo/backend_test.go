@@ -0,0 +1,110 @@
+package fsrepo
+
+import (
+	"context"
+	"encoding/json"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// backendTests are the datastore types besides flatfs and levelds, every one
+// of them gets the same spec and repo checks. What only one backend does is
+// tested in its own file.
+var backendTests = map[string]struct {
+	spec    func() DiskSpec
+	invalid []map[string]interface{}
+}{
+	"packds": {
+		spec: packDiskSpec,
+		invalid: []map[string]interface{}{
+			{"type": "packds"},
+			{"type": "packds", "path": "packs", "sync": "no"},
+			{"type": "packds", "path": "packs", "packSize": -1},
+			{"type": "packds", "path": "packs", "compactInterval": "-1s"},
+			{"type": "packds", "path": "packs", "compactRatio": 2.0},
+		},
+	},
+	"badgerds": {
+		spec: badgerDiskSpec,
+		invalid: []map[string]interface{}{
+			{"type": "badgerds"},
+			{"type": "badgerds", "path": "badger", "syncWrites": "yes"},
+			{"type": "badgerds", "path": "badger", "gcInterval": "often"},
+			{"type": "badgerds", "path": "badger", "gcInterval": "-1m"},
+			{"type": "badgerds", "path": "badger", "vlogFileSize": -1},
+		},
+	},
+	"pebbleds": {
+		spec: pebbleDiskSpec,
+		invalid: []map[string]interface{}{
+			{"type": "pebbleds"},
+			{"type": "pebbleds", "path": "pebble", "compression": "lz4"},
+			{"type": "pebbleds", "path": "pebble", "cacheSize": -1},
+			{"type": "pebbleds", "path": "pebble", "memTableSize": 1.5},
+			{"type": "pebbleds", "path": "pebble", "bytesPerSync": "1MB"},
+		},
+	},
+	"compress": {
+		spec: func() DiskSpec { return compressDiskSpec("zstd") },
+		invalid: []map[string]interface{}{
+			{"type": "compress"},
+			{"type": "compress", "algorithm": "lz4", "child": map[string]interface{}{"type": "mem"}},
+			{"type": "compress", "level": -1, "child": map[string]interface{}{"type": "mem"}},
+		},
+	},
+}
+
+func TestBackendDatastoreConfig(t *testing.T) {
+	for name, test := range backendTests {
+		t.Run(name, func(t *testing.T) {
+			dsc, err := AnyDatastoreConfig(test.spec())
+			require.NoError(t, err)
+
+			t.Log("the disk spec parses to the same disk spec")
+			var spec DiskSpec
+			require.NoError(t, json.Unmarshal(dsc.DiskSpec().Bytes(), &spec))
+			parsed, err := AnyDatastoreConfig(spec)
+			require.NoError(t, err)
+			require.Equal(t, dsc.DiskSpec().String(), parsed.DiskSpec().String())
+
+			for _, params := range test.invalid {
+				_, err := AnyDatastoreConfig(params)
+				require.Error(t, err, params)
+			}
+		})
+	}
+}
+
+func TestBackendRepo(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	key := ds.NewKey("/blocks/KEY")
+	// large enough to go to the badger value log
+	block := make([]byte, 64<<10)
+
+	for name, test := range backendTests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			path := t.TempDir()
+
+			r1, err := NewFSRepoWithSpec(path, test.spec())
+			require.NoError(t, err)
+			require.NoError(t, r1.Datastore().Put(ctx, key, block))
+			require.NoError(t, r1.Close())
+
+			t.Log("the repo opens again with the spec it was created with")
+			r2, err := Open(path, ExpectSpec(test.spec()))
+			require.NoError(t, err)
+			defer r2.Close()
+
+			value, err := r2.Datastore().Get(ctx, key)
+			require.NoError(t, err)
+			require.Equal(t, block, value)
+
+			require.NoError(t, r2.Datastore().Delete(ctx, key))
+			_, err = r2.Datastore().Get(ctx, key)
+			require.ErrorIs(t, err, ds.ErrNotFound)
+		})
+	}
+}
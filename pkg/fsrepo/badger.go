@@ -0,0 +1,110 @@
+package fsrepo
+
+import (
+	"fmt"
+	"github.com/dgraph-io/badger"
+	"github.com/dgraph-io/badger/options"
+	badgerds "github.com/ipfs/go-ds-badger"
+	"path/filepath"
+	"time"
+)
+
+type badgerDatastoreConfig struct {
+	path         string
+	syncWrites   bool
+	vlogFileSize int64
+	gcInterval   time.Duration
+}
+
+// BadgerDatastoreConfigParser parses a badgerds spec. syncWrites defaults to
+// true, vlogFileSize is in bytes and gcInterval is a duration like "15m", zero
+// turns the value log garbage collection off.
+func BadgerDatastoreConfigParser() ConfigFromMap {
+	return func(params map[string]interface{}) (DatastoreConfig, error) {
+		var c badgerDatastoreConfig
+		var ok bool
+		var err error
+
+		c.path, ok = params["path"].(string)
+		if !ok {
+			return nil, fmt.Errorf("'path' field is missing or not string")
+		}
+
+		c.syncWrites = true
+		if sw, found := params["syncWrites"]; found {
+			c.syncWrites, ok = sw.(bool)
+			if !ok {
+				return nil, fmt.Errorf("'syncWrites' field is not boolean")
+			}
+		}
+
+		if c.vlogFileSize, err = specInt(params, "vlogFileSize"); err != nil {
+			return nil, err
+		}
+
+		c.gcInterval = badgerds.DefaultOptions.GcInterval
+		if gc, found := params["gcInterval"]; found {
+			s, ok := gc.(string)
+			if !ok {
+				return nil, fmt.Errorf("'gcInterval' field is not a string")
+			}
+			if c.gcInterval, err = time.ParseDuration(s); err != nil {
+				return nil, fmt.Errorf("'gcInterval' field: %w", err)
+			}
+			if c.gcInterval < 0 {
+				return nil, fmt.Errorf("'gcInterval' field is negative")
+			}
+		}
+
+		return &c, nil
+	}
+}
+
+func (c *badgerDatastoreConfig) DiskSpec() DiskSpec {
+	return map[string]interface{}{
+		"type": "badgerds",
+		"path": c.path,
+	}
+}
+
+// Create opens the datastore, its value log garbage collection runs until it is closed
+func (c *badgerDatastoreConfig) Create(path string) (Datastore, error) {
+	return c.create(path, false)
+}
+
+// CreateReadOnly opens badger read-only, without garbage collection. badger
+// can not replay the value log of an open writer read-only, so this fails
+// while another process has the datastore open.
+func (c *badgerDatastoreConfig) CreateReadOnly(path string) (Datastore, error) {
+	d, err := c.create(path, true)
+	if err != nil {
+		return nil, err
+	}
+	return newReadOnlyDatastore(d), nil
+}
+
+func (c *badgerDatastoreConfig) create(path string, readOnly bool) (Datastore, error) {
+	p := c.path
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(path, p)
+	}
+
+	// blocks are larger than the value threshold, so they go to the value log
+	// and the LSM tree only keeps the keys
+	opts := badgerds.DefaultOptions
+	opts.Options = badger.DefaultOptions("")
+	opts.CompactL0OnClose = false
+	opts.Truncate = true
+	opts.ValueLogLoadingMode = options.FileIO
+	opts.SyncWrites = c.syncWrites
+	opts.GcInterval = c.gcInterval
+	if c.vlogFileSize != 0 {
+		opts.ValueLogFileSize = c.vlogFileSize
+	}
+	if readOnly {
+		opts.ReadOnly = true
+		opts.GcInterval = 0
+	}
+
+	return badgerds.NewDatastore(p, &opts)
+}
@@ -0,0 +1,57 @@
+package fsrepo
+
+import (
+	"github.com/stretchr/testify/require"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func badgerDiskSpec() DiskSpec {
+	return DiskSpec{
+		"type": "mount",
+		"mounts": []interface{}{
+			map[string]interface{}{
+				"mountpoint":   "/blocks",
+				"type":         "badgerds",
+				"path":         "badger",
+				"syncWrites":   false,
+				"vlogFileSize": 64 << 20,
+				"gcInterval":   "1m",
+			},
+			map[string]interface{}{
+				"mountpoint":  "/",
+				"type":        "levelds",
+				"path":        "datastore",
+				"compression": "none",
+			},
+		},
+	}
+}
+
+func TestBadgerGCStopsOnClose(t *testing.T) {
+	spec := badgerDiskSpec()
+	spec["mounts"].([]interface{})[0].(map[string]interface{})["gcInterval"] = "50ms"
+	r, err := NewFSRepoWithSpec(t.TempDir(), spec)
+	require.NoError(t, err)
+
+	t.Log("the value log garbage collection runs while the repo is open")
+	require.Eventually(t, badgerGCRunning, 5*time.Second, 10*time.Millisecond)
+
+	t.Log("closing the repo stops it")
+	require.NoError(t, r.Close())
+	require.Eventually(t, func() bool { return !badgerGCRunning() }, 5*time.Second, 10*time.Millisecond)
+}
+
+// badgerGCRunning tells if a goroutine runs the periodic garbage collection of go-ds-badger
+func badgerGCRunning() bool {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return strings.Contains(string(buf[:n]), "go-ds-badger.(*Datastore).periodicGC")
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
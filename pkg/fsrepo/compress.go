@@ -0,0 +1,80 @@
+package fsrepo
+
+import (
+	"fmt"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/compressds"
+)
+
+type compressDatastoreConfig struct {
+	child DatastoreConfig
+	codec compressds.Codec
+	level int
+}
+
+// CompressDatastoreConfig returns a compress DatastoreConfig from a spec. The
+// algorithm new values are compressed with is "zstd", the default, or
+// "snappy", level is the zstd level. Every value records how it is stored, so
+// the algorithm can change between opens.
+func CompressDatastoreConfig(params map[string]interface{}) (DatastoreConfig, error) {
+	childField, ok := params["child"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("'child' field is missing or not a map")
+	}
+	child, err := AnyDatastoreConfig(childField)
+	if err != nil {
+		return nil, err
+	}
+
+	c := compressDatastoreConfig{child: child, codec: compressds.Zstd}
+	switch algorithm := params["algorithm"]; algorithm {
+	case "zstd", nil:
+	case "snappy":
+		c.codec = compressds.Snappy
+	default:
+		return nil, fmt.Errorf("unrecognized value for algorithm: %v", algorithm)
+	}
+
+	level, err := specInt(params, "level")
+	if err != nil {
+		return nil, err
+	}
+	c.level = int(level)
+
+	return &c, nil
+}
+
+// DiskSpec leaves out the algorithm, values of any of them can be read
+func (c *compressDatastoreConfig) DiskSpec() DiskSpec {
+	return map[string]interface{}{
+		"type":  "compress",
+		"child": map[string]interface{}(c.child.DiskSpec()),
+	}
+}
+
+func (c *compressDatastoreConfig) Create(path string) (Datastore, error) {
+	child, err := c.child.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := compressds.New(child, c.codec, c.level)
+	if err != nil {
+		_ = child.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (c *compressDatastoreConfig) CreateReadOnly(path string) (Datastore, error) {
+	child, err := createReadOnly(c.child, path)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := compressds.New(child, c.codec, c.level)
+	if err != nil {
+		_ = child.Close()
+		return nil, err
+	}
+	return newReadOnlyDatastore(d), nil
+}
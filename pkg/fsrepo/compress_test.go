@@ -0,0 +1,51 @@
+package fsrepo
+
+import (
+	"bytes"
+	"context"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func compressDiskSpec(algorithm string) DiskSpec {
+	return DiskSpec{
+		"type":      "compress",
+		"algorithm": algorithm,
+		"child": map[string]interface{}{
+			"type":        "levelds",
+			"path":        "datastore",
+			"compression": "none",
+		},
+	}
+}
+
+func TestCompressDatastoreConfig(t *testing.T) {
+	dsc, err := AnyDatastoreConfig(compressDiskSpec("zstd"))
+	require.NoError(t, err)
+	require.Equal(t, `{"child":{"compression":"none","path":"datastore","type":"levelds"},"type":"compress"}`, dsc.DiskSpec().String())
+	require.Equal(t, []Mount{{Mountpoint: "/", Name: "levelds", Type: "levelds", Path: "datastore"}}, dsc.DiskSpec().Mounts())
+
+}
+
+func TestCompressAlgorithmChange(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir()
+	ctx := context.Background()
+	value := bytes.Repeat([]byte("compressible "), 100)
+
+	r1, err := NewFSRepoWithSpec(path, compressDiskSpec("snappy"))
+	require.NoError(t, err)
+	require.NoError(t, r1.Datastore().Put(ctx, ds.NewKey("/KEY"), value))
+	require.NoError(t, r1.Close())
+
+	t.Log("the algorithm is a runtime value, values of the old one still read")
+	r2, err := NewFSRepoWithSpec(path, compressDiskSpec("zstd"))
+	require.NoError(t, err)
+	defer r2.Close()
+	require.Equal(t, "zstd", r2.Spec()["algorithm"])
+
+	got, err := r2.Datastore().Get(ctx, ds.NewKey("/KEY"))
+	require.NoError(t, err)
+	require.Equal(t, value, got)
+}
@@ -5,7 +5,6 @@ import (
 	ds "github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/mount"
 	dssync "github.com/ipfs/go-datastore/sync"
-	"github.com/ipfs/go-ds-measure"
 	"sort"
 )
 
@@ -33,9 +32,11 @@ type DatastoreConfig interface {
 
 func init() {
 	datastores = map[string]ConfigFromMap{
-		"mount":   MountDatastoreConfig,
-		"mem":     MemDatastoreConfig,
-		"measure": MeasureDatastoreConfig,
+		"mount":     MountDatastoreConfig,
+		"mem":       MemDatastoreConfig,
+		"measure":   MeasureDatastoreConfig,
+		"encrypted": EncryptedDatastoreConfig,
+		"compress":  CompressDatastoreConfig,
 	}
 
 	if err := AddDatastoreConfigHandler("levelds", LevelDBDatastoreConfigParser()); err != nil {
@@ -45,6 +46,18 @@ func init() {
 	if err := AddDatastoreConfigHandler("flatfs", FlatFsDatastoreConfigParser()); err != nil {
 		panic(err)
 	}
+
+	if err := AddDatastoreConfigHandler("pebbleds", PebbleDatastoreConfigParser()); err != nil {
+		panic(err)
+	}
+
+	if err := AddDatastoreConfigHandler("badgerds", BadgerDatastoreConfigParser()); err != nil {
+		panic(err)
+	}
+
+	if err := AddDatastoreConfigHandler("packds", PackDatastoreConfigParser()); err != nil {
+		panic(err)
+	}
 }
 
 func AddDatastoreConfigHandler(name string, dsc ConfigFromMap) error {
@@ -146,6 +159,23 @@ func (c *mountDatastoreConfig) Create(path string) (Datastore, error) {
 	return mount.New(mounts), nil
 }
 
+// CreateReadOnly opens every mounted datastore read-only
+func (c *mountDatastoreConfig) CreateReadOnly(path string) (Datastore, error) {
+	mounts := make([]mount.Mount, len(c.mounts))
+	for i, m := range c.mounts {
+		ds, err := createReadOnly(m.ds, path)
+		if err != nil {
+			for _, opened := range mounts[:i] {
+				_ = opened.Datastore.Close()
+			}
+			return nil, err
+		}
+		mounts[i].Datastore = ds
+		mounts[i].Prefix = m.prefix
+	}
+	return mount.New(mounts), nil
+}
+
 type memDatastoreConfig struct {
 	cfg map[string]interface{}
 }
@@ -163,9 +193,16 @@ func (c *memDatastoreConfig) Create(string) (Datastore, error) {
 	return dssync.MutexWrap(ds.NewMapDatastore()), nil
 }
 
+func (c *memDatastoreConfig) CreateReadOnly(string) (Datastore, error) {
+	return newReadOnlyDatastore(dssync.MutexWrap(ds.NewMapDatastore())), nil
+}
+
 type measureDatastoreConfig struct {
 	child  DatastoreConfig
 	prefix string
+
+	// created is the datastore Create returned, its metrics are created by FSRepo.Measure
+	created *measuredDatastore
 }
 
 // MeasureDatastoreConfig returns a measure DatastoreConfig from a spec.
@@ -182,17 +219,27 @@ func MeasureDatastoreConfig(params map[string]interface{}) (DatastoreConfig, err
 	if !ok {
 		return nil, fmt.Errorf("'prefix' field was missing or not a string")
 	}
-	return &measureDatastoreConfig{child, prefix}, nil
+	return &measureDatastoreConfig{child: child, prefix: prefix}, nil
 }
 
 func (c *measureDatastoreConfig) DiskSpec() DiskSpec {
 	return c.child.DiskSpec()
 }
 
-func (c measureDatastoreConfig) Create(path string) (Datastore, error) {
+func (c *measureDatastoreConfig) Create(path string) (Datastore, error) {
 	child, err := c.child.Create(path)
 	if err != nil {
 		return nil, err
 	}
-	return measure.New(c.prefix, child), nil
+	c.created = newMeasuredDatastore(c.prefix, child)
+	return c.created, nil
+}
+
+func (c *measureDatastoreConfig) CreateReadOnly(path string) (Datastore, error) {
+	child, err := createReadOnly(c.child, path)
+	if err != nil {
+		return nil, err
+	}
+	c.created = newMeasuredDatastore(c.prefix, child)
+	return c.created, nil
 }
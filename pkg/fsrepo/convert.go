@@ -0,0 +1,444 @@
+package fsrepo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	lockfile "github.com/ipfs/go-fs-lock"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// convertDir holds the converted datastore and the replaced one until the conversion is done
+	convertDir = ".convert"
+	// convertStateFile records the conversion in progress, so it can be resumed
+	convertStateFile = "state"
+
+	convertBatchSize        = 1024
+	convertProgressInterval = 5 * time.Second
+)
+
+var (
+	ErrConversionPending = errors.New("datastore conversion is swapping datastores, run it again to finish")
+	ErrConvertMismatch   = errors.New("converted datastore does not match the source")
+)
+
+// ConvertProgress reports how far a conversion is
+type ConvertProgress struct {
+	// Keys is the number of keys of the source datastore
+	Keys   uint64
+	Copied uint64
+	// Skipped counts the keys a previous run copied already
+	Skipped uint64
+	// Pruned counts the keys a previous run copied that the source does not have anymore
+	Pruned uint64
+	Bytes  uint64
+	Done   bool
+}
+
+// convertState is persisted in the conversion directory
+type convertState struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Swapping bool   `json:"swapping"`
+}
+
+// Convert copies every key of the repo at repoPath into a new datastore built
+// from spec, checks that keys and sizes match, and replaces the datastore and
+// datastore_spec of the repo with it. The repo must not be open. An
+// interrupted conversion to the same spec resumes where it stopped, progress
+// is passed to fn, which may be nil.
+func Convert(ctx context.Context, repoPath string, spec DiskSpec, fn func(ConvertProgress)) (*ConvertProgress, error) {
+	dsc, err := AnyDatastoreConfig(spec)
+	if err != nil {
+		return nil, err
+	}
+	to := dsc.DiskSpec().String()
+	if err := localMounts(dsc.DiskSpec()); err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(repoPath, convertDir)
+	state, err := readConvertState(dir)
+	if err != nil {
+		return nil, err
+	}
+	if state != nil && state.Swapping {
+		if state.To != to {
+			return nil, fmt.Errorf("%w: to '%s'", ErrConversionPending, state.To)
+		}
+		return &ConvertProgress{Done: true}, swapDatastore(repoPath, state)
+	}
+
+	src, err := open(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	from, err := src.readSpec()
+	if err != nil {
+		return nil, err
+	}
+	if from == to {
+		return &ConvertProgress{Done: true}, nil
+	}
+	if err := localMounts(src.spec); err != nil {
+		return nil, err
+	}
+
+	if state == nil || state.To != to || state.From != from {
+		// a conversion to another spec, or leftovers of a finished one
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, err
+		}
+		state = &convertState{From: from, To: to}
+		if err := os.MkdirAll(filepath.Join(dir, "new"), 0o755); err != nil {
+			return nil, err
+		}
+		if err := writeConvertState(dir, state); err != nil {
+			return nil, err
+		}
+	}
+
+	dst, err := dsc.Create(filepath.Join(dir, "new"))
+	if err != nil {
+		return nil, err
+	}
+
+	progress, err := convert(ctx, src.Datastore(), dst, fn)
+	if err == nil {
+		err = dst.Sync(ctx, ds.NewKey("/"))
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return progress, err
+	}
+
+	// from here on the repo can only be opened once the swap is done
+	state.Swapping = true
+	if err := writeConvertState(dir, state); err != nil {
+		return progress, err
+	}
+	if err := src.Close(); err != nil {
+		return progress, err
+	}
+
+	if err := swapDatastore(repoPath, state); err != nil {
+		return progress, err
+	}
+
+	progress.Done = true
+	if fn != nil {
+		fn(*progress)
+	}
+	return progress, nil
+}
+
+// convert copies the keys of src that dst does not have with the same value
+// yet, drops the keys src does not have anymore, and verifies dst
+func convert(ctx context.Context, src, dst Datastore, fn func(ConvertProgress)) (*ConvertProgress, error) {
+	progress := &ConvertProgress{}
+
+	keys, err := CountKeys(ctx, src)
+	if err != nil {
+		return progress, err
+	}
+	progress.Keys = keys
+
+	results, err := src.Query(ctx, query.Query{KeysOnly: true})
+	if err != nil {
+		return progress, err
+	}
+	defer results.Close()
+
+	batch, err := dst.Batch(ctx)
+	if err != nil {
+		return progress, err
+	}
+	batched := 0
+
+	reported := time.Now()
+	for res := range results.Next() {
+		if err := ctx.Err(); err != nil {
+			return progress, err
+		}
+		if res.Error != nil {
+			return progress, res.Error
+		}
+		key := ds.NewKey(res.Key)
+
+		value, err := src.Get(ctx, key)
+		if err != nil {
+			return progress, fmt.Errorf("get %s: %w", key, err)
+		}
+
+		// the source may have changed since a previous run copied the key
+		if copied, err := dst.Get(ctx, key); err == nil && bytes.Equal(copied, value) {
+			progress.Skipped++
+		} else {
+			if err := batch.Put(ctx, key, value); err != nil {
+				return progress, fmt.Errorf("put %s: %w", key, err)
+			}
+			progress.Copied++
+			batched++
+		}
+		progress.Bytes += uint64(len(value))
+
+		if batched >= convertBatchSize {
+			if err := batch.Commit(ctx); err != nil {
+				return progress, err
+			}
+			if batch, err = dst.Batch(ctx); err != nil {
+				return progress, err
+			}
+			batched = 0
+		}
+
+		if fn != nil && time.Since(reported) >= convertProgressInterval {
+			reported = time.Now()
+			fn(*progress)
+		}
+	}
+
+	if err := batch.Commit(ctx); err != nil {
+		return progress, err
+	}
+
+	if err := pruneConvert(ctx, src, dst, progress); err != nil {
+		return progress, err
+	}
+
+	return progress, verifyConvert(ctx, src, dst, progress)
+}
+
+// pruneConvert deletes the keys of dst that were deleted from src after a previous run copied them
+func pruneConvert(ctx context.Context, src, dst Datastore, progress *ConvertProgress) error {
+	results, err := dst.Query(ctx, query.Query{KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		key := ds.NewKey(e.Key)
+		has, err := src.Has(ctx, key)
+		if err != nil {
+			return err
+		}
+		if has {
+			continue
+		}
+		if err := dst.Delete(ctx, key); err != nil {
+			return err
+		}
+		progress.Pruned++
+	}
+
+	return nil
+}
+
+// verifyConvert checks that dst has the keys of src, with the same sizes
+func verifyConvert(ctx context.Context, src, dst Datastore, progress *ConvertProgress) error {
+	results, err := dst.Query(ctx, query.Query{KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+
+	var keys, bytes uint64
+	for res := range results.Next() {
+		if res.Error != nil {
+			return res.Error
+		}
+		key := ds.NewKey(res.Key)
+
+		size, err := dst.GetSize(ctx, key)
+		if err != nil {
+			return err
+		}
+		srcSize, err := src.GetSize(ctx, key)
+		if errors.Is(err, ds.ErrNotFound) {
+			return fmt.Errorf("%w: %s is not in the source", ErrConvertMismatch, key)
+		}
+		if err != nil {
+			return err
+		}
+		if size != srcSize {
+			return fmt.Errorf("%w: %s has %d bytes instead of %d", ErrConvertMismatch, key, size, srcSize)
+		}
+		keys++
+		bytes += uint64(size)
+	}
+
+	if keys != progress.Keys {
+		return fmt.Errorf("%w: %d keys instead of %d", ErrConvertMismatch, keys, progress.Keys)
+	}
+	if bytes != progress.Bytes {
+		return fmt.Errorf("%w: %d bytes instead of %d", ErrConvertMismatch, bytes, progress.Bytes)
+	}
+
+	return nil
+}
+
+// CountKeys returns the number of keys of the datastore
+func CountKeys(ctx context.Context, d Datastore) (uint64, error) {
+	results, err := d.Query(ctx, query.Query{KeysOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer results.Close()
+
+	var n uint64
+	for res := range results.Next() {
+		if res.Error != nil {
+			return 0, res.Error
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// swapDatastore moves the old datastore directories aside, moves the converted
+// ones in their place and replaces datastore_spec. Every step can be repeated,
+// so an interrupted swap is finished by running it again.
+func swapDatastore(repoPath string, state *convertState) error {
+	lock, err := lockfile.Lock(repoPath, LockFile)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	var from, to DiskSpec
+	if err := json.Unmarshal([]byte(state.From), &from); err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(state.To), &to); err != nil {
+		return err
+	}
+
+	dir := filepath.Join(repoPath, convertDir)
+	for _, m := range from.Mounts() {
+		old := filepath.Join(dir, "old", m.Path)
+		if FileExists(old) || !FileExists(filepath.Join(repoPath, m.Path)) {
+			continue
+		}
+		if err := rename(filepath.Join(repoPath, m.Path), old); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range to.Mounts() {
+		staged := filepath.Join(dir, "new", m.Path)
+		if !FileExists(staged) {
+			continue
+		}
+		if err := rename(staged, filepath.Join(repoPath, m.Path)); err != nil {
+			return err
+		}
+	}
+
+	if err := writeSpec(repoPath, to); err != nil {
+		return err
+	}
+
+	// without its state the directory is removed by the next conversion
+	if err := os.Remove(filepath.Join(dir, convertStateFile)); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func rename(from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+// localMounts checks that every datastore of spec is in its own directory of the repo
+func localMounts(spec DiskSpec) error {
+	for _, m := range spec.Mounts() {
+		if !filepath.IsLocal(m.Path) || filepath.Clean(m.Path) == convertDir || filepath.Clean(m.Path) == migrateDir {
+			return fmt.Errorf("datastore path %q is not a directory of the repo", m.Path)
+		}
+	}
+
+	return nil
+}
+
+// convertPending returns true while a conversion is swapping the datastores of the repo
+func convertPending(repoPath string) (bool, error) {
+	state, err := readConvertState(filepath.Join(repoPath, convertDir))
+	if err != nil {
+		return false, err
+	}
+
+	return state != nil && state.Swapping, nil
+}
+
+func readConvertState(dir string) (*convertState, error) {
+	b, err := os.ReadFile(filepath.Join(dir, convertStateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state convertState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+func writeConvertState(dir string, state *convertState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return WriteFile(filepath.Join(dir, convertStateFile), b)
+}
+
+// writeSpec replaces datastore_spec atomically
+func writeSpec(repoPath string, spec DiskSpec) error {
+	return WriteFile(DatastoreSpec(repoPath), spec.Bytes())
+}
+
+// WriteFile replaces the file atomically, its data is synced before it is renamed over fn
+func WriteFile(fn string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(fn), filepath.Base(fn)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), fn)
+}
@@ -0,0 +1,164 @@
+package fsrepo
+
+import (
+	"context"
+	"fmt"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testConvertSpec() DiskSpec {
+	return DiskSpec{
+		"type": "mount",
+		"mounts": []interface{}{
+			map[string]interface{}{
+				"mountpoint": "/blocks",
+				"type":       "flatfs",
+				"path":       "blocks",
+				"shardFunc":  "/repo/flatfs/shard/v1/prefix/3",
+			},
+			map[string]interface{}{
+				"mountpoint":  "/",
+				"type":        "levelds",
+				"path":        "meta",
+				"compression": "none",
+			},
+		},
+	}
+}
+
+func putTestKeys(t *testing.T, path string, n int) {
+	r, err := NewFSRepo(path)
+	require.NoError(t, err)
+	defer r.Close()
+
+	ctx := context.Background()
+	for i := 0; i < n; i++ {
+		require.NoError(t, r.Datastore().Put(ctx, ds.NewKey(fmt.Sprintf("/blocks/KEY%d", i)), []byte(fmt.Sprintf("block %d", i))))
+		require.NoError(t, r.Datastore().Put(ctx, ds.NewKey(fmt.Sprintf("/meta/key%d", i)), []byte(fmt.Sprintf("meta %d", i))))
+	}
+}
+
+func requireTestKeys(t *testing.T, path string, n int) {
+	r, err := Open(path, ExpectSpec(testConvertSpec()))
+	require.NoError(t, err)
+	defer r.Close()
+
+	ctx := context.Background()
+	for i := 0; i < n; i++ {
+		value, err := r.Datastore().Get(ctx, ds.NewKey(fmt.Sprintf("/blocks/KEY%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("block %d", i), string(value))
+		value, err = r.Datastore().Get(ctx, ds.NewKey(fmt.Sprintf("/meta/key%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("meta %d", i), string(value))
+	}
+}
+
+func TestConvert(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir()
+	putTestKeys(t, path, 100)
+
+	progress, err := Convert(context.Background(), path, testConvertSpec(), nil)
+	require.NoError(t, err)
+	require.True(t, progress.Done)
+	require.EqualValues(t, 200, progress.Keys)
+	require.EqualValues(t, 200, progress.Copied)
+
+	requireTestKeys(t, path, 100)
+	require.NoDirExists(t, filepath.Join(path, convertDir))
+	require.NoDirExists(t, filepath.Join(path, "datastore"))
+
+	t.Log("converting to the same spec does nothing")
+	progress, err = Convert(context.Background(), path, testConvertSpec(), nil)
+	require.NoError(t, err)
+	require.True(t, progress.Done)
+	require.Zero(t, progress.Keys)
+}
+
+func TestConvertResumesCopy(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir()
+	putTestKeys(t, path, 50)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := Convert(ctx, path, testConvertSpec(), nil)
+	require.Error(t, err)
+	require.FileExists(t, filepath.Join(path, convertDir, convertStateFile))
+
+	// interrupted while copying, the repo is still usable
+	putTestKeys(t, path, 60)
+
+	progress, err := Convert(context.Background(), path, testConvertSpec(), nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 120, progress.Keys)
+	requireTestKeys(t, path, 60)
+}
+
+func TestConvertResumesSwap(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir()
+	putTestKeys(t, path, 20)
+
+	src, err := Open(path)
+	require.NoError(t, err)
+	from, err := src.readSpec()
+	require.NoError(t, err)
+
+	dsc, err := AnyDatastoreConfig(testConvertSpec())
+	require.NoError(t, err)
+	dir := filepath.Join(path, convertDir)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "new"), 0o755))
+	dst, err := dsc.Create(filepath.Join(dir, "new"))
+	require.NoError(t, err)
+	_, err = convert(context.Background(), src.Datastore(), dst, nil)
+	require.NoError(t, err)
+	require.NoError(t, dst.Close())
+	require.NoError(t, src.Close())
+
+	t.Log("interrupted after the old datastore was moved aside")
+	require.NoError(t, writeConvertState(dir, &convertState{From: from, To: dsc.DiskSpec().String(), Swapping: true}))
+	require.NoError(t, rename(filepath.Join(path, "blocks"), filepath.Join(dir, "old", "blocks")))
+
+	_, err = Open(path)
+	require.ErrorIs(t, err, ErrConversionPending)
+
+	_, err = Convert(context.Background(), path, DefaultDiskSpec(), nil)
+	require.ErrorIs(t, err, ErrConversionPending)
+
+	_, err = Convert(context.Background(), path, testConvertSpec(), nil)
+	require.NoError(t, err)
+	requireTestKeys(t, path, 20)
+}
+
+func TestConvertChangedSource(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	src := dssync.MutexWrap(ds.NewMapDatastore())
+	dst := dssync.MutexWrap(ds.NewMapDatastore())
+
+	t.Log("a previous run copied values the source changed or deleted since")
+	require.NoError(t, src.Put(ctx, ds.NewKey("/changed"), []byte("new value")))
+	require.NoError(t, src.Put(ctx, ds.NewKey("/same"), []byte("same")))
+	require.NoError(t, dst.Put(ctx, ds.NewKey("/changed"), []byte("old value")))
+	require.NoError(t, dst.Put(ctx, ds.NewKey("/same"), []byte("same")))
+	require.NoError(t, dst.Put(ctx, ds.NewKey("/deleted"), []byte("deleted")))
+
+	progress, err := convert(ctx, src, dst, nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, progress.Copied)
+	require.EqualValues(t, 1, progress.Skipped)
+	require.EqualValues(t, 1, progress.Pruned)
+
+	value, err := dst.Get(ctx, ds.NewKey("/changed"))
+	require.NoError(t, err)
+	require.Equal(t, "new value", string(value))
+	_, err = dst.Get(ctx, ds.NewKey("/deleted"))
+	require.ErrorIs(t, err, ds.ErrNotFound)
+}
@@ -0,0 +1,148 @@
+package fsrepo
+
+import (
+	"fmt"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/encds"
+)
+
+// KeyProviderFromMap creates a key provider from the keyProvider field of an encrypted spec
+type KeyProviderFromMap func(map[string]interface{}) (encds.KeyProvider, error)
+
+var keyProviders = map[string]KeyProviderFromMap{
+	"file": func(params map[string]interface{}) (encds.KeyProvider, error) {
+		dir, ok := params["dir"].(string)
+		if !ok {
+			return nil, fmt.Errorf("'dir' field of the file key provider is missing or not a string")
+		}
+		return &encds.FileKeyProvider{Dir: dir}, nil
+	},
+	"env": func(params map[string]interface{}) (encds.KeyProvider, error) {
+		prefix, ok := params["prefix"].(string)
+		if !ok {
+			prefix = "IPFSREPO_KEY_"
+		}
+		return &encds.EnvKeyProvider{Prefix: prefix}, nil
+	},
+}
+
+// AddKeyProviderHandler registers a key provider type for encrypted specs
+func AddKeyProviderHandler(name string, kp KeyProviderFromMap) error {
+	if _, ok := keyProviders[name]; ok {
+		return fmt.Errorf("key provider %s already registered", name)
+	}
+
+	keyProviders[name] = kp
+	return nil
+}
+
+type encryptedDatastoreConfig struct {
+	child    DatastoreConfig
+	keyID    string
+	provider map[string]interface{}
+	keys     encds.KeyProvider
+
+	// created is the datastore Create returned last
+	created *encds.Datastore
+}
+
+// EncryptedDatastoreConfig returns an encrypted DatastoreConfig from a spec.
+// The spec names the key new values are encrypted with in keyId, and where it
+// comes from in keyProvider. Opening a repo with another keyId rotates the key.
+func EncryptedDatastoreConfig(params map[string]interface{}) (DatastoreConfig, error) {
+	childField, ok := params["child"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("'child' field is missing or not a map")
+	}
+	child, err := AnyDatastoreConfig(childField)
+	if err != nil {
+		return nil, err
+	}
+
+	keyID, ok := params["keyId"].(string)
+	if !ok {
+		return nil, fmt.Errorf("'keyId' field is missing or not a string")
+	}
+
+	provider, ok := params["keyProvider"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("'keyProvider' field is missing or not a map")
+	}
+	which, ok := provider["type"].(string)
+	if !ok {
+		return nil, fmt.Errorf("'type' field of the key provider is missing or not a string")
+	}
+	fun, ok := keyProviders[which]
+	if !ok {
+		return nil, fmt.Errorf("unknown key provider type: %s", which)
+	}
+	keys, err := fun(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptedDatastoreConfig{child: child, keyID: keyID, provider: provider, keys: keys}, nil
+}
+
+// DiskSpec records the key id, and the key provider so the repo can be opened from it
+func (c *encryptedDatastoreConfig) DiskSpec() DiskSpec {
+	return map[string]interface{}{
+		"type":        "encrypted",
+		"keyId":       c.keyID,
+		"keyProvider": c.provider,
+		"child":       map[string]interface{}(c.child.DiskSpec()),
+	}
+}
+
+func (c *encryptedDatastoreConfig) Create(path string) (Datastore, error) {
+	child, err := c.child.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := encds.New(child, c.keys, c.keyID)
+	if err != nil {
+		_ = child.Close()
+		return nil, err
+	}
+	c.created = d
+	return d, nil
+}
+
+// CreateReadOnly does not record the key and does not re-encrypt, values of any available key can be read
+func (c *encryptedDatastoreConfig) CreateReadOnly(path string) (Datastore, error) {
+	child, err := createReadOnly(c.child, path)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := encds.NewReadOnly(child, c.keys, c.keyID)
+	if err != nil {
+		_ = child.Close()
+		return nil, err
+	}
+	c.created = d
+	return newReadOnlyDatastore(d), nil
+}
+
+// encryptedDatastores returns the encrypted datastores created from dsc
+func encryptedDatastores(dsc DatastoreConfig) []*encds.Datastore {
+	switch c := dsc.(type) {
+	case *mountDatastoreConfig:
+		var created []*encds.Datastore
+		for _, m := range c.mounts {
+			created = append(created, encryptedDatastores(m.ds)...)
+		}
+		return created
+	case *measureDatastoreConfig:
+		return encryptedDatastores(c.child)
+	case *compressDatastoreConfig:
+		return encryptedDatastores(c.child)
+	case *encryptedDatastoreConfig:
+		if c.created == nil {
+			return nil
+		}
+		return []*encds.Datastore{c.created}
+	}
+
+	return nil
+}
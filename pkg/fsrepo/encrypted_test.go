@@ -0,0 +1,101 @@
+package fsrepo
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/encds"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func encryptedDiskSpec(keyDir, keyID string) DiskSpec {
+	return DiskSpec{
+		"type": "mount",
+		"mounts": []interface{}{
+			map[string]interface{}{
+				"mountpoint":  "/blocks",
+				"type":        "encrypted",
+				"keyId":       keyID,
+				"keyProvider": map[string]interface{}{"type": "file", "dir": keyDir},
+				"child": map[string]interface{}{
+					"type":      "flatfs",
+					"path":      "blocks",
+					"shardFunc": "/repo/flatfs/shard/v1/next-to-last/2",
+				},
+			},
+			map[string]interface{}{
+				"mountpoint":  "/",
+				"type":        "levelds",
+				"path":        "datastore",
+				"compression": "none",
+			},
+		},
+	}
+}
+
+func writeTestKey(t *testing.T, dir, id string, b byte) {
+	key := hex.EncodeToString(bytes.Repeat([]byte{b}, encds.KeySize))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, id+".key"), []byte(key), 0o600))
+}
+
+func TestEncryptedRepo(t *testing.T) {
+	t.Parallel()
+	path, keyDir := t.TempDir(), t.TempDir()
+	ctx := context.Background()
+	writeTestKey(t, keyDir, "k1", 1)
+	writeTestKey(t, keyDir, "k2", 2)
+
+	r1, err := NewFSRepoWithSpec(path, encryptedDiskSpec(keyDir, "k1"))
+	require.NoError(t, err)
+	require.Len(t, r1.Spec().Mounts(), 2)
+	require.NoError(t, r1.Datastore().Put(ctx, ds.NewKey("/blocks/KEY"), []byte("secret block")))
+	require.NoError(t, r1.Close())
+
+	diskSpec, err := os.ReadFile(DatastoreSpec(path))
+	require.NoError(t, err)
+	require.Contains(t, string(diskSpec), `"keyId":"k1"`)
+
+	t.Log("opening with another key id rotates the key and records it")
+	r2, err := NewFSRepoWithSpec(path, encryptedDiskSpec(keyDir, "k2"))
+	require.NoError(t, err)
+	value, err := r2.Datastore().Get(ctx, ds.NewKey("/blocks/KEY"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret block"), value)
+	require.Eventually(t, func() bool { return !r2.Rotating() }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, r2.Close())
+
+	diskSpec, err = os.ReadFile(DatastoreSpec(path))
+	require.NoError(t, err)
+	require.Contains(t, string(diskSpec), `"keyId":"k2"`)
+
+	t.Log("the old key is not needed once the values are re-encrypted")
+	require.NoError(t, os.Remove(filepath.Join(keyDir, "k1.key")))
+	r3, err := Open(path)
+	require.NoError(t, err)
+	defer r3.Close()
+	value, err = r3.Datastore().Get(ctx, ds.NewKey("/blocks/KEY"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret block"), value)
+
+	t.Log("without the key the repo does not open")
+	require.NoError(t, r3.Close())
+	require.NoError(t, os.Remove(filepath.Join(keyDir, "k2.key")))
+	_, err = Open(path)
+	require.ErrorIs(t, err, encds.ErrKeyNotFound)
+
+	files, err := os.ReadDir(filepath.Join(path, "blocks"))
+	require.NoError(t, err)
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".data") {
+			b, err := os.ReadFile(filepath.Join(path, "blocks", f.Name()))
+			require.NoError(t, err)
+			require.NotContains(t, string(b), "secret")
+		}
+	}
+}
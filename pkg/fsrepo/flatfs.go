@@ -1,9 +1,15 @@
 package fsrepo
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
 	flatfs "github.com/ipfs/go-ds-flatfs"
+	"os"
 	"path/filepath"
+	"strings"
 )
 
 type flatFsDatastoreConfig struct {
@@ -49,10 +55,178 @@ func FlatFsDatastoreConfigParser() ConfigFromMap {
 			return nil, err
 		}
 
-		c.syncField, ok = params["sync"].(bool)
-		if !ok {
-			return nil, fmt.Errorf("'sync' field is missing or not boolean")
+		// sync is not part of the disk spec, it is missing when opening from the spec on disk
+		c.syncField = true
+		if sync, found := params["sync"]; found {
+			c.syncField, ok = sync.(bool)
+			if !ok {
+				return nil, fmt.Errorf("'sync' field is not boolean")
+			}
 		}
 		return &c, nil
 	}
 }
+
+// CreateReadOnly reads the flatfs directory directly. flatfs.Open clears the
+// temporary directory of the writer and computes the disk usage, neither is
+// safe while another process has the datastore open, and flatfs has no way
+// around them. Only the key to file mapping of flatfs is repeated here.
+func (c *flatFsDatastoreConfig) CreateReadOnly(path string) (Datastore, error) {
+	p := c.path
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(path, p)
+	}
+
+	shardFun, err := flatfs.ReadShardFunc(p)
+	if err != nil {
+		return nil, err
+	}
+	if shardFun.String() != c.shardFun.String() {
+		return nil, fmt.Errorf("flatfs %s is sharded with %s instead of %s", p, shardFun, c.shardFun)
+	}
+
+	return newReadOnlyDatastore(&flatFsReader{path: p, getDir: shardFun.Func()}), nil
+}
+
+// flatFsReader reads the values of a flatfs directory, every key is a file in its shard directory
+type flatFsReader struct {
+	path   string
+	getDir flatfs.ShardFunc
+}
+
+const flatFsExtension = ".data"
+
+func (r *flatFsReader) file(key ds.Key) string {
+	noslash := key.String()[1:]
+	return filepath.Join(r.path, r.getDir(noslash), noslash+flatFsExtension)
+}
+
+func (r *flatFsReader) Get(_ context.Context, key ds.Key) ([]byte, error) {
+	b, err := os.ReadFile(r.file(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ds.ErrNotFound
+	}
+	return b, err
+}
+
+func (r *flatFsReader) Has(ctx context.Context, key ds.Key) (bool, error) {
+	_, err := r.GetSize(ctx, key)
+	if errors.Is(err, ds.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *flatFsReader) GetSize(_ context.Context, key ds.Key) (int, error) {
+	fi, err := os.Stat(r.file(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return -1, ds.ErrNotFound
+	}
+	if err != nil {
+		return -1, err
+	}
+	return int(fi.Size()), nil
+}
+
+// Query lists the shard directories, keys written while it runs may or may not show up
+func (r *flatFsReader) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	shards, err := os.ReadDir(r.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []os.DirEntry
+	var dir string
+	results := query.ResultsFromIterator(q, query.Iterator{
+		Next: func() (query.Result, bool) {
+			for {
+				if len(files) == 0 {
+					if len(shards) == 0 {
+						return query.Result{}, false
+					}
+					shard := shards[0]
+					shards = shards[1:]
+					if !shard.IsDir() || strings.HasPrefix(shard.Name(), ".") {
+						continue
+					}
+					dir = filepath.Join(r.path, shard.Name())
+					if files, err = os.ReadDir(dir); err != nil {
+						return query.Result{Error: err}, true
+					}
+					continue
+				}
+
+				f := files[0]
+				files = files[1:]
+				name, ok := strings.CutSuffix(f.Name(), flatFsExtension)
+				if !ok || f.IsDir() {
+					continue
+				}
+
+				entry := query.Entry{Key: "/" + name, Size: -1}
+				if !q.KeysOnly {
+					entry.Value, err = os.ReadFile(filepath.Join(dir, f.Name()))
+					entry.Size = len(entry.Value)
+				} else if q.ReturnsSizes {
+					var fi os.FileInfo
+					if fi, err = f.Info(); err == nil {
+						entry.Size = int(fi.Size())
+					}
+				}
+				if errors.Is(err, os.ErrNotExist) {
+					// deleted by the writer
+					continue
+				}
+				if err != nil {
+					return query.Result{Error: err}, true
+				}
+				return query.Result{Entry: entry}, true
+			}
+		},
+	})
+
+	return query.NaiveQueryApply(q, results), nil
+}
+
+// DiskUsage walks the directory, the usage flatfs keeps is not read
+func (r *flatFsReader) DiskUsage(context.Context) (uint64, error) {
+	var usage uint64
+	err := filepath.WalkDir(r.path, func(_ string, d os.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		fi, err := d.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		usage += uint64(fi.Size())
+		return nil
+	})
+	return usage, err
+}
+
+func (r *flatFsReader) Put(context.Context, ds.Key, []byte) error {
+	return ErrReadOnly
+}
+
+func (r *flatFsReader) Delete(context.Context, ds.Key) error {
+	return ErrReadOnly
+}
+
+func (r *flatFsReader) Sync(context.Context, ds.Key) error {
+	return nil
+}
+
+func (r *flatFsReader) Batch(context.Context) (ds.Batch, error) {
+	return nil, ErrReadOnly
+}
+
+func (r *flatFsReader) Close() error {
+	return nil
+}
@@ -2,10 +2,10 @@ package fsrepo
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	ds "github.com/ipfs/go-datastore"
-	measure "github.com/ipfs/go-ds-measure"
 	lockfile "github.com/ipfs/go-fs-lock"
 	"github.com/mitchellh/go-homedir"
 	"io"
@@ -17,12 +17,85 @@ import (
 
 const LockFile = "hificloud.repo.lock"
 
+var ErrSpecMismatch = errors.New("datastore spec does not match")
+
+// OpenOption configures how a repo is opened
+type OpenOption func(*openOptions)
+
+type openOptions struct {
+	runtime    DiskSpec
+	expect     DiskSpec
+	readOnly   bool
+	unmeasured bool
+}
+
+// RuntimeSpec is used instead of the spec on disk when both describe the same
+// disk layout, it adds runtime values like measure wrappers. DefaultDiskSpec is
+// used if none is given.
+func RuntimeSpec(spec DiskSpec) OpenOption {
+	return func(o *openOptions) {
+		o.runtime = spec
+	}
+}
+
+// ExpectSpec makes open fail with ErrSpecMismatch unless the spec on disk describes the same layout as spec
+func ExpectSpec(spec DiskSpec) OpenOption {
+	return func(o *openOptions) {
+		o.expect = spec
+	}
+}
+
+// ReadOnly opens the repo without its lock and without writing to it, so it
+// can be inspected while another process has it open, or on a read-only
+// mount. The datastores are opened read-only and writes fail with
+// ErrReadOnly. A repo that needs a migration can not be opened read-only.
+//
+// What a read-only repo sees of a running writer depends on its datastores:
+//   - flatfs reads the files of the writer, so every write is seen
+//   - levelds and pebbleds see the writes up to the open, they are opened
+//     again when the writer compacted away a table they read
+//   - badgerds can only be opened once the writer closed it
+//   - packds fails with ErrReadOnlyUnsupported
+//
+// mount, measure, encrypted and compress open their children read-only.
+func ReadOnly() OpenOption {
+	return func(o *openOptions) {
+		o.readOnly = true
+	}
+}
+
+// Unmeasured opens the datastores without metrics, they are created by
+// Measure. It lets the metrics get labels that are only known once the repo
+// is open, without opening it again.
+func Unmeasured() OpenOption {
+	return func(o *openOptions) {
+		o.unmeasured = true
+	}
+}
+
 type Storage interface {
 	Datastore() Datastore
 	GetStorageUsage(ctx context.Context) (uint64, error)
 	Close() error
 }
 
+// SpecStorage is implemented by storages kept in a directory, like FSRepo. It
+// returns the directory and the spec the datastore was created from.
+type SpecStorage interface {
+	Path() string
+	Spec() DiskSpec
+}
+
+// MeasuredStorage is implemented by storages whose datastore metrics are
+// created once they are open, see Unmeasured
+type MeasuredStorage interface {
+	Measure(labels map[string]string)
+}
+
+var _ Storage = (*FSRepo)(nil)
+var _ SpecStorage = (*FSRepo)(nil)
+var _ MeasuredStorage = (*FSRepo)(nil)
+
 type FSRepo struct {
 	locker sync.Mutex
 
@@ -33,19 +106,28 @@ type FSRepo struct {
 	path string
 
 	// lockfile is the file system lock to prevent others from opening
-	// the same fsrepo path concurrently
+	// the same fsrepo path concurrently, it is nil if the repo is read-only
 	lockfile io.Closer
+	readOnly bool
 
 	ds Datastore
+
+	// spec is the spec the datastore was created from, the runtime spec if it matched the disk
+	spec DiskSpec
+	dsc  DatastoreConfig
+
+	// measured are the measure wrappers of the datastore, the outermost one last
+	measured []*measuredDatastore
 }
 
-func NewFSRepo(repoPath string) (*FSRepo, error) {
+// NewFSRepo initializes the repo with DefaultDiskSpec if it has no spec yet, and opens it
+func NewFSRepo(repoPath string, opts ...OpenOption) (*FSRepo, error) {
 
 	if err := Init(repoPath); err != nil {
 		return nil, err
 	}
 
-	reposrv, err := open(repoPath)
+	reposrv, err := open(repoPath, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -53,6 +135,21 @@ func NewFSRepo(repoPath string) (*FSRepo, error) {
 	return reposrv, nil
 }
 
+// NewFSRepoWithSpec initializes the repo with spec if it has no spec yet, and
+// opens it. spec is also used as runtime spec, so its measure wrappers apply.
+func NewFSRepoWithSpec(repoPath string, spec DiskSpec, opts ...OpenOption) (*FSRepo, error) {
+	if err := initSpec(repoPath, spec); err != nil {
+		return nil, err
+	}
+
+	return open(repoPath, append([]OpenOption{RuntimeSpec(spec)}, opts...)...)
+}
+
+// Open opens an initialized repo with the datastore described by its datastore_spec
+func Open(repoPath string, opts ...OpenOption) (*FSRepo, error) {
+	return open(repoPath, opts...)
+}
+
 func (r *FSRepo) Datastore() Datastore {
 	r.locker.Lock()
 	defer r.locker.Unlock()
@@ -65,6 +162,27 @@ func (r *FSRepo) Path() string {
 	return r.path
 }
 
+// Spec returns the spec the datastore was created from, including runtime values like measure prefixes
+func (r *FSRepo) Spec() DiskSpec {
+	return r.spec
+}
+
+// ReadOnly returns true if the repo was opened with the ReadOnly option
+func (r *FSRepo) ReadOnly() bool {
+	return r.readOnly
+}
+
+// Rotating returns true while values of encrypted datastores are re-encrypted with a new key
+func (r *FSRepo) Rotating() bool {
+	for _, d := range encryptedDatastores(r.dsc) {
+		if d.Rotating() {
+			return true
+		}
+	}
+
+	return false
+}
+
 // GetStorageUsage computes the storage space taken by the repo in bytes.
 func (r *FSRepo) GetStorageUsage(ctx context.Context) (uint64, error) {
 	return ds.DiskUsage(ctx, r.Datastore())
@@ -84,6 +202,9 @@ func (r *FSRepo) Close() error {
 	}
 
 	r.closed = true
+	if r.lockfile == nil {
+		return nil
+	}
 	return r.lockfile.Close()
 }
 
@@ -96,35 +217,126 @@ func (r *FSRepo) readSpec() (string, error) {
 	return strings.TrimSpace(string(b)), nil
 }
 
-// openDatastore returns an error if the config file is not present.
-func (r *FSRepo) openDatastore() error {
-	dsc, err := AnyDatastoreConfig(DefaultDiskSpec())
+// createDatastore creates the datastore from the spec on disk as it is,
+// without metrics. Migrations use it before the repo is opened.
+func (r *FSRepo) createDatastore() (Datastore, error) {
+	diskSpec, err := r.readSpec()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	spec := dsc.DiskSpec()
 
-	oldSpec, err := r.readSpec()
+	_, dsc, _, err := datastoreConfig(diskSpec, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return dsc.Create(r.path)
+}
+
+// openDatastore creates the datastore from the spec on disk, it returns an
+// error if the spec file is not present.
+func (r *FSRepo) openDatastore(o *openOptions) error {
+	diskSpec, err := r.readSpec()
 	if err != nil {
 		return err
 	}
-	if oldSpec != spec.String() {
-		return fmt.Errorf("datastore configuration of '%s' does not match what is on disk '%s'",
-			oldSpec, spec.String())
+
+	if o.expect != nil {
+		expected, err := AnyDatastoreConfig(o.expect)
+		if err != nil {
+			return err
+		}
+		if expected.DiskSpec().String() != diskSpec {
+			return fmt.Errorf("%w: expected '%s', found '%s' on disk", ErrSpecMismatch, expected.DiskSpec().String(), diskSpec)
+		}
 	}
 
-	d, err := dsc.Create(r.path)
+	spec, dsc, rewrite, err := datastoreConfig(diskSpec, o.runtime)
 	if err != nil {
 		return err
 	}
-	r.ds = d
+	if rewrite && o.readOnly {
+		// the spec on disk can not be updated, it is used as it is
+		spec, dsc, _, err = datastoreConfig(diskSpec, nil)
+		if err != nil {
+			return err
+		}
+		rewrite = false
+	}
 
+	var d Datastore
+	if o.readOnly {
+		d, err = createReadOnly(dsc, r.path)
+	} else {
+		d, err = dsc.Create(r.path)
+	}
+	if err != nil {
+		return err
+	}
+	if rewrite {
+		// new keys or leveldb options are in use, values with old keys are re-encrypted in the background
+		if err := writeSpec(r.path, dsc.DiskSpec()); err != nil {
+			_ = d.Close()
+			return err
+		}
+	}
 	// Wrap it with metrics gathering
-	prefix := "ipfs.fsrepo.datastore"
-	r.ds = measure.New(prefix, r.ds)
+	measured := newMeasuredDatastore(datastoreMetricsPrefix, d)
+	r.ds = measured
+	r.spec = spec
+	r.dsc = dsc
+	r.measured = append(measuredDatastores(dsc), measured)
+	if !o.unmeasured {
+		r.measure(nil)
+	}
 
 	return nil
 }
+
+// Measure creates the metrics of the datastore with the given labels, the
+// ones of the measure datastores of its spec too. A repo opened without
+// Unmeasured has metrics without labels already, they are replaced.
+func (r *FSRepo) Measure(labels map[string]string) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	r.measure(labels)
+}
+
+func (r *FSRepo) measure(labels map[string]string) {
+	for _, d := range r.measured {
+		d.measure(labels)
+	}
+}
+
+// datastoreConfig returns the runtime spec if it describes the same disk layout
+// as diskSpec, so its runtime values like measure prefixes are kept. Otherwise
+// the datastore is built from diskSpec alone. rewrite is true if the runtime
+// spec only differs in the keys of encrypted datastores, which rotates them,
+// or adds leveldb options to a disk spec that predates them.
+func datastoreConfig(diskSpec string, runtime DiskSpec) (spec DiskSpec, dsc DatastoreConfig, rewrite bool, err error) {
+	if err := json.Unmarshal([]byte(diskSpec), &spec); err != nil {
+		return nil, nil, false, fmt.Errorf("parse datastore spec: %w", err)
+	}
+
+	if runtime != nil {
+		dsc, err := AnyDatastoreConfig(runtime)
+		if err == nil && dsc.DiskSpec().String() == diskSpec {
+			return runtime, dsc, false, nil
+		}
+		if err == nil && sameLayout(dsc.DiskSpec().String(), diskSpec) {
+			return runtime, dsc, true, nil
+		}
+	}
+
+	dsc, err = AnyDatastoreConfig(spec)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	return spec, dsc, false, nil
+}
+
 func Init(repoPath string) error {
 	if err := initSpec(repoPath, DefaultDiskSpec()); err != nil {
 		return err
@@ -146,6 +358,12 @@ func initSpec(path string, conf map[string]interface{}) error {
 	}
 	bytes := dsc.DiskSpec().Bytes()
 
+	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+		return err
+	}
+	if err := writeVersion(path, RepoVersion); err != nil {
+		return err
+	}
 	return os.WriteFile(fn, bytes, 0o600)
 }
 
@@ -161,7 +379,12 @@ func newFSRepo(repoPath string) (*FSRepo, error) {
 	return &FSRepo{path: expPath}, nil
 }
 
-func open(repoPath string) (*FSRepo, error) {
+func open(repoPath string, opts ...OpenOption) (*FSRepo, error) {
+	o := &openOptions{runtime: DefaultDiskSpec()}
+	for _, opt := range opts {
+		opt(o)
+	}
+
 	r, err := newFSRepo(repoPath)
 	if err != nil {
 		return nil, err
@@ -170,6 +393,13 @@ func open(repoPath string) (*FSRepo, error) {
 	r.locker.Lock()
 	defer r.locker.Unlock()
 
+	if o.readOnly {
+		if err := r.openReadOnly(o); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+
 	r.lockfile, err = lockfile.Lock(r.path, LockFile)
 	if err != nil {
 		return nil, err
@@ -187,10 +417,46 @@ func open(repoPath string) (*FSRepo, error) {
 		return nil, err
 	}
 
-	if err := r.openDatastore(); err != nil {
+	pending, err := convertPending(r.path)
+	if err != nil {
+		return nil, err
+	}
+	if pending {
+		return nil, ErrConversionPending
+	}
+
+	// an uninitialized repo has nothing to migrate
+	if _, err := r.readSpec(); err != nil {
+		return nil, err
+	}
+
+	if err := migrateRepo(r.path, RepoVersion, registeredMigrations(), r.createDatastore); err != nil {
+		return nil, err
+	}
+
+	if err := r.openDatastore(o); err != nil {
 		return nil, err
 	}
 
 	keepLocked = true
 	return r, nil
 }
+
+// openReadOnly opens the datastore without taking the lock, the repo has to be at RepoVersion
+func (r *FSRepo) openReadOnly(o *openOptions) error {
+	r.readOnly = true
+
+	pending, err := convertPending(r.path)
+	if err != nil {
+		return err
+	}
+	if pending {
+		return ErrConversionPending
+	}
+
+	if err := checkVersion(r.path, RepoVersion); err != nil {
+		return err
+	}
+
+	return r.openDatastore(o)
+}
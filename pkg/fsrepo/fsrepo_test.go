@@ -24,64 +24,129 @@ func Remove(repoPath string) error {
 	return os.RemoveAll(repoPath)
 }
 
+// repoSpecs are the specs the repo tests run against
+var repoSpecs = map[string]func() DiskSpec{
+	"default": DefaultDiskSpec,
+	"pebble":  pebbleDiskSpec,
+}
+
 func TestCanManageReposIndependently(t *testing.T) {
 	t.Parallel()
-	pathA := t.TempDir()
-	pathB := t.TempDir()
-
-	t.Log("initialize two repos")
-	require.Nil(t, Init(pathA), "a", "should initialize successfully")
-	require.Nil(t, Init(pathB), "b", "should initialize successfully")
-
-	t.Log("open the two repos")
-	repoA, err := open(pathA)
-	require.Nil(t, err, "a")
-	repoB, err := open(pathB)
-	require.Nil(t, err, "b")
-
-	t.Log("close and remove b while a is open")
-	require.Nil(t, repoB.Close(), "close b")
-	require.Nil(t, Remove(pathB), "remove b")
-
-	t.Log("close and remove a")
-	require.Nil(t, repoA.Close())
-	require.Nil(t, Remove(pathA))
+	for name, spec := range repoSpecs {
+		t.Run(name, func(t *testing.T) {
+			pathA := t.TempDir()
+			pathB := t.TempDir()
+
+			t.Log("initialize two repos")
+			require.Nil(t, initSpec(pathA, spec()), "a", "should initialize successfully")
+			require.Nil(t, initSpec(pathB, spec()), "b", "should initialize successfully")
+
+			t.Log("open the two repos")
+			repoA, err := open(pathA)
+			require.Nil(t, err, "a")
+			repoB, err := open(pathB)
+			require.Nil(t, err, "b")
+
+			t.Log("close and remove b while a is open")
+			require.Nil(t, repoB.Close(), "close b")
+			require.Nil(t, Remove(pathB), "remove b")
+
+			t.Log("close and remove a")
+			require.Nil(t, repoA.Close())
+			require.Nil(t, Remove(pathA))
+		})
+	}
 }
 
 func TestDatastoreGetNotAllowedAfterClose(t *testing.T) {
+	t.Parallel()
+	for name, spec := range repoSpecs {
+		t.Run(name, func(t *testing.T) {
+			path := t.TempDir()
+
+			require.Nil(t, initSpec(path, spec()), "should initialize successfully")
+			r, err := open(path)
+			require.Nil(t, err, "should open successfully")
+
+			k := "key"
+			data := []byte(k)
+			require.Nil(t, r.Datastore().Put(context.Background(), datastore.NewKey(k), data), "Put should be successful")
+
+			require.Nil(t, r.Close())
+			_, err = r.Datastore().Get(context.Background(), datastore.NewKey(k))
+			require.Error(t, err, "after closer, Get should be fail")
+		})
+	}
+}
+
+func TestDatastorePersistsFromRepoToRepo(t *testing.T) {
+	t.Parallel()
+	for name, spec := range repoSpecs {
+		t.Run(name, func(t *testing.T) {
+			path := t.TempDir()
+
+			require.Nil(t, initSpec(path, spec()))
+			r1, err := open(path)
+			require.Nil(t, err)
+
+			k := "key"
+			expected := []byte(k)
+			require.Nil(t, r1.Datastore().Put(context.Background(), datastore.NewKey(k), expected), "using first repo, Put should be successful")
+			require.Nil(t, r1.Close())
+
+			r2, err := open(path)
+			require.Nil(t, err)
+			actual, err := r2.Datastore().Get(context.Background(), datastore.NewKey(k))
+			require.Nil(t, err, "using second repo, Get should be successful")
+			require.Nil(t, r2.Close())
+			require.True(t, bytes.Equal(expected, actual), "data should match")
+		})
+	}
+}
+
+func TestNewFSRepoWithSpec(t *testing.T) {
 	t.Parallel()
 	path := t.TempDir()
+	spec := DiskSpec{"type": "levelds", "path": "datastore", "compression": "none"}
+
+	r1, err := NewFSRepoWithSpec(path, spec)
+	require.NoError(t, err)
+	require.Equal(t, "levelds", r1.Spec()["type"])
+	require.NoError(t, r1.Datastore().Put(context.Background(), datastore.NewKey("key"), []byte("value")))
+	require.NoError(t, r1.Close())
+
+	t.Log("open with the default runtime spec uses the spec on disk")
+	r2, err := NewFSRepo(path)
+	require.NoError(t, err)
+	require.Equal(t, "levelds", r2.Spec()["type"])
+	value, err := r2.Datastore().Get(context.Background(), datastore.NewKey("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+	require.NoError(t, r2.Close())
+
+	t.Log("open expecting another spec fails")
+	_, err = Open(path, ExpectSpec(DefaultDiskSpec()))
+	require.ErrorIs(t, err, ErrSpecMismatch)
+
+	r3, err := Open(path, ExpectSpec(spec))
+	require.NoError(t, err)
+	require.NoError(t, r3.Close())
+}
 
-	require.Nil(t, Init(path), "should initialize successfully")
-	r, err := open(path)
-	require.Nil(t, err, "should open successfully")
+func TestOpenDefaultSpecKeepsRuntimeSpec(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir()
 
-	k := "key"
-	data := []byte(k)
-	require.Nil(t, r.Datastore().Put(context.Background(), datastore.NewKey(k), data), "Put should be successful")
+	r, err := NewFSRepo(path, ExpectSpec(DefaultDiskSpec()))
+	require.NoError(t, err)
+	defer r.Close()
 
-	require.Nil(t, r.Close())
-	_, err = r.Datastore().Get(context.Background(), datastore.NewKey(k))
-	require.Error(t, err, "after closer, Get should be fail")
+	require.Equal(t, DefaultDiskSpec(), r.Spec())
 }
 
-func TestDatastorePersistsFromRepoToRepo(t *testing.T) {
+func TestOpenUninitialized(t *testing.T) {
 	t.Parallel()
-	path := t.TempDir()
 
-	require.Nil(t, Init(path))
-	r1, err := open(path)
-	require.Nil(t, err)
-
-	k := "key"
-	expected := []byte(k)
-	require.Nil(t, r1.Datastore().Put(context.Background(), datastore.NewKey(k), expected), "using first repo, Put should be successful")
-	require.Nil(t, r1.Close())
-
-	r2, err := open(path)
-	require.Nil(t, err)
-	actual, err := r2.Datastore().Get(context.Background(), datastore.NewKey(k))
-	require.Nil(t, err, "using second repo, Get should be successful")
-	require.Nil(t, r2.Close())
-	require.True(t, bytes.Equal(expected, actual), "data should match")
+	_, err := Open(t.TempDir())
+	require.ErrorIs(t, err, os.ErrNotExist)
 }
@@ -50,3 +50,154 @@ func (spec DiskSpec) Bytes() []byte {
 func (spec DiskSpec) String() string {
 	return string(spec.Bytes())
 }
+
+// Mount is a datastore of a spec that keeps its data in a directory of the repo
+type Mount struct {
+	// Mountpoint is the datastore key prefix the datastore is mounted at
+	Mountpoint string
+	// Name is the measure prefix of the datastore if it has one, its type otherwise
+	Name string
+	Type string
+	// Path is the directory of the datastore, relative to the repo unless absolute
+	Path string
+}
+
+// Mounts returns the datastores of the spec that are stored on disk
+func (spec DiskSpec) Mounts() []Mount {
+	return specMounts(spec, Mount{Mountpoint: "/"})
+}
+
+func specMounts(params map[string]interface{}, m Mount) []Mount {
+	typ, _ := params["type"].(string)
+
+	switch typ {
+	case "mount":
+		var mounts []Mount
+		children, _ := params["mounts"].([]interface{})
+		for _, child := range children {
+			cfg, ok := child.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			mountpoint, _ := cfg["mountpoint"].(string)
+			mounts = append(mounts, specMounts(cfg, Mount{Mountpoint: mountpoint})...)
+		}
+		return mounts
+	case "measure":
+		child, ok := params["child"].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if m.Name == "" {
+			m.Name, _ = params["prefix"].(string)
+		}
+		return specMounts(child, m)
+	case "encrypted", "compress":
+		child, ok := params["child"].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		return specMounts(child, m)
+	}
+
+	path, ok := params["path"].(string)
+	if !ok {
+		return nil
+	}
+
+	m.Type = typ
+	m.Path = path
+	if m.Name == "" {
+		m.Name = typ
+	}
+	return []Mount{m}
+}
+
+// recordedOptions are the fields besides path that datastores keep in the
+// disk spec. Specs written before they were recorded have no compression.
+var recordedOptions = map[string][]string{
+	"levelds":  levelDBOptions,
+	"pebbleds": pebbleOptions,
+}
+
+// sameLayout returns true if the runtime spec describes the datastores of the
+// disk spec, and only differs in the keys of encrypted datastores, or in the
+// leveldb and pebble options of a disk spec written before they were recorded
+func sameLayout(runtime, disk string) bool {
+	var specR, specD map[string]interface{}
+	if json.Unmarshal([]byte(runtime), &specR) != nil || json.Unmarshal([]byte(disk), &specD) != nil {
+		return false
+	}
+
+	legacy := legacyOptions(specD)
+	return DiskSpec(layout(specR, legacy)).String() == DiskSpec(layout(specD, legacy)).String()
+}
+
+// legacyOptions returns true if a levelds or pebbleds datastore of the spec has no recorded options
+func legacyOptions(spec map[string]interface{}) bool {
+	typ, _ := spec["type"].(string)
+	if _, ok := recordedOptions[typ]; ok {
+		_, ok := spec["compression"]
+		return !ok
+	}
+
+	for _, child := range specChildren(spec) {
+		if legacyOptions(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// layout returns the spec without the keys of its encrypted datastores, and
+// without leveldb and pebble options if noOptions is set
+func layout(spec map[string]interface{}, noOptions bool) map[string]interface{} {
+	stripped := make(map[string]interface{}, len(spec))
+	for k, v := range spec {
+		stripped[k] = v
+	}
+
+	switch stripped["type"] {
+	case "encrypted":
+		delete(stripped, "keyId")
+		delete(stripped, "keyProvider")
+	case "levelds", "pebbleds":
+		if noOptions {
+			typ, _ := stripped["type"].(string)
+			for _, k := range recordedOptions[typ] {
+				delete(stripped, k)
+			}
+		}
+	}
+	if child, ok := spec["child"].(map[string]interface{}); ok {
+		stripped["child"] = layout(child, noOptions)
+	}
+	if mounts, ok := spec["mounts"].([]interface{}); ok {
+		children := make([]interface{}, len(mounts))
+		for i, m := range mounts {
+			if cfg, ok := m.(map[string]interface{}); ok {
+				m = layout(cfg, noOptions)
+			}
+			children[i] = m
+		}
+		stripped["mounts"] = children
+	}
+
+	return stripped
+}
+
+// specChildren returns the specs of the datastores a spec wraps or mounts
+func specChildren(spec map[string]interface{}) []map[string]interface{} {
+	var children []map[string]interface{}
+	if child, ok := spec["child"].(map[string]interface{}); ok {
+		children = append(children, child)
+	}
+	mounts, _ := spec["mounts"].([]interface{})
+	for _, m := range mounts {
+		if cfg, ok := m.(map[string]interface{}); ok {
+			children = append(children, cfg)
+		}
+	}
+
+	return children
+}
@@ -1,9 +1,20 @@
 package fsrepo
 
-import "testing"
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
 
 func TestDiskSpec_String(t *testing.T) {
 	spec := DefaultDiskSpec()
 	str := spec.String()
 	t.Logf("DiskSpec.String() = %s", str)
 }
+
+func TestDiskSpec_Mounts(t *testing.T) {
+	mounts := DefaultDiskSpec().Mounts()
+	require.Equal(t, []Mount{
+		{Mountpoint: "/blocks", Name: "flatfs.datastore", Type: "flatfs", Path: "blocks"},
+		{Mountpoint: "/", Name: "leveldb.datastore", Type: "levelds", Path: "datastore"},
+	}, mounts)
+}
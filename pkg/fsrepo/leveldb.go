@@ -1,21 +1,43 @@
 package fsrepo
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
 	levelds "github.com/ipfs/go-ds-leveldb"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/filter"
 	ldbopts "github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
+// levelDBOptions are the levelds fields besides path, they are kept in the disk spec
+var levelDBOptions = []string{"compression", "cacheSize", "writeBufferSize", "bloomFilterBits"}
+
 type levelDBDatastoreConfig struct {
-	path        string
-	compression ldbopts.Compression
+	path            string
+	compression     ldbopts.Compression
+	cacheSize       int64
+	writeBufferSize int64
+	bloomFilterBits int64
 }
 
+// LevelDBDatastoreConfigParser parses a levelds spec. compression is "none" or
+// "snappy", the default. cacheSize and writeBufferSize are in bytes and
+// bloomFilterBits is the bits per key of a bloom filter, zero leaves them at
+// the leveldb defaults and no filter.
 func LevelDBDatastoreConfigParser() ConfigFromMap {
 	return func(params map[string]interface{}) (DatastoreConfig, error) {
 		var c levelDBDatastoreConfig
 		var ok bool
+		var err error
 
 		c.path, ok = params["path"].(string)
 		if !ok {
@@ -25,23 +47,47 @@ func LevelDBDatastoreConfigParser() ConfigFromMap {
 		switch cm := params["compression"]; cm {
 		case "none":
 			c.compression = ldbopts.NoCompression
-		case "snappy":
+		case "snappy", "", nil:
 			c.compression = ldbopts.SnappyCompression
-		case "", nil:
-			c.compression = ldbopts.DefaultCompression
 		default:
 			return nil, fmt.Errorf("unrecognized value for compression: %s", cm)
 		}
 
+		if c.cacheSize, err = specInt(params, "cacheSize"); err != nil {
+			return nil, err
+		}
+		if c.writeBufferSize, err = specInt(params, "writeBufferSize"); err != nil {
+			return nil, err
+		}
+		if c.bloomFilterBits, err = specInt(params, "bloomFilterBits"); err != nil {
+			return nil, err
+		}
+
 		return &c, nil
 	}
 }
 
+// DiskSpec keeps the options, a reopened datastore is tuned the same way
 func (c *levelDBDatastoreConfig) DiskSpec() DiskSpec {
-	return map[string]interface{}{
-		"type": "levelds",
-		"path": c.path,
+	spec := map[string]interface{}{
+		"type":        "levelds",
+		"path":        c.path,
+		"compression": "snappy",
+	}
+	if c.compression == ldbopts.NoCompression {
+		spec["compression"] = "none"
 	}
+	if c.cacheSize != 0 {
+		spec["cacheSize"] = c.cacheSize
+	}
+	if c.writeBufferSize != 0 {
+		spec["writeBufferSize"] = c.writeBufferSize
+	}
+	if c.bloomFilterBits != 0 {
+		spec["bloomFilterBits"] = c.bloomFilterBits
+	}
+
+	return spec
 }
 
 func (c *levelDBDatastoreConfig) Create(path string) (Datastore, error) {
@@ -50,7 +96,225 @@ func (c *levelDBDatastoreConfig) Create(path string) (Datastore, error) {
 		p = filepath.Join(path, p)
 	}
 
-	return levelds.NewDatastore(p, &levelds.Options{
-		Compression: c.compression,
+	opts := &levelds.Options{
+		Compression:        c.compression,
+		BlockCacheCapacity: int(c.cacheSize),
+		WriteBuffer:        int(c.writeBufferSize),
+	}
+	if c.bloomFilterBits != 0 {
+		opts.Filter = filter.NewBloomFilter(int(c.bloomFilterBits))
+	}
+
+	return levelds.NewDatastore(p, opts)
+}
+
+// CreateReadOnly opens the leveldb without its lock, so it can be read while
+// another process writes it. It reads the tables of the manifest that was
+// current when it was opened, writes after that are not seen. It is opened
+// again when a compaction of the writer removed a table it reads.
+func (c *levelDBDatastoreConfig) CreateReadOnly(path string) (Datastore, error) {
+	p := c.path
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(path, p)
+	}
+
+	opts := &ldbopts.Options{
+		ReadOnly:           true,
+		BlockCacheCapacity: int(c.cacheSize),
+	}
+	if c.bloomFilterBits != 0 {
+		opts.Filter = filter.NewBloomFilter(int(c.bloomFilterBits))
+	}
+
+	return newReopeningDatastore(func() (Datastore, error) {
+		db, err := leveldb.Open(&sharedStorage{path: p}, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &levelDBReader{db: db}, nil
 	})
 }
+
+// levelDBReader reads a leveldb opened read-only
+type levelDBReader struct {
+	db *leveldb.DB
+}
+
+func (r *levelDBReader) Get(_ context.Context, key ds.Key) ([]byte, error) {
+	value, err := r.db.Get(key.Bytes(), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, ds.ErrNotFound
+	}
+	return value, err
+}
+
+func (r *levelDBReader) Has(_ context.Context, key ds.Key) (bool, error) {
+	return r.db.Has(key.Bytes(), nil)
+}
+
+func (r *levelDBReader) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	return ds.GetBackedSize(ctx, r, key)
+}
+
+// Query iterates a point in time view of the leveldb
+func (r *levelDBReader) Query(_ context.Context, q query.Query) (query.Results, error) {
+	prefix := ds.NewKey(q.Prefix).String()
+	if prefix != "/" {
+		prefix += "/"
+	}
+
+	it := r.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	results := query.ResultsFromIterator(q, query.Iterator{
+		Next: func() (query.Result, bool) {
+			if !it.Next() {
+				return query.Result{Error: it.Error()}, it.Error() != nil
+			}
+
+			entry := query.Entry{Key: string(it.Key()), Size: len(it.Value())}
+			if !q.KeysOnly {
+				entry.Value = append([]byte(nil), it.Value()...)
+			}
+			return query.Result{Entry: entry}, true
+		},
+		Close: func() error {
+			it.Release()
+			return nil
+		},
+	})
+
+	// the prefix is applied already
+	q.Prefix = ""
+	return query.NaiveQueryApply(q, results), nil
+}
+
+func (r *levelDBReader) DiskUsage(context.Context) (uint64, error) {
+	sizes, err := r.db.SizeOf([]util.Range{{}})
+	if err != nil {
+		return 0, err
+	}
+	return uint64(sizes.Sum()), nil
+}
+
+func (r *levelDBReader) Put(context.Context, ds.Key, []byte) error {
+	return ErrReadOnly
+}
+
+func (r *levelDBReader) Delete(context.Context, ds.Key) error {
+	return ErrReadOnly
+}
+
+func (r *levelDBReader) Sync(context.Context, ds.Key) error {
+	return nil
+}
+
+func (r *levelDBReader) Batch(context.Context) (ds.Batch, error) {
+	return nil, ErrReadOnly
+}
+
+func (r *levelDBReader) Close() error {
+	return r.db.Close()
+}
+
+// sharedStorage is a leveldb storage of a directory that does not take its lock and never writes
+type sharedStorage struct {
+	path string
+}
+
+type noLock struct{}
+
+func (noLock) Unlock() {}
+
+func (s *sharedStorage) Lock() (storage.Locker, error) {
+	return noLock{}, nil
+}
+
+func (s *sharedStorage) Log(string) {}
+
+func (s *sharedStorage) SetMeta(storage.FileDesc) error {
+	return ErrReadOnly
+}
+
+// GetMeta returns the manifest CURRENT points to
+func (s *sharedStorage) GetMeta() (storage.FileDesc, error) {
+	b, err := os.ReadFile(filepath.Join(s.path, "CURRENT"))
+	if err != nil {
+		return storage.FileDesc{}, err
+	}
+
+	fd, ok := parseLevelDBName(strings.TrimSuffix(string(b), "\n"))
+	if !ok || fd.Type != storage.TypeManifest {
+		return storage.FileDesc{}, &storage.ErrCorrupted{Err: fmt.Errorf("CURRENT has %q", b)}
+	}
+	return fd, nil
+}
+
+func (s *sharedStorage) List(ft storage.FileType) ([]storage.FileDesc, error) {
+	entries, err := os.ReadDir(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fds []storage.FileDesc
+	for _, e := range entries {
+		if fd, ok := parseLevelDBName(e.Name()); ok && fd.Type&ft != 0 {
+			fds = append(fds, fd)
+		}
+	}
+	return fds, nil
+}
+
+func (s *sharedStorage) Open(fd storage.FileDesc) (storage.Reader, error) {
+	f, err := os.Open(filepath.Join(s.path, fd.String()))
+	if errors.Is(err, os.ErrNotExist) && fd.Type == storage.TypeTable {
+		// tables of old leveldb versions
+		f, err = os.Open(filepath.Join(s.path, fmt.Sprintf("%06d.sst", fd.Num)))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *sharedStorage) Create(storage.FileDesc) (storage.Writer, error) {
+	return nil, ErrReadOnly
+}
+
+func (s *sharedStorage) Remove(storage.FileDesc) error {
+	return ErrReadOnly
+}
+
+func (s *sharedStorage) Rename(storage.FileDesc, storage.FileDesc) error {
+	return ErrReadOnly
+}
+
+func (s *sharedStorage) Close() error {
+	return nil
+}
+
+// parseLevelDBName parses the file names goleveldb gives its files, which
+// FileDesc.String formats but the storage package does not export a parser for
+func parseLevelDBName(name string) (storage.FileDesc, bool) {
+	if num, ok := strings.CutPrefix(name, "MANIFEST-"); ok {
+		n, err := strconv.ParseInt(num, 10, 64)
+		return storage.FileDesc{Type: storage.TypeManifest, Num: n}, err == nil
+	}
+
+	num, ext, ok := strings.Cut(name, ".")
+	if !ok {
+		return storage.FileDesc{}, false
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil {
+		return storage.FileDesc{}, false
+	}
+
+	switch ext {
+	case "log":
+		return storage.FileDesc{Type: storage.TypeJournal, Num: n}, true
+	case "ldb", "sst":
+		return storage.FileDesc{Type: storage.TypeTable, Num: n}, true
+	case "tmp":
+		return storage.FileDesc{Type: storage.TypeTemp, Num: n}, true
+	}
+	return storage.FileDesc{}, false
+}
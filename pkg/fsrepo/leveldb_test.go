@@ -0,0 +1,90 @@
+package fsrepo
+
+import (
+	"context"
+	"encoding/json"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+)
+
+func TestLevelDBDatastoreConfig(t *testing.T) {
+	dsc, err := AnyDatastoreConfig(map[string]interface{}{
+		"type":            "levelds",
+		"path":            "datastore",
+		"compression":     "none",
+		"cacheSize":       16 << 20,
+		"writeBufferSize": 8 << 20,
+		"bloomFilterBits": 10,
+	})
+	require.NoError(t, err)
+
+	var spec DiskSpec
+	require.NoError(t, json.Unmarshal(dsc.DiskSpec().Bytes(), &spec))
+	parsed, err := AnyDatastoreConfig(spec)
+	require.NoError(t, err)
+	require.Equal(t, dsc.DiskSpec().String(), parsed.DiskSpec().String())
+	require.Equal(t, float64(16<<20), spec["cacheSize"])
+	require.Equal(t, float64(10), spec["bloomFilterBits"])
+
+	t.Log("compression defaults to snappy and is recorded")
+	dsc, err = AnyDatastoreConfig(map[string]interface{}{"type": "levelds", "path": "datastore"})
+	require.NoError(t, err)
+	require.Equal(t, `{"compression":"snappy","path":"datastore","type":"levelds"}`, dsc.DiskSpec().String())
+
+	for _, params := range []map[string]interface{}{
+		{"type": "levelds", "path": "datastore", "compression": "zstd"},
+		{"type": "levelds", "path": "datastore", "cacheSize": -1},
+		{"type": "levelds", "path": "datastore", "bloomFilterBits": 1.5},
+	} {
+		_, err := AnyDatastoreConfig(params)
+		require.Error(t, err, params)
+	}
+}
+
+func TestLevelDBOptionsSurviveReopen(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir()
+	spec := DiskSpec{"type": "levelds", "path": "datastore", "compression": "none", "bloomFilterBits": 10}
+
+	r1, err := NewFSRepoWithSpec(path, spec)
+	require.NoError(t, err)
+	require.NoError(t, r1.Close())
+
+	r2, err := Open(path)
+	require.NoError(t, err)
+	defer r2.Close()
+	require.Equal(t, float64(10), r2.Spec()["bloomFilterBits"])
+	require.Equal(t, "none", r2.Spec()["compression"])
+}
+
+func TestLevelDBLegacySpec(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir()
+	ctx := context.Background()
+
+	t.Log("a spec written before leveldb options were recorded")
+	r1, err := NewFSRepo(path)
+	require.NoError(t, err)
+	require.NoError(t, r1.Datastore().Put(ctx, ds.NewKey("/key"), []byte("value")))
+	require.NoError(t, r1.Close())
+	legacy := `{"mounts":[{"mountpoint":"/blocks","path":"blocks","shardFunc":"/repo/flatfs/shard/v1/next-to-last/2","type":"flatfs"},{"mountpoint":"/","path":"datastore","type":"levelds"}],"type":"mount"}`
+	require.NoError(t, os.WriteFile(DatastoreSpec(path), []byte(legacy), 0o600))
+
+	r2, err := NewFSRepo(path)
+	require.NoError(t, err)
+	require.Equal(t, DefaultDiskSpec(), r2.Spec())
+	value, err := r2.Datastore().Get(ctx, ds.NewKey("/key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+	require.NoError(t, r2.Close())
+
+	diskSpec, err := os.ReadFile(DatastoreSpec(path))
+	require.NoError(t, err)
+	require.Contains(t, string(diskSpec), `"compression":"none"`)
+
+	r3, err := Open(path, ExpectSpec(DefaultDiskSpec()))
+	require.NoError(t, err)
+	require.NoError(t, r3.Close())
+}
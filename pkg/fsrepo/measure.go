@@ -0,0 +1,127 @@
+package fsrepo
+
+import (
+	"context"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/metrics"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	measure "github.com/ipfs/go-ds-measure"
+	"sync/atomic"
+)
+
+// datastoreMetricsPrefix is the prefix of the metrics of the whole datastore of a repo
+const datastoreMetricsPrefix = "ipfs.fsrepo.datastore"
+
+// measuredDatastore is a measure wrapper whose metrics are created when it is
+// measured rather than when it is opened, so they can get labels like the repo
+// the datastore belongs to. It forwards to its child until then.
+type measuredDatastore struct {
+	prefix string
+	child  Datastore
+	active atomic.Pointer[Datastore]
+}
+
+var _ ds.Batching = (*measuredDatastore)(nil)
+var _ ds.PersistentDatastore = (*measuredDatastore)(nil)
+
+func newMeasuredDatastore(prefix string, child Datastore) *measuredDatastore {
+	d := &measuredDatastore{prefix: prefix, child: child}
+	d.active.Store(&child)
+	return d
+}
+
+// measure creates the metrics of the datastore with the given labels, metrics
+// of the same name and labels are shared with the other datastores
+func (d *measuredDatastore) measure(labels map[string]string) {
+	var measured Datastore = measure.New(metrics.Labeled(d.prefix, labels), d.child)
+	d.active.Store(&measured)
+}
+
+func (d *measuredDatastore) current() Datastore {
+	return *d.active.Load()
+}
+
+func (d *measuredDatastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	return d.current().Get(ctx, key)
+}
+
+func (d *measuredDatastore) Has(ctx context.Context, key ds.Key) (bool, error) {
+	return d.current().Has(ctx, key)
+}
+
+func (d *measuredDatastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	return d.current().GetSize(ctx, key)
+}
+
+func (d *measuredDatastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	return d.current().Query(ctx, q)
+}
+
+func (d *measuredDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	return d.current().Put(ctx, key, value)
+}
+
+func (d *measuredDatastore) Delete(ctx context.Context, key ds.Key) error {
+	return d.current().Delete(ctx, key)
+}
+
+func (d *measuredDatastore) Sync(ctx context.Context, prefix ds.Key) error {
+	return d.current().Sync(ctx, prefix)
+}
+
+func (d *measuredDatastore) Batch(ctx context.Context) (ds.Batch, error) {
+	return d.current().Batch(ctx)
+}
+
+func (d *measuredDatastore) DiskUsage(ctx context.Context) (uint64, error) {
+	return ds.DiskUsage(ctx, d.current())
+}
+
+func (d *measuredDatastore) Check(ctx context.Context) error {
+	if c, ok := d.current().(ds.CheckedDatastore); ok {
+		return c.Check(ctx)
+	}
+	return nil
+}
+
+func (d *measuredDatastore) Scrub(ctx context.Context) error {
+	if s, ok := d.current().(ds.ScrubbedDatastore); ok {
+		return s.Scrub(ctx)
+	}
+	return nil
+}
+
+func (d *measuredDatastore) CollectGarbage(ctx context.Context) error {
+	if gc, ok := d.current().(ds.GCDatastore); ok {
+		return gc.CollectGarbage(ctx)
+	}
+	return nil
+}
+
+func (d *measuredDatastore) Close() error {
+	return d.current().Close()
+}
+
+// measuredDatastores returns the measure wrappers created from dsc
+func measuredDatastores(dsc DatastoreConfig) []*measuredDatastore {
+	switch c := dsc.(type) {
+	case *mountDatastoreConfig:
+		var created []*measuredDatastore
+		for _, m := range c.mounts {
+			created = append(created, measuredDatastores(m.ds)...)
+		}
+		return created
+	case *measureDatastoreConfig:
+		created := measuredDatastores(c.child)
+		if c.created != nil {
+			created = append(created, c.created)
+		}
+		return created
+	case *compressDatastoreConfig:
+		return measuredDatastores(c.child)
+	case *encryptedDatastoreConfig:
+		return measuredDatastores(c.child)
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package fsrepo
+
+import (
+	"fmt"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/packds"
+	"path/filepath"
+	"time"
+)
+
+type packDatastoreConfig struct {
+	path string
+	opts packds.Options
+}
+
+// PackDatastoreConfigParser parses a packds spec. sync defaults to true,
+// packSize is in bytes, compactInterval is a duration like "10m", zero turns
+// compaction off, and compactRatio is the deleted share of a pack that gets it
+// compacted.
+func PackDatastoreConfigParser() ConfigFromMap {
+	return func(params map[string]interface{}) (DatastoreConfig, error) {
+		c := packDatastoreConfig{opts: packds.DefaultOptions()}
+		var ok bool
+
+		c.path, ok = params["path"].(string)
+		if !ok {
+			return nil, fmt.Errorf("'path' field is missing or not string")
+		}
+
+		if sync, found := params["sync"]; found {
+			c.opts.Sync, ok = sync.(bool)
+			if !ok {
+				return nil, fmt.Errorf("'sync' field is not boolean")
+			}
+		}
+
+		packSize, err := specInt(params, "packSize")
+		if err != nil {
+			return nil, err
+		}
+		if packSize != 0 {
+			c.opts.PackSize = packSize
+		}
+
+		if interval, found := params["compactInterval"]; found {
+			s, ok := interval.(string)
+			if !ok {
+				return nil, fmt.Errorf("'compactInterval' field is not a string")
+			}
+			if c.opts.CompactInterval, err = time.ParseDuration(s); err != nil {
+				return nil, fmt.Errorf("'compactInterval' field: %w", err)
+			}
+			if c.opts.CompactInterval < 0 {
+				return nil, fmt.Errorf("'compactInterval' field is negative")
+			}
+		}
+
+		if ratio, found := params["compactRatio"]; found {
+			c.opts.CompactRatio, ok = ratio.(float64)
+			if !ok || c.opts.CompactRatio <= 0 || c.opts.CompactRatio > 1 {
+				return nil, fmt.Errorf("'compactRatio' field is not a number in (0, 1]")
+			}
+		}
+
+		return &c, nil
+	}
+}
+
+func (c *packDatastoreConfig) DiskSpec() DiskSpec {
+	return map[string]interface{}{
+		"type": "packds",
+		"path": c.path,
+	}
+}
+
+// Create opens the datastore, it compacts its packs in the background until it is closed
+func (c *packDatastoreConfig) Create(path string) (Datastore, error) {
+	p := c.path
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(path, p)
+	}
+
+	return packds.NewDatastore(p, c.opts)
+}
@@ -0,0 +1,85 @@
+package fsrepo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func packDiskSpec() DiskSpec {
+	return DiskSpec{
+		"type": "mount",
+		"mounts": []interface{}{
+			map[string]interface{}{
+				"mountpoint":      "/blocks",
+				"type":            "packds",
+				"path":            "packs",
+				"packSize":        1 << 20,
+				"compactInterval": "0",
+				"compactRatio":    0.3,
+			},
+			map[string]interface{}{
+				"mountpoint":  "/",
+				"type":        "levelds",
+				"path":        "datastore",
+				"compression": "none",
+			},
+		},
+	}
+}
+
+func TestPackCompaction(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir()
+	ctx := context.Background()
+
+	spec := packDiskSpec()
+	spec["mounts"].([]interface{})[0].(map[string]interface{})["compactInterval"] = "50ms"
+	r, err := NewFSRepoWithSpec(path, spec)
+	require.NoError(t, err)
+	defer r.Close()
+
+	t.Log("fill a few packs and delete all but one block")
+	block := make([]byte, 64<<10)
+	for i := 0; i < 64; i++ {
+		block[0] = byte(i)
+		require.NoError(t, r.Datastore().Put(ctx, ds.NewKey(fmt.Sprintf("/blocks/KEY%d", i)), block))
+	}
+	full := packsSize(t, path)
+	require.Greater(t, full, int64(4<<20))
+	for i := 1; i < 64; i++ {
+		require.NoError(t, r.Datastore().Delete(ctx, ds.NewKey(fmt.Sprintf("/blocks/KEY%d", i))))
+	}
+
+	t.Log("the compaction of the repo reclaims the packs")
+	require.Eventually(t, func() bool { return packsSize(t, path) < int64(2<<20) }, 10*time.Second, 50*time.Millisecond)
+
+	value, err := r.Datastore().Get(ctx, ds.NewKey("/blocks/KEY0"))
+	require.NoError(t, err)
+	require.Equal(t, byte(0), value[0])
+	require.Len(t, value, len(block))
+}
+
+// packsSize is the size of the pack files of the repo at path
+func packsSize(t *testing.T, path string) int64 {
+	entries, err := os.ReadDir(filepath.Join(path, "packs", "packs"))
+	require.NoError(t, err)
+
+	var size int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			// removed by the compaction
+			continue
+		}
+		require.NoError(t, err)
+		size += info.Size()
+	}
+	return size
+}
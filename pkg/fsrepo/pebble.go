@@ -0,0 +1,254 @@
+package fsrepo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	pebbleds "github.com/ipfs/go-ds-pebble"
+	"io"
+	"path/filepath"
+	"sync"
+)
+
+var ErrClosed = errors.New("datastore is closed")
+
+// pebbleOptions are the pebbleds fields besides path, they are kept in the disk spec
+var pebbleOptions = []string{"compression", "cacheSize", "memTableSize", "bytesPerSync"}
+
+type pebbleDatastoreConfig struct {
+	path         string
+	cacheSize    int64
+	memTableSize int64
+	bytesPerSync int64
+	compression  pebble.Compression
+}
+
+// PebbleDatastoreConfigParser parses a pebbleds spec. compression is "none",
+// "snappy", the default, or "zstd". Sizes are in bytes and pebble's defaults
+// are used for the ones that are missing or zero.
+func PebbleDatastoreConfigParser() ConfigFromMap {
+	return func(params map[string]interface{}) (DatastoreConfig, error) {
+		var c pebbleDatastoreConfig
+		var ok bool
+		var err error
+
+		c.path, ok = params["path"].(string)
+		if !ok {
+			return nil, fmt.Errorf("'path' field is missing or not string")
+		}
+
+		if c.cacheSize, err = specInt(params, "cacheSize"); err != nil {
+			return nil, err
+		}
+		if c.memTableSize, err = specInt(params, "memTableSize"); err != nil {
+			return nil, err
+		}
+		if c.bytesPerSync, err = specInt(params, "bytesPerSync"); err != nil {
+			return nil, err
+		}
+
+		switch cm := params["compression"]; cm {
+		case "none":
+			c.compression = pebble.NoCompression
+		case "snappy", "", nil:
+			c.compression = pebble.SnappyCompression
+		case "zstd":
+			c.compression = pebble.ZstdCompression
+		default:
+			return nil, fmt.Errorf("unrecognized value for compression: %s", cm)
+		}
+
+		return &c, nil
+	}
+}
+
+// DiskSpec keeps the options, a reopened datastore is tuned the same way
+func (c *pebbleDatastoreConfig) DiskSpec() DiskSpec {
+	spec := map[string]interface{}{
+		"type":        "pebbleds",
+		"path":        c.path,
+		"compression": "snappy",
+	}
+	switch c.compression {
+	case pebble.NoCompression:
+		spec["compression"] = "none"
+	case pebble.ZstdCompression:
+		spec["compression"] = "zstd"
+	}
+	if c.cacheSize != 0 {
+		spec["cacheSize"] = c.cacheSize
+	}
+	if c.memTableSize != 0 {
+		spec["memTableSize"] = c.memTableSize
+	}
+	if c.bytesPerSync != 0 {
+		spec["bytesPerSync"] = c.bytesPerSync
+	}
+
+	return spec
+}
+
+func (c *pebbleDatastoreConfig) Create(path string) (Datastore, error) {
+	return c.create(path, &pebble.Options{})
+}
+
+// CreateReadOnly opens pebble read-only and without its lock, so it can be
+// read while another process writes it. Like leveldb it reads the tables that
+// were current when it was opened, and it is opened again when the writer
+// removed one of them.
+func (c *pebbleDatastoreConfig) CreateReadOnly(path string) (Datastore, error) {
+	return newReopeningDatastore(func() (Datastore, error) {
+		return c.create(path, &pebble.Options{ReadOnly: true, FS: lockFreeFS{vfs.Default}})
+	})
+}
+
+func (c *pebbleDatastoreConfig) create(path string, opts *pebble.Options) (Datastore, error) {
+	p := c.path
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(path, p)
+	}
+
+	opts.MemTableSize = uint64(c.memTableSize)
+	opts.BytesPerSync = int(c.bytesPerSync)
+	opts.EnsureDefaults()
+	for i := range opts.Levels {
+		opts.Levels[i].Compression = c.compression
+	}
+
+	d, err := pebbleds.NewDatastore(p, pebbleds.WithCacheSize(c.cacheSize), pebbleds.WithPebbleOpts(opts))
+	if err != nil {
+		return nil, err
+	}
+
+	return &pebbleDatastore{Datastore: d}, nil
+}
+
+// lockFreeFS does not lock the pebble directory
+type lockFreeFS struct {
+	vfs.FS
+}
+
+func (fs lockFreeFS) Lock(string) (io.Closer, error) {
+	return io.NopCloser(nil), nil
+}
+
+// pebbleDatastore returns ErrClosed once it is closed, pebble panics instead
+type pebbleDatastore struct {
+	*pebbleds.Datastore
+
+	// mu is held for reading by operations and for writing by Close
+	mu     sync.RWMutex
+	closed bool
+}
+
+func (d *pebbleDatastore) do(fn func() error) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return ErrClosed
+	}
+	return fn()
+}
+
+func (d *pebbleDatastore) Get(ctx context.Context, key ds.Key) (value []byte, err error) {
+	err = d.do(func() error {
+		value, err = d.Datastore.Get(ctx, key)
+		return err
+	})
+	return value, err
+}
+
+func (d *pebbleDatastore) Has(ctx context.Context, key ds.Key) (exists bool, err error) {
+	err = d.do(func() error {
+		exists, err = d.Datastore.Has(ctx, key)
+		return err
+	})
+	return exists, err
+}
+
+func (d *pebbleDatastore) GetSize(ctx context.Context, key ds.Key) (size int, err error) {
+	size = -1
+	err = d.do(func() error {
+		size, err = d.Datastore.GetSize(ctx, key)
+		return err
+	})
+	return size, err
+}
+
+func (d *pebbleDatastore) Query(ctx context.Context, q query.Query) (results query.Results, err error) {
+	err = d.do(func() error {
+		results, err = d.Datastore.Query(ctx, q)
+		return err
+	})
+	return results, err
+}
+
+func (d *pebbleDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	return d.do(func() error { return d.Datastore.Put(ctx, key, value) })
+}
+
+func (d *pebbleDatastore) Delete(ctx context.Context, key ds.Key) error {
+	return d.do(func() error { return d.Datastore.Delete(ctx, key) })
+}
+
+func (d *pebbleDatastore) Sync(ctx context.Context, prefix ds.Key) error {
+	return d.do(func() error { return d.Datastore.Sync(ctx, prefix) })
+}
+
+func (d *pebbleDatastore) DiskUsage(ctx context.Context) (usage uint64, err error) {
+	err = d.do(func() error {
+		usage, err = d.Datastore.DiskUsage(ctx)
+		return err
+	})
+	return usage, err
+}
+
+func (d *pebbleDatastore) Batch(ctx context.Context) (batch ds.Batch, err error) {
+	err = d.do(func() error {
+		batch, err = d.Datastore.Batch(ctx)
+		return err
+	})
+	return batch, err
+}
+
+func (d *pebbleDatastore) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	return d.Datastore.Close()
+}
+
+// specInt returns the non-negative integer field of a spec, zero if it is missing
+func specInt(params map[string]interface{}, field string) (int64, error) {
+	var n int64
+	switch v := params[field].(type) {
+	case nil:
+		return 0, nil
+	case int:
+		n = int64(v)
+	case int64:
+		n = v
+	case float64:
+		// specs read from JSON
+		if v != float64(int64(v)) {
+			return 0, fmt.Errorf("'%s' field is not an integer", field)
+		}
+		n = int64(v)
+	default:
+		return 0, fmt.Errorf("'%s' field is not a number", field)
+	}
+
+	if n < 0 {
+		return 0, fmt.Errorf("'%s' field is negative", field)
+	}
+	return n, nil
+}
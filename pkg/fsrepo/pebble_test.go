@@ -0,0 +1,136 @@
+package fsrepo
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/cockroachdb/pebble"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func pebbleDiskSpec() DiskSpec {
+	return DiskSpec{
+		"type": "mount",
+		"mounts": []interface{}{
+			map[string]interface{}{
+				"mountpoint": "/blocks",
+				"type":       "flatfs",
+				"path":       "blocks",
+				"shardFunc":  "/repo/flatfs/shard/v1/next-to-last/2",
+			},
+			map[string]interface{}{
+				"mountpoint":   "/",
+				"type":         "pebbleds",
+				"path":         "pebble",
+				"cacheSize":    8 << 20,
+				"memTableSize": 4 << 20,
+				"bytesPerSync": 512 << 10,
+				"compression":  "zstd",
+			},
+		},
+	}
+}
+
+func TestPebbleDatastoreConfig(t *testing.T) {
+	dsc, err := AnyDatastoreConfig(map[string]interface{}{
+		"type":         "pebbleds",
+		"path":         "pebble",
+		"cacheSize":    8 << 20,
+		"memTableSize": 4 << 20,
+		"bytesPerSync": 512 << 10,
+		"compression":  "zstd",
+	})
+	require.NoError(t, err)
+
+	t.Log("the options are parsed back from the disk spec")
+	var spec DiskSpec
+	require.NoError(t, json.Unmarshal(dsc.DiskSpec().Bytes(), &spec))
+	parsed, err := AnyDatastoreConfig(spec)
+	require.NoError(t, err)
+	require.Equal(t, &pebbleDatastoreConfig{
+		path:         "pebble",
+		cacheSize:    8 << 20,
+		memTableSize: 4 << 20,
+		bytesPerSync: 512 << 10,
+		compression:  pebble.ZstdCompression,
+	}, parsed)
+
+	t.Log("compression defaults to snappy and is recorded")
+	dsc, err = AnyDatastoreConfig(map[string]interface{}{"type": "pebbleds", "path": "pebble"})
+	require.NoError(t, err)
+	require.Equal(t, `{"compression":"snappy","path":"pebble","type":"pebbleds"}`, dsc.DiskSpec().String())
+}
+
+func TestPebbleOptions(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir()
+	ctx := context.Background()
+
+	r1, err := NewFSRepoWithSpec(path, pebbleDiskSpec())
+	require.NoError(t, err)
+	require.NoError(t, r1.Datastore().Put(ctx, ds.NewKey("/key"), []byte("value")))
+	require.NoError(t, r1.Close())
+
+	t.Log("pebble runs with the options of the spec")
+	options := pebbleOptionsFile(t, path)
+	for _, option := range []string{"cache_size=8388608", "mem_table_size=4194304", "bytes_per_sync=524288", "compression=ZSTD"} {
+		require.Contains(t, options, option)
+	}
+
+	t.Log("an open without the runtime spec is tuned like the first one")
+	r2, err := Open(path)
+	require.NoError(t, err)
+	defer r2.Close()
+
+	c := r2.dsc.(*mountDatastoreConfig).mounts[1].ds.(*pebbleDatastoreConfig)
+	require.Equal(t, int64(8<<20), c.cacheSize)
+	require.Equal(t, int64(4<<20), c.memTableSize)
+	require.Equal(t, int64(512<<10), c.bytesPerSync)
+	require.Equal(t, pebble.ZstdCompression, c.compression)
+	require.Contains(t, pebbleOptionsFile(t, path), "cache_size=8388608")
+
+	value, err := r2.Datastore().Get(ctx, ds.NewKey("/key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+}
+
+func TestPebbleLegacySpec(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir()
+
+	t.Log("a spec written before pebble options were recorded")
+	r1, err := NewFSRepoWithSpec(path, pebbleDiskSpec())
+	require.NoError(t, err)
+	require.NoError(t, r1.Close())
+	legacy := `{"mounts":[{"mountpoint":"/blocks","path":"blocks","shardFunc":"/repo/flatfs/shard/v1/next-to-last/2","type":"flatfs"},{"mountpoint":"/","path":"pebble","type":"pebbleds"}],"type":"mount"}`
+	require.NoError(t, os.WriteFile(DatastoreSpec(path), []byte(legacy), 0o600))
+
+	r2, err := Open(path, RuntimeSpec(pebbleDiskSpec()))
+	require.NoError(t, err)
+	require.NoError(t, r2.Close())
+
+	diskSpec, err := os.ReadFile(DatastoreSpec(path))
+	require.NoError(t, err)
+	require.Contains(t, string(diskSpec), `"compression":"zstd"`)
+	require.Contains(t, string(diskSpec), `"cacheSize":8388608`)
+
+	r3, err := Open(path, ExpectSpec(pebbleDiskSpec()))
+	require.NoError(t, err)
+	require.NoError(t, r3.Close())
+}
+
+// pebbleOptionsFile returns the options pebble recorded when the repo at path was last opened
+func pebbleOptionsFile(t *testing.T, path string) string {
+	files, err := filepath.Glob(filepath.Join(path, "pebble", "OPTIONS-*"))
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	sort.Strings(files)
+
+	b, err := os.ReadFile(files[len(files)-1])
+	require.NoError(t, err)
+	return string(b)
+}
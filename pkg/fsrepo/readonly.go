@@ -0,0 +1,250 @@
+package fsrepo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"os"
+	"sync"
+)
+
+var (
+	ErrReadOnly            = errors.New("repo is opened read-only")
+	ErrReadOnlyUnsupported = errors.New("datastore can not be opened read-only")
+)
+
+// ReadOnlyDatastoreConfig is implemented by configs whose datastore can be
+// opened without writing to the repo, while another process has it open.
+// Writes to the datastore fail with ErrReadOnly.
+type ReadOnlyDatastoreConfig interface {
+	CreateReadOnly(path string) (Datastore, error)
+}
+
+func createReadOnly(dsc DatastoreConfig, path string) (Datastore, error) {
+	c, ok := dsc.(ReadOnlyDatastoreConfig)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrReadOnlyUnsupported, dsc.DiskSpec()["type"])
+	}
+
+	return c.CreateReadOnly(path)
+}
+
+// readOnlyDatastore rejects every write to its datastore
+type readOnlyDatastore struct {
+	Datastore
+}
+
+var _ ds.PersistentDatastore = (*readOnlyDatastore)(nil)
+
+func newReadOnlyDatastore(d Datastore) *readOnlyDatastore {
+	return &readOnlyDatastore{Datastore: d}
+}
+
+func (d *readOnlyDatastore) Put(context.Context, ds.Key, []byte) error {
+	return ErrReadOnly
+}
+
+func (d *readOnlyDatastore) Delete(context.Context, ds.Key) error {
+	return ErrReadOnly
+}
+
+func (d *readOnlyDatastore) Batch(context.Context) (ds.Batch, error) {
+	return nil, ErrReadOnly
+}
+
+func (d *readOnlyDatastore) DiskUsage(ctx context.Context) (uint64, error) {
+	return ds.DiskUsage(ctx, d.Datastore)
+}
+
+// reopeningDatastore opens its datastore again when a file it reads vanished.
+// A datastore opened read-only reads the files the writer had when it was
+// opened, and the writer removes some of them when it compacts. Reads retry
+// once on the new files, a query that was running fails and can be run again.
+type reopeningDatastore struct {
+	open func() (Datastore, error)
+
+	mu     sync.Mutex
+	cur    *openedDatastore
+	closed bool
+}
+
+// openedDatastore is closed once it was replaced and no query or read uses it
+type openedDatastore struct {
+	Datastore
+	users int
+}
+
+var _ ds.PersistentDatastore = (*reopeningDatastore)(nil)
+
+func newReopeningDatastore(open func() (Datastore, error)) (*reopeningDatastore, error) {
+	d, err := open()
+	if err != nil {
+		return nil, err
+	}
+	return &reopeningDatastore{open: open, cur: &openedDatastore{Datastore: d}}, nil
+}
+
+func (d *reopeningDatastore) acquire() (*openedDatastore, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return nil, ErrClosed
+	}
+	d.cur.users++
+	return d.cur, nil
+}
+
+func (d *reopeningDatastore) release(o *openedDatastore) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	o.users--
+	if o != d.cur && o.users == 0 {
+		_ = o.Close()
+	}
+}
+
+// reopen replaces o unless another read replaced it already
+func (d *reopeningDatastore) reopen(o *openedDatastore) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if o != d.cur || d.closed {
+		return nil
+	}
+
+	opened, err := d.open()
+	if err != nil {
+		return err
+	}
+	log.Infof("reopened read-only datastore, a file it read was removed by the writer")
+	d.cur = &openedDatastore{Datastore: opened}
+	return nil
+}
+
+// read runs fn, and once more after reopening if a file vanished
+func (d *reopeningDatastore) read(fn func(Datastore) error) error {
+	for retry := true; ; retry = false {
+		o, err := d.acquire()
+		if err != nil {
+			return err
+		}
+
+		err = fn(o)
+		if retry && errors.Is(err, os.ErrNotExist) {
+			err = d.reopen(o)
+			d.release(o)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		d.release(o)
+		return err
+	}
+}
+
+func (d *reopeningDatastore) Get(ctx context.Context, key ds.Key) (value []byte, err error) {
+	err = d.read(func(d Datastore) error {
+		value, err = d.Get(ctx, key)
+		return err
+	})
+	return value, err
+}
+
+func (d *reopeningDatastore) Has(ctx context.Context, key ds.Key) (exists bool, err error) {
+	err = d.read(func(d Datastore) error {
+		exists, err = d.Has(ctx, key)
+		return err
+	})
+	return exists, err
+}
+
+func (d *reopeningDatastore) GetSize(ctx context.Context, key ds.Key) (size int, err error) {
+	err = d.read(func(d Datastore) error {
+		size, err = d.GetSize(ctx, key)
+		return err
+	})
+	return size, err
+}
+
+// Query keeps the datastore it started on open until the results are closed
+func (d *reopeningDatastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	o, err := d.acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := o.Query(ctx, q)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := d.reopen(o); err != nil {
+			d.release(o)
+			return nil, err
+		}
+		d.release(o)
+		if o, err = d.acquire(); err != nil {
+			return nil, err
+		}
+		results, err = o.Query(ctx, q)
+	}
+	if err != nil {
+		d.release(o)
+		return nil, err
+	}
+
+	return query.ResultsFromIterator(q, query.Iterator{
+		Next: func() (query.Result, bool) {
+			r, ok := results.NextSync()
+			if errors.Is(r.Error, os.ErrNotExist) {
+				// the next query runs on the files the writer has now
+				_ = d.reopen(o)
+			}
+			return r, ok
+		},
+		Close: func() error {
+			err := results.Close()
+			d.release(o)
+			return err
+		},
+	}), nil
+}
+
+func (d *reopeningDatastore) DiskUsage(ctx context.Context) (usage uint64, err error) {
+	err = d.read(func(d Datastore) error {
+		usage, err = ds.DiskUsage(ctx, d)
+		return err
+	})
+	return usage, err
+}
+
+func (d *reopeningDatastore) Put(context.Context, ds.Key, []byte) error {
+	return ErrReadOnly
+}
+
+func (d *reopeningDatastore) Delete(context.Context, ds.Key) error {
+	return ErrReadOnly
+}
+
+func (d *reopeningDatastore) Sync(context.Context, ds.Key) error {
+	return nil
+}
+
+func (d *reopeningDatastore) Batch(context.Context) (ds.Batch, error) {
+	return nil, ErrReadOnly
+}
+
+// Close closes the datastore, one that was replaced is closed by its last user
+func (d *reopeningDatastore) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return ErrClosed
+	}
+	d.closed = true
+	return d.cur.Close()
+}
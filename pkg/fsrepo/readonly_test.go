@@ -0,0 +1,194 @@
+package fsrepo
+
+import (
+	"context"
+	"fmt"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadOnlyWhileOpen(t *testing.T) {
+	t.Parallel()
+	for name, spec := range map[string]DiskSpec{
+		"default": DefaultDiskSpec(),
+		"pebble":  pebbleDiskSpec(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			path := t.TempDir()
+			ctx := context.Background()
+
+			w, err := NewFSRepoWithSpec(path, spec)
+			require.NoError(t, err)
+			defer w.Close()
+			require.NoError(t, w.Datastore().Put(ctx, ds.NewKey("/blocks/KEY"), []byte("block")))
+			require.NoError(t, w.Datastore().Put(ctx, ds.NewKey("/key"), []byte("value")))
+			require.NoError(t, w.Datastore().Sync(ctx, ds.NewKey("/")))
+
+			r, err := Open(path, ReadOnly())
+			require.NoError(t, err)
+			require.True(t, r.ReadOnly())
+
+			value, err := r.Datastore().Get(ctx, ds.NewKey("/blocks/KEY"))
+			require.NoError(t, err)
+			require.Equal(t, []byte("block"), value)
+			value, err = r.Datastore().Get(ctx, ds.NewKey("/key"))
+			require.NoError(t, err)
+			require.Equal(t, []byte("value"), value)
+			_, err = r.Datastore().Get(ctx, ds.NewKey("/missing"))
+			require.ErrorIs(t, err, ds.ErrNotFound)
+
+			results, err := r.Datastore().Query(ctx, query.Query{KeysOnly: true, Orders: []query.Order{query.OrderByKey{}}})
+			require.NoError(t, err)
+			entries, err := results.Rest()
+			require.NoError(t, err)
+			require.Len(t, entries, 2)
+			require.Equal(t, "/blocks/KEY", entries[0].Key)
+
+			t.Log("writes fail")
+			require.ErrorIs(t, r.Datastore().Put(ctx, ds.NewKey("/blocks/OTHER"), []byte("block")), ErrReadOnly)
+			require.ErrorIs(t, r.Datastore().Put(ctx, ds.NewKey("/other"), []byte("value")), ErrReadOnly)
+			require.ErrorIs(t, r.Datastore().Delete(ctx, ds.NewKey("/key")), ErrReadOnly)
+			require.NoError(t, r.Close())
+
+			t.Log("the writer is not disturbed")
+			require.NoError(t, w.Datastore().Put(ctx, ds.NewKey("/blocks/OTHER"), []byte("block")))
+			value, err = w.Datastore().Get(ctx, ds.NewKey("/key"))
+			require.NoError(t, err)
+			require.Equal(t, []byte("value"), value)
+		})
+	}
+}
+
+func TestReadOnlyAfterCompaction(t *testing.T) {
+	t.Parallel()
+	for name, spec := range map[string]DiskSpec{
+		"default": DefaultDiskSpec(),
+		"pebble":  pebbleDiskSpec(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			path := t.TempDir()
+			ctx := context.Background()
+			value := make([]byte, 4<<10)
+			write := func(d Datastore, n int) {
+				for i := 0; i < n; i++ {
+					require.NoError(t, d.Put(ctx, ds.NewKey(fmt.Sprintf("/key/%d", i)), value))
+				}
+				require.NoError(t, d.Sync(ctx, ds.NewKey("/")))
+			}
+
+			w, err := NewFSRepoWithSpec(path, spec)
+			require.NoError(t, err)
+			defer w.Close()
+			write(w.Datastore(), 2000)
+
+			r, err := Open(path, ReadOnly())
+			require.NoError(t, err)
+			defer r.Close()
+
+			t.Log("the writer compacts away the tables the reader was opened with")
+			for i := 0; i < 5; i++ {
+				write(w.Datastore(), 2000)
+			}
+
+			for i := 0; i < 2000; i++ {
+				_, err := r.Datastore().Get(ctx, ds.NewKey(fmt.Sprintf("/key/%d", i)))
+				require.NoError(t, err)
+			}
+
+			results, err := r.Datastore().Query(ctx, query.Query{Prefix: "/key", KeysOnly: true})
+			require.NoError(t, err)
+			entries, err := results.Rest()
+			require.NoError(t, err)
+			require.Len(t, entries, 2000)
+		})
+	}
+}
+
+func TestReadOnlyBadger(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir()
+	ctx := context.Background()
+
+	w, err := NewFSRepoWithSpec(path, badgerDiskSpec())
+	require.NoError(t, err)
+	require.NoError(t, w.Datastore().Put(ctx, ds.NewKey("/blocks/KEY"), []byte("block")))
+
+	t.Log("badger can only be opened read-only once its writer closed it")
+	_, err = Open(path, ReadOnly())
+	require.Error(t, err)
+	require.NoError(t, w.Close())
+
+	r, err := Open(path, ReadOnly())
+	require.NoError(t, err)
+	defer r.Close()
+
+	value, err := r.Datastore().Get(ctx, ds.NewKey("/blocks/KEY"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("block"), value)
+	require.ErrorIs(t, r.Datastore().Put(ctx, ds.NewKey("/blocks/KEY"), []byte("block")), ErrReadOnly)
+}
+
+func TestReadOnlyDoesNotWrite(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "repo")
+
+	_, err := Open(path, ReadOnly())
+	require.Error(t, err)
+	require.NoDirExists(t, path)
+}
+
+func TestReadOnlyVersion(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir()
+
+	r, err := NewFSRepo(path)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	require.NoError(t, writeVersion(path, RepoVersion+1))
+	_, err = Open(path, ReadOnly())
+	require.ErrorIs(t, err, ErrRepoTooNew)
+
+	require.NoError(t, writeVersion(path, RepoVersion))
+	require.NoError(t, os.Mkdir(filepath.Join(path, migrateDir), 0o755))
+	_, err = Open(path, ReadOnly())
+	require.ErrorIs(t, err, ErrMigrationPending)
+}
+
+func TestReadOnlyUnsupported(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir()
+
+	r, err := NewFSRepoWithSpec(path, packDiskSpec())
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	_, err = Open(path, ReadOnly())
+	require.ErrorIs(t, err, ErrReadOnlyUnsupported)
+}
+
+func TestReadOnlyEncrypted(t *testing.T) {
+	t.Parallel()
+	path, keyDir := t.TempDir(), t.TempDir()
+	ctx := context.Background()
+	writeTestKey(t, keyDir, "k1", 1)
+
+	w, err := NewFSRepoWithSpec(path, encryptedDiskSpec(keyDir, "k1"))
+	require.NoError(t, err)
+	defer w.Close()
+	require.NoError(t, w.Datastore().Put(ctx, ds.NewKey("/blocks/KEY"), []byte("secret block")))
+
+	r, err := Open(path, ReadOnly())
+	require.NoError(t, err)
+	defer r.Close()
+
+	value, err := r.Datastore().Get(ctx, ds.NewKey("/blocks/KEY"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret block"), value)
+}
@@ -0,0 +1,299 @@
+package fsrepo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	logging "github.com/ipfs/go-log/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var log = logging.Logger("fsrepo")
+
+// RepoVersion is the version of the repo layout this library reads and writes.
+// Version 2 moved metadata kept in the datastore, its migration is registered
+// by the package that owns the metadata.
+const RepoVersion = 2
+
+const (
+	// legacyVersion is the version of repos written before the version file
+	legacyVersion = 1
+
+	// migrateDir holds the backup of the repo metadata while migrations run
+	migrateDir = ".migrate"
+)
+
+var (
+	ErrRepoTooNew       = errors.New("repo is newer than this library")
+	ErrMigrationMissing = errors.New("no migration to repo version")
+	ErrMigrationPending = errors.New("repo has to be migrated before it can be opened read-only")
+)
+
+// RepoTooNewError is returned for a repo with a version above the supported
+// one, it matches ErrRepoTooNew
+type RepoTooNewError struct {
+	Version   int
+	Supported int
+}
+
+func (e *RepoTooNewError) Error() string {
+	return fmt.Sprintf("%s: repo version %d, supported version %d", ErrRepoTooNew, e.Version, e.Supported)
+}
+
+func (e *RepoTooNewError) Is(target error) bool {
+	return target == ErrRepoTooNew
+}
+
+// backupFiles are the metadata files restored when a migration fails
+var backupFiles = []string{"datastore_spec", "version"}
+
+// Migration upgrades a repo from Version-1 to Version. Apply runs with the
+// repo locked and before its datastore is opened, it has to be safe to run
+// again after an interrupted one.
+type Migration struct {
+	Version int
+	Apply   func(repoPath string) error
+	// Datastore runs after Apply with the datastore of the repo, it may be
+	// nil. Its changes are not part of the backup, an interrupted or failed
+	// run is repeated on the next open and has to be safe to run again.
+	Datastore func(ctx context.Context, d Datastore) error
+	// Rollback undoes Apply if it or a later migration fails, it may be nil
+	Rollback func(repoPath string) error
+}
+
+var (
+	migrationsMu sync.Mutex
+	migrations   = map[int]Migration{}
+)
+
+// AddMigration registers the migration to m.Version, open applies it to older repos
+func AddMigration(m Migration) error {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+
+	if m.Version <= legacyVersion || (m.Apply == nil && m.Datastore == nil) {
+		return fmt.Errorf("invalid migration to version %d", m.Version)
+	}
+	if _, ok := migrations[m.Version]; ok {
+		return fmt.Errorf("already have a migration to version %d", m.Version)
+	}
+
+	migrations[m.Version] = m
+	return nil
+}
+
+func registeredMigrations() map[int]Migration {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+
+	registry := make(map[int]Migration, len(migrations))
+	for v, m := range migrations {
+		registry[v] = m
+	}
+	return registry
+}
+
+// VersionFile get repo version file path
+func VersionFile(repoPath string) string {
+	return filepath.Join(repoPath, "version")
+}
+
+// ReadVersion returns the version of the repo at repoPath, repos without a
+// version file predate it and have the first version
+func ReadVersion(repoPath string) (int, error) {
+	b, err := os.ReadFile(VersionFile(repoPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return legacyVersion, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	version, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("invalid repo version %q", strings.TrimSpace(string(b)))
+	}
+	return version, nil
+}
+
+func writeVersion(repoPath string, version int) error {
+	return WriteFile(VersionFile(repoPath), []byte(strconv.Itoa(version)+"\n"))
+}
+
+// checkVersion returns an error unless the repo at repoPath is at version and no migration was interrupted
+func checkVersion(repoPath string, version int) error {
+	if FileExists(filepath.Join(repoPath, migrateDir)) {
+		return fmt.Errorf("%w: a migration was interrupted", ErrMigrationPending)
+	}
+
+	current, err := ReadVersion(repoPath)
+	if err != nil {
+		return err
+	}
+	if current > version {
+		return &RepoTooNewError{Version: current, Supported: version}
+	}
+	if current < version {
+		return fmt.Errorf("%w: repo version %d, supported version %d", ErrMigrationPending, current, version)
+	}
+
+	return nil
+}
+
+// migrateRepo brings the repo at repoPath to version with the migrations of
+// registry. The metadata files are backed up first, if a migration fails the
+// applied ones are rolled back and the backup is restored. A backup left by
+// an interrupted run is restored before the migrations run again. open
+// creates the datastore for the migrations that change it.
+func migrateRepo(repoPath string, version int, registry map[int]Migration, open func() (Datastore, error)) error {
+	backup := filepath.Join(repoPath, migrateDir)
+	if FileExists(backup) {
+		log.Warnf("restoring repo metadata of an interrupted migration of %s", repoPath)
+		if err := restoreBackup(repoPath); err != nil {
+			return err
+		}
+	}
+
+	current, err := ReadVersion(repoPath)
+	if err != nil {
+		return err
+	}
+	if current > version {
+		return &RepoTooNewError{Version: current, Supported: version}
+	}
+	if current == version {
+		if !FileExists(VersionFile(repoPath)) {
+			return writeVersion(repoPath, version)
+		}
+		return nil
+	}
+
+	// every migration has to be there before any runs
+	pending := make([]Migration, 0, version-current)
+	for v := current + 1; v <= version; v++ {
+		m, ok := registry[v]
+		if !ok {
+			return fmt.Errorf("%w %d", ErrMigrationMissing, v)
+		}
+		pending = append(pending, m)
+	}
+
+	if err := writeBackup(repoPath); err != nil {
+		return err
+	}
+
+	for i, m := range pending {
+		log.Infof("migrating repo %s to version %d", repoPath, m.Version)
+		err := applyMigration(repoPath, m, open)
+		if err == nil {
+			err = writeVersion(repoPath, m.Version)
+		}
+		if err != nil {
+			err = fmt.Errorf("migrate repo to version %d: %w", m.Version, err)
+			return errors.Join(err, rollback(repoPath, pending[:i+1]))
+		}
+	}
+
+	return os.RemoveAll(backup)
+}
+
+// applyMigration runs Apply, then Datastore with the datastore as Apply left its spec
+func applyMigration(repoPath string, m Migration, open func() (Datastore, error)) error {
+	if m.Apply != nil {
+		if err := m.Apply(repoPath); err != nil {
+			return err
+		}
+	}
+	if m.Datastore == nil {
+		return nil
+	}
+	if open == nil {
+		return errors.New("no datastore to migrate")
+	}
+
+	d, err := open()
+	if err != nil {
+		return err
+	}
+
+	err = m.Datastore(context.Background(), d)
+	return errors.Join(err, d.Close())
+}
+
+// rollback undoes the migrations in reverse order and restores the backup
+func rollback(repoPath string, applied []Migration) error {
+	var errs []error
+	for i := len(applied) - 1; i >= 0; i-- {
+		m := applied[i]
+		if m.Rollback == nil {
+			continue
+		}
+		if err := m.Rollback(repoPath); err != nil {
+			errs = append(errs, fmt.Errorf("roll back migration to version %d: %w", m.Version, err))
+		}
+	}
+	if len(errs) > 0 {
+		// the backup stays, the next open restores it
+		return errors.Join(errs...)
+	}
+
+	return restoreBackup(repoPath)
+}
+
+// writeBackup copies the metadata files into the migrate directory
+func writeBackup(repoPath string) error {
+	backup := filepath.Join(repoPath, migrateDir)
+	if err := os.RemoveAll(backup); err != nil {
+		return err
+	}
+	// files are copied into a staging directory, a partial backup is never restored
+	staging := backup + ".tmp"
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(staging, 0o755); err != nil {
+		return err
+	}
+
+	for _, name := range backupFiles {
+		b, err := os.ReadFile(filepath.Join(repoPath, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := WriteFile(filepath.Join(staging, name), b); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(staging, backup)
+}
+
+// restoreBackup puts the backed up metadata files back and removes the backup
+func restoreBackup(repoPath string) error {
+	backup := filepath.Join(repoPath, migrateDir)
+	for _, name := range backupFiles {
+		b, err := os.ReadFile(filepath.Join(backup, name))
+		if errors.Is(err, os.ErrNotExist) {
+			// the file was created by a migration
+			if err := os.Remove(filepath.Join(repoPath, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := WriteFile(filepath.Join(repoPath, name), b); err != nil {
+			return err
+		}
+	}
+
+	return os.RemoveAll(backup)
+}
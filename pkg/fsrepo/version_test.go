@@ -0,0 +1,212 @@
+package fsrepo
+
+import (
+	"context"
+	"errors"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInitWritesVersion(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir()
+
+	r, err := NewFSRepo(path)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	version, err := ReadVersion(path)
+	require.NoError(t, err)
+	require.Equal(t, RepoVersion, version)
+	require.FileExists(t, VersionFile(path))
+}
+
+func init() {
+	// the migration to version 2 is registered by the repo package, repos of
+	// these tests have none of its metadata
+	if err := AddMigration(Migration{Version: 2, Apply: func(string) error { return nil }}); err != nil {
+		panic(err)
+	}
+}
+
+func TestOpenLegacyRepoWritesVersion(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir()
+
+	r1, err := NewFSRepo(path)
+	require.NoError(t, err)
+	require.NoError(t, r1.Close())
+	require.NoError(t, os.Remove(VersionFile(path)))
+
+	r2, err := Open(path)
+	require.NoError(t, err)
+	require.NoError(t, r2.Close())
+	require.FileExists(t, VersionFile(path))
+}
+
+func TestOpenRepoTooNew(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir()
+
+	r, err := NewFSRepo(path)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.NoError(t, writeVersion(path, RepoVersion+1))
+
+	_, err = Open(path)
+	require.ErrorIs(t, err, ErrRepoTooNew)
+	var tooNew *RepoTooNewError
+	require.ErrorAs(t, err, &tooNew)
+	require.Equal(t, RepoTooNewError{Version: RepoVersion + 1, Supported: RepoVersion}, *tooNew)
+}
+
+// testMigration records its runs in the file name
+func testMigration(version int, name string, fail bool) Migration {
+	return Migration{
+		Version: version,
+		Apply: func(repoPath string) error {
+			if err := os.WriteFile(filepath.Join(repoPath, name), nil, 0o600); err != nil {
+				return err
+			}
+			if err := os.WriteFile(DatastoreSpec(repoPath), []byte(name), 0o600); err != nil {
+				return err
+			}
+			if fail {
+				return errors.New("migration failed")
+			}
+			return nil
+		},
+		Rollback: func(repoPath string) error {
+			return os.Remove(filepath.Join(repoPath, name))
+		},
+	}
+}
+
+func TestMigrateRepo(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir()
+	require.NoError(t, os.WriteFile(DatastoreSpec(path), []byte("spec"), 0o600))
+
+	registry := map[int]Migration{
+		2: testMigration(2, "two", false),
+		3: testMigration(3, "three", false),
+	}
+	require.NoError(t, migrateRepo(path, 3, registry, nil))
+
+	version, err := ReadVersion(path)
+	require.NoError(t, err)
+	require.Equal(t, 3, version)
+	require.FileExists(t, filepath.Join(path, "two"))
+	require.FileExists(t, filepath.Join(path, "three"))
+	require.NoDirExists(t, filepath.Join(path, migrateDir))
+
+	t.Log("a repo at the version is left alone")
+	require.NoError(t, migrateRepo(path, 3, nil, nil))
+
+	t.Log("a missing migration fails before any runs")
+	err = migrateRepo(path, 5, map[int]Migration{5: testMigration(5, "five", false)}, nil)
+	require.ErrorIs(t, err, ErrMigrationMissing)
+	require.NoFileExists(t, filepath.Join(path, "five"))
+}
+
+func TestMigrateRepoRollback(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir()
+	require.NoError(t, os.WriteFile(DatastoreSpec(path), []byte("spec"), 0o600))
+
+	registry := map[int]Migration{
+		2: testMigration(2, "two", false),
+		3: testMigration(3, "three", true),
+	}
+	require.Error(t, migrateRepo(path, 3, registry, nil))
+
+	version, err := ReadVersion(path)
+	require.NoError(t, err)
+	require.Equal(t, legacyVersion, version)
+	require.NoFileExists(t, VersionFile(path))
+	require.NoFileExists(t, filepath.Join(path, "two"))
+	require.NoFileExists(t, filepath.Join(path, "three"))
+	spec, err := os.ReadFile(DatastoreSpec(path))
+	require.NoError(t, err)
+	require.Equal(t, "spec", string(spec))
+	require.NoDirExists(t, filepath.Join(path, migrateDir))
+}
+
+func TestMigrateRepoInterrupted(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir()
+	require.NoError(t, os.WriteFile(DatastoreSpec(path), []byte("spec"), 0o600))
+	require.NoError(t, writeVersion(path, 1))
+	require.NoError(t, writeBackup(path))
+
+	t.Log("a migration stopped after it changed the metadata")
+	require.NoError(t, os.WriteFile(DatastoreSpec(path), []byte("half migrated"), 0o600))
+	require.NoError(t, writeVersion(path, 2))
+
+	require.NoError(t, migrateRepo(path, 2, map[int]Migration{2: testMigration(2, "two", false)}, nil))
+	spec, err := os.ReadFile(DatastoreSpec(path))
+	require.NoError(t, err)
+	require.Equal(t, "two", string(spec), "the migration runs again from the restored metadata")
+	version, err := ReadVersion(path)
+	require.NoError(t, err)
+	require.Equal(t, 2, version)
+}
+
+func TestAddMigration(t *testing.T) {
+	require.Error(t, AddMigration(Migration{Version: legacyVersion, Apply: func(string) error { return nil }}))
+	require.Error(t, AddMigration(Migration{Version: 100}))
+	require.Error(t, AddMigration(Migration{Version: 2, Apply: func(string) error { return nil }}))
+}
+
+func TestMigrateRepoDatastore(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir()
+	require.NoError(t, os.WriteFile(DatastoreSpec(path), []byte("spec"), 0o600))
+
+	ctx := context.Background()
+	key := ds.NewKey("/moved")
+	d := &closeRecorder{Datastore: dssync.MutexWrap(ds.NewMapDatastore())}
+	open := func() (Datastore, error) { return d, nil }
+
+	failing := Migration{
+		Version: 2,
+		Datastore: func(ctx context.Context, d Datastore) error {
+			return errors.New("migration failed")
+		},
+	}
+	require.Error(t, migrateRepo(path, 2, map[int]Migration{2: failing}, open))
+	require.True(t, d.closed)
+	version, err := ReadVersion(path)
+	require.NoError(t, err)
+	require.Equal(t, legacyVersion, version)
+
+	t.Log("the datastore migration runs again on the next open")
+	moving := Migration{
+		Version: 2,
+		Datastore: func(ctx context.Context, d Datastore) error {
+			return d.Put(ctx, key, nil)
+		},
+	}
+	require.NoError(t, migrateRepo(path, 2, map[int]Migration{2: moving}, open))
+	has, err := d.Has(ctx, key)
+	require.NoError(t, err)
+	require.True(t, has)
+	version, err = ReadVersion(path)
+	require.NoError(t, err)
+	require.Equal(t, 2, version)
+}
+
+// closeRecorder records that the datastore was closed
+type closeRecorder struct {
+	Datastore
+	closed bool
+}
+
+func (d *closeRecorder) Close() error {
+	d.closed = true
+	return nil
+}
@@ -1,6 +1,7 @@
 package lsblk
 
 import (
+	"errors"
 	"fmt"
 	"github.com/Xib1uvXi/ipfsrepo/pkg/linuxutils/cmd"
 	"github.com/goccy/go-json"
@@ -29,14 +30,29 @@ type BlockDevice struct {
 	Children   []*BlockDevice `json:"children,omitempty"`
 }
 
+var (
+	ErrDeviceNotFound  = errors.New("block device not found")
+	ErrDeviceAmbiguous = errors.New("more than one block device matches")
+)
+
+// Executor runs a command line, cmd.Executor runs it on the host
+type Executor interface {
+	ExecuteCmd(cmdStr string) (outStr string, errStr string, err error)
+}
+
 type Cmd struct {
-	*cmd.Executor
+	Executor
 }
 
 func NewCmd() *Cmd {
 	return &Cmd{Executor: cmd.NewExecutor()}
 }
 
+// NewCmdWithExecutor returns a Cmd running lsblk through e
+func NewCmdWithExecutor(e Executor) *Cmd {
+	return &Cmd{Executor: e}
+}
+
 // GetBlockDevices run os lsblk command for device and construct BlockDevice struct based on output
 // Receives device path. If device is empty string, info about all devices will be collected
 // Returns slice of BlockDevice structs or error if something went wrong
@@ -83,3 +99,46 @@ func (c *Cmd) SearchBlockDevice(fstype, label string, hasMountPoint bool) ([]Blo
 
 	return res, nil
 }
+
+// FindBlockDevice returns the device, partitions included, whose UUID or label is uuidOrLabel.
+// A UUID match wins over label matches, a label has to be unique.
+func (c *Cmd) FindBlockDevice(uuidOrLabel string) (*BlockDevice, error) {
+	devices, err := c.GetBlockDevices("")
+	if err != nil {
+		return nil, err
+	}
+
+	roots := make([]*BlockDevice, len(devices))
+	for i := range devices {
+		roots[i] = &devices[i]
+	}
+
+	var labeled []*BlockDevice
+	var found *BlockDevice
+	walkBlockDevices(roots, func(dev *BlockDevice) {
+		if dev.UUID == uuidOrLabel && found == nil {
+			found = dev
+		}
+		if dev.Label == uuidOrLabel {
+			labeled = append(labeled, dev)
+		}
+	})
+
+	switch {
+	case found != nil:
+		return found, nil
+	case len(labeled) == 1:
+		return labeled[0], nil
+	case len(labeled) > 1:
+		return nil, fmt.Errorf("%w: label %s", ErrDeviceAmbiguous, uuidOrLabel)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrDeviceNotFound, uuidOrLabel)
+	}
+}
+
+func walkBlockDevices(devices []*BlockDevice, fn func(dev *BlockDevice)) {
+	for _, dev := range devices {
+		fn(dev)
+		walkBlockDevices(dev.Children, fn)
+	}
+}
@@ -0,0 +1,46 @@
+package lsblk
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// fakeExecutor returns canned output instead of running commands
+type fakeExecutor struct {
+	out string
+}
+
+func (e *fakeExecutor) ExecuteCmd(string) (string, string, error) {
+	return e.out, "", nil
+}
+
+const testOutput = `{
+   "blockdevices": [
+      {"name":"/dev/sda", "type":"disk", "size":500107862016, "rota":true, "mountpoint":null, "fstype":null, "partuuid":null, "label":null, "uuid":null,
+         "children": [
+            {"name":"/dev/sda1", "type":"part", "size":250053931008, "rota":true, "mountpoint":"/mnt/data1", "fstype":"ext4", "partuuid":"1c7b-01", "label":"data", "uuid":"6a4c-1111"},
+            {"name":"/dev/sda2", "type":"part", "size":250053931008, "rota":true, "mountpoint":null, "fstype":"ext4", "partuuid":"1c7b-02", "label":"data", "uuid":"6a4c-2222"}
+         ]
+      },
+      {"name":"/dev/sdb", "type":"disk", "size":1000204886016, "rota":false, "mountpoint":"/mnt/backup", "fstype":"xfs", "partuuid":null, "label":"backup", "uuid":"9f1e-3333"}
+   ]
+}`
+
+func TestCmd_FindBlockDevice(t *testing.T) {
+	c := NewCmdWithExecutor(&fakeExecutor{out: testOutput})
+
+	dev, err := c.FindBlockDevice("6a4c-2222")
+	require.NoError(t, err)
+	require.Equal(t, "/dev/sda2", dev.Name)
+
+	dev, err = c.FindBlockDevice("backup")
+	require.NoError(t, err)
+	require.Equal(t, "/mnt/backup", dev.MountPoint)
+	require.Equal(t, uint64(1000204886016), dev.Size)
+
+	_, err = c.FindBlockDevice("data")
+	require.ErrorIs(t, err, ErrDeviceAmbiguous)
+
+	_, err = c.FindBlockDevice("missing")
+	require.ErrorIs(t, err, ErrDeviceNotFound)
+}
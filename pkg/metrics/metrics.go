@@ -0,0 +1,205 @@
+package metrics
+
+import (
+	"errors"
+	"github.com/ipfs/go-metrics-interface"
+	"github.com/prometheus/client_golang/prometheus"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var defaultCollector = NewCollector()
+
+// Inject makes the metrics created through go-metrics-interface, like the
+// ones of go-ds-measure, Prometheus metrics collected by Default. Datastores
+// created before have no metrics. It is a no-op if an implementation was
+// injected already.
+func Inject() error {
+	err := metrics.InjectImpl(defaultCollector.New)
+	if errors.Is(err, metrics.ErrImplemented) {
+		return nil
+	}
+	return err
+}
+
+// Labeled returns a go-metrics-interface prefix whose metrics get labels in
+// Prometheus, like the repo a datastore belongs to. Metrics of the same name
+// share a metric vector, one series per label values.
+func Labeled(prefix string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return prefix
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + labels[name]
+	}
+	return prefix + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// parseLabels splits the labels Labeled added off name
+func parseLabels(name string) (string, prometheus.Labels) {
+	start, end := strings.Index(name, "{"), strings.LastIndex(name, "}")
+	if start < 0 || end < start {
+		return name, nil
+	}
+
+	labels := make(prometheus.Labels)
+	for _, pair := range strings.Split(name[start+1:end], ",") {
+		label, value, _ := strings.Cut(pair, "=")
+		labels[label] = value
+	}
+	return name[:start] + name[end+1:], labels
+}
+
+// Default returns the collector Inject feeds
+func Default() *Collector {
+	return defaultCollector
+}
+
+// Collector implements go-metrics-interface with Prometheus metrics and
+// collects all of them. Metrics created twice with the same name are shared.
+type Collector struct {
+	mu      sync.Mutex
+	metrics map[string]prometheus.Collector
+}
+
+func NewCollector() *Collector {
+	return &Collector{metrics: make(map[string]prometheus.Collector)}
+}
+
+// New is a go-metrics-interface constructor, dots in name become underscores.
+// The labels of a name from Labeled become Prometheus labels.
+func (c *Collector) New(name, help string) metrics.Creator {
+	name, labels := parseLabels(name)
+	return &creator{collector: c, name: promName(name), help: help, labels: labels}
+}
+
+// Describe sends no descriptions, the collector is unchecked as metrics are created over time
+func (c *Collector) Describe(chan<- *prometheus.Desc) {}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	collectors := make([]prometheus.Collector, 0, len(c.metrics))
+	for _, m := range c.metrics {
+		collectors = append(collectors, m)
+	}
+	c.mu.Unlock()
+
+	for _, m := range collectors {
+		m.Collect(ch)
+	}
+}
+
+// get returns the metric with the given name, or creates it. A name reused
+// for another kind of metric gets a metric that is not collected.
+func get[T prometheus.Collector](c *Collector, name string, create func() T) T {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if m, ok := c.metrics[name]; ok {
+		if m, ok := m.(T); ok {
+			return m
+		}
+		return create()
+	}
+
+	m := create()
+	c.metrics[name] = m
+	return m
+}
+
+// vec is a Prometheus metric vector
+type vec[T any] interface {
+	prometheus.Collector
+	GetMetricWith(prometheus.Labels) (T, error)
+}
+
+// getWith returns the metric with the given labels of the vector with the
+// given name, or creates them. Labels the vector was not created with get a
+// metric that is not collected.
+func getWith[T any, V vec[T]](c *Collector, name string, labels prometheus.Labels, create func() V, uncollected func() T) T {
+	m, err := get(c, name, create).GetMetricWith(labels)
+	if err != nil {
+		return uncollected()
+	}
+	return m
+}
+
+type creator struct {
+	collector *Collector
+	name      string
+	help      string
+	labels    prometheus.Labels
+}
+
+// labelNames returns the names of the labels of the metric
+func (c *creator) labelNames() []string {
+	names := make([]string, 0, len(c.labels))
+	for name := range c.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *creator) Counter() metrics.Counter {
+	opts := prometheus.CounterOpts{Name: c.name, Help: c.help}
+	create := func() prometheus.Counter { return prometheus.NewCounter(opts) }
+	if c.labels == nil {
+		return get(c.collector, c.name, create)
+	}
+	return getWith(c.collector, c.name, c.labels, func() *prometheus.CounterVec {
+		return prometheus.NewCounterVec(opts, c.labelNames())
+	}, create)
+}
+
+func (c *creator) Gauge() metrics.Gauge {
+	opts := prometheus.GaugeOpts{Name: c.name, Help: c.help}
+	create := func() prometheus.Gauge { return prometheus.NewGauge(opts) }
+	if c.labels == nil {
+		return get(c.collector, c.name, create)
+	}
+	return getWith(c.collector, c.name, c.labels, func() *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(opts, c.labelNames())
+	}, create)
+}
+
+func (c *creator) Histogram(buckets []float64) metrics.Histogram {
+	opts := prometheus.HistogramOpts{Name: c.name, Help: c.help, Buckets: buckets}
+	if c.labels == nil {
+		return get(c.collector, c.name, func() prometheus.Histogram { return prometheus.NewHistogram(opts) })
+	}
+	return getWith(c.collector, c.name, c.labels, func() *prometheus.HistogramVec {
+		return prometheus.NewHistogramVec(opts, c.labelNames())
+	}, func() prometheus.Observer { return prometheus.NewHistogram(opts) })
+}
+
+func (c *creator) Summary(summaryOpts metrics.SummaryOpts) metrics.Summary {
+	opts := prometheus.SummaryOpts{
+		Name:       c.name,
+		Help:       c.help,
+		Objectives: summaryOpts.Objectives,
+		MaxAge:     summaryOpts.MaxAge,
+		AgeBuckets: summaryOpts.AgeBuckets,
+		BufCap:     summaryOpts.BufCap,
+	}
+	if c.labels == nil {
+		return get(c.collector, c.name, func() prometheus.Summary { return prometheus.NewSummary(opts) })
+	}
+	return getWith(c.collector, c.name, c.labels, func() *prometheus.SummaryVec {
+		return prometheus.NewSummaryVec(opts, c.labelNames())
+	}, func() prometheus.Observer { return prometheus.NewSummary(opts) })
+}
+
+// promName turns a dot separated go-metrics-interface name into a Prometheus one
+func promName(name string) string {
+	return strings.NewReplacer(".", "_", "-", "_").Replace(strings.TrimPrefix(name, "."))
+}
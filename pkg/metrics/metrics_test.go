@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCollector(t *testing.T) {
+	c := NewCollector()
+
+	c.New("flatfs.datastore.put_total", "puts").Counter().Inc()
+	c.New("flatfs.datastore.put_total", "puts").Counter().Add(2)
+	c.New("flatfs.datastore.put.latency_seconds", "latency").Histogram([]float64{1}).Observe(0.5)
+
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(c))
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	require.Len(t, families, 2)
+
+	for _, f := range families {
+		switch f.GetName() {
+		case "flatfs_datastore_put_total":
+			require.Equal(t, 3.0, f.GetMetric()[0].GetCounter().GetValue())
+		case "flatfs_datastore_put_latency_seconds":
+			require.Equal(t, uint64(1), f.GetMetric()[0].GetHistogram().GetSampleCount())
+		default:
+			t.Fatalf("unexpected metric %s", f.GetName())
+		}
+	}
+}
+
+func TestCollector_Labeled(t *testing.T) {
+	c := NewCollector()
+	c.New(Labeled("flatfs.datastore", map[string]string{"repo": "a"})+".put_total", "puts").Counter().Inc()
+	c.New(Labeled("flatfs.datastore", map[string]string{"repo": "b"})+".put_total", "puts").Counter().Add(2)
+
+	t.Log("other label names get a metric that is not collected")
+	c.New(Labeled("flatfs.datastore", map[string]string{"disk": "a"})+".put_total", "puts").Counter().Inc()
+
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(c))
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	require.Len(t, families, 1)
+	require.Equal(t, "flatfs_datastore_put_total", families[0].GetName())
+
+	values := make(map[string]float64)
+	for _, m := range families[0].GetMetric() {
+		require.Len(t, m.GetLabel(), 1)
+		values[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+	}
+	require.Equal(t, map[string]float64{"a": 1, "b": 2}, values)
+}
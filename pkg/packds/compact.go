@@ -0,0 +1,170 @@
+package packds
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// CompactResult reports what a compaction reclaimed
+type CompactResult struct {
+	Packs int
+	// Moved is the number of live records copied to the active pack
+	Moved int
+	// Freed is the size of the packs removed, less what was moved
+	Freed int64
+}
+
+// loop is a background goroutine that periodically compacts the packs
+func (d *Datastore) loop() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.opts.CompactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.closing:
+			return
+		case <-ticker.C:
+			if _, err := d.Compact(); err != nil && !errors.Is(err, ErrClosed) {
+				log.Errorf("compact: %s", err)
+			}
+		}
+	}
+}
+
+// Compact rewrites the live records of every pack whose deleted share reaches
+// the compact ratio into the active pack, and removes the pack. A compaction
+// that is called while another one runs waits for it.
+func (d *Datastore) Compact() (*CompactResult, error) {
+	d.compactMu.Lock()
+	defer d.compactMu.Unlock()
+
+	result := &CompactResult{}
+
+	for _, id := range d.candidates() {
+		moved, freed, err := d.compactPack(id)
+		result.Moved += moved
+		result.Freed += freed
+		if err != nil {
+			return result, err
+		}
+		result.Packs++
+	}
+
+	return result, nil
+}
+
+// candidates returns the packs that are worth compacting, never the active one
+func (d *Datastore) candidates() []uint32 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var ids []uint32
+	for _, id := range d.ids() {
+		if id == d.active {
+			continue
+		}
+		size := d.sizes[id]
+		if size == 0 || float64(d.dead[id]) >= d.opts.CompactRatio*float64(size) {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// compactPack moves the records of the pack that are still indexed to the
+// active pack one at a time, so writes go on in between, then removes the pack
+func (d *Datastore) compactPack(id uint32) (int, int64, error) {
+	d.mu.RLock()
+	f, size := d.packs[id], d.sizes[id]
+	d.mu.RUnlock()
+
+	var moved int
+	var movedBytes int64
+	var offset int64
+	for {
+		rec, err := readRecord(f, offset, size)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return moved, 0, err
+		}
+
+		loc := location{pack: id, offset: offset, size: rec.size()}
+		offset += loc.size
+		if rec.deleted {
+			continue
+		}
+
+		ok, err := d.move(rec, loc)
+		if err != nil {
+			return moved, 0, err
+		}
+		if ok {
+			moved++
+			movedBytes += loc.size
+		}
+	}
+
+	return moved, size - movedBytes, d.removePack(id)
+}
+
+// move copies rec to the active pack if the index still points at loc
+func (d *Datastore) move(rec *record, loc location) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return false, ErrClosed
+	}
+
+	current, ok, err := d.lookup(rec.key)
+	if err != nil || !ok || current != loc {
+		return false, err
+	}
+
+	b := rec.encode()
+	if err := d.makeRoom(int64(len(b))); err != nil {
+		return false, err
+	}
+	moved, err := d.appendRecord(b)
+	if err != nil {
+		d.reset()
+		return false, err
+	}
+	d.applyPut(rec.key, moved)
+
+	return true, d.commit(false)
+}
+
+// removePack makes the moved records durable before the pack is dropped from the index and removed
+func (d *Datastore) removePack(id uint32) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return ErrClosed
+	}
+
+	if err := d.packs[d.active].Sync(); err != nil {
+		return err
+	}
+
+	delete(d.dead, id)
+	d.pendingPacks[id] = struct{}{}
+	if err := d.commit(true); err != nil {
+		return err
+	}
+
+	f := d.packs[id]
+	delete(d.packs, id)
+	delete(d.sizes, id)
+	_ = f.Close()
+
+	return os.Remove(d.packPath(id))
+}
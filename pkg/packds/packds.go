@@ -0,0 +1,733 @@
+// Package packds is a datastore that appends values to large pack files and
+// keeps the location of every key in a leveldb index. Deleted and overwritten
+// values are reclaimed by compacting packs in the background.
+package packds
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var log = logging.Logger("packds")
+
+const (
+	DefaultPackSize        = 256 << 20
+	DefaultCompactInterval = 10 * time.Minute
+	DefaultCompactRatio    = 0.5
+
+	packsDir = "packs"
+	indexDir = "index"
+	packExt  = ".pack"
+)
+
+// index keys
+var (
+	keyPrefix  = []byte("k")
+	packPrefix = []byte("p")
+	tailKey    = []byte("t")
+)
+
+var (
+	ErrClosed = errors.New("packds: datastore is closed")
+	// ErrNoIndex is returned for a datastore with packs but without an index, opening it would overwrite them
+	ErrNoIndex = errors.New("packds: the index of the packs is missing")
+)
+
+type Options struct {
+	// PackSize is the size a pack grows to before the next one is started
+	PackSize int64
+	// Sync makes every write durable before it returns
+	Sync bool
+	// CompactInterval is how often packs are compacted, zero turns compaction off
+	CompactInterval time.Duration
+	// CompactRatio is the share of a pack that has to be deleted or overwritten before it is compacted
+	CompactRatio float64
+}
+
+func DefaultOptions() Options {
+	return Options{
+		PackSize:        DefaultPackSize,
+		Sync:            true,
+		CompactInterval: DefaultCompactInterval,
+		CompactRatio:    DefaultCompactRatio,
+	}
+}
+
+// Datastore appends every write to the active pack. The index maps keys to
+// their records, and it keeps the deleted bytes of every pack and how far the
+// active pack is indexed, so writes that did not make it into the index are
+// replayed from the pack when it is opened.
+type Datastore struct {
+	path  string
+	opts  Options
+	index *leveldb.DB
+
+	// mu is held for writing by writes, compaction and Close, and for reading by reads
+	mu sync.RWMutex
+	// compactMu runs one compaction at a time
+	compactMu sync.Mutex
+	// writeAt writes to a pack, tests make it fail
+	writeAt func(f *os.File, b []byte, off int64) (int, error)
+	packs   map[uint32]*os.File
+	// sizes are the sizes of the packs, the one of the active pack is its tail
+	sizes  map[uint32]int64
+	dead   map[uint32]int64
+	active uint32
+
+	// the index updates of appended records until they are committed
+	pending      *leveldb.Batch
+	pendingLocs  map[string]*location
+	pendingPacks map[uint32]struct{}
+
+	closed  bool
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+var _ ds.Batching = (*Datastore)(nil)
+var _ ds.PersistentDatastore = (*Datastore)(nil)
+
+// NewDatastore opens the datastore at path, creating it if it does not exist
+func NewDatastore(path string, opts Options) (*Datastore, error) {
+	if opts.PackSize <= 0 {
+		opts.PackSize = DefaultPackSize
+	}
+	if opts.CompactRatio <= 0 {
+		opts.CompactRatio = DefaultCompactRatio
+	}
+
+	if err := os.MkdirAll(filepath.Join(path, packsDir), 0o755); err != nil {
+		return nil, err
+	}
+
+	index, err := leveldb.OpenFile(filepath.Join(path, indexDir), &opt.Options{
+		Compression: opt.NoCompression,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Datastore{
+		path:    path,
+		opts:    opts,
+		index:   index,
+		packs:   make(map[uint32]*os.File),
+		sizes:   make(map[uint32]int64),
+		dead:    make(map[uint32]int64),
+		closing: make(chan struct{}),
+		writeAt: (*os.File).WriteAt,
+	}
+	d.reset()
+
+	if err := d.open(); err != nil {
+		d.closeFiles()
+		_ = index.Close()
+		return nil, err
+	}
+
+	if opts.CompactInterval > 0 {
+		d.wg.Add(1)
+		go d.loop()
+	}
+
+	return d, nil
+}
+
+// open loads the packs and replays the records of the active pack that are not indexed yet
+func (d *Datastore) open() error {
+	it := d.index.NewIterator(util.BytesPrefix(packPrefix), nil)
+	for it.Next() {
+		id := binary.BigEndian.Uint32(it.Key()[len(packPrefix):])
+		d.dead[id] = int64(binary.BigEndian.Uint64(it.Value()))
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		return err
+	}
+
+	tail, err := d.index.Get(tailKey, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		// a new datastore, unless the index was lost
+		if err := d.checkNoPacks(); err != nil {
+			return err
+		}
+		return d.create(1)
+	}
+	if err != nil {
+		return err
+	}
+	d.active = binary.BigEndian.Uint32(tail)
+	indexed := int64(binary.BigEndian.Uint64(tail[4:]))
+
+	if err := d.removeOrphans(); err != nil {
+		return err
+	}
+
+	for id := range d.dead {
+		f, err := os.OpenFile(d.packPath(id), os.O_RDWR, 0o644)
+		if err != nil {
+			return err
+		}
+		d.packs[id] = f
+
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		d.sizes[id] = info.Size()
+	}
+
+	return d.replay(indexed)
+}
+
+// checkNoPacks returns ErrNoIndex if there are packs, the index can not be
+// rebuilt from them as compaction may have dropped the tombstones of records
+// that are still in older packs
+func (d *Datastore) checkNoPacks() error {
+	entries, err := os.ReadDir(filepath.Join(d.path, packsDir))
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), packExt) {
+			return fmt.Errorf("%w: %s has %s", ErrNoIndex, filepath.Join(d.path, packsDir), e.Name())
+		}
+	}
+
+	return nil
+}
+
+// removeOrphans removes the packs the index does not know, a new pack that
+// was never written to or one whose compaction was done
+func (d *Datastore) removeOrphans() error {
+	entries, err := os.ReadDir(filepath.Join(d.path, packsDir))
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), packExt)
+		id, err := strconv.ParseUint(name, 10, 32)
+		if err != nil || name == e.Name() {
+			continue
+		}
+		if _, ok := d.dead[uint32(id)]; ok {
+			continue
+		}
+
+		log.Infof("removing orphan pack %s", e.Name())
+		if err := os.Remove(filepath.Join(d.path, packsDir, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replay indexes the records of the active pack after offset, and cuts off a record that was not written completely
+func (d *Datastore) replay(offset int64) error {
+	f := d.packs[d.active]
+	size := d.sizes[d.active]
+
+	replayed := 0
+	for {
+		rec, err := readRecord(f, offset, size)
+		if errors.Is(err, errTorn) {
+			log.Warnf("truncating pack %d at %d, dropping %d bytes of a torn write", d.active, offset, size-offset)
+			if err := f.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		loc := location{pack: d.active, offset: offset, size: rec.size()}
+		if rec.deleted {
+			d.applyDelete(rec.key, loc)
+		} else {
+			d.applyPut(rec.key, loc)
+		}
+		offset += loc.size
+		replayed++
+	}
+
+	d.sizes[d.active] = offset
+	if replayed > 0 {
+		log.Infof("replayed %d records of pack %d", replayed, d.active)
+	}
+	return d.commit(true)
+}
+
+// create starts the pack id and makes it the active one
+func (d *Datastore) create(id uint32) error {
+	f, err := os.OpenFile(d.packPath(id), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	d.packs[id] = f
+	d.sizes[id] = 0
+	d.dead[id] = 0
+	d.pendingPacks[id] = struct{}{}
+	d.active = id
+	return d.commit(true)
+}
+
+// rotate makes the current records durable and starts the next pack
+func (d *Datastore) rotate() error {
+	if err := d.packs[d.active].Sync(); err != nil {
+		return err
+	}
+	if err := d.commit(true); err != nil {
+		return err
+	}
+
+	return d.create(d.active + 1)
+}
+
+func (d *Datastore) packPath(id uint32) string {
+	return filepath.Join(d.path, packsDir, fmt.Sprintf("%08d%s", id, packExt))
+}
+
+// makeRoom starts the next pack unless size more bytes fit into the active one
+func (d *Datastore) makeRoom(size int64) error {
+	if d.sizes[d.active] > 0 && d.sizes[d.active]+size > d.opts.PackSize {
+		return d.rotate()
+	}
+	return nil
+}
+
+// appendRecord writes the encoded record b to the active pack and returns where
+func (d *Datastore) appendRecord(b []byte) (location, error) {
+	f, offset := d.packs[d.active], d.sizes[d.active]
+	if _, err := d.writeAt(f, b, offset); err != nil {
+		_ = f.Truncate(offset)
+		return location{}, err
+	}
+	d.sizes[d.active] += int64(len(b))
+
+	return location{pack: d.active, offset: offset, size: int64(len(b))}, nil
+}
+
+// lookup returns the location of key, including the updates that are not committed yet
+func (d *Datastore) lookup(key []byte) (location, bool, error) {
+	if loc, ok := d.pendingLocs[string(key)]; ok {
+		if loc == nil {
+			return location{}, false, nil
+		}
+		return *loc, true, nil
+	}
+
+	b, err := d.index.Get(indexKey(key), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return location{}, false, nil
+	}
+	if err != nil {
+		return location{}, false, err
+	}
+
+	loc, err := parseLocation(b)
+	return loc, err == nil, err
+}
+
+func (d *Datastore) applyPut(key []byte, loc location) {
+	if old, ok, _ := d.lookup(key); ok {
+		d.addDead(old)
+	}
+
+	d.pending.Put(indexKey(key), loc.bytes())
+	d.pendingLocs[string(key)] = &loc
+}
+
+func (d *Datastore) applyDelete(key []byte, tombstone location) {
+	if old, ok, _ := d.lookup(key); ok {
+		d.addDead(old)
+	}
+	d.addDead(tombstone)
+
+	d.pending.Delete(indexKey(key))
+	d.pendingLocs[string(key)] = nil
+}
+
+func (d *Datastore) addDead(loc location) {
+	if _, ok := d.dead[loc.pack]; !ok {
+		// the pack was compacted already
+		return
+	}
+	d.dead[loc.pack] += loc.size
+	d.pendingPacks[loc.pack] = struct{}{}
+}
+
+// commit writes the pending index updates and how far the active pack is indexed
+func (d *Datastore) commit(sync bool) error {
+	for id := range d.pendingPacks {
+		dead, ok := d.dead[id]
+		if !ok {
+			d.pending.Delete(packKey(id))
+			continue
+		}
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(dead))
+		d.pending.Put(packKey(id), b)
+	}
+
+	tail := make([]byte, 12)
+	binary.BigEndian.PutUint32(tail, d.active)
+	binary.BigEndian.PutUint64(tail[4:], uint64(d.sizes[d.active]))
+	d.pending.Put(tailKey, tail)
+
+	err := d.index.Write(d.pending, &opt.WriteOptions{Sync: sync})
+	d.reset()
+	return err
+}
+
+func (d *Datastore) reset() {
+	d.pending = new(leveldb.Batch)
+	d.pendingLocs = make(map[string]*location)
+	d.pendingPacks = make(map[uint32]struct{})
+}
+
+// write appends the records of ops to the active pack and indexes them. They
+// go to the same pack, so a failed write leaves the pack and index as they were.
+func (d *Datastore) write(ops []op) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return ErrClosed
+	}
+
+	records := make([][]byte, len(ops))
+	// exists are the keys of ops that came before, deleting a missing key writes nothing
+	exists := make(map[ds.Key]bool)
+	var size int64
+	for i, o := range ops {
+		if o.deleted {
+			ok, seen := exists[o.key]
+			if !seen {
+				var err error
+				if _, ok, err = d.lookup(o.key.Bytes()); err != nil {
+					return err
+				}
+			}
+			if !ok {
+				continue
+			}
+		}
+		exists[o.key] = !o.deleted
+
+		records[i] = (&record{key: o.key.Bytes(), value: o.value, deleted: o.deleted}).encode()
+		size += int64(len(records[i]))
+	}
+	if size == 0 {
+		return nil
+	}
+	if err := d.makeRoom(size); err != nil {
+		return err
+	}
+
+	start := d.sizes[d.active]
+	dead := maps.Clone(d.dead)
+	rollback := func(err error) error {
+		if terr := d.packs[d.active].Truncate(start); terr != nil {
+			log.Errorf("truncate pack %d after a failed write: %s", d.active, terr)
+		}
+		d.sizes[d.active] = start
+		d.dead = dead
+		d.reset()
+		return err
+	}
+
+	for i, o := range ops {
+		if records[i] == nil {
+			continue
+		}
+
+		loc, err := d.appendRecord(records[i])
+		if err != nil {
+			return rollback(err)
+		}
+
+		if o.deleted {
+			d.applyDelete(o.key.Bytes(), loc)
+		} else {
+			d.applyPut(o.key.Bytes(), loc)
+		}
+	}
+
+	if d.opts.Sync {
+		if err := d.packs[d.active].Sync(); err != nil {
+			return rollback(err)
+		}
+	}
+
+	// the index does not need to be synced, records it misses are replayed from the pack
+	if err := d.commit(false); err != nil {
+		return rollback(err)
+	}
+	return nil
+}
+
+type op struct {
+	key     ds.Key
+	value   []byte
+	deleted bool
+}
+
+func (d *Datastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	return d.write([]op{{key: key, value: value}})
+}
+
+func (d *Datastore) Delete(ctx context.Context, key ds.Key) error {
+	return d.write([]op{{key: key, deleted: true}})
+}
+
+// get returns the value of key, or only its location if value is false
+func (d *Datastore) get(key ds.Key, value bool) ([]byte, location, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return nil, location{}, ErrClosed
+	}
+
+	loc, ok, err := d.lookup(key.Bytes())
+	if err != nil {
+		return nil, location{}, err
+	}
+	if !ok {
+		return nil, location{}, ds.ErrNotFound
+	}
+	if !value {
+		return nil, loc, nil
+	}
+
+	rec, err := readRecord(d.packs[loc.pack], loc.offset, loc.offset+loc.size)
+	if err != nil {
+		return nil, location{}, fmt.Errorf("packds: read %s from pack %d at %d: %w", key, loc.pack, loc.offset, err)
+	}
+	if string(rec.key) != string(key.Bytes()) || rec.deleted {
+		return nil, location{}, fmt.Errorf("packds: pack %d at %d does not hold %s", loc.pack, loc.offset, key)
+	}
+
+	return rec.value, loc, nil
+}
+
+func (d *Datastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	value, _, err := d.get(key, true)
+	return value, err
+}
+
+func (d *Datastore) Has(ctx context.Context, key ds.Key) (bool, error) {
+	_, _, err := d.get(key, false)
+	if errors.Is(err, ds.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d *Datastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	_, loc, err := d.get(key, false)
+	if err != nil {
+		return -1, err
+	}
+	return loc.valueSize(key.Bytes()), nil
+}
+
+// Query iterates a snapshot of the index, values are read when they are reached
+func (d *Datastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return nil, ErrClosed
+	}
+
+	snapshot, err := d.index.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	prefix := append(append([]byte(nil), keyPrefix...), []byte(q.Prefix)...)
+	it := snapshot.NewIterator(util.BytesPrefix(prefix), nil)
+
+	next := func() (query.Result, bool) {
+		for it.Next() {
+			key := ds.RawKey(string(it.Key()[len(keyPrefix):]))
+			loc, err := parseLocation(it.Value())
+			if err != nil {
+				return query.Result{Error: err}, true
+			}
+
+			entry := query.Entry{Key: key.String(), Size: loc.valueSize(key.Bytes())}
+			if !q.KeysOnly {
+				value, _, err := d.get(key, true)
+				if errors.Is(err, ds.ErrNotFound) {
+					// deleted since the snapshot
+					continue
+				}
+				if err != nil {
+					return query.Result{Error: err}, true
+				}
+				entry.Value = value
+				entry.Size = len(value)
+			}
+			return query.Result{Entry: entry}, true
+		}
+
+		if err := it.Error(); err != nil {
+			return query.Result{Error: err}, true
+		}
+		return query.Result{}, false
+	}
+
+	results := query.ResultsFromIterator(q, query.Iterator{
+		Next: next,
+		Close: func() error {
+			it.Release()
+			snapshot.Release()
+			return nil
+		},
+	})
+
+	return query.NaiveQueryApply(q, results), nil
+}
+
+// Sync makes the writes durable, the prefix is ignored
+func (d *Datastore) Sync(ctx context.Context, prefix ds.Key) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return ErrClosed
+	}
+
+	if err := d.packs[d.active].Sync(); err != nil {
+		return err
+	}
+	return d.commit(true)
+}
+
+// DiskUsage is the size of the packs and of the index
+func (d *Datastore) DiskUsage(ctx context.Context) (uint64, error) {
+	d.mu.RLock()
+	var usage uint64
+	for _, size := range d.sizes {
+		usage += uint64(size)
+	}
+	d.mu.RUnlock()
+
+	err := filepath.WalkDir(filepath.Join(d.path, indexDir), func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		usage += uint64(info.Size())
+		return nil
+	})
+
+	return usage, err
+}
+
+func (d *Datastore) Batch(ctx context.Context) (ds.Batch, error) {
+	return &batch{ds: d}, nil
+}
+
+// Close stops the compaction and makes the writes durable
+func (d *Datastore) Close() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return ErrClosed
+	}
+	d.closed = true
+	close(d.closing)
+	d.mu.Unlock()
+
+	d.wg.Wait()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	err := d.packs[d.active].Sync()
+	if err == nil {
+		err = d.commit(true)
+	}
+	d.closeFiles()
+	if cerr := d.index.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+func (d *Datastore) closeFiles() {
+	for _, f := range d.packs {
+		_ = f.Close()
+	}
+}
+
+// ids returns the ids of the packs in order
+func (d *Datastore) ids() []uint32 {
+	ids := make([]uint32, 0, len(d.packs))
+	for id := range d.packs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids
+}
+
+func indexKey(key []byte) []byte {
+	return append(append([]byte(nil), keyPrefix...), key...)
+}
+
+func packKey(id uint32) []byte {
+	b := append([]byte(nil), packPrefix...)
+	return binary.BigEndian.AppendUint32(b, id)
+}
+
+// batch buffers its operations, they are written to the active pack together on commit
+type batch struct {
+	ds  *Datastore
+	ops []op
+}
+
+func (b *batch) Put(ctx context.Context, key ds.Key, value []byte) error {
+	b.ops = append(b.ops, op{key: key, value: value})
+	return nil
+}
+
+func (b *batch) Delete(ctx context.Context, key ds.Key) error {
+	b.ops = append(b.ops, op{key: key, deleted: true})
+	return nil
+}
+
+func (b *batch) Commit(ctx context.Context) error {
+	return b.ds.write(b.ops)
+}
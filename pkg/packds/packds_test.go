@@ -0,0 +1,299 @@
+package packds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func testOptions() Options {
+	opts := DefaultOptions()
+	opts.PackSize = 4 << 10
+	opts.CompactInterval = 0
+	return opts
+}
+
+func testKey(i int) ds.Key {
+	return ds.NewKey(fmt.Sprintf("/blocks/KEY%03d", i))
+}
+
+func testValue(i int) []byte {
+	return []byte(fmt.Sprintf("value of block %03d, padded to a few hundred bytes %0200d", i, i))
+}
+
+func TestDatastore(t *testing.T) {
+	ctx := context.Background()
+	d, err := NewDatastore(t.TempDir(), testOptions())
+	require.NoError(t, err)
+	defer d.Close()
+
+	for i := 0; i < 50; i++ {
+		require.NoError(t, d.Put(ctx, testKey(i), testValue(i)))
+	}
+	require.Greater(t, len(d.packs), 1, "writes rotate to new packs")
+
+	value, err := d.Get(ctx, testKey(7))
+	require.NoError(t, err)
+	require.Equal(t, testValue(7), value)
+
+	size, err := d.GetSize(ctx, testKey(7))
+	require.NoError(t, err)
+	require.Equal(t, len(testValue(7)), size)
+
+	require.NoError(t, d.Delete(ctx, testKey(7)))
+	require.NoError(t, d.Delete(ctx, testKey(7)), "deleting a missing key succeeds")
+	_, err = d.Get(ctx, testKey(7))
+	require.ErrorIs(t, err, ds.ErrNotFound)
+	has, err := d.Has(ctx, testKey(7))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	require.NoError(t, d.Put(ctx, ds.NewKey("/other"), []byte("other")))
+	results, err := d.Query(ctx, query.Query{Prefix: "/blocks"})
+	require.NoError(t, err)
+	entries, err := results.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 49)
+	for _, e := range entries {
+		var i int
+		_, err := fmt.Sscanf(e.Key, "/blocks/KEY%03d", &i)
+		require.NoError(t, err)
+		require.Equal(t, testValue(i), e.Value)
+	}
+
+	usage, err := d.DiskUsage(ctx)
+	require.NoError(t, err)
+	require.Greater(t, usage, uint64(50*len(testValue(0))))
+}
+
+func TestBatch(t *testing.T) {
+	ctx := context.Background()
+	d, err := NewDatastore(t.TempDir(), testOptions())
+	require.NoError(t, err)
+	defer d.Close()
+
+	b, err := d.Batch(ctx)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, b.Put(ctx, testKey(i), testValue(i)))
+	}
+	require.NoError(t, b.Delete(ctx, testKey(3)))
+
+	has, err := d.Has(ctx, testKey(0))
+	require.NoError(t, err)
+	require.False(t, has, "nothing is written before commit")
+
+	require.NoError(t, b.Commit(ctx))
+	has, err = d.Has(ctx, testKey(0))
+	require.NoError(t, err)
+	require.True(t, has)
+	has, err = d.Has(ctx, testKey(3))
+	require.NoError(t, err)
+	require.False(t, has)
+}
+
+func TestFailedBatch(t *testing.T) {
+	ctx := context.Background()
+	path := t.TempDir()
+
+	d, err := NewDatastore(path, testOptions())
+	require.NoError(t, err)
+	require.NoError(t, d.Put(ctx, testKey(0), testValue(0)))
+	size, dead := d.sizes[d.active], d.dead[d.active]
+
+	t.Log("the second record of a batch fails")
+	writes := 0
+	d.writeAt = func(f *os.File, b []byte, off int64) (int, error) {
+		if writes++; writes == 2 {
+			return 0, errors.New("disk full")
+		}
+		return f.WriteAt(b, off)
+	}
+	b, err := d.Batch(ctx)
+	require.NoError(t, err)
+	require.NoError(t, b.Put(ctx, testKey(0), testValue(1)))
+	require.NoError(t, b.Put(ctx, testKey(1), testValue(1)))
+	require.Error(t, b.Commit(ctx))
+
+	require.Equal(t, size, d.sizes[d.active], "the pack is truncated to where the batch started")
+	require.Equal(t, dead, d.dead[d.active], "the overwritten record is not dead")
+	value, err := d.Get(ctx, testKey(0))
+	require.NoError(t, err)
+	require.Equal(t, testValue(0), value)
+
+	t.Log("nothing of the batch is replayed")
+	require.NoError(t, d.Close())
+	d, err = NewDatastore(path, testOptions())
+	require.NoError(t, err)
+	defer d.Close()
+	value, err = d.Get(ctx, testKey(0))
+	require.NoError(t, err)
+	require.Equal(t, testValue(0), value)
+	_, err = d.Get(ctx, testKey(1))
+	require.ErrorIs(t, err, ds.ErrNotFound)
+}
+
+func TestMissingIndex(t *testing.T) {
+	ctx := context.Background()
+	path := t.TempDir()
+
+	d, err := NewDatastore(path, testOptions())
+	require.NoError(t, err)
+	require.NoError(t, d.Put(ctx, testKey(0), testValue(0)))
+	require.NoError(t, d.Close())
+	pack, err := os.ReadFile(d.packPath(1))
+	require.NoError(t, err)
+
+	require.NoError(t, os.RemoveAll(filepath.Join(path, indexDir)))
+	_, err = NewDatastore(path, testOptions())
+	require.ErrorIs(t, err, ErrNoIndex)
+
+	after, err := os.ReadFile(d.packPath(1))
+	require.NoError(t, err)
+	require.Equal(t, pack, after, "the pack is not overwritten")
+}
+
+func TestReopen(t *testing.T) {
+	ctx := context.Background()
+	path := t.TempDir()
+
+	d, err := NewDatastore(path, testOptions())
+	require.NoError(t, err)
+	for i := 0; i < 30; i++ {
+		require.NoError(t, d.Put(ctx, testKey(i), testValue(i)))
+	}
+	require.NoError(t, d.Delete(ctx, testKey(1)))
+	require.NoError(t, d.Close())
+	require.ErrorIs(t, d.Close(), ErrClosed)
+
+	_, err = d.Get(ctx, testKey(0))
+	require.ErrorIs(t, err, ErrClosed)
+
+	d, err = NewDatastore(path, testOptions())
+	require.NoError(t, err)
+	defer d.Close()
+
+	for i := 0; i < 30; i++ {
+		value, err := d.Get(ctx, testKey(i))
+		if i == 1 {
+			require.ErrorIs(t, err, ds.ErrNotFound)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, testValue(i), value)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	ctx := context.Background()
+	path := t.TempDir()
+
+	d, err := NewDatastore(path, testOptions())
+	require.NoError(t, err)
+	require.NoError(t, d.Put(ctx, testKey(0), testValue(0)))
+	require.NoError(t, d.Close())
+
+	t.Log("records written after the index, and a torn one at the tail")
+	f, err := os.OpenFile(d.packPath(d.active), os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	for _, rec := range []*record{
+		{key: testKey(1).Bytes(), value: testValue(1)},
+		{key: testKey(0).Bytes(), deleted: true},
+	} {
+		_, err = f.Write(rec.encode())
+		require.NoError(t, err)
+	}
+	torn := (&record{key: testKey(2).Bytes(), value: testValue(2)}).encode()
+	_, err = f.Write(torn[:len(torn)/2])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	d, err = NewDatastore(path, testOptions())
+	require.NoError(t, err)
+	defer d.Close()
+
+	value, err := d.Get(ctx, testKey(1))
+	require.NoError(t, err)
+	require.Equal(t, testValue(1), value)
+	_, err = d.Get(ctx, testKey(0))
+	require.ErrorIs(t, err, ds.ErrNotFound)
+	_, err = d.Get(ctx, testKey(2))
+	require.ErrorIs(t, err, ds.ErrNotFound)
+
+	t.Log("the torn record is cut off, writes go on after the last valid one")
+	require.NoError(t, d.Put(ctx, testKey(2), testValue(2)))
+	value, err = d.Get(ctx, testKey(2))
+	require.NoError(t, err)
+	require.Equal(t, testValue(2), value)
+}
+
+func TestCompact(t *testing.T) {
+	ctx := context.Background()
+	path := t.TempDir()
+
+	d, err := NewDatastore(path, testOptions())
+	require.NoError(t, err)
+	for i := 0; i < 60; i++ {
+		require.NoError(t, d.Put(ctx, testKey(i), testValue(i)))
+	}
+	for i := 0; i < 60; i++ {
+		if i%4 != 0 {
+			require.NoError(t, d.Delete(ctx, testKey(i)))
+		}
+	}
+
+	before, err := d.DiskUsage(ctx)
+	require.NoError(t, err)
+	packs := len(d.packs)
+
+	t.Log("compactions called at the same time run one after the other")
+	results := make(chan *CompactResult, 2)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := d.Compact()
+			require.NoError(t, err)
+			results <- result
+		}()
+	}
+	wg.Wait()
+	close(results)
+	var result CompactResult
+	for r := range results {
+		result.Packs += r.Packs
+		result.Moved += r.Moved
+		result.Freed += r.Freed
+	}
+	require.NotZero(t, result.Packs)
+	require.Positive(t, result.Moved)
+	require.Positive(t, result.Freed)
+
+	after, err := d.DiskUsage(ctx)
+	require.NoError(t, err)
+	require.Less(t, after, before)
+	require.Less(t, len(d.packs), packs)
+
+	require.NoError(t, d.Close())
+	d, err = NewDatastore(path, testOptions())
+	require.NoError(t, err)
+	defer d.Close()
+
+	for i := 0; i < 60; i++ {
+		value, err := d.Get(ctx, testKey(i))
+		if i%4 != 0 {
+			require.ErrorIs(t, err, ds.ErrNotFound)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, testValue(i), value)
+	}
+}
@@ -0,0 +1,128 @@
+package packds
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+)
+
+// A record is a put or a delete of a key appended to a pack:
+//
+//	crc32c(4) | key length(4) | value length(4) | key | value
+//
+// The crc covers everything after it, a delete has no value and the value
+// length tombstoneLen.
+const (
+	headerSize   = 12
+	tombstoneLen = math.MaxUint32
+)
+
+var (
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+	// errTorn is a record that was not written completely, or not at all
+	errTorn = errors.New("packds: torn record")
+)
+
+type record struct {
+	key   []byte
+	value []byte
+	// deleted is a tombstone
+	deleted bool
+}
+
+func (r *record) size() int64 {
+	return headerSize + int64(len(r.key)) + int64(len(r.value))
+}
+
+func (r *record) encode() []byte {
+	b := make([]byte, r.size())
+	binary.BigEndian.PutUint32(b[4:], uint32(len(r.key)))
+	if r.deleted {
+		binary.BigEndian.PutUint32(b[8:], tombstoneLen)
+	} else {
+		binary.BigEndian.PutUint32(b[8:], uint32(len(r.value)))
+	}
+	copy(b[headerSize:], r.key)
+	copy(b[headerSize+len(r.key):], r.value)
+	binary.BigEndian.PutUint32(b, crc32.Checksum(b[4:], castagnoli))
+
+	return b
+}
+
+// readRecord reads the record at off of a pack of size bytes. It returns
+// io.EOF at the end of the pack and errTorn if the rest of the pack is not a
+// valid record.
+func readRecord(f *os.File, off, size int64) (*record, error) {
+	if off == size {
+		return nil, io.EOF
+	}
+	if off+headerSize > size {
+		return nil, errTorn
+	}
+
+	header := make([]byte, headerSize)
+	if _, err := f.ReadAt(header, off); err != nil {
+		return nil, err
+	}
+
+	keyLen := int64(binary.BigEndian.Uint32(header[4:]))
+	valueLen := int64(binary.BigEndian.Uint32(header[8:]))
+	deleted := valueLen == tombstoneLen
+	if deleted {
+		valueLen = 0
+	}
+	if off+headerSize+keyLen+valueLen > size {
+		return nil, errTorn
+	}
+
+	b := make([]byte, headerSize+keyLen+valueLen)
+	if _, err := f.ReadAt(b, off); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(b[4:], castagnoli) != binary.BigEndian.Uint32(b) {
+		return nil, errTorn
+	}
+
+	return &record{
+		key:     b[headerSize : headerSize+keyLen],
+		value:   b[headerSize+keyLen:],
+		deleted: deleted,
+	}, nil
+}
+
+// location is where the record of a key is
+type location struct {
+	pack   uint32
+	offset int64
+	// size is the size of the whole record
+	size int64
+}
+
+func (l location) bytes() []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint32(b, l.pack)
+	binary.BigEndian.PutUint64(b[4:], uint64(l.offset))
+	binary.BigEndian.PutUint32(b[12:], uint32(l.size))
+	return b
+}
+
+func parseLocation(b []byte) (location, error) {
+	if len(b) != 16 {
+		return location{}, errors.New("packds: invalid index entry")
+	}
+
+	return location{
+		pack:   binary.BigEndian.Uint32(b),
+		offset: int64(binary.BigEndian.Uint64(b[4:])),
+		size:   int64(binary.BigEndian.Uint32(b[12:])),
+	}, nil
+}
+
+// valueSize is the size of the value of the record of key
+func (l location) valueSize(key []byte) int {
+	return int(l.size - headerSize - int64(len(key)))
+}
@@ -19,20 +19,31 @@ func NewSrv(dagSrv ipld.DAGService) *Srv {
 }
 
 func (s *Srv) WriteTo(ctx context.Context, rootCid string, toPath string) error {
+	_, err := s.Write(ctx, rootCid, toPath)
+	return err
+}
+
+// Write is WriteTo that also returns the size of what was written
+func (s *Srv) Write(ctx context.Context, rootCid string, toPath string) (int64, error) {
 	cid, err := cid2.Parse(rootCid)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	node, err := s.dagSrv.Get(ctx, cid)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	fileNode, err := unixfile.NewUnixfsFile(ctx, s.dagSrv, node)
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	size, err := fileNode.Size()
+	if err != nil {
+		return 0, err
 	}
 
-	return files.WriteTo(fileNode, toPath)
+	return size, files.WriteTo(fileNode, toPath)
 }
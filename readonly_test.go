@@ -0,0 +1,84 @@
+package ipfsrepo
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestFromPathReadOnly(t *testing.T) {
+	ctx := context.Background()
+	repoPath := t.TempDir()
+
+	writer, err := FromPath("test-uuid", repoPath, 1<<30)
+	require.NoError(t, err)
+	defer writer.Close()
+
+	fileBytes, err := createFile0to100k()
+	require.NoError(t, err)
+	filePath := path.Join(t.TempDir(), "testfile")
+	require.NoError(t, os.WriteFile(filePath, fileBytes, 0644))
+
+	result, err := writer.Import(ctx, filePath)
+	require.NoError(t, err)
+	tenant, err := writer.CreateTenant(ctx, "a", 1<<20)
+	require.NoError(t, err)
+	require.NoError(t, tenant.SaveBlock(ctx, [][]byte{[]byte("tenant block")}))
+
+	t.Log("the repo is inspected while the writer has it open")
+	repo, err := FromPathReadOnly("test-uuid", repoPath, 1<<30)
+	require.NoError(t, err)
+	defer repo.Close()
+	require.True(t, repo.ReadOnly())
+
+	roots, err := repo.Roots(ctx)
+	require.NoError(t, err)
+	require.Len(t, roots, 1)
+	require.Equal(t, result.RootCid, roots[0].Cid)
+	require.True(t, repo.HasBlock(ctx, result.Blocks))
+
+	extracted := path.Join(t.TempDir(), "extracted")
+	require.NoError(t, repo.Extract(ctx, result.RootCid, extracted))
+	b, err := os.ReadFile(extracted)
+	require.NoError(t, err)
+	require.Equal(t, fileBytes, b)
+
+	readTenant, err := repo.Tenant(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, uint64(len("tenant block")), readTenant.Usage())
+
+	t.Log("every change fails")
+	_, err = repo.Import(ctx, filePath)
+	require.ErrorIs(t, err, ErrReadOnly)
+	require.ErrorIs(t, repo.Retain(ctx, result.RootCid), ErrReadOnly)
+	require.ErrorIs(t, repo.Release(ctx, result.RootCid), ErrReadOnly)
+	require.ErrorIs(t, repo.SaveBlock(ctx, [][]byte{[]byte("block")}), ErrReadOnly)
+	require.ErrorIs(t, repo.DeleteBlock(ctx, result.Blocks), ErrReadOnly)
+	_, err = repo.CreateTenant(ctx, "b", 1<<20)
+	require.ErrorIs(t, err, ErrReadOnly)
+	_, err = repo.Evict(ctx)
+	require.ErrorIs(t, err, ErrReadOnly)
+	_, err = repo.MigrateTo(ctx, t.TempDir())
+	require.ErrorIs(t, err, ErrReadOnly)
+	require.ErrorIs(t, readTenant.SaveBlock(ctx, [][]byte{[]byte("block")}), ErrReadOnly)
+	require.ErrorIs(t, readTenant.SetQuota(ctx, 1), ErrReadOnly)
+	require.ErrorIs(t, readTenant.DeleteRoot(ctx, result.RootCid), ErrReadOnly)
+	require.NoError(t, repo.Degraded(), "rejected writes do not degrade the repo")
+
+	t.Log("the writer is not disturbed")
+	require.NoError(t, writer.SaveBlock(ctx, [][]byte{[]byte("block")}))
+	require.True(t, writer.HasBlock(ctx, result.Blocks))
+}
+
+func TestFromPathReadOnlyEviction(t *testing.T) {
+	repoPath := t.TempDir()
+
+	repo, err := FromPath("test-uuid", repoPath, 1<<30)
+	require.NoError(t, err)
+	repo.Close()
+
+	_, err = FromPathReadOnly("test-uuid", repoPath, 1<<30, SetEviction(EvictLRU, 90, 80))
+	require.ErrorIs(t, err, ErrReadOnly)
+}
@@ -2,17 +2,32 @@ package ipfsrepo
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/Xib1uvXi/ipfsrepo/pkg/chunker"
 	"github.com/Xib1uvXi/ipfsrepo/pkg/fsrepo"
 	"github.com/Xib1uvXi/ipfsrepo/pkg/linuxutils/lsblk"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/metrics"
 	"github.com/Xib1uvXi/ipfsrepo/pkg/writer"
 	"github.com/ipfs/boxo/blockservice"
 	"github.com/ipfs/boxo/blockstore"
 	"github.com/ipfs/boxo/exchange/offline"
 	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/go-cid"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/atomic"
+	"path/filepath"
 	"time"
 )
 
+// DeviceRepoDir is the directory of the repo under the mount point of its device
+const DeviceRepoDir = "ipfsrepo"
+
+var ErrDeviceNotMounted = errors.New("block device is not mounted")
+
+// ErrReadOnly is returned by every API that changes a repo opened read-only
+var ErrReadOnly = fsrepo.ErrReadOnly
+
 type RepoOption func(*Repo) error
 
 func SetBlockStoreWithCache(cache blockstore.CacheOpts, blockOpts ...blockstore.Option) RepoOption {
@@ -36,30 +51,146 @@ func SetBlockStore(blockOpts ...blockstore.Option) RepoOption {
 	}
 }
 
+// SetChunkSize sets the chunk size of the chunking profile, 0 keeps the one of the repo config
 func SetChunkSize(chunkSize int64) RepoOption {
 	return func(r *Repo) error {
-		r.chunkSize = chunkSize
+		if chunkSize != 0 {
+			r.profile.ChunkSize = chunkSize
+		}
+		return nil
+	}
+}
+
+// SetChunkingProfile sets how imported files are chunked and which CIDs they get
+func SetChunkingProfile(profile chunker.Profile) RepoOption {
+	return func(r *Repo) error {
+		if err := profile.Validate(); err != nil {
+			return err
+		}
+		r.profile = profile
 		return nil
 	}
 }
 
+// OverrideConfig lets the options win over the repo config, which is
+// rewritten with them unless the repo is read-only. Without it, options that
+// differ from the repo config fail with ErrConfigConflict.
+func OverrideConfig() RepoOption {
+	return func(r *Repo) error {
+		r.overrideConfig = true
+		return nil
+	}
+}
+
+// SetStorageUsage sets how often usage is refreshed from the datastore and the threshold of IsFull
 func SetStorageUsage(scanInterval time.Duration, threshold float64) RepoOption {
 	return func(r *Repo) error {
 		r.StorageUsage.SetScanInterval(scanInterval)
-		r.StorageUsage.SetThreshold(threshold)
+		return r.StorageUsage.SetThreshold(threshold)
+	}
+
+}
+
+// SetUsageWatermarks sets the warn, critical and full usage levels, see StorageUsage.OnLevelChange
+func SetUsageWatermarks(watermarks Watermarks) RepoOption {
+	return func(r *Repo) error {
+		return r.StorageUsage.SetWatermarks(watermarks)
+	}
+}
+
+// SetUsageReconcileInterval sets how often the repo directory is walked to correct the usage
+func SetUsageReconcileInterval(reconcileInterval time.Duration) RepoOption {
+	return func(r *Repo) error {
+		r.StorageUsage.SetReconcileInterval(reconcileInterval)
+		return nil
+	}
+}
+
+// SetUsageHistorySize sets how many usage samples are kept for StorageUsage.Forecast
+func SetUsageHistorySize(size int) RepoOption {
+	return func(r *Repo) error {
+		return r.StorageUsage.SetHistorySize(size)
+	}
+}
+
+// SetDeviceCheckInterval sets how often the repo checks that it is still on its device
+func SetDeviceCheckInterval(interval time.Duration) RepoOption {
+	return func(r *Repo) error {
+		r.health.SetInterval(interval)
 		return nil
 	}
+}
 
+// SetIOErrorThreshold degrades the repo once at least minErrors datastore
+// operations failed during a device check interval, and they are at least rate of all operations
+func SetIOErrorThreshold(rate float64, minErrors uint64) RepoOption {
+	return func(r *Repo) error {
+		r.health.SetErrorThreshold(rate, minErrors)
+		return nil
+	}
+}
+
+// SetBlockMetaFlushInterval sets how often block metadata updates are written to the datastore
+func SetBlockMetaFlushInterval(flushInterval time.Duration) RepoOption {
+	return func(r *Repo) error {
+		r.blockMeta.SetFlushInterval(flushInterval)
+		return nil
+	}
+}
+
+// SetEviction enables automatic eviction of unretained content once usage
+// crosses highWatermark, until usage drops below lowWatermark
+func SetEviction(policy EvictionPolicy, highWatermark, lowWatermark float64) RepoOption {
+	return func(r *Repo) error {
+		if lowWatermark >= highWatermark {
+			return fmt.Errorf("low watermark %.1f must be below high watermark %.1f", lowWatermark, highWatermark)
+		}
+
+		r.evictionEnabled = true
+		r.evictor.SetPolicy(policy)
+		r.evictor.SetWatermarks(highWatermark, lowWatermark)
+		return nil
+	}
+}
+
+// SetEvictionInterval sets how often usage is checked against the eviction high watermark
+func SetEvictionInterval(interval time.Duration) RepoOption {
+	return func(r *Repo) error {
+		r.evictor.SetInterval(interval)
+		return nil
+	}
 }
 
 type Repo struct {
 	ctx         context.Context
 	cancel      context.CancelFunc
 	blockDevice *lsblk.BlockDevice
-	storage     fsrepo.Storage
+	storage     *switchStorage
 	blockStore  blockstore.Blockstore
-	chunkSize   int64
+	profile     chunker.Profile
 	importer    *Importer
+	admission   *Admission
+	// repoBlockStore is blockStore before it is hidden behind the interface
+	repoBlockStore *repoBlockstore
+	blockMeta      *BlockMetaIndex
+	roots          *RootSet
+	tenants        *tenants
+	evictor        *Evictor
+	events         *eventBus
+	health         *deviceHealth
+	migrating      *atomic.Bool
+	// imports counts running imports, the evictor waits for them to record their roots
+	imports *atomic.Int32
+	// registry is served by MetricsHandler, metricsRegisterer is set by SetMetricsRegistry
+	registry          *prometheus.Registry
+	metricsRegisterer prometheus.Registerer
+	metrics           *repoMetrics
+	// evictionEnabled starts the evictor loop, the evictor itself always exists for manual runs
+	evictionEnabled bool
+	readOnly        bool
+	// config is what the repo runs with, overrideConfig is set by OverrideConfig
+	config         RepoConfig
+	overrideConfig bool
 	*StorageUsage
 	*BlockRepo
 }
@@ -72,50 +203,206 @@ func (r *Repo) DataStore() fsrepo.Datastore {
 	return r.storage.Datastore()
 }
 
-// FromPath creates a new repo from the given path
+// FromPath creates a new repo from the given path. Its chunking and usage
+// settings come from the repo config, see OverrideConfig.
 func FromPath(uuid string, repoPath string, maxStorage uint64, opts ...RepoOption) (*Repo, error) {
-	storage, err := fsrepo.NewFSRepo(repoPath)
+	mockBlockDevice := &lsblk.BlockDevice{Size: maxStorage, UUID: uuid}
+	return fromBlockDevice(mockBlockDevice, nil, repoPath, false, opts...)
+}
+
+// FromPathReadOnly opens the repo at the given path read-only, see fsrepo.ReadOnly.
+// It can be opened while another process has it open, every API that changes
+// the repo fails with ErrReadOnly.
+func FromPathReadOnly(uuid string, repoPath string, maxStorage uint64, opts ...RepoOption) (*Repo, error) {
+	mockBlockDevice := &lsblk.BlockDevice{Size: maxStorage, UUID: uuid}
+	return fromBlockDevice(mockBlockDevice, nil, repoPath, true, opts...)
+}
+
+// FromDevice opens the repo of the block device with the given UUID or label.
+// The device has to be mounted, the repo lives in DeviceRepoDir under its
+// mount point and may use the whole device.
+func FromDevice(uuidOrLabel string, opts ...RepoOption) (*Repo, error) {
+	return fromDevice(lsblk.NewCmd(), uuidOrLabel, false, opts...)
+}
+
+// FromDeviceReadOnly opens the repo of the block device read-only, see FromPathReadOnly
+func FromDeviceReadOnly(uuidOrLabel string, opts ...RepoOption) (*Repo, error) {
+	return fromDevice(lsblk.NewCmd(), uuidOrLabel, true, opts...)
+}
+
+func fromDevice(lsblkCmd *lsblk.Cmd, uuidOrLabel string, readOnly bool, opts ...RepoOption) (*Repo, error) {
+	dev, err := lsblkCmd.FindBlockDevice(uuidOrLabel)
 	if err != nil {
 		return nil, err
 	}
-	mockBlockDevice := &lsblk.BlockDevice{Size: maxStorage, UUID: uuid}
-	ctx, cancel := context.WithCancel(context.Background())
 
-	storageUsage, err := NewStorageUsage(ctx, repoPath, maxStorage)
+	if !filepath.IsAbs(dev.MountPoint) {
+		return nil, fmt.Errorf("%w: %s", ErrDeviceNotMounted, dev.Name)
+	}
+
+	repoPath := filepath.Join(dev.MountPoint, DeviceRepoDir)
+	if !readOnly {
+		if err := fsrepo.Writable(repoPath); err != nil {
+			return nil, err
+		}
+	}
+
+	return fromBlockDevice(dev, lsblkCmd, repoPath, readOnly, opts...)
+}
+
+// fromBlockDevice opens the repo at repoPath on blockDevice, lsblkCmd is nil if the device was not looked up
+func fromBlockDevice(blockDevice *lsblk.BlockDevice, lsblkCmd *lsblk.Cmd, repoPath string, readOnly bool, opts ...RepoOption) (*Repo, error) {
+	// the datastore metrics are created once the options are known, see SetMetricsRegistry
+	var storage fsrepo.Storage
+	var err error
+	if readOnly {
+		storage, err = fsrepo.Open(repoPath, fsrepo.ReadOnly(), fsrepo.Unmeasured())
+	} else {
+		storage, err = fsrepo.NewFSRepo(repoPath, fsrepo.Unmeasured())
+	}
 	if err != nil {
+		return nil, err
+	}
+	uuid, maxStorage := blockDevice.UUID, blockDevice.Size
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Repo{ctx: ctx, cancel: cancel, storage: newSwitchStorage(storage), blockDevice: blockDevice, readOnly: readOnly}
+
+	// every error after the storage is open releases it and its lock
+	fail := func(err error) (*Repo, error) {
 		cancel()
+		_ = r.storage.Close()
 		return nil, err
 	}
 
-	r := &Repo{ctx: ctx, cancel: cancel, storage: storage, blockDevice: mockBlockDevice, StorageUsage: storageUsage}
+	storageUsage, err := NewStorageUsage(ctx, repoPath, maxStorage)
+	if err != nil {
+		return fail(err)
+	}
+	r.StorageUsage = storageUsage
+	storageUsage.readOnly = readOnly
+	r.migrating = atomic.NewBool(false)
+	r.imports = atomic.NewInt32(0)
+	r.events = newEventBus()
+	storageUsage.events = r.events
+	storageUsage.SetUsageSource(r.storage.GetStorageUsage)
+	r.health, err = newDeviceHealth(ctx, repoPath, blockDevice, lsblkCmd)
+	if err != nil {
+		return fail(err)
+	}
+	r.health.events = r.events
+	storageUsage.health = r.health
+	// the metadata of the repo is not written once it is degraded, like its blocks
+	metaDS := newHealthDatastore(r.storage.Datastore(), r.health)
+	r.blockMeta = NewBlockMetaIndex(ctx, metaDS)
+	r.blockMeta.readOnly = readOnly
+	r.roots = NewRootSet(metaDS, rootsPrefix)
+	r.admission = NewAdmission(storageUsage)
+	r.tenants = newTenants(r, metaDS)
+	r.evictor = NewEvictor(ctx, storageUsage, nil, r.blockMeta, r.roots)
+	r.evictor.protected = r.tenants.owned
+	r.evictor.importing = func() bool { return r.imports.Load() > 0 }
+	r.evictor.events = r.events
+
+	config, created, err := r.loadConfig(repoPath)
+	if err != nil {
+		return fail(err)
+	}
 
 	for _, opt := range opts {
 		if err := opt(r); err != nil {
-			return nil, err
+			return fail(err)
 		}
 	}
+	if err := r.settleConfig(repoPath, config, created); err != nil {
+		return fail(err)
+	}
+	// the level was computed before the watermarks of the config and the options were set
+	r.StorageUsage.resetLevel()
+	if r.evictionEnabled && readOnly {
+		return fail(fmt.Errorf("%w: eviction can not be enabled", ErrReadOnly))
+	}
+
+	if r.metricsRegisterer != nil {
+		// the datastores were opened without metrics, they get the ones of this repo now
+		if err := metrics.Inject(); err != nil {
+			return fail(err)
+		}
+		r.storage.measure(prometheus.Labels{"repo": uuid})
+	}
 
 	if r.blockStore == nil {
-		r.blockStore = blockstore.NewBlockstore(storage.Datastore(), blockstore.WriteThrough(true))
+		r.blockStore = blockstore.NewBlockstore(r.storage.Datastore(), blockstore.WriteThrough(true))
 	}
 
-	if r.chunkSize == 0 {
-		r.importer = NewImporter(r.blockStore, chunker.Chunk1MiB)
-	} else {
-		r.importer = NewImporter(r.blockStore, r.chunkSize)
+	// every read and write goes through the repo blockstore
+	r.repoBlockStore = newRepoBlockstore(r.blockStore, r.blockMeta, r.StorageUsage, r.events, r.health)
+	r.repoBlockStore.readOnly = readOnly
+	r.blockStore = r.repoBlockStore
+	r.evictor.blockStore = r.repoBlockStore
+
+	r.importer = r.newImporter()
+
+	r.registry = prometheus.NewRegistry()
+	r.registry.MustRegister(metrics.Default())
+	r.metrics = newRepoMetrics(uuid, r.StorageUsage)
+	if err := r.metrics.register(r.registry); err != nil {
+		return fail(err)
 	}
+	if r.metricsRegisterer != nil {
+		if err := r.metrics.register(r.metricsRegisterer); err != nil {
+			return fail(err)
+		}
+		if err := registerDatastoreMetrics(r.metricsRegisterer); err != nil {
+			r.metrics.unregister(r.metricsRegisterer)
+			return fail(err)
+		}
+	}
+	metricsEvents, err := r.events.subscribe(ctx,
+		EventImportFinished|EventExtractFinished|EventBlocksAdded|EventBlocksDeleted|EventGC,
+		SetDeliveryPolicy(DeliveryBlock), SetEventBufferSize(metricsEventBufferSize))
+	if err != nil {
+		return fail(err)
+	}
+	go r.metrics.observe(metricsEvents)
 
 	r.StorageUsage.Start()
-	r.BlockRepo = &BlockRepo{blockStore: r.blockStore}
+	r.blockMeta.Start()
+	r.health.Start()
+	if r.evictionEnabled {
+		r.evictor.Start()
+	}
+	r.BlockRepo = &BlockRepo{blockStore: r.blockStore, admission: r.admission}
 
 	return r, nil
 }
 
+// newImporter returns an importer with the chunking profile and admission of the repo
+func (r *Repo) newImporter() *Importer {
+	importer := NewImporter(r.blockStore, r.profile.ChunkSize)
+	importer.SetProfile(r.profile)
+	importer.SetAdmission(r.admission)
+	importer.events = r.events
+	return importer
+}
+
 // UUID returns UUID of the block device
 func (r *Repo) UUID() string {
 	return r.blockDevice.UUID
 }
 
+// ReadOnly returns true if the repo was opened read-only
+func (r *Repo) ReadOnly() bool {
+	return r.readOnly
+}
+
+// writable returns ErrReadOnly if the repo was opened read-only
+func (r *Repo) writable() error {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
 // MaxStorageSize returns the maximum size of the block device
 func (r *Repo) MaxStorageSize() uint64 {
 	return r.blockDevice.Size
@@ -124,6 +411,16 @@ func (r *Repo) MaxStorageSize() uint64 {
 // Close closes the repo
 func (r *Repo) Close() {
 	r.cancel()
+	r.events.close()
+
+	// the repo can be opened again with the same UUID and registerer
+	if r.metricsRegisterer != nil {
+		r.metrics.unregister(r.metricsRegisterer)
+	}
+
+	if r.blockMeta != nil {
+		_ = r.blockMeta.Close()
+	}
 
 	if r.storage != nil {
 		_ = r.storage.Close()
@@ -135,12 +432,118 @@ func (r *Repo) Extract(ctx context.Context, rootCid string, toPath string) error
 	bSrv := blockservice.New(r.blockStore, offline.Exchange(r.blockStore))
 	dSrv := merkledag.NewDAGService(bSrv)
 
-	return writer.NewSrv(dSrv).WriteTo(ctx, rootCid, toPath)
+	start := time.Now()
+	size, err := writer.NewSrv(dSrv).Write(ctx, rootCid, toPath)
+	r.events.publish(ExtractFinishedEvent{
+		eventBase: newEventBase(),
+		RootCid:   rootCid,
+		Path:      toPath,
+		Bytes:     size,
+		Duration:  time.Since(start),
+		Err:       err,
+	})
+
+	return err
 }
 
-// Import the file to the repo
+// Import the file to the repo, the imported root is recorded unretained.
+// It fails with RepoFullError if the file does not fit into the repo.
 func (r *Repo) Import(ctx context.Context, path string) (*chunker.Result, error) {
-	return r.importer.Import(ctx, path)
+	if err := r.writable(); err != nil {
+		return nil, err
+	}
+	r.imports.Inc()
+	defer r.imports.Dec()
+
+	result, err := r.importer.Import(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.roots.Add(ctx, &Root{Cid: result.RootCid, Name: result.FileName, Added: time.Now()}); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Roots returns all imported roots
+func (r *Repo) Roots(ctx context.Context) ([]*Root, error) {
+	return r.roots.List(ctx)
+}
+
+// Retain protects the root and its blocks from eviction
+func (r *Repo) Retain(ctx context.Context, rootCid string) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	return r.roots.SetRetained(ctx, rootCid, true)
+}
+
+// Release makes the root evictable again
+func (r *Repo) Release(ctx context.Context, rootCid string) error {
+	if err := r.writable(); err != nil {
+		return err
+	}
+	return r.roots.SetRetained(ctx, rootCid, false)
+}
+
+// CreateTenant creates a tenant with its own roots and the given quota in bytes
+func (r *Repo) CreateTenant(ctx context.Context, id string, quota uint64) (*Tenant, error) {
+	if err := r.writable(); err != nil {
+		return nil, err
+	}
+	return r.tenants.create(ctx, id, quota)
+}
+
+// Tenant returns an existing tenant
+func (r *Repo) Tenant(ctx context.Context, id string) (*Tenant, error) {
+	return r.tenants.get(ctx, id)
+}
+
+// Tenants returns the ids of all tenants
+func (r *Repo) Tenants(ctx context.Context) ([]string, error) {
+	return r.tenants.list(ctx)
+}
+
+// Evict runs the eviction policy right away
+func (r *Repo) Evict(ctx context.Context) (*EvictionResult, error) {
+	if err := r.writable(); err != nil {
+		return nil, err
+	}
+	return r.evictor.Run(ctx)
+}
+
+// BlockMeta returns the size, insertion time and access statistics of a block
+func (r *Repo) BlockMeta(ctx context.Context, blockCid string) (*BlockMeta, error) {
+	c, err := cid.Parse(blockCid)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.blockMeta.Get(ctx, c)
+}
+
+// Subscribe delivers the repo events matching filter until ctx is done or the
+// subscription is closed. Events are buffered per subscriber and dropped when
+// the buffer is full, unless SetDeliveryPolicy(DeliveryBlock) is given.
+func (r *Repo) Subscribe(ctx context.Context, filter EventType, opts ...SubscribeOption) (*Subscription, error) {
+	return r.events.subscribe(ctx, filter, opts...)
+}
+
+// Degraded returns an ErrRepoDegraded error once the repo turned read-only, nil while it is healthy
+func (r *Repo) Degraded() error {
+	return r.health.err()
+}
+
+// CheckDevice checks right away that the repo is still on its device, see Degraded
+func (r *Repo) CheckDevice() error {
+	return r.health.Check()
+}
+
+// Available returns the bytes that can still be written to the repo
+func (r *Repo) Available() uint64 {
+	return r.admission.Available()
 }
 
 // ImportProgressInfo returns the progress info of the importer
@@ -0,0 +1,301 @@
+package ipfsrepo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/fsrepo"
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/boxo/ipld/unixfs"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	ipld "github.com/ipfs/go-ipld-format"
+	"time"
+)
+
+var (
+	ErrRootNotFound = errors.New("root not found")
+
+	rootsPrefix = ds.NewKey("/roots")
+	// rootsRecordedKey is set once the roots of content stored before roots were recorded are added
+	rootsRecordedKey = ds.NewKey("/layout/roots")
+)
+
+// Root is an imported dag root. Retained roots are never evicted.
+type Root struct {
+	Cid      string    `json:"cid"`
+	Name     string    `json:"name"`
+	Retained bool      `json:"retained"`
+	Added    time.Time `json:"added"`
+}
+
+// RootSet keeps track of the roots stored in a repo
+type RootSet struct {
+	ds     fsrepo.Datastore
+	prefix ds.Key
+}
+
+func NewRootSet(d fsrepo.Datastore, prefix ds.Key) *RootSet {
+	return &RootSet{ds: d, prefix: prefix}
+}
+
+// Add records the root, a root that is already known keeps its retention
+func (s *RootSet) Add(ctx context.Context, root *Root) error {
+	old, err := s.Get(ctx, root.Cid)
+	if err != nil && !errors.Is(err, ErrRootNotFound) {
+		return err
+	}
+
+	if old != nil {
+		root.Retained = root.Retained || old.Retained
+		root.Added = old.Added
+	}
+
+	return s.put(ctx, root)
+}
+
+// Get returns the root with the given cid
+func (s *RootSet) Get(ctx context.Context, rootCid string) (*Root, error) {
+	b, err := s.ds.Get(ctx, s.prefix.ChildString(rootCid))
+	if err != nil {
+		if errors.Is(err, ds.ErrNotFound) {
+			return nil, ErrRootNotFound
+		}
+		return nil, err
+	}
+
+	var root Root
+	if err := json.Unmarshal(b, &root); err != nil {
+		return nil, err
+	}
+
+	return &root, nil
+}
+
+// SetRetained marks the root as retained or not
+func (s *RootSet) SetRetained(ctx context.Context, rootCid string, retained bool) error {
+	root, err := s.Get(ctx, rootCid)
+	if err != nil {
+		return err
+	}
+
+	root.Retained = retained
+	return s.put(ctx, root)
+}
+
+// Remove forgets the root, its blocks are left untouched
+func (s *RootSet) Remove(ctx context.Context, rootCid string) error {
+	return s.ds.Delete(ctx, s.prefix.ChildString(rootCid))
+}
+
+// List returns all roots of the set
+func (s *RootSet) List(ctx context.Context) ([]*Root, error) {
+	results, err := s.ds.Query(ctx, query.Query{Prefix: s.prefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	var roots []*Root
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+
+		var root Root
+		if err := json.Unmarshal(r.Value, &root); err != nil {
+			return nil, err
+		}
+		roots = append(roots, &root)
+	}
+
+	return roots, nil
+}
+
+// blocks returns the hashes of the stored blocks of every root in the set
+func (s *RootSet) blocks(ctx context.Context, bs blockstore.Blockstore) (map[string]struct{}, error) {
+	roots, err := s.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make(map[string]struct{})
+	for _, root := range roots {
+		rootCid, err := cid.Parse(root.Cid)
+		if err != nil {
+			return nil, err
+		}
+
+		blks, err := dagBlocks(ctx, bs, rootCid)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range blks {
+			hashes[string(c.Hash())] = struct{}{}
+		}
+	}
+
+	return hashes, nil
+}
+
+func (s *RootSet) put(ctx context.Context, root *Root) error {
+	b, err := json.Marshal(root)
+	if err != nil {
+		return err
+	}
+
+	return s.ds.Put(ctx, s.prefix.ChildString(root.Cid), b)
+}
+
+// recordLegacyRoots adds the content stored before roots were recorded as
+// unretained roots, so it is evicted as a whole instead of block by block.
+// Imports store the file or directory in a wrapper directory no other block
+// links to, the entries of such wrappers are the roots. Content of tenants is
+// left out. Every block is read, it is part of the migration to repo version 2
+// and skipped for repos that recorded the roots before.
+func recordLegacyRoots(ctx context.Context, d fsrepo.Datastore) error {
+	recorded, err := d.Has(ctx, rootsRecordedKey)
+	if err != nil || recorded {
+		return err
+	}
+
+	bs := blockstore.NewBlockstore(d)
+	roots := NewRootSet(d, rootsPrefix)
+	ts := &tenants{ds: d}
+	blockMeta := NewBlockMetaIndex(ctx, d)
+	keys, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		return err
+	}
+
+	nodes := make(map[string]struct{})
+	linked := make(map[string]struct{})
+	// dirs keeps the links of directories, wrappers are among them
+	dirs := make(map[string][]*ipld.Link)
+	for c := range keys {
+		blk, err := bs.Get(ctx, c)
+		if err != nil {
+			if ipld.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+
+		nd, err := merkledag.DecodeProtobuf(blk.RawData())
+		if err != nil {
+			continue
+		}
+		fsNode, err := unixfs.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			// raw data that happens to parse as protobuf
+			continue
+		}
+
+		nodes[string(c.Hash())] = struct{}{}
+		for _, l := range nd.Links() {
+			linked[string(l.Cid.Hash())] = struct{}{}
+		}
+		if fsNode.Type() == unixfs.TDirectory {
+			dirs[string(c.Hash())] = nd.Links()
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var candidates []*ipld.Link
+	for hash := range nodes {
+		if _, ok := linked[hash]; ok {
+			continue
+		}
+		if links, ok := dirs[hash]; ok {
+			candidates = append(candidates, links...)
+			continue
+		}
+		candidates = append(candidates, &ipld.Link{Cid: cid.NewCidV1(cid.DagProtobuf, []byte(hash))})
+	}
+
+	referenced, err := roots.blocks(ctx, bs)
+	if err != nil {
+		return err
+	}
+
+	var added int
+	for _, l := range candidates {
+		if _, ok := referenced[string(l.Cid.Hash())]; ok {
+			continue
+		}
+		owned, err := ts.owned(ctx, l.Cid)
+		if err != nil {
+			return err
+		}
+		if owned {
+			continue
+		}
+
+		root := &Root{Cid: l.Cid.String(), Name: l.Name, Added: time.Now()}
+		if meta, err := blockMeta.Get(ctx, l.Cid); err == nil {
+			root.Added = meta.Inserted
+		}
+		if err := roots.Add(ctx, root); err != nil {
+			return err
+		}
+		added++
+	}
+	if added > 0 {
+		log.Infof("recorded %d roots of content stored before roots were recorded", added)
+	}
+
+	return d.Put(ctx, rootsRecordedKey, nil)
+}
+
+// dagBlocks returns every block of the dag below root that is still stored.
+// Callers pass the inner blockstore, so the walk does not count as an access.
+func dagBlocks(ctx context.Context, bs blockstore.Blockstore, root cid.Cid) ([]cid.Cid, error) {
+	var blks []cid.Cid
+	visited := cid.NewSet()
+	queue := []cid.Cid{root}
+
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+
+		if !visited.Visit(c) {
+			continue
+		}
+
+		// leaves have no links, there is no need to read them
+		if c.Prefix().Codec != cid.DagProtobuf {
+			has, err := bs.Has(ctx, c)
+			if err != nil {
+				return nil, err
+			}
+			if has {
+				blks = append(blks, c)
+			}
+			continue
+		}
+
+		blk, err := bs.Get(ctx, c)
+		if err != nil {
+			if ipld.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		blks = append(blks, c)
+
+		nd, err := merkledag.DecodeProtobufBlock(blk)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, l := range nd.Links() {
+			queue = append(queue, l.Cid)
+		}
+	}
+
+	return blks, nil
+}
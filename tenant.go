@@ -0,0 +1,700 @@
+package ipfsrepo
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/chunker"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/fsrepo"
+	"github.com/dustin/go-humanize"
+	"github.com/ipfs/boxo/datastore/dshelp"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTenantNotFound = errors.New("tenant not found")
+	ErrTenantExists   = errors.New("tenant already exists")
+	ErrQuotaExceeded  = errors.New("tenant quota exceeded")
+
+	tenantsPrefix = ds.NewKey("/tenants")
+	// tenantInfoPrefix holds the description of every tenant, /tenantinfo/<tenant>
+	tenantInfoPrefix = ds.NewKey("/tenantinfo")
+	// tenantInfoMovedKey is set once descriptions kept as /tenants/<tenant>/info were moved
+	tenantInfoMovedKey = ds.NewKey("/layout/tenantinfo")
+	// blockOwnersPrefix maps a block to the tenants referencing it, /blockowners/<block>/<tenant>
+	blockOwnersPrefix = ds.NewKey("/blockowners")
+)
+
+// tenantInfo is the persisted description of a tenant
+type tenantInfo struct {
+	ID      string    `json:"id"`
+	Quota   uint64    `json:"quota"`
+	Created time.Time `json:"created"`
+}
+
+// Tenant is a logical namespace inside a repo with its own roots and quota.
+//
+// A tenant is charged the full size of every distinct block it references,
+// even if the block is shared with other tenants. A tenant's usage therefore
+// never changes because of what the others store or delete, and one tenant
+// can never push another one over its quota.
+type Tenant struct {
+	repo    *Repo
+	ds      fsrepo.Datastore
+	info    tenantInfo
+	infoKey ds.Key
+	roots   *RootSet
+	// importer is the tenant's own, imports of different tenants run concurrently
+	importer *Importer
+
+	// mu serializes the quota check with the accounting of new blocks
+	mu    sync.Mutex
+	usage uint64
+	// reserved is quota held by imports in flight
+	reserved uint64
+}
+
+// tenants keeps the loaded tenants of a repo, so all users share the same accounting
+type tenants struct {
+	repo   *Repo
+	ds     fsrepo.Datastore
+	mu     sync.Mutex
+	loaded map[string]*Tenant
+	// owners serializes adding owners of blocks with deleting blocks without
+	// owners, it is taken after the mutex of a tenant
+	owners sync.Mutex
+}
+
+func newTenants(repo *Repo, d fsrepo.Datastore) *tenants {
+	return &tenants{repo: repo, ds: d, loaded: make(map[string]*Tenant)}
+}
+
+func (ts *tenants) create(ctx context.Context, id string, quota uint64) (*Tenant, error) {
+	if err := validTenantID(id); err != nil {
+		return nil, err
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	has, err := ts.ds.Has(ctx, tenantInfoKey(id))
+	if err != nil {
+		return nil, err
+	}
+	if has {
+		return nil, fmt.Errorf("%w: %s", ErrTenantExists, id)
+	}
+
+	t := ts.newTenant(tenantInfo{ID: id, Quota: quota, Created: time.Now()})
+	if err := t.saveInfo(ctx); err != nil {
+		return nil, err
+	}
+
+	ts.loaded[id] = t
+	return t, nil
+}
+
+func (ts *tenants) get(ctx context.Context, id string) (*Tenant, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if t, ok := ts.loaded[id]; ok {
+		return t, nil
+	}
+
+	b, err := ts.ds.Get(ctx, tenantInfoKey(id))
+	if err != nil {
+		if errors.Is(err, ds.ErrNotFound) {
+			return nil, fmt.Errorf("%w: %s", ErrTenantNotFound, id)
+		}
+		return nil, err
+	}
+
+	var info tenantInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		return nil, err
+	}
+
+	t := ts.newTenant(info)
+	if err := t.loadUsage(ctx); err != nil {
+		return nil, err
+	}
+
+	ts.loaded[id] = t
+	return t, nil
+}
+
+func (ts *tenants) list(ctx context.Context) ([]string, error) {
+	results, err := ts.ds.Query(ctx, query.Query{Prefix: tenantInfoPrefix.String(), KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	var ids []string
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+
+		ids = append(ids, ds.RawKey(r.Key).Name())
+	}
+
+	return ids, nil
+}
+
+// owned reports whether any tenant references the block
+func (ts *tenants) owned(ctx context.Context, c cid.Cid) (bool, error) {
+	results, err := ts.ds.Query(ctx, query.Query{
+		Prefix:   blockOwnersPrefix.Child(dshelp.MultihashToDsKey(c.Hash())).String(),
+		KeysOnly: true,
+		Limit:    1,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	entries, err := results.Rest()
+	if err != nil {
+		return false, err
+	}
+
+	return len(entries) > 0, nil
+}
+
+func (ts *tenants) newTenant(info tenantInfo) *Tenant {
+	return &Tenant{
+		repo:     ts.repo,
+		ds:       ts.ds,
+		info:     info,
+		infoKey:  tenantInfoKey(info.ID),
+		roots:    NewRootSet(ts.ds, tenantsPrefix.ChildString(info.ID).ChildString("roots")),
+		importer: ts.repo.newImporter(),
+	}
+}
+
+// ID returns the id of the tenant
+func (t *Tenant) ID() string {
+	return t.info.ID
+}
+
+// Quota returns the quota of the tenant in bytes
+func (t *Tenant) Quota() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.info.Quota
+}
+
+// SetQuota changes the quota of the tenant, stored content is never removed
+func (t *Tenant) SetQuota(ctx context.Context, quota uint64) error {
+	if err := t.repo.writable(); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	old := t.info.Quota
+	t.info.Quota = quota
+	if err := t.saveInfo(ctx); err != nil {
+		t.info.Quota = old
+		return err
+	}
+	return nil
+}
+
+// Usage returns the bytes charged to the tenant
+func (t *Tenant) Usage() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.usage
+}
+
+// UsagePercentage returns the usage of the tenant relative to its quota, a
+// tenant without quota is at 100 percent once it uses anything
+func (t *Tenant) UsagePercentage() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.info.Quota == 0 {
+		if t.usage == 0 {
+			return 0
+		}
+		return 100
+	}
+	return float64(t.usage) / float64(t.info.Quota) * 100
+}
+
+// Import the file to the repo on behalf of the tenant. The file size is
+// reserved from the quota up front, and every batch written must still fit.
+func (t *Tenant) Import(ctx context.Context, path string) (*chunker.Result, error) {
+	if err := t.repo.writable(); err != nil {
+		return nil, err
+	}
+	t.repo.imports.Inc()
+	defer t.repo.imports.Dec()
+
+	quota := &quotaReservation{tenant: t}
+	defer quota.Release()
+
+	result, err := t.importer.importReserved(ctx, path, quota)
+	if err != nil {
+		return nil, err
+	}
+
+	var cids []cid.Cid
+	for _, b := range result.Blocks {
+		c, err := cid.Parse(b)
+		if err != nil {
+			return nil, err
+		}
+		cids = append(cids, c)
+	}
+
+	if err := t.chargeReserved(ctx, cids, quota); err != nil {
+		return nil, err
+	}
+
+	if err := t.roots.Add(ctx, &Root{Cid: result.RootCid, Name: result.FileName, Added: time.Now()}); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// SaveBlock save blocks on behalf of the tenant, blocks the tenant already
+// references are not charged again
+func (t *Tenant) SaveBlock(ctx context.Context, data [][]byte) error {
+	if err := t.repo.writable(); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// blocks the tenant references are in the repo already, only the others are written
+	var blks []blocks.Block
+	var cids []cid.Cid
+	var size uint64
+	for _, d := range data {
+		blk := blocks.NewBlock(d)
+
+		has, err := t.ds.Has(ctx, t.blockKey(blk.Cid()))
+		if err != nil {
+			return err
+		}
+		if !has {
+			size += uint64(len(d))
+			blks = append(blks, blk)
+		}
+
+		cids = append(cids, blk.Cid())
+	}
+
+	if err := t.checkQuotaLocked(size); err != nil {
+		return err
+	}
+
+	// the reservation keeps concurrent writes from taking the same capacity
+	reservation, err := t.repo.admission.Reserve(size)
+	if err != nil {
+		return err
+	}
+	defer reservation.Release()
+
+	bs := &reservedBlockstore{Blockstore: t.repo.blockStore, reservation: reservation}
+	if err := bs.PutMany(ctx, blks); err != nil {
+		return err
+	}
+
+	return t.chargeLocked(ctx, cids, 0)
+}
+
+// HasBlock check if the tenant references all blocks
+func (t *Tenant) HasBlock(ctx context.Context, cids []string) bool {
+	for _, cidStr := range cids {
+		c, err := cid.Parse(cidStr)
+		if err != nil {
+			return false
+		}
+
+		has, err := t.ds.Has(ctx, t.blockKey(c))
+		if err != nil || !has {
+			return false
+		}
+	}
+
+	return true
+}
+
+// DeleteBlock releases the blocks from the tenant, a block is only deleted
+// from the repo once no tenant and no root of the repo references it anymore
+func (t *Tenant) DeleteBlock(ctx context.Context, cids []string) error {
+	if err := t.repo.writable(); err != nil {
+		return err
+	}
+
+	var cs []cid.Cid
+	for _, cidStr := range cids {
+		c, err := cid.Parse(cidStr)
+		if err != nil {
+			return err
+		}
+		cs = append(cs, c)
+	}
+
+	return t.release(ctx, cs)
+}
+
+// Extract the root of the tenant, writes it to the given path
+func (t *Tenant) Extract(ctx context.Context, rootCid string, toPath string) error {
+	if _, err := t.roots.Get(ctx, rootCid); err != nil {
+		return err
+	}
+
+	return t.repo.Extract(ctx, rootCid, toPath)
+}
+
+// Roots returns the roots of the tenant
+func (t *Tenant) Roots(ctx context.Context) ([]*Root, error) {
+	return t.roots.List(ctx)
+}
+
+// DeleteRoot removes the root of the tenant and releases its blocks, blocks
+// still referenced by other roots of the tenant are kept
+func (t *Tenant) DeleteRoot(ctx context.Context, rootCid string) error {
+	if err := t.repo.writable(); err != nil {
+		return err
+	}
+
+	c, err := cid.Parse(rootCid)
+	if err != nil {
+		return err
+	}
+
+	roots, err := t.roots.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	inner := t.repo.repoBlockStore.Blockstore
+	keep := make(map[string]struct{})
+	found := false
+	for _, root := range roots {
+		if root.Cid == rootCid {
+			found = true
+			continue
+		}
+
+		rc, err := cid.Parse(root.Cid)
+		if err != nil {
+			return err
+		}
+
+		blks, err := dagBlocks(ctx, inner, rc)
+		if err != nil {
+			return err
+		}
+		for _, b := range blks {
+			keep[string(b.Hash())] = struct{}{}
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("%w: %s", ErrRootNotFound, rootCid)
+	}
+
+	blks, err := dagBlocks(ctx, inner, c)
+	if err != nil {
+		return err
+	}
+
+	var releases []cid.Cid
+	for _, b := range blks {
+		if _, ok := keep[string(b.Hash())]; !ok {
+			releases = append(releases, b)
+		}
+	}
+
+	if err := t.release(ctx, releases); err != nil {
+		return err
+	}
+
+	return t.roots.Remove(ctx, rootCid)
+}
+
+// checkQuotaLocked checks that size more bytes fit next to the usage and the
+// reserved quota, t.mu must be held
+func (t *Tenant) checkQuotaLocked(size uint64) error {
+	if t.usage+t.reserved+size > t.info.Quota {
+		return fmt.Errorf("%w: tenant %s requested %s, %s of %s used", ErrQuotaExceeded, t.info.ID,
+			humanize.Bytes(size), humanize.Bytes(t.usage+t.reserved), humanize.Bytes(t.info.Quota))
+	}
+
+	return nil
+}
+
+// chargeReserved charges the blocks and gives the quota held for them back in
+// one step, so the written bytes are never counted twice or not at all
+func (t *Tenant) chargeReserved(ctx context.Context, cids []cid.Cid, q *quotaReservation) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.chargeLocked(ctx, cids, q.held); err != nil {
+		return err
+	}
+
+	q.releaseLocked()
+	return nil
+}
+
+// chargeLocked adds references from the tenant to the blocks, t.mu must be held.
+// held is the quota the caller reserved for them, blocks that were in the repo
+// already are not written but charged and must still fit.
+func (t *Tenant) chargeLocked(ctx context.Context, cids []cid.Cid, held uint64) error {
+	t.repo.tenants.owners.Lock()
+	defer t.repo.tenants.owners.Unlock()
+
+	batch, err := t.ds.Batch(ctx)
+	if err != nil {
+		return err
+	}
+
+	var added uint64
+	seen := make(map[string]struct{})
+	for _, c := range cids {
+		if _, ok := seen[string(c.Hash())]; ok {
+			continue
+		}
+		seen[string(c.Hash())] = struct{}{}
+
+		key := t.blockKey(c)
+		has, err := t.ds.Has(ctx, key)
+		if err != nil {
+			return err
+		}
+		if has {
+			continue
+		}
+
+		size, err := t.repo.blockStore.GetSize(ctx, c)
+		if err != nil {
+			return err
+		}
+
+		if err := batch.Put(ctx, key, encodeSize(uint64(size))); err != nil {
+			return err
+		}
+		if err := batch.Put(ctx, t.ownerKey(c), nil); err != nil {
+			return err
+		}
+		added += uint64(size)
+	}
+
+	if added > held {
+		if err := t.checkQuotaLocked(added - held); err != nil {
+			return err
+		}
+	}
+
+	if err := batch.Commit(ctx); err != nil {
+		return err
+	}
+
+	t.usage += added
+	return nil
+}
+
+// release drops references from the tenant to the blocks, and deletes the
+// blocks nobody references anymore
+func (t *Tenant) release(ctx context.Context, cids []cid.Cid) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// no other tenant may become an owner between the check and the delete
+	t.repo.tenants.owners.Lock()
+	defer t.repo.tenants.owners.Unlock()
+
+	// blocks of roots imported outside of any tenant, walked once a block is about to go
+	var rootBlocks map[string]struct{}
+
+	for _, c := range cids {
+		key := t.blockKey(c)
+		b, err := t.ds.Get(ctx, key)
+		if err != nil {
+			if errors.Is(err, ds.ErrNotFound) {
+				continue
+			}
+			return err
+		}
+
+		if err := t.ds.Delete(ctx, key); err != nil {
+			return err
+		}
+		if err := t.ds.Delete(ctx, t.ownerKey(c)); err != nil {
+			return err
+		}
+		t.usage -= decodeSize(b)
+
+		owned, err := t.repo.tenants.owned(ctx, c)
+		if err != nil {
+			return err
+		}
+		if owned {
+			continue
+		}
+
+		if rootBlocks == nil {
+			rootBlocks, err = t.repo.roots.blocks(ctx, t.repo.repoBlockStore.Blockstore)
+			if err != nil {
+				return err
+			}
+		}
+		if _, ok := rootBlocks[string(c.Hash())]; ok {
+			continue
+		}
+
+		if err := t.repo.blockStore.DeleteBlock(ctx, c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *Tenant) loadUsage(ctx context.Context) error {
+	results, err := t.ds.Query(ctx, query.Query{Prefix: t.blocksPrefix().String()})
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+
+	var usage uint64
+	for r := range results.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		usage += decodeSize(r.Value)
+	}
+
+	t.usage = usage
+	return nil
+}
+
+func (t *Tenant) saveInfo(ctx context.Context) error {
+	b, err := json.Marshal(t.info)
+	if err != nil {
+		return err
+	}
+
+	return t.ds.Put(ctx, t.infoKey, b)
+}
+
+func (t *Tenant) blocksPrefix() ds.Key {
+	return tenantsPrefix.ChildString(t.info.ID).ChildString("blocks")
+}
+
+func (t *Tenant) blockKey(c cid.Cid) ds.Key {
+	return t.blocksPrefix().Child(dshelp.MultihashToDsKey(c.Hash()))
+}
+
+func (t *Tenant) ownerKey(c cid.Cid) ds.Key {
+	return blockOwnersPrefix.Child(dshelp.MultihashToDsKey(c.Hash())).ChildString(t.info.ID)
+}
+
+func tenantInfoKey(id string) ds.Key {
+	return tenantInfoPrefix.ChildString(id)
+}
+
+func validTenantID(id string) error {
+	if id == "" || strings.ContainsAny(id, "/ ") {
+		return fmt.Errorf("invalid tenant id %q", id)
+	}
+	return nil
+}
+
+func encodeSize(size uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, size)
+	return b
+}
+
+func decodeSize(b []byte) uint64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+// quotaReservation is quota of a tenant held by an import in flight. Written
+// bytes stay held until the blocks are charged to the tenant.
+type quotaReservation struct {
+	tenant *Tenant
+	// held is the reserved quota, written the bytes written so far
+	held     uint64
+	written  uint64
+	released bool
+}
+
+// Grow reserves size more bytes of the quota
+func (q *quotaReservation) Grow(size int64) error {
+	t := q.tenant
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.checkQuotaLocked(uint64(size)); err != nil {
+		return err
+	}
+
+	q.held += uint64(size)
+	t.reserved += uint64(size)
+	return nil
+}
+
+// Consume counts written bytes, bytes beyond the reservation must still fit
+func (q *quotaReservation) Consume(size uint64) error {
+	t := q.tenant
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if q.written+size > q.held {
+		extra := q.written + size - q.held
+		if err := t.checkQuotaLocked(extra); err != nil {
+			return err
+		}
+		q.held += extra
+		t.reserved += extra
+	}
+
+	q.written += size
+	return nil
+}
+
+// Release gives the held quota back
+func (q *quotaReservation) Release() {
+	q.tenant.mu.Lock()
+	defer q.tenant.mu.Unlock()
+
+	q.releaseLocked()
+}
+
+// releaseLocked is Release with the mutex of the tenant held
+func (q *quotaReservation) releaseLocked() {
+	if q.released {
+		return
+	}
+
+	q.tenant.reserved -= q.held
+	q.held = 0
+	q.released = true
+}
@@ -0,0 +1,248 @@
+package ipfsrepo
+
+import (
+	"context"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/fsrepo"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestTenant_Quota(t *testing.T) {
+	ctx := context.Background()
+	repoPath := t.TempDir()
+
+	repo, err := FromPath("test-uuid", repoPath, 1<<30)
+	require.NoError(t, err)
+
+	a, err := repo.CreateTenant(ctx, "a", 32)
+	require.NoError(t, err)
+	b, err := repo.CreateTenant(ctx, "b", 1<<20)
+	require.NoError(t, err)
+
+	_, err = repo.CreateTenant(ctx, "a", 32)
+	require.ErrorIs(t, err, ErrTenantExists)
+
+	shared := []byte("shared block of 24 bytes")
+	sharedCid := blocks.NewBlock(shared).Cid().String()
+
+	require.NoError(t, a.SaveBlock(ctx, [][]byte{shared}))
+	require.NoError(t, b.SaveBlock(ctx, [][]byte{shared}))
+	require.Equal(t, uint64(len(shared)), a.Usage())
+	require.Equal(t, uint64(len(shared)), b.Usage())
+
+	// saving the same block again is not charged twice
+	require.NoError(t, a.SaveBlock(ctx, [][]byte{shared}))
+	require.Equal(t, uint64(len(shared)), a.Usage())
+
+	// a is over quota, b is not affected
+	require.ErrorIs(t, a.SaveBlock(ctx, [][]byte{[]byte("too much for a")}), ErrQuotaExceeded)
+	require.NoError(t, b.SaveBlock(ctx, [][]byte{[]byte("fine for b")}))
+
+	tmpDir := t.TempDir()
+	fileBytes, err := createFile0to100k()
+	require.NoError(t, err)
+	filePath := path.Join(tmpDir, "testfile")
+	require.NoError(t, os.WriteFile(filePath, fileBytes, 0644))
+
+	_, err = a.Import(ctx, filePath)
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+
+	result, err := b.Import(ctx, filePath)
+	require.NoError(t, err)
+	roots, err := b.Roots(ctx)
+	require.NoError(t, err)
+	require.Len(t, roots, 1)
+	require.True(t, b.HasBlock(ctx, result.Blocks))
+	require.False(t, a.HasBlock(ctx, result.Blocks))
+
+	// the block stays until the last tenant releases it
+	require.NoError(t, a.DeleteBlock(ctx, []string{sharedCid}))
+	require.Zero(t, a.Usage())
+	require.True(t, repo.HasBlock(ctx, []string{sharedCid}))
+
+	usage := b.Usage()
+	repo.Close()
+
+	repo, err = FromPath("test-uuid", repoPath, 1<<30)
+	require.NoError(t, err)
+	defer repo.Close()
+
+	b, err = repo.Tenant(ctx, "b")
+	require.NoError(t, err)
+	require.Equal(t, usage, b.Usage())
+
+	ids, err := repo.Tenants(ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"a", "b"}, ids)
+
+	require.NoError(t, b.DeleteBlock(ctx, []string{sharedCid}))
+	require.False(t, repo.HasBlock(ctx, []string{sharedCid}))
+
+	require.NoError(t, b.DeleteRoot(ctx, result.RootCid))
+	require.False(t, repo.HasBlock(ctx, result.Blocks))
+	require.Equal(t, uint64(len("fine for b")), b.Usage())
+}
+
+func TestTenant_SharedWithRepoRoots(t *testing.T) {
+	ctx := context.Background()
+
+	repo, err := FromPath("test-uuid", t.TempDir(), 1<<30)
+	require.NoError(t, err)
+	defer repo.Close()
+
+	fileBytes, err := createFile0to200k()
+	require.NoError(t, err)
+	filePath := path.Join(t.TempDir(), "testfile")
+	require.NoError(t, os.WriteFile(filePath, fileBytes, 0644))
+
+	result, err := repo.Import(ctx, filePath)
+	require.NoError(t, err)
+
+	a, err := repo.CreateTenant(ctx, "a", 1<<30)
+	require.NoError(t, err)
+	_, err = a.Import(ctx, filePath)
+	require.NoError(t, err)
+
+	t.Log("the tenant releases the content, the root of the repo keeps it")
+	require.NoError(t, a.DeleteRoot(ctx, result.RootCid))
+	require.Zero(t, a.Usage())
+	require.True(t, repo.HasBlock(ctx, result.Blocks))
+
+	extracted := path.Join(t.TempDir(), "extracted")
+	require.NoError(t, repo.Extract(ctx, result.RootCid, extracted))
+	b, err := os.ReadFile(extracted)
+	require.NoError(t, err)
+	require.Equal(t, fileBytes, b)
+}
+
+func TestTenant_ConcurrentImports(t *testing.T) {
+	ctx := context.Background()
+
+	repo, err := FromPath("test-uuid", t.TempDir(), 1<<30)
+	require.NoError(t, err)
+	defer repo.Close()
+
+	fileBytes, err := createFile0to100k()
+	require.NoError(t, err)
+	filePath := path.Join(t.TempDir(), "testfile")
+	require.NoError(t, os.WriteFile(filePath, fileBytes, 0644))
+
+	a, err := repo.CreateTenant(ctx, "a", 1<<30)
+	require.NoError(t, err)
+	b, err := repo.CreateTenant(ctx, "b", 1<<30)
+	require.NoError(t, err)
+
+	t.Log("an import of the repo or of another tenant does not block a tenant")
+	repo.importer.running.Store(true)
+	a.importer.running.Store(true)
+	_, err = b.Import(ctx, filePath)
+	require.NoError(t, err)
+
+	_, err = a.Import(ctx, filePath)
+	require.ErrorIs(t, err, ErrImporterAlreadyRunning)
+}
+
+func TestTenant_UsagePercentage(t *testing.T) {
+	ctx := context.Background()
+
+	repo, err := FromPath("test-uuid", t.TempDir(), 1<<30)
+	require.NoError(t, err)
+	defer repo.Close()
+
+	a, err := repo.CreateTenant(ctx, "a", 0)
+	require.NoError(t, err)
+	require.Zero(t, a.UsagePercentage())
+
+	require.NoError(t, a.SetQuota(ctx, 100))
+	require.NoError(t, a.SaveBlock(ctx, [][]byte{make([]byte, 50)}))
+	require.Equal(t, 50.0, a.UsagePercentage())
+
+	require.NoError(t, a.SetQuota(ctx, 0))
+	require.Equal(t, 100.0, a.UsagePercentage())
+}
+
+func TestTenant_MoveInfo(t *testing.T) {
+	ctx := context.Background()
+	repoPath := t.TempDir()
+
+	repo, err := FromPath("test-uuid", repoPath, 1<<30)
+	require.NoError(t, err)
+	a, err := repo.CreateTenant(ctx, "a", 1<<20)
+	require.NoError(t, err)
+	require.NoError(t, a.SaveBlock(ctx, [][]byte{[]byte("block of a")}))
+
+	// put the description where it was kept before
+	d := repo.DataStore()
+	info, err := d.Get(ctx, tenantInfoKey("a"))
+	require.NoError(t, err)
+	require.NoError(t, d.Put(ctx, tenantsPrefix.ChildString("a").ChildString("info"), info))
+	require.NoError(t, d.Delete(ctx, tenantInfoKey("a")))
+	require.NoError(t, d.Delete(ctx, tenantInfoMovedKey))
+	repo.Close()
+	require.NoError(t, os.WriteFile(fsrepo.VersionFile(repoPath), []byte("1\n"), 0o600))
+
+	t.Log("a read-only repo has to be migrated first")
+	_, err = FromPathReadOnly("test-uuid", repoPath, 1<<30)
+	require.ErrorIs(t, err, fsrepo.ErrMigrationPending)
+
+	t.Log("the migration to version 2 moves the description")
+	repo, err = FromPath("test-uuid", repoPath, 1<<30)
+	require.NoError(t, err)
+	defer repo.Close()
+
+	version, err := fsrepo.ReadVersion(repoPath)
+	require.NoError(t, err)
+	require.Equal(t, 2, version)
+	ids, err := repo.Tenants(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, ids)
+	a, err = repo.Tenant(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1<<20), a.Quota())
+	require.Equal(t, uint64(len("block of a")), a.Usage())
+
+	has, err := repo.DataStore().Has(ctx, tenantsPrefix.ChildString("a").ChildString("info"))
+	require.NoError(t, err)
+	require.False(t, has)
+}
+
+func TestTenant_ImportReservesQuota(t *testing.T) {
+	ctx := context.Background()
+
+	repo, err := FromPath("test-uuid", t.TempDir(), 1<<30)
+	require.NoError(t, err)
+	defer repo.Close()
+
+	fileBytes, err := createFile0to200k()
+	require.NoError(t, err)
+	filePath := path.Join(t.TempDir(), "testfile")
+	require.NoError(t, os.WriteFile(filePath, fileBytes, 0644))
+
+	a, err := repo.CreateTenant(ctx, "a", 1<<30)
+	require.NoError(t, err)
+	result, err := a.Import(ctx, filePath)
+	require.NoError(t, err)
+	written := a.Usage()
+	require.Zero(t, a.reserved)
+
+	t.Log("every block of the DAG counts against the quota, not only the file size")
+	b, err := repo.CreateTenant(ctx, "b", written-1)
+	require.NoError(t, err)
+	_, err = b.Import(ctx, filePath)
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+	require.Zero(t, b.Usage())
+	require.Zero(t, b.reserved)
+	require.False(t, b.HasBlock(ctx, result.Blocks))
+
+	t.Log("quota held by an import in flight is not available to other writes")
+	c, err := repo.CreateTenant(ctx, "c", written)
+	require.NoError(t, err)
+	quota := &quotaReservation{tenant: c}
+	require.NoError(t, quota.Grow(int64(written)))
+	require.ErrorIs(t, c.SaveBlock(ctx, [][]byte{[]byte("no room")}), ErrQuotaExceeded)
+	quota.Release()
+	require.NoError(t, c.SaveBlock(ctx, [][]byte{[]byte("room again")}))
+}
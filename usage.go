@@ -2,55 +2,218 @@ package ipfsrepo
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"github.com/Xib1uvXi/ipfsrepo/pkg/fsrepo"
 	"github.com/dustin/go-humanize"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 )
 
 const (
-	defaultScanInterval = 5 * time.Minute
-	defaultThreshold    = 70.0
+	defaultScanInterval      = 5 * time.Minute
+	defaultReconcileInterval = 24 * time.Hour
+	defaultThreshold         = 70.0
+
+	// usageCacheFile keeps the last reconciliation across restarts
+	usageCacheFile = "usage_cache"
 )
 
+// UsageSource reports the bytes used by the datastore, see fsrepo.Storage.GetStorageUsage
+type UsageSource func(ctx context.Context) (uint64, error)
+
+// usageCache is the result of the last full walk of the repo directory
+type usageCache struct {
+	// Reconciled is the allocated size of the repo directory
+	Reconciled uint64 `json:"reconciled"`
+	// Source is what the usage source reported at the same time
+	Source uint64    `json:"source"`
+	Time   time.Time `json:"time"`
+}
+
+// UsageSnapshot is a consistent view of the storage usage of a repo
+type UsageSnapshot struct {
+	// Used is the number of bytes used by the repo
+	Used uint64
+	// Max is the maximum storage size of the repo
+	Max     uint64
+	Percent float64
+	// FSFree is the number of bytes available to the repo on the underlying filesystem
+	FSFree uint64
+	// FSFreeInodes is the number of free inodes on the underlying filesystem
+	FSFreeInodes uint64
+	// LastScan is the time usage was last updated successfully from the source or a walk
+	LastScan time.Time
+	// LastReconcile is the time of the last walk of the repo directory
+	LastReconcile time.Time
+	// LastScanErr is the error of the last scan, nil if it succeeded
+	LastScanErr error
+	Level       UsageLevel
+}
+
+// StorageUsage tracks the storage used by the repo.
+//
+// Without a source the repo directory is walked every scanInterval. With a
+// source, usage follows block puts and deletes as they happen, is re-read from
+// the source every scanInterval and the expensive walk only runs every
+// reconcileInterval to account for what the source does not see, like
+// filesystem overhead and files outside the datastore.
 type StorageUsage struct {
-	ctx          context.Context
-	repoPath     string
-	maxStorage   uint64
-	usage        uint64
-	scanInterval time.Duration
-	threshold    float64
+	ctx               context.Context
+	repoPath          string
+	maxStorage        uint64
+	scanInterval      time.Duration
+	reconcileInterval time.Duration
+	source            UsageSource
+	events            *eventBus
+
+	mu          sync.Mutex
+	usage       uint64
+	watermarks  Watermarks
+	level       UsageLevel
+	listeners   []LevelFunc
+	lastScan    time.Time
+	lastScanErr error
+	cache       usageCache
+	history     []UsageSample
+	historySize int
+	// historyLines is the number of samples in the history file, it is
+	// rewritten with the kept samples once it holds twice as many. It is
+	// negative if unknown, the file is rewritten with the next sample then.
+	historyLines int
+	// historyMu serializes writes to the history file
+	historyMu sync.Mutex
+	// cached is set if cache was loaded from disk rather than walked on open
+	cached bool
+	// readOnly keeps the cache and history in memory, the repo can not be written
+	readOnly bool
+	// health keeps them in memory as well once the repo is degraded
+	health *deviceHealth
 }
 
 func (s *StorageUsage) SetScanInterval(scanInterval time.Duration) {
 	s.scanInterval = scanInterval
 }
 
-func (s *StorageUsage) SetThreshold(threshold float64) {
-	s.threshold = threshold
+func (s *StorageUsage) SetReconcileInterval(reconcileInterval time.Duration) {
+	s.reconcileInterval = reconcileInterval
+}
+
+// SetThreshold sets the full watermark, it is left again once usage drops
+// defaultHysteresis percent below threshold. The warn and critical watermarks
+// are lowered to threshold if they are above it.
+func (s *StorageUsage) SetThreshold(threshold float64) error {
+	w := s.Watermarks()
+	w.Warn = w.Warn.clamp(threshold)
+	w.Critical = w.Critical.clamp(threshold)
+	w.Full = Watermark{Enter: threshold, Exit: max(threshold-defaultHysteresis, 0)}
+	return s.SetWatermarks(w)
+}
+
+// SetWatermarks sets the warn, critical and full levels
+func (s *StorageUsage) SetWatermarks(w Watermarks) error {
+	if err := w.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.watermarks = w
+	s.mu.Unlock()
+
+	s.update(func(usage uint64) uint64 { return usage })
+	return nil
+}
+
+// Watermarks returns the warn, critical and full levels
+func (s *StorageUsage) Watermarks() Watermarks {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.watermarks
+}
+
+// OnLevelChange registers fn to be called on every usage level transition
+func (s *StorageUsage) OnLevelChange(fn LevelFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.listeners = append(s.listeners, fn)
+}
+
+// NotifyLevelChange sends usage level transitions on ch, they are dropped if ch is not ready
+func (s *StorageUsage) NotifyLevelChange(ch chan<- LevelChange) {
+	s.OnLevelChange(func(change LevelChange) {
+		select {
+		case ch <- change:
+		default:
+		}
+	})
+}
+
+// SetUsageSource makes usage incremental, the walk becomes an occasional
+// reconciliation whose result is kept in the repo directory
+func (s *StorageUsage) SetUsageSource(source UsageSource) {
+	s.source = source
 }
 
 func NewStorageUsage(ctx context.Context, repoPath string, maxStorage uint64) (*StorageUsage, error) {
 	s := &StorageUsage{
-		ctx:          ctx,
-		repoPath:     repoPath,
-		maxStorage:   maxStorage,
-		scanInterval: defaultScanInterval,
-		threshold:    defaultThreshold,
+		ctx:               ctx,
+		repoPath:          repoPath,
+		maxStorage:        maxStorage,
+		scanInterval:      defaultScanInterval,
+		reconcileInterval: defaultReconcileInterval,
+		watermarks:        DefaultWatermarks(),
+		historySize:       defaultHistorySize,
+		historyLines:      -1,
 	}
 
-	size, err := s.getStorageUsage(repoPath) // initial scan
-	if err != nil {
-		return nil, err
+	if history, err := readUsageHistory(repoPath); err == nil {
+		s.history = history[max(len(history)-s.historySize, 0):]
 	}
 
-	s.usage = size
+	if cache, err := readUsageCache(repoPath); err == nil {
+		s.cache = *cache
+		s.cached = true
+		s.usage = cache.Reconciled
+	} else {
+		size, err := s.getStorageUsage(repoPath) // initial scan
+		if err != nil {
+			return nil, err
+		}
+
+		s.cache = usageCache{Reconciled: size, Time: time.Now()}
+		s.usage = size
+		s.lastScan = s.cache.Time
+	}
+
+	s.level = s.watermarks.level(LevelNormal, s.UsagePercentage())
 
 	return s, nil
 }
 
+// resetLevel computes the level without the hysteresis of the current one
+// and without notifying, once the watermarks of the options are set
+func (s *StorageUsage) resetLevel() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.level = s.watermarks.level(LevelNormal, float64(s.usage)/float64(s.maxStorage)*100)
+}
+
 // Start starts the storage usage monitoring
 func (s *StorageUsage) Start() {
+	if s.source != nil {
+		if s.cached {
+			_ = s.Refresh()
+		} else {
+			// tie the walk done on open to the source
+			_ = s.scanned(s.setBaseline(s.cache.Reconciled))
+		}
+	}
+
 	go s.loop()
 }
 
@@ -61,55 +224,301 @@ func (s *StorageUsage) MaxStorage() string {
 
 // Usage returns the current storage usage of the repo
 func (s *StorageUsage) Usage() string {
-	return humanize.Bytes(s.usage)
+	return humanize.Bytes(s.used())
 }
 
 // UsagePercentage returns the current storage usage percentage of the repo
 func (s *StorageUsage) UsagePercentage() float64 {
-	return float64(s.usage) / float64(s.maxStorage) * 100
+	return float64(s.used()) / float64(s.maxStorage) * 100
+}
+
+// Snapshot returns the current usage together with the free space of the filesystem
+func (s *StorageUsage) Snapshot() UsageSnapshot {
+	s.mu.Lock()
+	snapshot := UsageSnapshot{
+		Used:          s.usage,
+		Max:           s.maxStorage,
+		Percent:       float64(s.usage) / float64(s.maxStorage) * 100,
+		LastScan:      s.lastScan,
+		LastReconcile: s.cache.Time,
+		LastScanErr:   s.lastScanErr,
+		Level:         s.level,
+	}
+	s.mu.Unlock()
+
+	free, freeInodes, err := fsFree(s.path())
+	if err != nil {
+		log.Debugf("statfs %s: %s", s.path(), err)
+	}
+	snapshot.FSFree = free
+	snapshot.FSFreeInodes = freeInodes
+
+	return snapshot
 }
 
-// IsFull returns true if the repo is full
+// Level returns the current usage level
+func (s *StorageUsage) Level() UsageLevel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.level
+}
+
+// IsFull returns true if the repo is at the full level
 func (s *StorageUsage) IsFull() bool {
-	return s.UsagePercentage() >= s.threshold
+	return s.Level() == LevelFull
+}
+
+// Refresh updates the storage usage right away, from the source if there is one
+func (s *StorageUsage) Refresh() error {
+	return s.scanned(s.refresh())
+}
+
+// Reconcile walks the repo directory and makes its allocated size the new base of the usage
+func (s *StorageUsage) Reconcile() error {
+	return s.scanned(s.reconcile())
+}
+
+func (s *StorageUsage) refresh() error {
+	if s.source == nil {
+		usage, err := s.getStorageUsage(s.path())
+		if err != nil {
+			return err
+		}
+
+		s.setUsage(usage)
+		return nil
+	}
+
+	current, err := s.source(s.ctx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	usage := int64(s.cache.Reconciled) + int64(current) - int64(s.cache.Source)
+	s.mu.Unlock()
+
+	if usage < 0 {
+		usage = 0
+	}
+
+	s.setUsage(uint64(usage))
+	return nil
+}
+
+func (s *StorageUsage) reconcile() error {
+	usage, err := s.getStorageUsage(s.path())
+	if err != nil {
+		return err
+	}
+
+	if s.source == nil {
+		s.setUsage(usage)
+		return nil
+	}
+
+	return s.setBaseline(usage)
+}
+
+// added accounts for bytes written, until the next refresh
+func (s *StorageUsage) added(size uint64) {
+	s.update(func(usage uint64) uint64 { return usage + size })
+}
+
+// removed accounts for bytes deleted, until the next refresh
+func (s *StorageUsage) removed(size uint64) {
+	s.update(func(usage uint64) uint64 {
+		if size > usage {
+			return 0
+		}
+		return usage - size
+	})
+}
+
+// setBaseline records a walked usage together with the current source value, and persists both
+func (s *StorageUsage) setBaseline(reconciled uint64) error {
+	current, err := s.source(s.ctx)
+	if err != nil {
+		return err
+	}
+
+	cache := usageCache{Reconciled: reconciled, Source: current, Time: time.Now()}
+
+	s.mu.Lock()
+	s.cache = cache
+	s.mu.Unlock()
+
+	s.setUsage(reconciled)
+
+	if !s.writable() {
+		return nil
+	}
+	return writeUsageCache(s.path(), &cache)
 }
 
-// loop is a background goroutine that periodically scans the repo for storage usage
+// writable returns false if the cache and history can not be written to the repo
+func (s *StorageUsage) writable() bool {
+	return !s.readOnly && s.health.err() == nil
+}
+
+// scanned records the outcome of a scan, and a usage sample if it succeeded
+func (s *StorageUsage) scanned(err error) error {
+	s.mu.Lock()
+	s.lastScanErr = err
+	if err == nil {
+		s.lastScan = time.Now()
+	}
+	s.mu.Unlock()
+
+	if err == nil {
+		s.record()
+	}
+
+	return err
+}
+
+// path returns the repo directory, a migration moves it
+func (s *StorageUsage) path() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.repoPath
+}
+
+// moveTo makes usage follow the repo to a new directory
+func (s *StorageUsage) moveTo(repoPath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.repoPath = repoPath
+	s.historyLines = -1
+}
+
+func (s *StorageUsage) used() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.usage
+}
+
+// loop is a background goroutine that periodically updates the storage usage
 func (s *StorageUsage) loop() {
 	ticker := time.NewTicker(s.scanInterval)
 	defer ticker.Stop()
 
+	// the first reconciliation is due one interval after the cached one, so reopening the repo does not postpone it
+	reconcileTimer := time.NewTimer(s.untilReconcile())
+	defer reconcileTimer.Stop()
+
 	for {
 		select {
 		case <-s.ctx.Done():
 			return
 		case <-ticker.C:
-			usage, err := s.getStorageUsage(s.repoPath)
-			if err != nil {
-				continue
+			if err := s.Refresh(); err != nil {
+				log.Warnf("refresh storage usage of %s: %s", s.path(), err)
 			}
-
-			s.usage = usage
+		case <-reconcileTimer.C:
+			if s.source != nil {
+				if err := s.Reconcile(); err != nil {
+					log.Warnf("reconcile storage usage of %s: %s", s.path(), err)
+				}
+			}
+			next := s.untilReconcile()
+			if next == 0 {
+				// it failed or there is no source, the cache was not renewed
+				next = s.reconcileInterval
+			}
+			reconcileTimer.Reset(next)
 		}
 	}
 }
 
-// getStorageUsage returns the current storage usage of the repo
-func (s *StorageUsage) getStorageUsage(checkPath string) (uint64, error) {
-	var usage uint64
+// untilReconcile returns how long it is until the next reconciliation is due, zero if it is overdue
+func (s *StorageUsage) untilReconcile() time.Duration {
+	s.mu.Lock()
+	last := s.cache.Time
+	s.mu.Unlock()
 
-	err := filepath.Walk(checkPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+	due := time.Until(last.Add(s.reconcileInterval))
+	if due <= 0 {
+		return 0
+	}
+	return due
+}
 
-		usage += uint64(info.Size())
-		return nil
+// setUsage stores a new usage and reports level changes
+func (s *StorageUsage) setUsage(usage uint64) {
+	s.update(func(uint64) uint64 { return usage })
+}
+
+// update changes the usage and reports level changes
+func (s *StorageUsage) update(fn func(usage uint64) uint64) {
+	s.mu.Lock()
+	s.usage = fn(s.usage)
+	percentage := float64(s.usage) / float64(s.maxStorage) * 100
+	change := LevelChange{From: s.level, To: s.watermarks.level(s.level, percentage), Percentage: percentage}
+	s.level = change.To
+	watermark := s.watermarks.get(change.To)
+	if change.To < change.From {
+		watermark = s.watermarks.get(change.From)
+	}
+	listeners := s.listeners
+	s.mu.Unlock()
+
+	if change.From == change.To {
+		return
+	}
+
+	s.events.publish(UsageThresholdEvent{
+		eventBase:  newEventBase(),
+		Percentage: percentage,
+		Watermark:  watermark,
+		From:       change.From,
+		To:         change.To,
+		Full:       change.To == LevelFull,
 	})
 
-	if err != nil {
+	for _, fn := range listeners {
+		fn(change)
+	}
+}
+
+// getStorageUsage returns the space allocated on disk for the given path
+func (s *StorageUsage) getStorageUsage(checkPath string) (uint64, error) {
+	// unlike the directories of a breakdown, the repo has to exist
+	if _, err := os.Stat(checkPath); err != nil {
 		return 0, err
 	}
 
-	return usage, nil
+	return dirUsage(checkPath)
+}
+
+func readUsageCache(repoPath string) (*usageCache, error) {
+	b, err := os.ReadFile(filepath.Join(repoPath, usageCacheFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var cache usageCache
+	if err := json.Unmarshal(b, &cache); err != nil {
+		return nil, err
+	}
+
+	if cache.Time.IsZero() {
+		return nil, errors.New("usage cache has no time")
+	}
+
+	return &cache, nil
+}
+
+// writeUsageCache replaces the cache file atomically
+func writeUsageCache(repoPath string, cache *usageCache) error {
+	b, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+
+	return fsrepo.WriteFile(filepath.Join(repoPath, usageCacheFile), b)
 }
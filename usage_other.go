@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !freebsd
+
+package ipfsrepo
+
+import (
+	"errors"
+	"os"
+)
+
+// allocatedSize returns the apparent size, allocated blocks are not available on this platform
+func allocatedSize(info os.FileInfo) uint64 {
+	return uint64(info.Size())
+}
+
+func fsFree(string) (uint64, uint64, error) {
+	return 0, 0, errors.New("statfs is not supported on this platform")
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/dustin/go-humanize"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
 	"os"
 	"path"
 	"strconv"
@@ -23,13 +24,13 @@ func TestNewStorageUsage(t *testing.T) {
 	usage, err := NewStorageUsage(ctx, tmpDir, maxStorage)
 	require.NoError(t, err)
 	require.NotNil(t, usage)
-	usage.SetThreshold(70.0)
+	require.NoError(t, usage.SetThreshold(70.0))
 	usage.SetScanInterval(5 * time.Millisecond)
 	usage.Start()
 
 	require.False(t, usage.IsFull())
 	require.Equal(t, 5*time.Millisecond, usage.scanInterval)
-	require.Equal(t, 70.0, usage.threshold)
+	require.Equal(t, 70.0, usage.watermarks.Full.Enter)
 	require.Equal(t, humanize.Bytes(maxStorage), usage.MaxStorage())
 
 	time.Sleep(10 * time.Millisecond)
@@ -95,7 +96,7 @@ func TestStorageUsage_getStorageUsage(t *testing.T) {
 	usage, err := NewStorageUsage(ctx, tmpDir, maxStorage)
 	require.NoError(t, err)
 	require.NotNil(t, usage)
-	usage.SetThreshold(70.0)
+	require.NoError(t, usage.SetThreshold(70.0))
 	usage.SetScanInterval(5 * time.Millisecond)
 	usage.Start()
 
@@ -104,3 +105,106 @@ func TestStorageUsage_getStorageUsage(t *testing.T) {
 
 	t.Logf("Size: %s", humanize.Bytes(size))
 }
+
+func TestStorageUsage_UsageSource(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tmpDir := t.TempDir()
+	source := atomic.NewUint64(1000)
+
+	usage, err := NewStorageUsage(ctx, tmpDir, 1<<30)
+	require.NoError(t, err)
+	usage.SetUsageSource(func(context.Context) (uint64, error) {
+		return source.Load(), nil
+	})
+	usage.Start()
+
+	walked := usage.used()
+
+	// puts and deletes are accounted right away
+	usage.added(100)
+	require.Equal(t, walked+100, usage.used())
+	usage.removed(50)
+	require.Equal(t, walked+50, usage.used())
+
+	// a refresh replaces the estimate with the source
+	source.Store(1200)
+	require.NoError(t, usage.Refresh())
+	require.Equal(t, walked+200, usage.used())
+
+	// the last reconciliation survives a restart, no walk happens on open
+	fileBytes, err := createFile0to100k()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path.Join(tmpDir, "testfile"), fileBytes, 0644))
+
+	reopened, err := NewStorageUsage(ctx, tmpDir, 1<<30)
+	require.NoError(t, err)
+	reopened.SetUsageSource(func(context.Context) (uint64, error) {
+		return source.Load(), nil
+	})
+	reopened.Start()
+	require.Equal(t, walked+200, reopened.used())
+
+	require.NoError(t, reopened.Reconcile())
+	require.Greater(t, reopened.used(), walked+uint64(len(fileBytes)))
+}
+
+func TestStorageUsage_Snapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tmpDir := t.TempDir()
+
+	usage, err := NewStorageUsage(ctx, tmpDir, 1<<30)
+	require.NoError(t, err)
+
+	snapshot := usage.Snapshot()
+	require.Equal(t, uint64(1<<30), snapshot.Max)
+	require.Equal(t, usage.used(), snapshot.Used)
+	require.NotZero(t, snapshot.FSFree)
+	require.NotZero(t, snapshot.FSFreeInodes)
+	require.False(t, snapshot.LastScan.IsZero())
+	require.NoError(t, snapshot.LastScanErr)
+
+	// a failing scan is reported, the last successful one is kept
+	usage.repoPath = path.Join(tmpDir, "missing")
+	require.Error(t, usage.Refresh())
+
+	failed := usage.Snapshot()
+	require.Error(t, failed.LastScanErr)
+	require.Equal(t, snapshot.LastScan, failed.LastScan)
+}
+
+func TestStorageUsage_ReconcileSchedule(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tmpDir := t.TempDir()
+	source := func(context.Context) (uint64, error) { return 1000, nil }
+
+	t.Log("a reconciliation that is due since the last open runs right away")
+	lastReconcile := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, writeUsageCache(tmpDir, &usageCache{Reconciled: 10, Source: 1000, Time: lastReconcile}))
+	usage, err := NewStorageUsage(ctx, tmpDir, 1<<30)
+	require.NoError(t, err)
+	usage.SetReconcileInterval(time.Hour)
+	usage.SetUsageSource(source)
+	usage.Start()
+	require.Eventually(t, func() bool {
+		return usage.Snapshot().LastReconcile.After(lastReconcile)
+	}, time.Second, 10*time.Millisecond)
+
+	t.Log("one that is not due yet is not moved back by the open")
+	lastReconcile = time.Now().Add(-time.Hour + 100*time.Millisecond)
+	require.NoError(t, writeUsageCache(tmpDir, &usageCache{Reconciled: 10, Source: 1000, Time: lastReconcile}))
+	usage, err = NewStorageUsage(ctx, tmpDir, 1<<30)
+	require.NoError(t, err)
+	usage.SetReconcileInterval(time.Hour)
+	usage.SetUsageSource(source)
+	usage.Start()
+	require.Equal(t, lastReconcile.Unix(), usage.Snapshot().LastReconcile.Unix())
+	require.Eventually(t, func() bool {
+		return usage.Snapshot().LastReconcile.After(lastReconcile)
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,27 @@
+//go:build linux || darwin || freebsd
+
+package ipfsrepo
+
+import (
+	"os"
+	"syscall"
+)
+
+// allocatedSize returns the space the file occupies on disk
+func allocatedSize(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Blocks) * 512
+	}
+
+	return uint64(info.Size())
+}
+
+// fsFree returns the bytes available to unprivileged users and the free inodes of the filesystem holding path
+func fsFree(path string) (uint64, uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+
+	return uint64(st.Bavail) * uint64(st.Bsize), uint64(st.Ffree), nil
+}
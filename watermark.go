@@ -0,0 +1,118 @@
+package ipfsrepo
+
+import (
+	"errors"
+	"fmt"
+)
+
+// defaultHysteresis is how far usage has to drop below a level before it is left
+const defaultHysteresis = 5.0
+
+var ErrInvalidWatermarks = errors.New("invalid watermarks")
+
+// UsageLevel is how full a repo is, according to its watermarks
+type UsageLevel int
+
+const (
+	LevelNormal UsageLevel = iota
+	LevelWarn
+	LevelCritical
+	LevelFull
+)
+
+func (l UsageLevel) String() string {
+	switch l {
+	case LevelNormal:
+		return "normal"
+	case LevelWarn:
+		return "warn"
+	case LevelCritical:
+		return "critical"
+	case LevelFull:
+		return "full"
+	default:
+		return fmt.Sprintf("UsageLevel(%d)", int(l))
+	}
+}
+
+// Watermark is entered when usage reaches Enter percent and left once usage
+// drops below Exit percent, so usage hovering around Enter does not flap
+type Watermark struct {
+	Enter float64 `json:"enter"`
+	Exit  float64 `json:"exit"`
+}
+
+// clamp lowers the watermark so it is entered at enter at the latest
+func (wm Watermark) clamp(enter float64) Watermark {
+	if wm.Enter <= enter {
+		return wm
+	}
+
+	return Watermark{Enter: enter, Exit: min(wm.Exit, max(enter-defaultHysteresis, 0))}
+}
+
+// Watermarks are the usage percentages of the warn, critical and full levels
+type Watermarks struct {
+	Warn     Watermark `json:"warn"`
+	Critical Watermark `json:"critical"`
+	Full     Watermark `json:"full"`
+}
+
+// DefaultWatermarks returns the watermarks used when none are set
+func DefaultWatermarks() Watermarks {
+	return Watermarks{
+		Warn:     Watermark{Enter: 50, Exit: 50 - defaultHysteresis},
+		Critical: Watermark{Enter: 60, Exit: 60 - defaultHysteresis},
+		Full:     Watermark{Enter: defaultThreshold, Exit: defaultThreshold - defaultHysteresis},
+	}
+}
+
+// Validate checks that every Exit is at most its Enter and that levels increase
+func (w Watermarks) Validate() error {
+	levels := []Watermark{w.Warn, w.Critical, w.Full}
+	for i, wm := range levels {
+		if wm.Exit > wm.Enter || wm.Exit < 0 {
+			return fmt.Errorf("%w: %s exit %.2f must be between 0 and enter %.2f", ErrInvalidWatermarks, UsageLevel(i+1), wm.Exit, wm.Enter)
+		}
+		if i > 0 && wm.Enter < levels[i-1].Enter {
+			return fmt.Errorf("%w: %s enter %.2f is below %s", ErrInvalidWatermarks, UsageLevel(i+1), wm.Enter, UsageLevel(i))
+		}
+	}
+
+	return nil
+}
+
+func (w Watermarks) get(l UsageLevel) Watermark {
+	switch l {
+	case LevelWarn:
+		return w.Warn
+	case LevelCritical:
+		return w.Critical
+	default:
+		return w.Full
+	}
+}
+
+// level returns the level for percentage, coming from current. A level is
+// entered at its Enter watermark and kept until usage drops below its Exit.
+func (w Watermarks) level(current UsageLevel, percentage float64) UsageLevel {
+	for l := LevelFull; l > LevelNormal; l-- {
+		wm := w.get(l)
+		if percentage >= wm.Enter || (current >= l && percentage >= wm.Exit) {
+			return l
+		}
+	}
+
+	return LevelNormal
+}
+
+// LevelChange describes a usage level transition
+type LevelChange struct {
+	From       UsageLevel
+	To         UsageLevel
+	Percentage float64
+}
+
+// LevelFunc is called on usage level transitions. It runs on the goroutine
+// that changed the usage, which may be a block write, so it must not block.
+type LevelFunc func(change LevelChange)
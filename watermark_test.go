@@ -0,0 +1,120 @@
+package ipfsrepo
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestWatermarks_level(t *testing.T) {
+	w := DefaultWatermarks()
+
+	require.Equal(t, LevelNormal, w.level(LevelNormal, 49))
+	require.Equal(t, LevelWarn, w.level(LevelNormal, 50))
+	require.Equal(t, LevelFull, w.level(LevelNormal, 90))
+
+	// levels are kept until usage drops below their exit
+	require.Equal(t, LevelFull, w.level(LevelFull, 66))
+	require.Equal(t, LevelCritical, w.level(LevelFull, 64))
+	require.Equal(t, LevelWarn, w.level(LevelCritical, 54))
+	require.Equal(t, LevelNormal, w.level(LevelWarn, 44))
+}
+
+func TestWatermarks_Validate(t *testing.T) {
+	require.NoError(t, DefaultWatermarks().Validate())
+
+	w := DefaultWatermarks()
+	w.Full.Exit = w.Full.Enter + 1
+	require.ErrorIs(t, w.Validate(), ErrInvalidWatermarks)
+
+	w = DefaultWatermarks()
+	w.Critical.Enter = w.Full.Enter + 1
+	require.ErrorIs(t, w.Validate(), ErrInvalidWatermarks)
+}
+
+func TestStorageUsage_SetThreshold(t *testing.T) {
+	usage, err := NewStorageUsage(context.Background(), t.TempDir(), 1000)
+	require.NoError(t, err)
+
+	require.NoError(t, usage.SetThreshold(80))
+	require.Equal(t, Watermark{Enter: 80, Exit: 80 - defaultHysteresis}, usage.Watermarks().Full)
+
+	t.Log("a threshold below the critical watermark lowers warn and critical to it")
+	require.NoError(t, usage.SetThreshold(40))
+	w := usage.Watermarks()
+	require.Equal(t, Watermark{Enter: 40, Exit: 40 - defaultHysteresis}, w.Full)
+	require.Equal(t, Watermark{Enter: 40, Exit: 40 - defaultHysteresis}, w.Critical)
+	require.Equal(t, Watermark{Enter: 40, Exit: 40 - defaultHysteresis}, w.Warn)
+
+	t.Log("raising the threshold again keeps the lowered levels")
+	require.NoError(t, usage.SetThreshold(90))
+	require.Equal(t, 40.0, usage.Watermarks().Critical.Enter)
+
+	t.Log("a negative threshold is rejected and changes nothing")
+	require.ErrorIs(t, usage.SetThreshold(-1), ErrInvalidWatermarks)
+	require.Equal(t, 90.0, usage.Watermarks().Full.Enter)
+
+	repo, err := FromPath("test-uuid", t.TempDir(), 1<<30, SetStorageUsage(time.Minute, 40))
+	require.NoError(t, err)
+	defer repo.Close()
+	require.Equal(t, 40.0, repo.StorageUsage.Watermarks().Critical.Enter)
+}
+
+func TestStorageUsage_OnLevelChange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	usage, err := NewStorageUsage(ctx, t.TempDir(), 1000)
+	require.NoError(t, err)
+	usage.setUsage(0)
+
+	var changes []LevelChange
+	usage.OnLevelChange(func(change LevelChange) {
+		changes = append(changes, change)
+	})
+	ch := make(chan LevelChange, 10)
+	usage.NotifyLevelChange(ch)
+
+	usage.added(700)
+	require.True(t, usage.IsFull())
+
+	// hovering around the full watermark does not flap
+	usage.removed(10)
+	usage.added(10)
+	usage.removed(30)
+	require.True(t, usage.IsFull())
+	require.Len(t, changes, 1)
+
+	usage.removed(100)
+	require.Equal(t, LevelCritical, usage.Level())
+
+	require.Len(t, changes, 2)
+	require.Equal(t, LevelNormal, changes[0].From)
+	require.Equal(t, LevelFull, changes[0].To)
+	require.Equal(t, LevelCritical, changes[1].To)
+	require.InDelta(t, 57.0, changes[1].Percentage, 0.001)
+	require.Len(t, ch, 2)
+	require.Equal(t, changes[0], <-ch)
+}
+
+func TestRepo_LevelAfterOptions(t *testing.T) {
+	repoPath := t.TempDir()
+
+	repo, err := FromPath("test-uuid", repoPath, 1<<30)
+	require.NoError(t, err)
+	used := repo.StorageUsage.used()
+	repo.Close()
+
+	t.Log("62% is critical with the default watermarks and a warning with these")
+	w := Watermarks{
+		Warn:     Watermark{Enter: 50, Exit: 45},
+		Critical: Watermark{Enter: 64, Exit: 59},
+		Full:     Watermark{Enter: 70, Exit: 65},
+	}
+	repo, err = FromPath("test-uuid", repoPath, used*100/62, SetUsageWatermarks(w), OverrideConfig())
+	require.NoError(t, err)
+	defer repo.Close()
+
+	require.Equal(t, LevelWarn, repo.StorageUsage.Level())
+}